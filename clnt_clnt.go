@@ -12,6 +12,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // The Clnt type represents a 9P2000 client. The client is connected to
@@ -25,15 +26,34 @@ type Clnt struct {
 	Root       *Fid   // Fid that points to the rood directory
 	Id         string // Used when printing debug messages
 	Log        *Logger
+	Trace      TraceSink       // If not nil, receives an event for each request
+	Metrics    *Metrics        // If not nil, collects the client metrics
+	Options    ProtocolOptions // Protocol dialect spoken by the server
 
-	conn     net.Conn
+	trans    Transport
+	rpc      RpcFunc // the interceptors, nil if none
+	icpts    []Interceptor
 	tagpool  *Pool
 	reqout   chan *Req
-	done     chan bool
+	done     chan bool // closed when the connection is closed
+	sent     chan bool // closed when send stops
 	reqfirst *Req
 	reqlast  *Req
 	err      error
 
+	// timeouts
+	timeouts ClntTimeouts
+	watch    *time.Timer // checks the timeouts
+	pinging  bool        // true while the heartbeat runs
+	busy     time.Time   // when requests became pending
+	lastRecv time.Time   // when the last response was received
+	lastUse  time.Time   // when the last request was sent or response received
+
+	// When the message being written was sent, in ns, or 0. send sets
+	// it without the lock, so it is a pointer that printing a Clnt
+	// doesn't follow.
+	writing *atomic.Int64
+
 	reqchan chan *Req
 	tchan   chan *Fcall
 
@@ -71,6 +91,9 @@ type Req struct {
 	tag        uint16
 	prev, next *Req
 	fid        *Fid
+	start      time.Time // time the request was sent
+	rpcdone    chan *Req // Done channel used by Rpc, kept when the Req is reused
+	wait       chan *Req // if not nil, receives the Req instead of Done
 }
 
 type ClntList struct {
@@ -82,7 +105,34 @@ var clnts *ClntList
 var DefaultDebuglevel int
 var DefaultLogger *Logger
 
+// Sends a request without waiting for the response. r.Done receives r
+// once it is completed, with r.Rc or r.Err set. Returns an error if the
+// request can't be sent. With interceptors, the request is sent from a
+// goroutine, so only the error of a broken client is returned, the others
+// are set in r.Err and lost if r.Done is nil.
 func (clnt *Clnt) Rpcnb(r *Req) error {
+	clnt.Lock()
+	rpc, err := clnt.rpc, clnt.err
+	clnt.Unlock()
+	if rpc == nil {
+		return clnt.rpcnb(r)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		r.Err = rpc(r)
+		if r.Done != nil {
+			r.Done <- r
+		}
+	}()
+
+	return nil
+}
+
+func (clnt *Clnt) rpcnb(r *Req) error {
 	var tag uint16
 
 	if r.Tc.Type == Tversion {
@@ -92,148 +142,182 @@ func (clnt *Clnt) Rpcnb(r *Req) error {
 	}
 
 	SetTag(r.Tc, tag)
+	r.start = time.Now()
 	clnt.Lock()
-	if clnt.err != nil {
+	if err := clnt.err; err != nil {
 		clnt.Unlock()
-		return clnt.err
+		return err
 	}
 
 	if clnt.reqlast != nil {
 		clnt.reqlast.next = r
 	} else {
 		clnt.reqfirst = r
+		clnt.busy = r.start
 	}
 
+	clnt.lastUse = r.start
+
 	r.prev = clnt.reqlast
 	clnt.reqlast = r
 	clnt.Unlock()
 
-	clnt.reqout <- r
+	select {
+	case clnt.reqout <- r:
+	case <-clnt.done:
+		// the connection is closed, recv responds with the error
+	}
+
 	return nil
 }
 
+// Sends a request and waits for the response.
 func (clnt *Clnt) Rpc(tc *Fcall) (rc *Fcall, err error) {
-	r := clnt.ReqAlloc()
-	r.Tc = tc
-	r.Done = make(chan *Req)
-	err = clnt.Rpcnb(r)
-	if err != nil {
-		return
+	clnt.Lock()
+	rpc := clnt.rpc
+	clnt.Unlock()
+	if rpc == nil {
+		rpc = clnt.rpcWait
 	}
 
-	<-r.Done
+	r := clnt.ReqAlloc()
+	r.Tc = tc
+	err = rpc(r)
 	rc = r.Rc
-	err = r.Err
 	clnt.ReqFree(r)
 	return
 }
 
+// Sends the request and waits for the response, the innermost RpcFunc.
+func (clnt *Clnt) rpcWait(r *Req) error {
+	if r.rpcdone == nil {
+		r.rpcdone = make(chan *Req)
+	}
+
+	r.Rc = nil
+	r.Err = nil
+	r.wait = r.rpcdone
+	if err := clnt.rpcnb(r); err != nil {
+		r.wait = nil
+		return err
+	}
+
+	<-r.wait
+	r.wait = nil
+	return r.Err
+}
+
+// Completes the request.
+func (r *Req) done() {
+	switch {
+	case r.wait != nil:
+		r.wait <- r
+	case r.Done != nil:
+		r.Done <- r
+	}
+}
+
 func (clnt *Clnt) recv() {
 	var err error
-	var buf []byte
 
-	err = nil
-	pos := 0
 	for {
-		// Connect can change the client Msize.
-		clntmsize := int(atomic.LoadUint32(&clnt.Msize))
-		if len(buf) < clntmsize {
-			b := make([]byte, clntmsize*8)
-			copy(b, buf[0:pos])
-			buf = b
-		}
+		// Each message is read into the buffer of its own Fcall,
+		// which is handed to the caller with the response.
+		fc := GetFcall(atomic.LoadUint32(&clnt.Msize))
+		sz, oerr := clnt.trans.ReadMsg(fc.Buf)
+		if oerr != nil {
+			if e, ok := oerr.(*Error); ok {
+				err = e
+			} else {
+				err = &Error{oerr.Error(), EIO}
+			}
 
-		n, oerr := clnt.conn.Read(buf[pos:])
-		if oerr != nil || n == 0 {
-			err = &Error{oerr.Error(), EIO}
+			// keep the error the connection was closed with
 			clnt.Lock()
-			clnt.err = err
+			if clnt.err == nil {
+				clnt.err = err
+			} else {
+				err = clnt.err
+			}
 			clnt.Unlock()
 			goto closed
 		}
 
-		pos += n
-		for pos > 4 {
-			sz, _ := Gint32(buf)
-			if pos < int(sz) {
-				if len(buf) < int(sz) {
-					b := make([]byte, atomic.LoadUint32(&clnt.Msize)*8)
-					copy(b, buf[0:pos])
-					buf = b
-				}
+		_, err = UnpackInto(fc, fc.Buf[0:sz], clnt.Dotu)
+		clnt.Lock()
+		if err != nil {
+			clnt.err = err
+			_ = clnt.trans.Close()
+			clnt.Unlock()
+			goto closed
+		}
 
-				break
+		if clnt.Debuglevel > 0 {
+			clnt.logFcall(fc)
+			if clnt.Debuglevel&DbgPrintPackets != 0 {
+				log.Println("}-}", clnt.Id, fmt.Sprintf("%v", fc.Pkt))
 			}
 
-			fc, fcsize, err := Unpack(buf, clnt.Dotu)
-			clnt.Lock()
-			if err != nil {
-				clnt.err = err
-				_ = clnt.conn.Close()
-				clnt.Unlock()
-				goto closed
+			if clnt.Debuglevel&DbgPrintFcalls != 0 {
+				log.Println("}}}", clnt.Id, fc.String())
 			}
+		}
 
-			if clnt.Debuglevel > 0 {
-				clnt.logFcall(fc)
-				if clnt.Debuglevel&DbgPrintPackets != 0 {
-					log.Println("}-}", clnt.Id, fmt.Sprintf("%v", fc.Pkt))
-				}
-
-				if clnt.Debuglevel&DbgPrintFcalls != 0 {
-					log.Println("}}}", clnt.Id, fc.String())
-				}
+		var r *Req
+		for r = clnt.reqfirst; r != nil; r = r.next {
+			if r.Tc.Tag == fc.Tag {
+				break
 			}
+		}
 
-			var r *Req
-			for r = clnt.reqfirst; r != nil; r = r.next {
-				if r.Tc.Tag == fc.Tag {
-					break
-				}
-			}
+		if r == nil {
+			clnt.err = &Error{"unexpected response", EINVAL}
+			_ = clnt.trans.Close()
+			clnt.Unlock()
+			goto closed
+		}
 
-			if r == nil {
-				clnt.err = &Error{"unexpected response", EINVAL}
-				_ = clnt.conn.Close()
-				clnt.Unlock()
-				goto closed
-			}
+		r.Rc = fc
+		clnt.unlink(r)
+		clnt.lastRecv = time.Now()
+		clnt.lastUse = clnt.lastRecv
+		flushed := clnt.flushed(r)
+		clnt.Unlock()
 
-			r.Rc = fc
-			if r.prev != nil {
-				r.prev.next = r.next
-			} else {
-				clnt.reqfirst = r.next
-			}
+		if flushed != nil {
+			flushed.Err = Eflushed
+			flushed.done()
+		}
 
-			if r.next != nil {
-				r.next.prev = r.prev
-			} else {
-				clnt.reqlast = r.prev
-			}
-			clnt.Unlock()
+		if clnt.Trace != nil {
+			var ev TraceEvent
+			ev.set(clnt.Id, r.start, r.Tc, r.Rc)
+			clnt.Trace.Trace(&ev)
+		}
 
-			if r.Tc.Type != r.Rc.Type-1 {
-				if r.Rc.Type != Rerror {
-					r.Err = &Error{"invalid response", EINVAL}
-					log.Printf("TTT %v", r.Tc)
-					log.Printf("RRR %v", r.Rc)
-				} else if r.Err == nil {
-					r.Err = &Error{r.Rc.Error, r.Rc.Errornum}
-				}
-			}
+		if m := clnt.Metrics; m != nil {
+			m.request(r.start, r.Tc, r.Rc)
+			m.fids(r.Tc, r.Rc)
+		}
 
-			if r.Done != nil {
-				r.Done <- r
+		if r.Tc.Type != r.Rc.Type-1 {
+			if r.Rc.Type != Rerror {
+				r.Err = &Error{"invalid response", EINVAL}
+				log.Printf("TTT %v", r.Tc)
+				log.Printf("RRR %v", r.Rc)
+			} else if r.Err == nil {
+				r.Err = clnt.Options.rerror(r.Rc)
 			}
-
-			pos -= fcsize
-			buf = buf[fcsize:]
 		}
+
+		r.done()
 	}
 
 closed:
-	clnt.done <- true
+	// send may still use the requests it took, wait for it
+	_ = clnt.trans.Close()
+	close(clnt.done)
+	<-clnt.sent
 
 	/* send error to all pending requests */
 	clnt.Lock()
@@ -243,12 +327,17 @@ closed:
 	if err == nil {
 		err = clnt.err
 	}
+
+	if clnt.watch != nil {
+		clnt.watch.Stop()
+	}
 	clnt.Unlock()
-	for ; r != nil; r = r.next {
+	for r != nil {
+		// r can be reused once it is done
+		next := r.next
 		r.Err = err
-		if r.Done != nil {
-			r.Done <- r
-		}
+		r.done()
+		r = next
 	}
 
 	clnts.Lock()
@@ -264,13 +353,48 @@ closed:
 		clnts.clntLast = clnt.prev
 	}
 	clnts.Unlock()
+}
 
-	if sop, ok := (interface{}(clnt)).(StatsOps); ok {
-		sop.statsUnregister()
+// Returns the request flushed by the response to a Tflush, removed from
+// the pending requests. The server didn't respond to it before the
+// Rflush, so it never will. Should be called with the client locked.
+func (clnt *Clnt) flushed(r *Req) *Req {
+	if r.Tc.Type != Tflush || r.Rc.Type != Rflush {
+		return nil
+	}
+
+	for p := clnt.reqfirst; p != nil; p = p.next {
+		if p.Tc.Tag == r.Tc.Oldtag {
+			clnt.unlink(p)
+			return p
+		}
 	}
+
+	return nil
+}
+
+// Removes the request from the list of pending requests. Should be
+// called with the client locked.
+func (clnt *Clnt) unlink(r *Req) {
+	if r.prev != nil {
+		r.prev.next = r.next
+	} else {
+		clnt.reqfirst = r.next
+	}
+
+	if r.next != nil {
+		r.next.prev = r.prev
+	} else {
+		clnt.reqlast = r.prev
+	}
+
+	r.prev = nil
+	r.next = nil
 }
 
 func (clnt *Clnt) send() {
+	defer close(clnt.sent)
+	var pkt []byte
 	for {
 		select {
 		case <-clnt.done:
@@ -292,18 +416,15 @@ func (clnt *Clnt) send() {
 			// with Fcall buffer reuse. The recv goroutine may deliver
 			// the response (freeing the Fcall back to the pool) before
 			// send finishes writing, allowing PackT* to overwrite Pkt
-			// while conn.Write is still reading from it.
-			pkt := make([]byte, len(req.Tc.Pkt))
-			copy(pkt, req.Tc.Pkt)
-			for buf := pkt; len(buf) > 0; {
-				n, err := clnt.conn.Write(buf)
-				if err != nil {
-					/* just close the socket, will get signal on clnt.done */
-					_ = clnt.conn.Close()
-					break
-				}
-
-				buf = buf[n:]
+			// while WriteMsg is still reading from it. The copy is
+			// private to this goroutine, so it is reused.
+			pkt = append(pkt[:0], req.Tc.Pkt...)
+			clnt.writing.Store(time.Now().UnixNano())
+			err := clnt.trans.WriteMsg(pkt)
+			clnt.writing.Store(0)
+			if err != nil {
+				/* just close the transport, will get signal on clnt.done */
+				_ = clnt.trans.Close()
 			}
 		}
 	}
@@ -312,18 +433,26 @@ func (clnt *Clnt) send() {
 // Creates and initializes a new Clnt object. Doesn't send any data
 // on the wire.
 func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
+	return NewClntTransport(newConnTransport(c, msize), msize, dotu)
+}
+
+// Creates a new Clnt object that sends and receives the messages with
+// the transport. Doesn't send any data.
+func NewClntTransport(t Transport, msize uint32, dotu bool) *Clnt {
 	clnt := new(Clnt)
-	clnt.conn = c
+	clnt.trans = t
 	clnt.Msize = msize
 	clnt.Dotu = dotu
 	clnt.Debuglevel = DefaultDebuglevel
 	clnt.Log = DefaultLogger
-	clnt.Id = c.RemoteAddr().String() + ":"
+	clnt.Id = transportId(t) + ":"
 	clnt.tagpool = NewPool(0, uint32(NOTAG))
 	clnt.reqout = make(chan *Req)
 	clnt.done = make(chan bool)
+	clnt.sent = make(chan bool)
 	clnt.reqchan = make(chan *Req, 16)
 	clnt.tchan = make(chan *Fcall, 16)
+	clnt.writing = new(atomic.Int64)
 
 	go clnt.recv()
 	go clnt.send()
@@ -339,10 +468,6 @@ func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
 	clnts.clntLast = clnt
 	clnts.Unlock()
 
-	if sop, ok := (interface{}(clnt)).(StatsOps); ok {
-		sop.statsRegister()
-	}
-
 	return clnt
 }
 
@@ -350,7 +475,13 @@ func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
 // a client object for it. Negotiates the dialect and msize for the
 // connection. Returns a Clnt object, or Error.
 func Connect(c net.Conn, msize uint32, dotu bool) (*Clnt, error) {
-	clnt := NewClnt(c, msize, dotu)
+	return ConnectTransport(newConnTransport(c, msize), msize, dotu)
+}
+
+// Creates a client object that uses the transport, and negotiates the
+// dialect and msize. Returns a Clnt object, or Error.
+func ConnectTransport(t Transport, msize uint32, dotu bool) (*Clnt, error) {
+	clnt := NewClntTransport(t, msize, dotu)
 	ver := "9P2000"
 	if clnt.Dotu {
 		ver = "9P2000.u"
@@ -364,6 +495,7 @@ func Connect(c net.Conn, msize uint32, dotu bool) (*Clnt, error) {
 	}
 
 	rc, err := clnt.Rpc(tc)
+	defer PutFcall(rc)
 	if err != nil {
 		return nil, err
 	}
@@ -421,6 +553,7 @@ func (clnt *Clnt) ReqFree(req *Req) {
 	req.Rc = nil
 	req.Err = nil
 	req.Done = nil
+	req.wait = nil
 	req.next = nil
 	req.prev = nil
 
@@ -440,10 +573,7 @@ func (clnt *Clnt) logFcall(fc *Fcall) {
 	}
 
 	if clnt.Debuglevel&DbgLogFcalls != 0 {
-		f := new(Fcall)
-		*f = *fc
-		f.Pkt = nil
-		clnt.Log.Log(f, clnt, DbgLogFcalls)
+		clnt.Log.Log(fc.clone(), clnt, DbgLogFcalls)
 	}
 }
 
@@ -455,7 +585,4 @@ func FidFile(fid *Fid, offset uint64) *File {
 
 func init() {
 	clnts = new(ClntList)
-	if sop, ok := (interface{}(clnts)).(StatsOps); ok {
-		sop.statsRegister()
-	}
 }
@@ -1,6 +1,10 @@
 package go9p
 
-import "testing"
+import (
+	"io"
+	"net"
+	"testing"
+)
 
 func TestFidFile(t *testing.T) {
 	fid := &Fid{Fid: 1}
@@ -18,3 +22,86 @@ func TestClntLogFcall(t *testing.T) {
 	fc := &Fcall{Type: Tversion, Pkt: []byte("pkt")}
 	clnt.logFcall(fc)
 }
+
+// Serves the requests on c with canned responses: Rread with 4k of
+// data, Rwrite and Rattach.
+func serveRaw(c net.Conn) {
+	buf := make([]byte, 8192+IOHDRSZ)
+	rc := NewFcall(8192 + IOHDRSZ)
+	tc := new(Fcall)
+	data := make([]byte, 4096)
+	for {
+		if _, err := io.ReadFull(c, buf[0:4]); err != nil {
+			return
+		}
+
+		sz, _ := gint32(buf)
+		if _, err := io.ReadFull(c, buf[4:sz]); err != nil {
+			return
+		}
+
+		_, err := UnpackInto(tc, buf[0:sz], true)
+		if err != nil {
+			return
+		}
+
+		switch tc.Type {
+		case Tversion:
+			_ = PackRversion(rc, tc.Msize, tc.Version)
+		case Tattach:
+			_ = PackRattach(rc, &Qid{Type: QTDIR})
+		case Tread:
+			_ = PackRread(rc, data[0:tc.Count])
+		case Twrite:
+			_ = PackRwrite(rc, tc.Count)
+		default:
+			_ = PackRerror(rc, "not implemented", EINVAL, true)
+		}
+
+		SetTag(rc, tc.Tag)
+		if _, err := c.Write(rc.Pkt); err != nil {
+			return
+		}
+	}
+}
+
+func newRawClnt(b *testing.B) *File {
+	c1, c2 := net.Pipe()
+	go serveRaw(c2)
+	clnt, err := MountConn(c1, "", 8192, OsUsers.Uid2User(0))
+	if err != nil {
+		b.Fatalf("MountConn error = %v", err)
+	}
+	b.Cleanup(clnt.Unmount)
+
+	clnt.Root.Iounit = 8192
+	return FidFile(clnt.Root, 0)
+}
+
+func BenchmarkClntRead(b *testing.B) {
+	f := newRawClnt(b)
+	buf := make([]byte, 4096)
+
+	b.ReportAllocs()
+	b.SetBytes(4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.ReadAt(buf, 0); err != nil {
+			b.Fatalf("ReadAt error = %v", err)
+		}
+	}
+}
+
+func BenchmarkClntWrite(b *testing.B) {
+	f := newRawClnt(b)
+	buf := make([]byte, 4096)
+
+	b.ReportAllocs()
+	b.SetBytes(4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.WriteAt(buf, 0); err != nil {
+			b.Fatalf("WriteAt error = %v", err)
+		}
+	}
+}
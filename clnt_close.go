@@ -12,7 +12,9 @@ func (clnt *Clnt) Clunk(fid *Fid) error {
 			return err
 		}
 
-		if _, err := clnt.Rpc(tc); err != nil {
+		rc, err := clnt.Rpc(tc)
+		PutFcall(rc)
+		if err != nil {
 			fid.walked = false
 			fid.Fid = NOFID
 			return err
@@ -0,0 +1,24 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+// Returned for a request flushed before the server responded to it.
+var Eflushed error = &Error{"request flushed", EINTR}
+
+// Flushes a pending request sent with Rpcnb. Sends a Tflush for it and
+// waits for the Rflush. If the server didn't respond to the request
+// before the Rflush, the request is completed with the Eflushed error.
+// Returns nil if successful.
+func (clnt *Clnt) Flush(r *Req) error {
+	tc := clnt.NewFcall()
+	if err := PackTflush(tc, r.tag); err != nil {
+		return err
+	}
+
+	// the client completes the request once the Rflush is received
+	rc, err := clnt.Rpc(tc)
+	PutFcall(rc)
+	return err
+}
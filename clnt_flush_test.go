@@ -0,0 +1,118 @@
+package go9p
+
+import (
+	"testing"
+)
+
+// A Ramfs that can flush the requests being worked on.
+type flushRamfs struct {
+	*Ramfs
+}
+
+func (fs *flushRamfs) Flush(req *SrvReq) { req.Flush() }
+
+// A file whose reads block until release is closed.
+type blockFile struct {
+	srvFile
+	started chan bool
+	release chan bool
+}
+
+func (f *blockFile) Read(fid *FFid, buf []byte, offset uint64) (int, error) {
+	f.started <- true
+	<-f.release
+	return 0, nil
+}
+
+// Starts a flushRamfs with a /block file.
+func newBlockRamfs(t *testing.T) (*flushRamfs, *blockFile) {
+	t.Helper()
+	fs := &flushRamfs{newTestRamfs()}
+	f := &blockFile{started: make(chan bool, 1), release: make(chan bool)}
+	if err := f.Add(fs.Root, "block", OsUsers.Uid2User(0), nil, 0666, f); err != nil {
+		t.Fatalf("Add error = %v", err)
+	}
+	t.Cleanup(func() { close(f.release) })
+	fs.Dotu = true
+	fs.Start(fs)
+	return fs, f
+}
+
+// Sends a Tread for the file without waiting for the response.
+func startRead(t *testing.T, file *File) *Req {
+	t.Helper()
+	clnt := file.Fid.Clnt
+	r := clnt.ReqAlloc()
+	r.Tc = clnt.NewFcall()
+	r.Done = make(chan *Req, 1)
+	if err := PackTread(r.Tc, file.Fid.Fid, 0, 10); err != nil {
+		t.Fatalf("PackTread error = %v", err)
+	}
+	if err := clnt.Rpcnb(r); err != nil {
+		t.Fatalf("Rpcnb error = %v", err)
+	}
+	return r
+}
+
+func TestClntFlush(t *testing.T) {
+	fs, f := newBlockRamfs(t)
+	clnt := mountPipe(t, fs)
+
+	file, err := clnt.FOpen("/block", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	r := startRead(t, file)
+	<-f.started
+	if err := clnt.Flush(r); err != nil {
+		t.Fatalf("Flush error = %v", err)
+	}
+	if r := <-r.Done; r.Err != Eflushed {
+		t.Fatalf("flushed request error = %v", r.Err)
+	}
+	f.release <- true
+
+	// a request that was already responded isn't affected
+	r = startRead(t, file)
+	<-f.started
+	f.release <- true
+	<-r.Done
+	if err := clnt.Flush(r); err != nil {
+		t.Fatalf("Flush error = %v", err)
+	}
+	if r.Err != nil || r.Rc.Type != Rread {
+		t.Fatalf("responded request = %v %v", r.Rc, r.Err)
+	}
+}
+
+// A Tflush sent with a tag chosen by the caller completes the flushed
+// request too.
+func TestClntReqWithTag(t *testing.T) {
+	fs, f := newBlockRamfs(t)
+	clnt := mountPipe(t, fs)
+
+	file, err := clnt.FOpen("/block", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	r := startRead(t, file)
+	<-f.started
+	fr := clnt.ReqWithTag(1000)
+	fr.Tc = clnt.NewFcall()
+	fr.Done = make(chan *Req, 1)
+	if err := PackTflush(fr.Tc, r.tag); err != nil {
+		t.Fatalf("PackTflush error = %v", err)
+	}
+	if err := clnt.Rpcnb(fr); err != nil {
+		t.Fatalf("Rpcnb error = %v", err)
+	}
+	if r := <-r.Done; r.Err != Eflushed {
+		t.Fatalf("flushed request error = %v", r.Err)
+	}
+	if fr := <-fr.Done; fr.Err != nil || fr.Rc.Tag != 1000 {
+		t.Fatalf("Rflush = %v, %v, want tag 1000", fr.Rc, fr.Err)
+	}
+	f.release <- true
+}
@@ -0,0 +1,31 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+// An RpcFunc sends the request r.Tc and waits for the response. It sets
+// r.Rc if the server responded, and returns r.Err.
+type RpcFunc func(r *Req) error
+
+// An Interceptor wraps the RpcFunc of a client. It sees each request
+// before calling next, and the response after. It can change r.Tc, fail
+// the request without calling next, or call next again to retry it. A
+// response that is discarded should be freed with PutFcall.
+type Interceptor func(next RpcFunc) RpcFunc
+
+// Adds interceptors to the client. They are used by Rpc and Rpcnb, and
+// by all methods that send requests. The interceptor added first is the
+// outermost, it sees the requests first and the responses last. With
+// interceptors, Rpcnb waits for the response in a goroutine of its own.
+func (clnt *Clnt) Use(icpts ...Interceptor) {
+	clnt.Lock()
+	defer clnt.Unlock()
+	clnt.icpts = append(clnt.icpts, icpts...)
+	rpc := RpcFunc(clnt.rpcWait)
+	for i := len(clnt.icpts) - 1; i >= 0; i-- {
+		rpc = clnt.icpts[i](rpc)
+	}
+
+	clnt.rpc = rpc
+}
@@ -0,0 +1,110 @@
+package go9p
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestClntUse(t *testing.T) {
+	fs := newTestRamfs()
+	addRamFile(t, fs, nil, "file", "data", 0644)
+	clnt := newRamfsClnt(t, fs)
+
+	var mu sync.Mutex
+	var log []string
+	logger := func(name string) Interceptor {
+		return func(next RpcFunc) RpcFunc {
+			return func(r *Req) error {
+				typ := r.Tc.Type
+				err := next(r)
+				mu.Lock()
+				log = append(log, fmt.Sprintf("%s %s %v", name, MsgName(typ), err))
+				mu.Unlock()
+				return err
+			}
+		}
+	}
+	deny := func(next RpcFunc) RpcFunc {
+		return func(r *Req) error {
+			if r.Tc.Type == Tremove {
+				return Eperm
+			}
+			return next(r)
+		}
+	}
+	nstat := 0
+	retry := func(next RpcFunc) RpcFunc {
+		return func(r *Req) error {
+			if r.Tc.Type != Tstat {
+				return next(r)
+			}
+			nstat++
+			if err := next(r); err != nil {
+				return err
+			}
+			PutFcall(r.Rc)
+			nstat++
+			return next(r)
+		}
+	}
+	clnt.Use(logger("outer"), deny, retry, logger("inner"))
+
+	fid := clnt.FidAlloc()
+	if _, err := clnt.Walk(clnt.Root, fid, []string{"file"}); err != nil {
+		t.Fatalf("Walk error = %v", err)
+	}
+	d, err := clnt.Stat(fid)
+	if err != nil || d.Name != "file" || nstat != 2 {
+		t.Fatalf("Stat = %v, %v after %d stats", d, err, nstat)
+	}
+	if err := clnt.Remove(fid); err != Eperm {
+		t.Fatalf("Remove error = %v", err)
+	}
+	if fs.Root.Find("file") == nil {
+		t.Fatalf("denied Tremove was sent")
+	}
+
+	// Rpcnb goes through the interceptors too, Tremove clunked the fid
+	fid = clnt.FidAlloc()
+	if _, err := clnt.Walk(clnt.Root, fid, []string{"file"}); err != nil {
+		t.Fatalf("Walk error = %v", err)
+	}
+	if err := clnt.Open(fid, OREAD); err != nil {
+		t.Fatalf("Open error = %v", err)
+	}
+	r := startRead(t, &File{Fid: fid})
+	if r := <-r.Done; r.Err != nil || string(r.Rc.Data) != "data" {
+		t.Fatalf("read = %v", r.Err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"inner Twalk <nil>", "outer Twalk <nil>",
+		"inner Tstat <nil>", "inner Tstat <nil>", "outer Tstat <nil>",
+		"outer Tremove permission denied",
+		"inner Twalk <nil>", "outer Twalk <nil>",
+		"inner Topen <nil>", "outer Topen <nil>",
+		"inner Tread <nil>", "outer Tread <nil>",
+	}
+	if fmt.Sprint(log) != fmt.Sprint(want) {
+		t.Fatalf("log = %v\nwant %v", log, want)
+	}
+}
+
+func TestClntUseRpcnbClosed(t *testing.T) {
+	clnt := newRamfsClnt(t, newTestRamfs())
+	clnt.Use(func(next RpcFunc) RpcFunc { return next })
+	clnt.Unmount()
+
+	// the error is returned even if nothing waits on r.Done
+	r := clnt.ReqAlloc()
+	r.Tc = clnt.NewFcall()
+	if err := PackTclunk(r.Tc, clnt.Root.Fid); err != nil {
+		t.Fatalf("PackTclunk error = %v", err)
+	}
+	if err := clnt.Rpcnb(r); err == nil {
+		t.Fatalf("Rpcnb on a closed client succeeded")
+	}
+}
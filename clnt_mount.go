@@ -18,7 +18,8 @@ func (clnt *Clnt) Auth(user User, aname string) (*Fid, error) {
 		return nil, err
 	}
 
-	_, err = clnt.Rpc(tc)
+	rc, err := clnt.Rpc(tc)
+	PutFcall(rc)
 	if err != nil {
 		return nil, err
 	}
@@ -48,6 +49,7 @@ func (clnt *Clnt) Attach(afid *Fid, user User, aname string) (*Fid, error) {
 	}
 
 	rc, err := clnt.Rpc(tc)
+	defer PutFcall(rc)
 	if err != nil {
 		return nil, err
 	}
@@ -68,6 +70,12 @@ func Mount(ntype, addr, aname string, msize uint32, user User) (*Clnt, error) {
 	return MountConn(c, aname, msize, user)
 }
 
+// Connects to a file server listening on a Unix socket and attaches to
+// it as the specified user.
+func MountUnix(path, aname string, msize uint32, user User) (*Clnt, error) {
+	return Mount("unix", path, aname, msize, user)
+}
+
 func MountConn(c net.Conn, aname string, msize uint32, user User) (*Clnt, error) {
 	clnt, err := Connect(c, msize+IOHDRSZ, true)
 	if err != nil {
@@ -88,6 +96,6 @@ func MountConn(c net.Conn, aname string, msize uint32, user User) (*Clnt, error)
 func (clnt *Clnt) Unmount() {
 	clnt.Lock()
 	clnt.err = &Error{"connection closed", EIO}
-	_ = clnt.conn.Close()
+	_ = clnt.trans.Close()
 	clnt.Unlock()
 }
@@ -18,6 +18,7 @@ func (clnt *Clnt) Open(fid *Fid, mode uint8) error {
 	}
 
 	rc, err := clnt.Rpc(tc)
+	defer PutFcall(rc)
 	if err != nil {
 		return err
 	}
@@ -41,6 +42,7 @@ func (clnt *Clnt) Create(fid *Fid, name string, perm uint32, mode uint8, ext str
 	}
 
 	rc, err := clnt.Rpc(tc)
+	defer PutFcall(rc)
 	if err != nil {
 		return err
 	}
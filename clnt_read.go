@@ -24,10 +24,40 @@ func (clnt *Clnt) Read(fid *Fid, offset uint64, count uint32) ([]byte, error) {
 
 	rc, err := clnt.Rpc(tc)
 	if err != nil {
+		PutFcall(rc)
 		return nil, err
 	}
 
-	return rc.Data, nil
+	// the response buffer is reused, return a copy of the data
+	data := make([]byte, len(rc.Data))
+	copy(data, rc.Data)
+	PutFcall(rc)
+	return data, nil
+}
+
+// Reads up to len(buf) bytes starting from offset into buf. Returns
+// the number of bytes read, or an Error.
+func (clnt *Clnt) read(fid *Fid, buf []byte, offset uint64) (int, error) {
+	count := uint32(len(buf))
+	if count > fid.Iounit {
+		count = fid.Iounit
+	}
+
+	tc := clnt.NewFcall()
+	err := PackTread(tc, fid.Fid, offset, count)
+	if err != nil {
+		return 0, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		PutFcall(rc)
+		return 0, err
+	}
+
+	n := copy(buf, rc.Data)
+	PutFcall(rc)
+	return n, nil
 }
 
 // Reads up to len(buf) bytes from the File. Returns the number
@@ -44,17 +74,16 @@ func (file *File) Read(buf []byte) (int, error) {
 // Reads up to len(buf) bytes from the file starting from offset.
 // Returns the number of bytes read, or an Error.
 func (file *File) ReadAt(buf []byte, offset int64) (int, error) {
-	b, err := file.Fid.Clnt.Read(file.Fid, uint64(offset), uint32(len(buf)))
+	n, err := file.Fid.Clnt.read(file.Fid, buf, uint64(offset))
 	if err != nil {
 		return 0, err
 	}
 
-	if len(b) == 0 {
+	if n == 0 {
 		return 0, io.EOF
 	}
 
-	copy(buf, b)
-	return len(b), nil
+	return n, nil
 }
 
 // Reads exactly len(buf) bytes from the File starting from offset.
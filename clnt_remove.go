@@ -13,7 +13,8 @@ func (clnt *Clnt) Remove(fid *Fid) error {
 		return err
 	}
 
-	_, err = clnt.Rpc(tc)
+	rc, err := clnt.Rpc(tc)
+	PutFcall(rc)
 	fid.Fid = NOFID
 
 	return err
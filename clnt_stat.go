@@ -13,11 +13,13 @@ func (clnt *Clnt) Stat(fid *Fid) (*Dir, error) {
 	}
 
 	rc, err := clnt.Rpc(tc)
+	defer PutFcall(rc)
 	if err != nil {
 		return nil, err
 	}
 
-	return &rc.Dir, nil
+	d := rc.Dir
+	return &d, nil
 }
 
 // Returns the metadata for a named file, or an Error.
@@ -32,6 +34,23 @@ func (clnt *Clnt) FStat(path string) (*Dir, error) {
 	return d, err
 }
 
+// Returns a Dir that doesn't change anything when passed to Wstat. The
+// fields to change are set in it.
+func NewWstatDir() *Dir {
+	return &Dir{
+		Type:    ^uint16(0),
+		Dev:     ^uint32(0),
+		Qid:     Qid{Type: ^uint8(0), Version: ^uint32(0), Path: ^uint64(0)},
+		Mode:    ^uint32(0),
+		Atime:   ^uint32(0),
+		Mtime:   ^uint32(0),
+		Length:  ^uint64(0),
+		Uidnum:  NOUID,
+		Gidnum:  NOUID,
+		Muidnum: NOUID,
+	}
+}
+
 // Modifies the data of the file associated with the Fid, or an Error.
 func (clnt *Clnt) Wstat(fid *Fid, dir *Dir) error {
 	tc := clnt.NewFcall()
@@ -40,6 +59,7 @@ func (clnt *Clnt) Wstat(fid *Fid, dir *Dir) error {
 		return err
 	}
 
-	_, err = clnt.Rpc(tc)
+	rc, err := clnt.Rpc(tc)
+	PutFcall(rc)
 	return err
 }
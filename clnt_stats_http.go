@@ -2,60 +2,73 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build httpstats && !tinygo
+//go:build !tinygo
 
 package go9p
 
 import (
 	"fmt"
+	"html"
 	"io"
 	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
-func (clnt *Clnt) ServeHTTP(c http.ResponseWriter, r *http.Request) {
-	io.WriteString(c, fmt.Sprintf("<html><body><h1>Client %s</h1>", clnt.Id))
-	defer io.WriteString(c, "</body></html>")
-
-	// fcalls
-	if clnt.Debuglevel&DbgLogFcalls != 0 {
-		fs := clnt.Log.Filter(clnt, DbgLogFcalls)
-		io.WriteString(c, fmt.Sprintf("<h2>Last %d 9P messages</h2>", len(fs)))
-		for _, l := range fs {
-			fc := l.Data.(*Fcall)
-			if fc.Type != 0 {
-				io.WriteString(c, fmt.Sprintf("<br>%s", fc))
-			}
-		}
-	}
+type clntStats struct {
+	Id        string     `json:"id"`
+	Msize     uint32     `json:"msize"`
+	Dotu      bool       `json:"dotu"`
+	Connected bool       `json:"connected"`
+	Reqs      []reqStats `json:"pending_requests"`
 }
 
-func clntServeHTTP(c http.ResponseWriter, r *http.Request) {
-	io.WriteString(c, fmt.Sprintf("<html><body>"))
-	defer io.WriteString(c, "</body></html>")
-
-	clnts.Lock()
-	if clnts.clntList == nil {
-		io.WriteString(c, "no clients")
+// Returns a snapshot of the client state.
+func (clnt *Clnt) stats() *clntStats {
+	now := time.Now()
+	cs := &clntStats{Id: clnt.Id, Msize: atomic.LoadUint32(&clnt.Msize), Dotu: clnt.Dotu}
+	clnt.Lock()
+	cs.Connected = clnt.err == nil
+	for r := clnt.reqfirst; r != nil; r = r.next {
+		cs.Reqs = append(cs.Reqs, newReqStats(r.Tc, r.start, now))
 	}
+	clnt.Unlock()
 
-	for clnt := clnts.clntList; clnt != nil; clnt = clnt.next {
-		io.WriteString(c, fmt.Sprintf("<a href='/go9p/clnt/%s'>%s</a><br>", clnt.Id, clnt.Id))
-	}
-	clnts.Unlock()
+	sort.Slice(cs.Reqs, func(i, j int) bool { return cs.Reqs[i].Age > cs.Reqs[j].Age })
+	return cs
 }
 
-func (clnt *Clnt) statsRegister() {
-	http.Handle("/go9p/clnt/"+clnt.Id, clnt)
-}
+// Returns an http.Handler that serves the state of the client and its
+// pending requests. The handler can be mounted on any path. The state
+// is served as HTML, or as JSON if the "format=json" query parameter
+// is given or the request accepts "application/json".
+func (clnt *Clnt) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(c http.ResponseWriter, r *http.Request) {
+		cs := clnt.stats()
+		if wantJSON(r) {
+			serveJSON(c, cs)
+			return
+		}
 
-func (clnt *Clnt) statsUnregister() {
-	http.Handle("/go9p/clnt/"+clnt.Id, nil)
-}
+		c.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(c, fmt.Sprintf("<html><body><h1>Client %s</h1>", html.EscapeString(cs.Id)))
+		defer io.WriteString(c, "</body></html>")
 
-func (c *ClntList) statsRegister() {
-	http.HandleFunc("/go9p/clnt", clntServeHTTP)
-}
+		io.WriteString(c, fmt.Sprintf("<p>Connected: %v", cs.Connected))
+		io.WriteString(c, fmt.Sprintf("<br>Msize %d, 9P2000.u %v", cs.Msize, cs.Dotu))
+		writeReqs(c, cs.Reqs)
 
-func (c *ClntList) statsUnregister() {
-	http.HandleFunc("/go9p/clnt", nil)
+		// fcalls
+		if clnt.Debuglevel&DbgLogFcalls != 0 && clnt.Log != nil {
+			fs := clnt.Log.Filter(clnt, DbgLogFcalls)
+			io.WriteString(c, fmt.Sprintf("<h2>Last %d 9P messages</h2>", len(fs)))
+			for _, l := range fs {
+				fc := l.Data.(*Fcall)
+				if fc.Type != 0 {
+					io.WriteString(c, fmt.Sprintf("<br>%s", html.EscapeString(fc.String())))
+				}
+			}
+		}
+	})
 }
@@ -29,6 +29,17 @@ func (clnt *Clnt) TagFree(tag *Tag) {
 	clnt.tagpool.Put(uint32(tag.tag))
 }
 
+// Returns a request sent with the given tag instead of a tag from the
+// client's pool, for tools controlling the tags on the wire. The caller
+// must not reuse the tag of a pending request, and must not free the
+// request with ReqFree.
+func (clnt *Clnt) ReqWithTag(tag uint16) *Req {
+	r := new(Req)
+	r.Clnt = clnt
+	r.tag = tag
+	return r
+}
+
 func (tag *Tag) reqAlloc() *Req {
 	r := new(Req)
 	r.tag = tag.tag
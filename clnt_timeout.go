@@ -0,0 +1,170 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"time"
+)
+
+// Returned once the client stopped waiting for a server that doesn't
+// respond.
+var Enotresponding error = &Error{"server not responding", ETIMEDOUT}
+
+// Returned once the client closed an idle connection.
+var Eidle error = &Error{"connection idle", ETIMEDOUT}
+
+// The ClntTimeouts type contains the time limits of a client
+// connection. A zero field means no limit. When a limit is exceeded, the
+// connection is closed and all requests fail with Enotresponding or
+// Eidle.
+type ClntTimeouts struct {
+	// Closes the connection when no requests were pending for this
+	// long. The heartbeat keeps the connection in use.
+	Idle time.Duration
+
+	// Time limit to receive a response while requests are pending.
+	// Requests the server may block on, like reads of pipes, need a
+	// longer limit than they may block.
+	Read time.Duration
+
+	// Time limit to send a message.
+	Write time.Duration
+
+	// Interval of the heartbeat, a Tstat of the Root fid. The client
+	// is broken if the server doesn't respond to it within the
+	// interval. There is no heartbeat until Root is set.
+	Keepalive time.Duration
+}
+
+// Sets the time limits of the connection. It should be called after
+// the client is attached, and can be called again to change them.
+func (clnt *Clnt) SetTimeouts(t ClntTimeouts) {
+	clnt.Lock()
+	defer clnt.Unlock()
+	if clnt.err != nil {
+		return
+	}
+
+	clnt.timeouts = t
+	if clnt.watch != nil {
+		clnt.watch.Stop()
+		clnt.watch = nil
+	}
+
+	if p := t.period(); p > 0 {
+		now := time.Now()
+		clnt.lastUse = now
+		clnt.lastRecv = now
+		clnt.watch = time.AfterFunc(p, clnt.watchCheck)
+	}
+
+	if t.Keepalive > 0 && !clnt.pinging {
+		clnt.pinging = true
+		go clnt.keepalive()
+	}
+}
+
+// Returns how often the limits are checked, 0 if there are none.
+func (t ClntTimeouts) period() time.Duration {
+	var p time.Duration
+	for _, d := range []time.Duration{t.Idle, t.Read, t.Write} {
+		if d > 0 && (p == 0 || d < p) {
+			p = d
+		}
+	}
+
+	return p / 4
+}
+
+// Closes the connection if a limit is exceeded, otherwise checks again
+// later.
+func (clnt *Clnt) watchCheck() {
+	now := time.Now()
+	clnt.Lock()
+	t := clnt.timeouts
+	var err error
+	w := clnt.writing.Load()
+	switch {
+	case clnt.err != nil:
+		clnt.Unlock()
+		return
+	case t.Write > 0 && w != 0 && now.Sub(time.Unix(0, w)) >= t.Write:
+		err = Enotresponding
+	case t.Read > 0 && clnt.reqfirst != nil && now.Sub(later(clnt.busy, clnt.lastRecv)) >= t.Read:
+		err = Enotresponding
+	case t.Idle > 0 && clnt.reqfirst == nil && now.Sub(clnt.lastUse) >= t.Idle:
+		err = Eidle
+	}
+
+	if err == nil {
+		clnt.watch.Reset(t.period())
+	}
+	clnt.Unlock()
+
+	if err != nil {
+		clnt.fail(err)
+	}
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+// Sends the heartbeat until the connection is closed or Keepalive is
+// reset.
+func (clnt *Clnt) keepalive() {
+	for {
+		clnt.Lock()
+		d := clnt.timeouts.Keepalive
+		if d <= 0 {
+			clnt.pinging = false
+		}
+		clnt.Unlock()
+		if d <= 0 {
+			return
+		}
+
+		select {
+		case <-clnt.done:
+			return
+		case <-time.After(d):
+		}
+
+		if clnt.Root == nil {
+			continue
+		}
+
+		// any response, even an error, means the server is alive
+		ch := make(chan bool, 1)
+		go func() {
+			_, _ = clnt.Stat(clnt.Root)
+			ch <- true
+		}()
+
+		select {
+		case <-clnt.done:
+			return
+		case <-ch:
+		case <-time.After(d):
+			clnt.fail(Enotresponding)
+			return
+		}
+	}
+}
+
+// Marks the client broken with the error and closes the connection.
+// The pending requests fail with err.
+func (clnt *Clnt) fail(err error) {
+	clnt.Lock()
+	if clnt.err == nil {
+		clnt.err = err
+	}
+	clnt.Unlock()
+	_ = clnt.trans.Close()
+}
@@ -0,0 +1,83 @@
+package go9p
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// A Ramfs that doesn't respond to Tstat until the test ends.
+type stallRamfs struct {
+	*Ramfs
+	release chan bool
+}
+
+func (fs *stallRamfs) Stat(req *SrvReq) {
+	<-fs.release
+	fs.Ramfs.Stat(req)
+}
+
+func TestClntTimeouts(t *testing.T) {
+	tests := []struct {
+		name   string
+		t      ClntTimeouts
+		server func(c net.Conn)
+	}{
+		// the server reads the requests but doesn't respond
+		{"read", ClntTimeouts{Read: 20 * time.Millisecond}, func(c net.Conn) { _, _ = io.Copy(io.Discard, c) }},
+		// the server doesn't read the requests
+		{"write", ClntTimeouts{Write: 20 * time.Millisecond}, func(c net.Conn) {}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			t.Cleanup(func() { _ = c1.Close() })
+			go tt.server(c1)
+			clnt := NewClnt(c2, 8192, false)
+			t.Cleanup(clnt.Unmount)
+			clnt.SetTimeouts(tt.t)
+
+			tc := clnt.NewFcall()
+			if err := PackTversion(tc, 8192, "9P2000"); err != nil {
+				t.Fatalf("PackTversion error = %v", err)
+			}
+			if _, err := clnt.Rpc(tc); err != Enotresponding {
+				t.Fatalf("Rpc error = %v, want %v", err, Enotresponding)
+			}
+		})
+	}
+}
+
+func TestClntIdle(t *testing.T) {
+	clnt := newRamfsClnt(t, newTestRamfs())
+	clnt.SetTimeouts(ClntTimeouts{Idle: 50 * time.Millisecond})
+	time.Sleep(200 * time.Millisecond)
+	if _, err := clnt.FStat("/"); err != Eidle {
+		t.Fatalf("FStat error = %v, want %v", err, Eidle)
+	}
+}
+
+func TestClntKeepalive(t *testing.T) {
+	clnt := newRamfsClnt(t, newTestRamfs())
+	clnt.SetTimeouts(ClntTimeouts{Idle: 100 * time.Millisecond, Keepalive: 20 * time.Millisecond})
+	time.Sleep(300 * time.Millisecond)
+	if _, err := clnt.FStat("/"); err != nil {
+		t.Fatalf("FStat error = %v, heartbeat didn't keep the connection", err)
+	}
+}
+
+func TestClntKeepaliveDead(t *testing.T) {
+	fs := &stallRamfs{newTestRamfs(), make(chan bool)}
+	t.Cleanup(func() { close(fs.release) })
+	fs.Dotu = true
+	fs.Start(fs)
+	clnt := mountPipe(t, fs)
+
+	clnt.SetTimeouts(ClntTimeouts{Keepalive: 20 * time.Millisecond})
+	time.Sleep(200 * time.Millisecond)
+	if _, err := clnt.FOpen("/", OREAD); err != Enotresponding {
+		t.Fatalf("FOpen error = %v, want %v", err, Enotresponding)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+// The Transport type carries the 9P2000 messages of a client. A Clnt
+// calls ReadMsg from one goroutine and WriteMsg from another.
+type Transport interface {
+	// Reads the next message, including its size, into buf and
+	// returns its length. Fails with Ebadmsgsize if the message
+	// doesn't fit in buf.
+	ReadMsg(buf []byte) (int, error)
+
+	// Writes a message. The transport shouldn't retain msg after
+	// it returns.
+	WriteMsg(msg []byte) error
+
+	// Closes the transport. Pending and later ReadMsg and WriteMsg
+	// calls should fail.
+	Close() error
+}
+
+// A transport sending the messages as a stream on a net.Conn.
+type connTransport struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newConnTransport(c net.Conn, msize uint32) *connTransport {
+	// The Msize can only shrink after the version negotiation.
+	return &connTransport{conn: c, rd: bufio.NewReaderSize(c, int(msize))}
+}
+
+func (t *connTransport) ReadMsg(buf []byte) (int, error) {
+	if _, err := io.ReadFull(t.rd, buf[0:4]); err != nil {
+		return 0, err
+	}
+
+	sz, _ := Gint32(buf)
+	if sz > uint32(len(buf)) || sz < 7 {
+		return 0, Ebadmsgsize
+	}
+
+	if _, err := io.ReadFull(t.rd, buf[4:sz]); err != nil {
+		return 0, err
+	}
+
+	return int(sz), nil
+}
+
+func (t *connTransport) WriteMsg(msg []byte) error {
+	for len(msg) > 0 {
+		n, err := t.conn.Write(msg)
+		if err != nil {
+			return err
+		}
+
+		msg = msg[n:]
+	}
+
+	return nil
+}
+
+func (t *connTransport) Close() error { return t.conn.Close() }
+
+func (t *connTransport) RemoteAddr() net.Addr { return t.conn.RemoteAddr() }
+
+// Returns the name of the transport used in the client's Id.
+func transportId(t Transport) string {
+	if a, ok := t.(interface{ RemoteAddr() net.Addr }); ok {
+		return a.RemoteAddr().String()
+	}
+
+	return "transport"
+}
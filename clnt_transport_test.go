@@ -0,0 +1,115 @@
+package go9p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// A transport passing whole messages on channels.
+type chanTransport struct {
+	in, out chan []byte
+	closed  chan bool
+	once    sync.Once
+}
+
+func (t *chanTransport) ReadMsg(buf []byte) (int, error) {
+	select {
+	case msg := <-t.in:
+		if len(msg) > len(buf) {
+			return 0, Ebadmsgsize
+		}
+		return copy(buf, msg), nil
+	case <-t.closed:
+		return 0, io.EOF
+	}
+}
+
+func (t *chanTransport) WriteMsg(msg []byte) error {
+	select {
+	case t.out <- append([]byte(nil), msg...):
+		return nil
+	case <-t.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (t *chanTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+// Returns a chanTransport connected to the file server.
+func newChanTransport(fs *Ramfs) *chanTransport {
+	t := &chanTransport{make(chan []byte), make(chan []byte), make(chan bool), sync.Once{}}
+	c1, c2 := net.Pipe()
+	fs.NewConn(c1)
+	go func() {
+		ct := newConnTransport(c2, MSIZE)
+		for {
+			buf := make([]byte, MSIZE)
+			n, err := ct.ReadMsg(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case t.in <- buf[:n]:
+			case <-t.closed:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer c2.Close()
+		for {
+			select {
+			case msg := <-t.out:
+				if _, err := c2.Write(msg); err != nil {
+					return
+				}
+			case <-t.closed:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func TestClntTransport(t *testing.T) {
+	fs := newTestRamfs()
+	addRamFile(t, fs, nil, "file", "over channels", 0644)
+	fs.Dotu = true
+	fs.Start(fs)
+
+	clnt, err := ConnectTransport(newChanTransport(fs), 8192+IOHDRSZ, true)
+	if err != nil {
+		t.Fatalf("ConnectTransport error = %v", err)
+	}
+	if clnt.Id != "transport:" {
+		t.Fatalf("Id = %q", clnt.Id)
+	}
+	clnt.Root, err = clnt.Attach(nil, OsUsers.Uid2User(0), "")
+	if err != nil {
+		t.Fatalf("Attach error = %v", err)
+	}
+	if got := readFile(t, clnt, "/file"); got != "over channels" {
+		t.Fatalf("read = %q", got)
+	}
+
+	clnt.Unmount()
+	if _, err := clnt.FStat("/file"); err == nil {
+		t.Fatalf("FStat after Unmount succeeded")
+	}
+}
+
+func TestConnTransportMsgSize(t *testing.T) {
+	msg := make([]byte, 64)
+	pint32(64, msg)
+	ct := newConnTransport(nil, 128)
+	ct.rd.Reset(bytes.NewReader(msg))
+	if _, err := ct.ReadMsg(make([]byte, 32)); err != Ebadmsgsize {
+		t.Fatalf("ReadMsg of a large message error = %v", err)
+	}
+}
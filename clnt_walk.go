@@ -78,6 +78,7 @@ func (clnt *Clnt) FWalk(path string) (*Fid, error) {
 
 		newfid.walked = true
 		if len(rc.Wqid) != n {
+			PutFcall(rc)
 			err = &Error{"file not found", ENOENT}
 			goto error
 		}
@@ -88,6 +89,8 @@ func (clnt *Clnt) FWalk(path string) (*Fid, error) {
 			newfid.Qid = fid.Qid
 		}
 
+		PutFcall(rc)
+
 		wnames = wnames[n:]
 		fid = newfid
 		if len(wnames) == 0 {
@@ -18,6 +18,7 @@ func (clnt *Clnt) Write(fid *Fid, data []byte, offset uint64) (int, error) {
 	}
 
 	rc, err := clnt.Rpc(tc)
+	defer PutFcall(rc)
 	if err != nil {
 		return 0, err
 	}
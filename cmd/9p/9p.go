@@ -0,0 +1,540 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Accesses the files of a 9P server from the command line.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rminnich/go9p"
+)
+
+var addr = flag.String("addr", "127.0.0.1:5640", "network address of the server, or a ws:// or wss:// URL")
+var ntype = flag.String("net", "tcp", "network type of addr, tcp or unix")
+var aname = flag.String("aname", "", "file tree to attach to")
+var uname = flag.String("user", "", "user to attach as, default the current user")
+var msize = flag.Uint("msize", 8192, "maximum size of the data in a message")
+var dialect = flag.String("dialect", "9P2000.u", "protocol dialect: 9P2000, 9P2000.u or akaros")
+
+// A subcommand.
+type command struct {
+	args string // usage of the arguments
+	desc string
+	run  func(c *client, args []string) error
+}
+
+var commands = map[string]command{
+	"ls":    {"[-l] [path...]", "list directories", (*client).ls},
+	"cat":   {"path...", "print files", (*client).cat},
+	"write": {"path", "write the standard input to a file, creating it if needed", (*client).write},
+	"stat":  {"path...", "print the metadata of files", (*client).stat},
+	"rm":    {"path...", "remove files and empty directories", (*client).rm},
+	"mkdir": {"path...", "create directories", (*client).mkdir},
+	"mv":    {"path newpath", "rename a file in its directory", (*client).mv},
+	"cp":    {"src dst", "copy files and directories recursively, remote paths start with ':'", (*client).cp},
+	"tree":  {"[path]", "list a directory recursively", (*client).tree},
+}
+
+// A client with the standard input and output of the subcommands.
+type client struct {
+	*go9p.Clnt
+	in  io.Reader
+	out io.Writer
+}
+
+// The user attaching to the server.
+type cmdUser struct {
+	name string
+	id   int
+}
+
+func (u *cmdUser) Name() string               { return u.name }
+func (u *cmdUser) Id() int                    { return u.id }
+func (u *cmdUser) Groups() []go9p.Group       { return nil }
+func (u *cmdUser) IsMember(g go9p.Group) bool { return false }
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: 9p [flags] command [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-6s %-16s %s\n", name, c.args, c.desc)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "9p: unknown command %q\n", flag.Arg(0))
+		usage()
+	}
+
+	clnt, err := mount()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "9p: %v\n", err)
+		os.Exit(1)
+	}
+
+	c := &client{clnt, os.Stdin, os.Stdout}
+	err = cmd.run(c, flag.Args()[1:])
+	clnt.Unmount()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "9p: %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// Connects to the server and attaches to it.
+func mount() (*go9p.Clnt, error) {
+	var dotu bool
+	var options go9p.ProtocolOptions
+	switch *dialect {
+	case "9P2000":
+	case "9P2000.u":
+		dotu = true
+	case "akaros":
+		options = go9p.AkarosOptions
+	default:
+		return nil, fmt.Errorf("unknown dialect %q", *dialect)
+	}
+
+	var c net.Conn
+	var err error
+	if strings.HasPrefix(*addr, "ws://") || strings.HasPrefix(*addr, "wss://") {
+		c, err = go9p.DialWebSocket(*addr)
+	} else {
+		c, err = net.Dial(*ntype, *addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return attach(c, uint32(*msize), dotu, options, attachUser(*uname), *aname)
+}
+
+// Returns the user to attach as. The uid is only known for the
+// current user.
+func attachUser(name string) go9p.User {
+	u := &cmdUser{name, int(go9p.NOUID)}
+	if cur, err := user.Current(); err == nil && (name == "" || name == cur.Username) {
+		u.name = cur.Username
+		u.id = os.Getuid()
+	}
+
+	return u
+}
+
+func attach(c net.Conn, msize uint32, dotu bool, options go9p.ProtocolOptions, u go9p.User, aname string) (*go9p.Clnt, error) {
+	clnt, err := go9p.Connect(c, msize+go9p.IOHDRSZ, dotu)
+	if err != nil {
+		return nil, err
+	}
+
+	clnt.Options = options
+	root, err := clnt.Attach(nil, u, aname)
+	if err != nil {
+		clnt.Unmount()
+		return nil, err
+	}
+
+	clnt.Root = root
+	return clnt, nil
+}
+
+func (c *client) ls(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	long := fs.Bool("l", false, "long format")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+
+	for _, p := range paths {
+		d, err := c.FStat(p)
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+
+		dirs := []*go9p.Dir{d}
+		if d.Mode&go9p.DMDIR != 0 {
+			if dirs, err = c.readDir(p); err != nil {
+				return fmt.Errorf("%s: %v", p, err)
+			}
+		}
+
+		if len(paths) > 1 && d.Mode&go9p.DMDIR != 0 {
+			fmt.Fprintf(c.out, "%s:\n", p)
+		}
+
+		for _, d := range dirs {
+			if *long {
+				fmt.Fprintln(c.out, longFormat(d))
+			} else {
+				fmt.Fprintln(c.out, d.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the entries of a directory, sorted by name.
+func (c *client) readDir(p string) ([]*go9p.Dir, error) {
+	f, err := c.FOpen(p, go9p.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dirs, err := f.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name < dirs[j].Name })
+	return dirs, nil
+}
+
+func longFormat(d *go9p.Dir) string {
+	mtime := time.Unix(int64(d.Mtime), 0).Format("Jan _2 15:04 2006")
+	return fmt.Sprintf("%-6s %-8s %-8s %10d %s %s", go9p.PermString(d.Mode), d.Uid, d.Gid, d.Length, mtime, d.Name)
+}
+
+func (c *client) cat(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no files")
+	}
+
+	for _, p := range args {
+		f, err := c.FOpen(p, go9p.OREAD)
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+
+		_, err = io.Copy(c.out, f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *client) write(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("one file expected")
+	}
+
+	f, err := c.create(args[0], 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return copyTo(f, c.in)
+}
+
+// Opens a file for writing, truncated, creating it if it doesn't
+// exist.
+func (c *client) create(p string, perm uint32) (*go9p.File, error) {
+	f, err := c.FOpen(p, go9p.OWRITE|go9p.OTRUNC)
+	if err == nil {
+		return f, nil
+	}
+
+	if f, cerr := c.FCreate(p, perm, go9p.OWRITE); cerr == nil {
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("%s: %v", p, err)
+}
+
+// Copies r to the file. The server may write less than asked.
+func copyTo(f *go9p.File, r io.Reader) error {
+	buf := make([]byte, f.Fid.Clnt.Msize-go9p.IOHDRSZ)
+	var offset uint64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			m, werr := f.Written(buf[0:n], offset)
+			offset += uint64(m)
+			if werr != nil {
+				return werr
+			}
+
+			if m < n {
+				return io.ErrShortWrite
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *client) stat(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no files")
+	}
+
+	for _, p := range args {
+		d, err := c.FStat(p)
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+
+		fmt.Fprintf(c.out, "name   %s\n", d.Name)
+		fmt.Fprintf(c.out, "qid    %v\n", &d.Qid)
+		fmt.Fprintf(c.out, "mode   %s\n", go9p.PermString(d.Mode))
+		fmt.Fprintf(c.out, "length %d\n", d.Length)
+		fmt.Fprintf(c.out, "atime  %v\n", time.Unix(int64(d.Atime), 0))
+		fmt.Fprintf(c.out, "mtime  %v\n", time.Unix(int64(d.Mtime), 0))
+		fmt.Fprintf(c.out, "uid    %s\n", d.Uid)
+		fmt.Fprintf(c.out, "gid    %s\n", d.Gid)
+		fmt.Fprintf(c.out, "muid   %s\n", d.Muid)
+		if c.Dotu {
+			fmt.Fprintf(c.out, "ext    %s\n", d.Ext)
+			fmt.Fprintf(c.out, "ids    %d %d %d\n", d.Uidnum, d.Gidnum, d.Muidnum)
+		}
+	}
+
+	return nil
+}
+
+func (c *client) rm(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no files")
+	}
+
+	for _, p := range args {
+		if err := c.FRemove(p); err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *client) mkdir(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no directories")
+	}
+
+	for _, p := range args {
+		f, err := c.FCreate(p, go9p.DMDIR|0777, go9p.OREAD)
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+
+		_ = f.Close()
+	}
+
+	return nil
+}
+
+// Renames a file. 9P2000 only renames files in their directory.
+func (c *client) mv(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("two files expected")
+	}
+
+	from, to := path.Clean("/"+args[0]), path.Clean("/"+args[1])
+	if path.Dir(from) != path.Dir(to) {
+		return fmt.Errorf("%s and %s are in different directories", args[0], args[1])
+	}
+
+	fid, err := c.FWalk(from)
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	defer c.Clunk(fid)
+
+	d := go9p.NewWstatDir()
+	d.Name = path.Base(to)
+	return c.Wstat(fid, d)
+}
+
+// Copies from or to the server. The remote path starts with ':'.
+func (c *client) cp(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("source and destination expected")
+	}
+
+	src, dst := args[0], args[1]
+	switch {
+	case strings.HasPrefix(src, ":") && !strings.HasPrefix(dst, ":"):
+		return c.get(src[1:], dst)
+	case !strings.HasPrefix(src, ":") && strings.HasPrefix(dst, ":"):
+		return c.put(src, dst[1:])
+	}
+
+	return fmt.Errorf("exactly one of the paths should be remote")
+}
+
+// Copies a remote file or directory to the local disk.
+func (c *client) get(remote, local string) error {
+	d, err := c.FStat(remote)
+	if err != nil {
+		return fmt.Errorf("%s: %v", remote, err)
+	}
+
+	if d.Mode&go9p.DMDIR != 0 {
+		if err := os.MkdirAll(local, 0777); err != nil {
+			return err
+		}
+
+		dirs, err := c.readDir(remote)
+		if err != nil {
+			return fmt.Errorf("%s: %v", remote, err)
+		}
+
+		for _, d := range dirs {
+			if err := c.get(path.Join(remote, d.Name), filepath.Join(local, d.Name)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	f, err := c.FOpen(remote, go9p.OREAD)
+	if err != nil {
+		return fmt.Errorf("%s: %v", remote, err)
+	}
+	defer f.Close()
+
+	lf, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(d.Mode&0777))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(lf, f); err != nil {
+		_ = lf.Close()
+		return fmt.Errorf("%s: %v", remote, err)
+	}
+
+	return lf.Close()
+}
+
+// Copies a local file or directory to the server.
+func (c *client) put(local, remote string) error {
+	fi, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+
+	perm := uint32(fi.Mode().Perm())
+	if fi.IsDir() {
+		if d, err := c.FStat(remote); err != nil || d.Mode&go9p.DMDIR == 0 {
+			f, err := c.FCreate(remote, go9p.DMDIR|perm, go9p.OREAD)
+			if err != nil {
+				return fmt.Errorf("%s: %v", remote, err)
+			}
+			_ = f.Close()
+		}
+
+		entries, err := os.ReadDir(local)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err := c.put(filepath.Join(local, e.Name()), path.Join(remote, e.Name())); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	lf, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	f, err := c.create(remote, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := copyTo(f, lf); err != nil {
+		return fmt.Errorf("%s: %v", remote, err)
+	}
+
+	return nil
+}
+
+func (c *client) tree(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("one directory expected")
+	}
+
+	root := "/"
+	if len(args) == 1 {
+		root = args[0]
+	}
+
+	fmt.Fprintln(c.out, root)
+	return c.treeDir(root, "")
+}
+
+func (c *client) treeDir(dir, indent string) error {
+	dirs, err := c.readDir(dir)
+	if err != nil {
+		return fmt.Errorf("%s: %v", dir, err)
+	}
+
+	for i, d := range dirs {
+		branch, next := "├── ", "│   "
+		if i == len(dirs)-1 {
+			branch, next = "└── ", "    "
+		}
+
+		fmt.Fprintln(c.out, indent+branch+d.Name)
+		if d.Mode&go9p.DMDIR != 0 {
+			if err := c.treeDir(path.Join(dir, d.Name), indent+next); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rminnich/go9p"
+)
+
+func newTestClient(t *testing.T) (*client, *bytes.Buffer) {
+	t.Helper()
+	fs := go9p.NewRamfs(go9p.OsUsers.Uid2User(0), go9p.OsUsers.Gid2Group(0), 0777)
+	fs.Dotu = true
+	fs.Start(fs)
+	c1, c2 := net.Pipe()
+	fs.NewConn(c1)
+	clnt, err := attach(c2, 8192, true, go9p.ProtocolOptions{}, go9p.OsUsers.Uid2User(0), "")
+	if err != nil {
+		t.Fatalf("attach error = %v", err)
+	}
+	t.Cleanup(clnt.Unmount)
+
+	out := new(bytes.Buffer)
+	return &client{clnt, strings.NewReader(""), out}, out
+}
+
+// Runs the command and returns its output.
+func run(t *testing.T, c *client, out *bytes.Buffer, in string, args ...string) string {
+	t.Helper()
+	out.Reset()
+	c.in = strings.NewReader(in)
+	if err := commands[args[0]].run(c, args[1:]); err != nil {
+		t.Fatalf("%v error = %v", args, err)
+	}
+	return out.String()
+}
+
+func TestCommands(t *testing.T) {
+	c, out := newTestClient(t)
+	big := strings.Repeat("0123456789", 2000)
+	run(t, c, out, "", "mkdir", "/dir", "/dir/sub")
+	run(t, c, out, big, "write", "/dir/big")
+	run(t, c, out, "hello\n", "write", "/dir/sub/a")
+	run(t, c, out, "hi\n", "write", "/dir/sub/a")
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"cat", "/dir/sub/a"}, "hi\n"},
+		{[]string{"ls", "/dir"}, "big\nsub\n"},
+		{[]string{"tree", "/dir"}, "/dir\n├── big\n└── sub\n    └── a\n"},
+		{[]string{"mv", "/dir/sub/a", "/dir/sub/b"}, ""},
+		{[]string{"ls", "/dir/sub"}, "b\n"},
+	}
+	for _, tt := range tests {
+		if got := run(t, c, out, "", tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	if got := run(t, c, out, "", "cat", "/dir/big"); got != big {
+		t.Errorf("cat /dir/big returned %d bytes, want %d", len(got), len(big))
+	}
+	if got := run(t, c, out, "", "ls", "-l", "/dir/sub/b"); !strings.HasPrefix(got, "666 ") || !strings.HasSuffix(got, " b\n") {
+		t.Errorf("ls -l = %q", got)
+	}
+	if got := run(t, c, out, "", "stat", "/dir"); !strings.Contains(got, "mode   d") {
+		t.Errorf("stat = %q", got)
+	}
+
+	// a round trip through the local disk
+	local := filepath.Join(t.TempDir(), "copy")
+	run(t, c, out, "", "cp", ":/dir", local)
+	if b, err := os.ReadFile(filepath.Join(local, "sub", "b")); err != nil || string(b) != "hi\n" {
+		t.Fatalf("ReadFile = %q, %v", b, err)
+	}
+	run(t, c, out, "", "cp", local, ":/copy")
+	if got := run(t, c, out, "", "cat", "/copy/big"); got != big {
+		t.Errorf("cat /copy/big returned %d bytes, want %d", len(got), len(big))
+	}
+
+	run(t, c, out, "", "rm", "/dir/sub/b", "/dir/sub")
+	if got := run(t, c, out, "", "ls", "/dir"); got != "big\n" {
+		t.Errorf("ls after rm = %q", got)
+	}
+	if err := c.mv([]string{"/dir/big", "/other/big"}); err == nil {
+		t.Errorf("mv across directories succeeded")
+	}
+}
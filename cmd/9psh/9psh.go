@@ -0,0 +1,691 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// An interactive shell sending raw 9P messages, for debugging servers.
+//
+// Each line is a T-message with explicit fids, like "walk 1 2 a b".
+// A line starting with "@tag" sends the message with that tag, and a
+// line ending with "&" doesn't wait for the response, except for
+// version, which changes the dialect of the messages. The messages
+// sent and the responses received are printed decoded and dumped in
+// hex. The lines are read from the script files, if any, or from the
+// standard input.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rminnich/go9p"
+)
+
+var addr = flag.String("addr", "127.0.0.1:5640", "network address of the server, or a ws:// or wss:// URL")
+var ntype = flag.String("net", "tcp", "network type of addr, tcp or unix")
+var msize = flag.Uint("msize", 8192+go9p.IOHDRSZ, "maximum message size")
+var dotu = flag.Bool("dotu", true, "pack the messages as 9P2000.u until the version is negotiated")
+var hexdump = flag.Bool("hex", true, "dump the messages in hex")
+
+// A message the shell sends. Packs the message from the arguments.
+type message struct {
+	args string // usage of the arguments
+	pack func(s *shell, tc *go9p.Fcall, args []string) error
+}
+
+var messages = map[string]message{
+	"version": {"[msize] [version]", packVersion},
+	"auth":    {"afid uname [aname] [uid]", packAuth},
+	"attach":  {"fid afid uname [aname] [uid]", packAttach},
+	"flush":   {"oldtag", packFlush},
+	"walk":    {"fid newfid [name...]", packWalk},
+	"open":    {"fid mode", packOpen},
+	"create":  {"fid name perm mode [ext]", packCreate},
+	"read":    {"fid offset count", packRead},
+	"write":   {"fid offset data...", packWrite},
+	"clunk":   {"fid", packClunk},
+	"remove":  {"fid", packRemove},
+	"stat":    {"fid", packStat},
+	"wstat":   {"fid field=value...", packWstat},
+}
+
+// The shell commands that don't send messages.
+var builtins = map[string]string{
+	"wait":  "wait for the responses to all messages",
+	"sleep": "duration, pause a script",
+	"hex":   "on|off, dump the messages in hex",
+	"help":  "list the commands",
+	"quit":  "exit",
+}
+
+type shell struct {
+	clnt *go9p.Clnt
+	dotu bool // the messages are packed as 9P2000.u
+	hex  bool
+
+	sync.Mutex
+	out     io.Writer
+	next    uint16          // next tag, if not given
+	pending map[uint16]bool // tags of the messages not responded
+	wg      sync.WaitGroup
+}
+
+func newShell(clnt *go9p.Clnt, out io.Writer) *shell {
+	return &shell{
+		clnt:    clnt,
+		dotu:    clnt.Dotu,
+		hex:     *hexdump,
+		out:     out,
+		next:    1,
+		pending: make(map[uint16]bool),
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: 9psh [flags] [script...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var c net.Conn
+	var err error
+	if strings.HasPrefix(*addr, "ws://") || strings.HasPrefix(*addr, "wss://") {
+		c, err = go9p.DialWebSocket(*addr)
+	} else {
+		c, err = net.Dial(*ntype, *addr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "9psh: %v\n", err)
+		os.Exit(1)
+	}
+
+	s := newShell(go9p.NewClnt(c, uint32(*msize), *dotu), os.Stdout)
+	if flag.NArg() == 0 {
+		prompt := false
+		if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			prompt = true
+		}
+
+		// an interactive session goes on after errors
+		_ = s.run(os.Stdin, prompt, !prompt)
+		s.wg.Wait()
+		return
+	}
+
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "9psh: %v\n", err)
+			os.Exit(1)
+		}
+
+		err = s.run(f, false, true)
+		_ = f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "9psh: %s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+
+	s.wg.Wait()
+}
+
+// Runs the commands read from r. A script stops at the first error and
+// returns it, and has its commands echoed.
+func (s *shell) run(r io.Reader, prompt, script bool) error {
+	sc := bufio.NewScanner(r)
+	for line := 1; ; line++ {
+		if prompt {
+			s.printf("9p> ")
+		}
+
+		if !sc.Scan() {
+			return sc.Err()
+		}
+
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if script {
+			s.printf("%s\n", text)
+		}
+
+		quit, err := s.exec(text)
+		if quit {
+			return nil
+		}
+
+		if err != nil {
+			if script {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+
+			s.printf("error: %v\n", err)
+		}
+	}
+}
+
+// Executes a command line. Returns true if the shell should exit.
+func (s *shell) exec(text string) (bool, error) {
+	args := strings.Fields(text)
+	async := false
+	if len(args) > 0 && strings.HasSuffix(args[len(args)-1], "&") {
+		async = true
+		if last := strings.TrimSuffix(args[len(args)-1], "&"); last == "" {
+			args = args[:len(args)-1]
+		} else {
+			args[len(args)-1] = last
+		}
+	}
+
+	if len(args) == 0 {
+		return false, fmt.Errorf("no command")
+	}
+
+	tag, explicit := uint16(0), false
+	if strings.HasPrefix(args[0], "@") {
+		n, err := strconv.ParseUint(args[0][1:], 0, 16)
+		if err != nil {
+			return false, fmt.Errorf("invalid tag %q", args[0])
+		}
+
+		tag, explicit = uint16(n), true
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		return false, fmt.Errorf("no command")
+	}
+
+	switch args[0] {
+	case "quit", "exit":
+		return true, nil
+	case "help":
+		s.help()
+		return false, nil
+	case "wait":
+		s.wg.Wait()
+		return false, nil
+	case "sleep":
+		if len(args) != 2 {
+			return false, fmt.Errorf("usage: sleep duration")
+		}
+
+		d, err := time.ParseDuration(args[1])
+		if err != nil {
+			return false, err
+		}
+
+		time.Sleep(d)
+		return false, nil
+	case "hex":
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			return false, fmt.Errorf("usage: hex on|off")
+		}
+
+		s.Lock()
+		s.hex = args[1] == "on"
+		s.Unlock()
+		return false, nil
+	}
+
+	m, ok := messages[args[0]]
+	if !ok {
+		return false, fmt.Errorf("unknown command %q, try help", args[0])
+	}
+
+	tc := go9p.NewFcall(atomic.LoadUint32(&s.clnt.Msize))
+	if err := m.pack(s, tc, args[1:]); err != nil {
+		return false, fmt.Errorf("%s: %v (usage: %s %s)", args[0], err, args[0], m.args)
+	}
+
+	if tc.Type == go9p.Tversion {
+		// the client sends Tversion with NOTAG, and the dialect
+		// changes once Rversion is received
+		tag, explicit, async = go9p.NOTAG, true, false
+	}
+
+	return false, s.send(tc, tag, explicit, async)
+}
+
+// Sends the message, and waits for the response unless async is true.
+func (s *shell) send(tc *go9p.Fcall, tag uint16, explicit, async bool) error {
+	s.Lock()
+	if !explicit {
+		for s.pending[s.next] || s.next == go9p.NOTAG {
+			s.next++
+		}
+
+		tag = s.next
+		s.next++
+	}
+
+	if s.pending[tag] {
+		s.Unlock()
+		return fmt.Errorf("tag %d is in use", tag)
+	}
+
+	s.pending[tag] = true
+	go9p.SetTag(tc, tag)
+	s.printFcallLocked("->", tc)
+	s.Unlock()
+
+	r := s.clnt.ReqWithTag(tag)
+	r.Tc = tc
+	r.Done = make(chan *go9p.Req, 1)
+	if err := s.clnt.Rpcnb(r); err != nil {
+		s.Lock()
+		delete(s.pending, tag)
+		s.Unlock()
+		return err
+	}
+
+	done := make(chan bool)
+	s.wg.Add(1)
+	go func() {
+		s.response(<-r.Done)
+		close(done)
+		s.wg.Done()
+	}()
+
+	if async {
+		return nil
+	}
+
+	<-done
+
+	// the client reads Dotu while receiving, so it is only changed
+	// after Rversion and before the next message is sent
+	if rc := r.Rc; rc != nil && rc.Type == go9p.Rversion {
+		s.Lock()
+		s.dotu = rc.Version == "9P2000.u"
+		s.clnt.Dotu = s.dotu
+		s.Unlock()
+	}
+
+	return nil
+}
+
+// Prints the response to a message.
+func (s *shell) response(r *go9p.Req) {
+	rc := r.Rc
+	if rc != nil && rc.Type == go9p.Rversion {
+		if rc.Msize < atomic.LoadUint32(&s.clnt.Msize) {
+			atomic.StoreUint32(&s.clnt.Msize, rc.Msize)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	delete(s.pending, r.Tc.Tag)
+	switch {
+	case rc != nil:
+		s.printFcallLocked("<-", rc)
+	case r.Err == go9p.Eflushed:
+		fmt.Fprintf(s.out, "<- tag %d flushed\n", r.Tc.Tag)
+	default:
+		fmt.Fprintf(s.out, "<- tag %d: %v\n", r.Tc.Tag, r.Err)
+	}
+}
+
+func (s *shell) printFcallLocked(dir string, fc *go9p.Fcall) {
+	fmt.Fprintf(s.out, "%s %v\n", dir, fc)
+	if fc.Type == go9p.Rread && len(fc.Data) > 0 {
+		fmt.Fprintf(s.out, "   data %q\n", fc.Data)
+	}
+
+	if s.hex {
+		fmt.Fprint(s.out, hex.Dump(fc.Pkt))
+	}
+}
+
+func (s *shell) printf(format string, args ...interface{}) {
+	s.Lock()
+	fmt.Fprintf(s.out, format, args...)
+	s.Unlock()
+}
+
+func (s *shell) help() {
+	s.Lock()
+	defer s.Unlock()
+	fmt.Fprintf(s.out, "messages, \"@tag\" first to set the tag, \"&\" last not to wait:\n")
+	for _, name := range sortedKeys(messages) {
+		fmt.Fprintf(s.out, "  %-8s %s\n", name, messages[name].args)
+	}
+
+	fmt.Fprintf(s.out, "commands:\n")
+	for _, name := range sortedKeys(builtins) {
+		fmt.Fprintf(s.out, "  %-8s %s\n", name, builtins[name])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	for i := 1; i < len(keys); i++ {
+		for j := i; j > 0 && keys[j] < keys[j-1]; j-- {
+			keys[j], keys[j-1] = keys[j-1], keys[j]
+		}
+	}
+
+	return keys
+}
+
+// Parses an unsigned number, in Go syntax.
+func parseNum(s string, bits int) (uint64, error) {
+	n, err := strconv.ParseUint(s, 0, bits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+
+	return n, nil
+}
+
+// Parses a fid, or "nofid".
+func parseFid(s string) (uint32, error) {
+	if s == "nofid" || s == "-1" {
+		return go9p.NOFID, nil
+	}
+
+	n, err := parseNum(s, 32)
+	return uint32(n), err
+}
+
+// Parses the fids at the start of the arguments.
+func parseFids(args []string, n int) ([]uint32, error) {
+	if len(args) < n {
+		return nil, fmt.Errorf("missing arguments")
+	}
+
+	fids := make([]uint32, n)
+	for i := range fids {
+		fid, err := parseFid(args[i])
+		if err != nil {
+			return nil, err
+		}
+
+		fids[i] = fid
+	}
+
+	return fids, nil
+}
+
+// Returns the optional arguments: the aname, and the uid or NOUID.
+func anameUid(args []string) (string, uint32, error) {
+	aname, uid := "", go9p.NOUID
+	if len(args) > 0 {
+		aname = args[0]
+	}
+
+	if len(args) > 1 {
+		n, err := parseNum(args[1], 32)
+		if err != nil {
+			return "", 0, err
+		}
+
+		uid = uint32(n)
+	}
+
+	if len(args) > 2 {
+		return "", 0, fmt.Errorf("too many arguments")
+	}
+
+	return aname, uid, nil
+}
+
+func packVersion(s *shell, tc *go9p.Fcall, args []string) error {
+	ms, ver := atomic.LoadUint32(&s.clnt.Msize), "9P2000"
+	if s.dotu {
+		ver = "9P2000.u"
+	}
+
+	if len(args) > 0 {
+		n, err := parseNum(args[0], 32)
+		if err != nil {
+			return err
+		}
+
+		ms = uint32(n)
+	}
+
+	if len(args) > 1 {
+		ver = args[1]
+	}
+
+	return go9p.PackTversion(tc, ms, ver)
+}
+
+func packAuth(s *shell, tc *go9p.Fcall, args []string) error {
+	fids, err := parseFids(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("missing uname")
+	}
+
+	aname, uid, err := anameUid(args[2:])
+	if err != nil {
+		return err
+	}
+
+	return go9p.PackTauth(tc, fids[0], args[1], aname, uid, s.dotu)
+}
+
+func packAttach(s *shell, tc *go9p.Fcall, args []string) error {
+	fids, err := parseFids(args, 2)
+	if err != nil {
+		return err
+	}
+
+	if len(args) < 3 {
+		return fmt.Errorf("missing uname")
+	}
+
+	aname, uid, err := anameUid(args[3:])
+	if err != nil {
+		return err
+	}
+
+	return go9p.PackTattach(tc, fids[0], fids[1], args[2], aname, uid, s.dotu)
+}
+
+func packFlush(s *shell, tc *go9p.Fcall, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("one tag expected")
+	}
+
+	n, err := parseNum(args[0], 16)
+	if err != nil {
+		return err
+	}
+
+	return go9p.PackTflush(tc, uint16(n))
+}
+
+func packWalk(s *shell, tc *go9p.Fcall, args []string) error {
+	fids, err := parseFids(args, 2)
+	if err != nil {
+		return err
+	}
+
+	return go9p.PackTwalk(tc, fids[0], fids[1], args[2:])
+}
+
+func packOpen(s *shell, tc *go9p.Fcall, args []string) error {
+	fids, err := parseFids(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("missing mode")
+	}
+
+	mode, err := parseNum(args[1], 8)
+	if err != nil {
+		return err
+	}
+
+	return go9p.PackTopen(tc, fids[0], uint8(mode))
+}
+
+func packCreate(s *shell, tc *go9p.Fcall, args []string) error {
+	fids, err := parseFids(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if len(args) < 4 || len(args) > 5 {
+		return fmt.Errorf("wrong number of arguments")
+	}
+
+	perm, err := parseNum(args[2], 32)
+	if err != nil {
+		return err
+	}
+
+	mode, err := parseNum(args[3], 8)
+	if err != nil {
+		return err
+	}
+
+	ext := ""
+	if len(args) == 5 {
+		ext = args[4]
+	}
+
+	return go9p.PackTcreate(tc, fids[0], args[1], uint32(perm), uint8(mode), ext, s.dotu)
+}
+
+func packRead(s *shell, tc *go9p.Fcall, args []string) error {
+	fids, err := parseFids(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if len(args) != 3 {
+		return fmt.Errorf("wrong number of arguments")
+	}
+
+	offset, err := parseNum(args[1], 64)
+	if err != nil {
+		return err
+	}
+
+	count, err := parseNum(args[2], 32)
+	if err != nil {
+		return err
+	}
+
+	return go9p.PackTread(tc, fids[0], offset, uint32(count))
+}
+
+// The data is the rest of the arguments, separated by spaces.
+func packWrite(s *shell, tc *go9p.Fcall, args []string) error {
+	fids, err := parseFids(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("missing offset")
+	}
+
+	offset, err := parseNum(args[1], 64)
+	if err != nil {
+		return err
+	}
+
+	data := []byte(strings.Join(args[2:], " "))
+	return go9p.PackTwrite(tc, fids[0], offset, uint32(len(data)), data)
+}
+
+func packClunk(s *shell, tc *go9p.Fcall, args []string) error {
+	fids, err := parseFids(args, 1)
+	if err != nil {
+		return err
+	}
+
+	return go9p.PackTclunk(tc, fids[0])
+}
+
+func packRemove(s *shell, tc *go9p.Fcall, args []string) error {
+	fids, err := parseFids(args, 1)
+	if err != nil {
+		return err
+	}
+
+	return go9p.PackTremove(tc, fids[0])
+}
+
+func packStat(s *shell, tc *go9p.Fcall, args []string) error {
+	fids, err := parseFids(args, 1)
+	if err != nil {
+		return err
+	}
+
+	return go9p.PackTstat(tc, fids[0])
+}
+
+// The fields not given are not changed.
+func packWstat(s *shell, tc *go9p.Fcall, args []string) error {
+	fids, err := parseFids(args, 1)
+	if err != nil {
+		return err
+	}
+
+	d := go9p.NewWstatDir()
+	for _, a := range args[1:] {
+		field, value, ok := strings.Cut(a, "=")
+		if !ok {
+			return fmt.Errorf("invalid field %q", a)
+		}
+
+		var n uint64
+		switch field {
+		case "name":
+			d.Name = value
+		case "uid":
+			d.Uid = value
+		case "gid":
+			d.Gid = value
+		case "mode":
+			n, err = parseNum(value, 32)
+			d.Mode = uint32(n)
+		case "length":
+			n, err = parseNum(value, 64)
+			d.Length = n
+		case "mtime":
+			n, err = parseNum(value, 32)
+			d.Mtime = uint32(n)
+		case "atime":
+			n, err = parseNum(value, 32)
+			d.Atime = uint32(n)
+		default:
+			return fmt.Errorf("unknown field %q", field)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return go9p.PackTwstat(tc, fids[0], d, s.dotu)
+}
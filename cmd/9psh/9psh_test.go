@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/rminnich/go9p"
+)
+
+func newTestShell(t *testing.T) (*shell, *bytes.Buffer) {
+	t.Helper()
+	fs := go9p.NewRamfs(go9p.OsUsers.Uid2User(0), go9p.OsUsers.Gid2Group(0), 0777)
+	fs.Dotu = true
+	fs.Start(fs)
+	c1, c2 := net.Pipe()
+	fs.NewConn(c1)
+	clnt := go9p.NewClnt(c2, 8192+go9p.IOHDRSZ, true)
+	t.Cleanup(clnt.Unmount)
+
+	out := new(bytes.Buffer)
+	s := newShell(clnt, out)
+	s.hex = false
+	return s, out
+}
+
+func TestScript(t *testing.T) {
+	s, out := newTestShell(t)
+	script := `# a scripted session
+version
+attach 1 nofid root
+@7 walk 1 2
+create 2 hello 0644 2
+write 2 0 hello world
+read 2 0 100 &
+wait
+stat 2
+wstat 2 name=bye
+walk 1 3 bye
+clunk 3
+flush 99
+clunk 2
+walk 2 4
+hex on
+clunk 1
+quit
+clunk 1
+`
+	if err := s.run(strings.NewReader(script), false, true); err != nil {
+		t.Fatalf("run error = %v", err)
+	}
+	s.wg.Wait()
+
+	got := out.String()
+	for _, want := range []string{
+		"-> Tversion tag 65535 msize 8216 version '9P2000.u'",
+		"<- Rversion tag 65535 msize 8216 version '9P2000.u'",
+		"<- Rattach tag 1",
+		"-> Twalk tag 7 fid 1 newfid 2",
+		"<- Rwalk tag 7",
+		"<- Rcreate tag 2",
+		"<- Rwrite tag 3 count 11",
+		"<- Rread tag 4 count 11",
+		`   data "hello world"`,
+		"st ('hello'",
+		"<- Rwstat tag 6",
+		"<- Rwalk tag 7 (",
+		"<- Rflush tag 9",
+		"<- Rerror tag 11",
+		"<- Rclunk tag 12\n00000000",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, got)
+		}
+	}
+	if strings.Count(got, "-> Tclunk") != 3 {
+		t.Errorf("the commands after quit ran:\n%s", got)
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	for _, script := range []string{
+		"bogus 1",
+		"walk x 2",
+		"read 1 0",
+		"@x clunk 1",
+		"wstat 1 color=red",
+		"&",
+		"@5 &",
+	} {
+		s, _ := newTestShell(t)
+		if err := s.run(strings.NewReader("version\n"+script), false, true); err == nil || !strings.HasPrefix(err.Error(), "line 2: ") {
+			t.Errorf("%q error = %v", script, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Runs the protocol conformance checks against a 9P server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/rminnich/go9p"
+	"github.com/rminnich/go9p/conformance"
+)
+
+var addr = flag.String("addr", "127.0.0.1:5640", "network address of the server")
+var ntype = flag.String("net", "tcp", "network type")
+var dotu = flag.Bool("dotu", false, "request 9P2000.u")
+var uname = flag.String("uname", "", "user to attach as, default the current user")
+var aname = flag.String("aname", "", "file tree to attach to")
+var dir = flag.String("dir", "", "writable directory the checks create files in")
+var msize = flag.Uint("msize", 8192+go9p.IOHDRSZ, "maximum message size")
+var timeout = flag.Duration("timeout", 10*time.Second, "time limit for each check")
+var run = flag.String("run", "", "run only the checks with names starting with the prefix")
+var list = flag.Bool("list", false, "list the checks and exit")
+
+func main() {
+	flag.Parse()
+	if *list {
+		for _, c := range conformance.Checks {
+			fmt.Printf("%-20s %s\n", c.Name, c.Desc)
+		}
+		return
+	}
+
+	cfg := &conformance.Config{
+		Dial:    func() (net.Conn, error) { return net.Dial(*ntype, *addr) },
+		Msize:   uint32(*msize),
+		Dotu:    *dotu,
+		Uname:   *uname,
+		Uid:     go9p.NOUID,
+		Aname:   *aname,
+		Dir:     *dir,
+		Timeout: *timeout,
+	}
+
+	if cfg.Uname == "" {
+		if u, err := user.Current(); err == nil {
+			cfg.Uname = u.Username
+		}
+	}
+
+	if cfg.Dotu {
+		cfg.Uid = uint32(os.Getuid())
+	}
+
+	nfail := 0
+	for _, c := range conformance.Checks {
+		if !strings.HasPrefix(c.Name, *run) {
+			continue
+		}
+
+		r := c.Run(cfg)
+		fmt.Println(r.String())
+		if r.Status == conformance.Fail {
+			nfail++
+		}
+	}
+
+	if nfail > 0 {
+		fmt.Printf("%d checks failed\n", nfail)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/rminnich/go9p"
+)
+
+var addr = flag.String("addr", ":5640", "network address")
+var ntype = flag.String("net", "tcp", "network type of addr, tcp or unix")
+var stdio = flag.Bool("stdio", false, "serve a single connection on the standard input and output")
+var debug = flag.Int("debug", 0, "print debug messages")
+var perm = flag.Uint("perm", 0777, "permissions of the root directory")
+var quota = flag.Uint64("quota", 0, "maximum number of bytes stored, 0 for no limit")
+var maxfiles = flag.Int("maxfiles", 0, "maximum number of files, 0 for no limit")
+var maxfilesize = flag.Uint64("maxfilesize", 0, "maximum size of a file, 0 for the default")
+var akaros = flag.Bool("akaros", false, "Akaros extensions")
+var httpaddr = flag.String("http", "", "network address for the stats and metrics pages, and 9P over WebSocket at /9p")
+
+func main() {
+	flag.Parse()
+	user := go9p.OsUsers.Uid2User(os.Getuid())
+	group := go9p.OsUsers.Gid2Group(os.Getgid())
+	ramfs := go9p.NewRamfs(user, group, uint32(*perm))
+	ramfs.Dotu = true
+	ramfs.Id = "ramfs"
+	ramfs.Debuglevel = *debug
+	ramfs.Quota = *quota
+	ramfs.Maxfiles = *maxfiles
+	ramfs.MaxFileSize = *maxfilesize
+	if *akaros {
+		ramfs.Options = go9p.AkarosOptions
+	}
+	ramfs.Metrics = go9p.NewMetrics()
+	ramfs.Start(ramfs)
+	if *httpaddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/go9p/", ramfs.StatsHandler())
+		mux.Handle("/metrics", ramfs.MetricsHandler())
+		mux.Handle("/9p", ramfs.WebSocketHandler())
+		go func() {
+			log.Println(http.ListenAndServe(*httpaddr, mux)) // nosemgrep: go.lang.security.audit.net.use-tls.use-tls
+		}()
+	}
+
+	if *stdio {
+		ramfs.ServeStdio()
+		return
+	}
+
+	fmt.Print("ramfs starting\n")
+	// started by socket activation, or listening on addr
+	err := ramfs.StartActivatedListeners()
+	switch {
+	case err != go9p.Enolisteners:
+	case *ntype == "unix":
+		err = ramfs.StartUnixListener(*addr)
+	default:
+		err = ramfs.StartNetListener(*ntype, *addr)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
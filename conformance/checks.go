@@ -0,0 +1,683 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conformance
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/rminnich/go9p"
+)
+
+// The checks run by Run, in order.
+var Checks = []*Check{
+	checkConn("version/negotiate", "Rversion returns the requested version and an msize not larger than requested", versionNegotiate),
+	checkConn("version/unknown", "an unknown version is answered with Rversion \"unknown\"", versionUnknown),
+	checkConn("version/suffix", "the part of the version after the period is ignored", versionSuffix),
+	checkConn("version/msize", "the msize is clamped to the requested one and no response is larger than it", versionMsize),
+	check("attach/fid-in-use", "Tattach with a fid in use fails", attachFidInUse),
+	check("walk/newfid-in-use", "Twalk with a newfid in use fails", walkNewfidInUse),
+	check("walk/clone", "Twalk with no names clones the fid", walkClone),
+	check("walk/partial", "a partial walk returns the qids walked and doesn't create newfid", walkPartial),
+	check("walk/first-missing", "a walk failing on the first name returns Rerror", walkFirstMissing),
+	check("walk/dotdot-root", "walking .. from the root stays at the root", walkDotdotRoot),
+	check("walk/open-fid", "an open fid can't be walked", walkOpenFid),
+	check("open/twice", "a fid can't be opened twice", openTwice),
+	check("open/dir-write", "a directory can't be opened for writing", openDirWrite),
+	check("create/exists", "creating an existing file fails", createExists),
+	check("read-write", "data written can be read back", readWrite),
+	check("dirread/entries", "directory reads return whole entries at sequential offsets", dirreadEntries),
+	check("dirread/rewind", "a directory read at offset 0 starts again", dirreadRewind),
+	check("flush/unknown-tag", "flushing a tag not in use returns Rflush", flushUnknownTag),
+	check("flush/order", "the response to a flushed request comes before Rflush", flushOrder),
+	check("clunk/unknown", "clunking an unknown fid fails", clunkUnknown),
+	check("clunk/twice", "a fid can't be clunked twice", clunkTwice),
+	check("remove/clunks", "Tremove clunks the fid", removeClunks),
+	check("remove/fail-clunks", "Tremove clunks the fid even if the remove fails", removeFailClunks),
+	check("orclose/create", "a file created with ORCLOSE is removed when clunked", orcloseCreate),
+	check("orclose/open", "a file opened with ORCLOSE is removed when clunked", orcloseOpen),
+	check("wstat/dont-touch", "Twstat with all \"don't touch\" values changes nothing", wstatDontTouch),
+	check("wstat/length", "Twstat changes the length", wstatLength),
+	check("wstat/rename", "Twstat changes the name", wstatRename),
+}
+
+func versionNegotiate(s *session) error {
+	ver := "9P2000"
+	if s.cfg.Dotu {
+		ver = "9P2000.u"
+	}
+
+	rc, err := s.rpc(s.tversion(s.cfg.Msize, ver))
+	if err != nil {
+		return err
+	}
+
+	if rc.Msize > s.cfg.Msize {
+		return fmt.Errorf("msize %d, requested %d", rc.Msize, s.cfg.Msize)
+	}
+
+	if rc.Version != ver && rc.Version != "9P2000" {
+		return fmt.Errorf("version %q, requested %q", rc.Version, ver)
+	}
+
+	return nil
+}
+
+func versionUnknown(s *session) error {
+	rc, err := s.rpc(s.tversion(s.cfg.Msize, "XP3000"))
+	if err != nil {
+		return err
+	}
+
+	if rc.Version != "unknown" {
+		return fmt.Errorf("version %q, want \"unknown\"", rc.Version)
+	}
+
+	return nil
+}
+
+func versionSuffix(s *session) error {
+	rc, err := s.rpc(s.tversion(s.cfg.Msize, "9P2000.conformance"))
+	if err != nil {
+		return err
+	}
+
+	if rc.Version != "9P2000" {
+		return fmt.Errorf("version %q, want \"9P2000\"", rc.Version)
+	}
+
+	return nil
+}
+
+func versionMsize(s *session) error {
+	msize := uint32(256 + go9p.IOHDRSZ)
+	if err := s.version(msize); err != nil {
+		return err
+	}
+
+	if err := s.attach(); err != nil {
+		return err
+	}
+
+	fid, err := s.open("", go9p.OREAD)
+	if err != nil {
+		return err
+	}
+
+	// recv fails if the response is larger than msize
+	_, err = s.rpc(s.tread(fid, 0, msize))
+	if _, ok := err.(*go9p.Error); ok {
+		return nil
+	}
+
+	return err
+}
+
+func attachFidInUse(s *session) error {
+	_, err := s.rpc(s.tattach(s.root))
+	return wantRerror("attach with the root fid", err)
+}
+
+func walkNewfidInUse(s *session) error {
+	fid := s.newfid()
+	if _, err := s.walk(s.root, fid); err != nil {
+		return err
+	}
+
+	_, err := s.walk(s.root, fid)
+	return wantRerror("walk to a newfid in use", err)
+}
+
+func walkClone(s *session) error {
+	fid := s.newfid()
+	rc, err := s.walk(s.root, fid)
+	if err != nil {
+		return err
+	}
+
+	if len(rc.Wqid) != 0 {
+		return fmt.Errorf("%d qids, want 0", len(rc.Wqid))
+	}
+
+	d1, err := s.stat(s.root)
+	if err != nil {
+		return err
+	}
+
+	d2, err := s.stat(fid)
+	if err != nil {
+		return err
+	}
+
+	if d1.Qid != d2.Qid {
+		return fmt.Errorf("clone qid %v, want %v", &d2.Qid, &d1.Qid)
+	}
+
+	return nil
+}
+
+func walkPartial(s *session) error {
+	dir := s.newname("dir")
+	fid, err := s.create(dir, go9p.DMDIR|0755, go9p.OREAD)
+	if err != nil {
+		return err
+	}
+
+	_ = s.clunk(fid)
+	fid = s.newfid()
+	rc, err := s.walk(s.dir, fid, dir, "missing", "file")
+	if err != nil {
+		return err
+	}
+
+	if len(rc.Wqid) != 1 {
+		return fmt.Errorf("%d qids, want 1", len(rc.Wqid))
+	}
+
+	if (rc.Wqid[0].Type & go9p.QTDIR) == 0 {
+		return fmt.Errorf("qid %v is not a directory", &rc.Wqid[0])
+	}
+
+	return wantRerror("clunk of the newfid of a partial walk", s.clunk(fid))
+}
+
+func walkFirstMissing(s *session) error {
+	fid := s.newfid()
+	_, err := s.walk(s.dir, fid, s.newname("missing"))
+	if err = wantRerror("walk to a missing file", err); err != nil {
+		return err
+	}
+
+	return wantRerror("clunk of the newfid of a failed walk", s.clunk(fid))
+}
+
+func walkDotdotRoot(s *session) error {
+	fid := s.newfid()
+	rc, err := s.walk(s.root, fid, "..")
+	if err != nil {
+		return err
+	}
+
+	if len(rc.Wqid) != 1 {
+		return fmt.Errorf("%d qids, want 1", len(rc.Wqid))
+	}
+
+	d, err := s.stat(s.root)
+	if err != nil {
+		return err
+	}
+
+	if rc.Wqid[0].Path != d.Qid.Path {
+		return fmt.Errorf("qid %v, want %v", &rc.Wqid[0], &d.Qid)
+	}
+
+	return nil
+}
+
+func walkOpenFid(s *session) error {
+	fid, err := s.open("", go9p.OREAD)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.walk(fid, s.newfid())
+	return wantRerror("walk of an open fid", err)
+}
+
+func openTwice(s *session) error {
+	fid, err := s.open("", go9p.OREAD)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.rpc(s.topen(fid, go9p.OREAD))
+	return wantRerror("second open", err)
+}
+
+func openDirWrite(s *session) error {
+	fid, err := s.lookup("")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.rpc(s.topen(fid, go9p.ORDWR))
+	return wantRerror("open of a directory for writing", err)
+}
+
+func createExists(s *session) error {
+	name := s.newname("file")
+	fid, err := s.create(name, 0644, go9p.OREAD)
+	if err != nil {
+		return err
+	}
+
+	_ = s.clunk(fid)
+	if fid, err = s.lookup(""); err != nil {
+		return err
+	}
+
+	_, err = s.rpc(s.tcreate(fid, name, 0644, go9p.OREAD))
+	return wantRerror("create of an existing file", err)
+}
+
+func readWrite(s *session) error {
+	data := []byte("hello, world")
+	fid, err := s.create(s.newname("file"), 0644, go9p.ORDWR)
+	if err != nil {
+		return err
+	}
+
+	rc, err := s.rpc(s.twrite(fid, 0, data))
+	if err != nil {
+		return err
+	}
+
+	if rc.Count != uint32(len(data)) {
+		return fmt.Errorf("wrote %d bytes, want %d", rc.Count, len(data))
+	}
+
+	if rc, err = s.rpc(s.tread(fid, 0, 100)); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(rc.Data, data) {
+		return fmt.Errorf("read %q, want %q", rc.Data, data)
+	}
+
+	if rc, err = s.rpc(s.tread(fid, 7, 100)); err != nil {
+		return err
+	}
+
+	if string(rc.Data) != "world" {
+		return fmt.Errorf("read at 7 %q, want \"world\"", rc.Data)
+	}
+
+	if rc, err = s.rpc(s.tread(fid, uint64(len(data)), 100)); err != nil {
+		return err
+	}
+
+	if len(rc.Data) != 0 {
+		return fmt.Errorf("read at the end returned %d bytes", len(rc.Data))
+	}
+
+	return nil
+}
+
+// Reads the open directory to the end, count bytes at a time. Returns
+// the data returned by each read.
+func (s *session) readdir(fid uint32, count uint32) ([][]byte, error) {
+	var bufs [][]byte
+	var offset uint64
+	for {
+		rc, err := s.rpc(s.tread(fid, offset, count))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rc.Data) == 0 {
+			return bufs, nil
+		}
+
+		if len(bufs) > 100000 {
+			return nil, fmt.Errorf("directory read doesn't end")
+		}
+
+		bufs = append(bufs, rc.Data)
+		offset += uint64(len(rc.Data))
+	}
+}
+
+// Returns the names of the entries in the directory data. Returns an
+// error if the data doesn't contain whole entries.
+func (s *session) dirents(buf []byte) ([]string, error) {
+	var names []string
+	for len(buf) > 0 {
+		d, rest, _, err := go9p.UnpackDir(buf, s.dotu)
+		if err != nil {
+			return nil, fmt.Errorf("directory entry: %v", err)
+		}
+
+		names = append(names, d.Name)
+		buf = rest
+	}
+
+	return names, nil
+}
+
+func dirreadEntries(s *session) error {
+	var created []string
+	for i := 0; i < 8; i++ {
+		name := s.newname(fmt.Sprintf("file%d", i))
+		fid, err := s.create(name, 0644, go9p.OREAD)
+		if _, ok := err.(errSkip); ok {
+			// read-only server, read what is there
+			break
+		} else if err != nil {
+			return err
+		}
+
+		_ = s.clunk(fid)
+		created = append(created, name)
+	}
+
+	fid, err := s.open("", go9p.OREAD)
+	if err != nil {
+		return err
+	}
+
+	bufs, err := s.readdir(fid, 256)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, buf := range bufs {
+		names, err := s.dirents(buf)
+		if err != nil {
+			return err
+		}
+
+		if len(names) == 0 {
+			return fmt.Errorf("read returned no entries")
+		}
+
+		for _, name := range names {
+			if seen[name] {
+				return fmt.Errorf("%s read twice", name)
+			}
+
+			seen[name] = true
+		}
+	}
+
+	for _, name := range created {
+		if !seen[name] {
+			return fmt.Errorf("%s not read", name)
+		}
+	}
+
+	return nil
+}
+
+func dirreadRewind(s *session) error {
+	fid, err := s.open("", go9p.OREAD)
+	if err != nil {
+		return err
+	}
+
+	bufs, err := s.readdir(fid, 8192)
+	if err != nil {
+		return err
+	}
+
+	rc, err := s.rpc(s.tread(fid, 0, 8192))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(bufs) == 0 && len(rc.Data) != 0:
+		return fmt.Errorf("read at 0 returned %d bytes, want 0", len(rc.Data))
+	case len(bufs) != 0 && !bytes.Equal(bufs[0], rc.Data):
+		return fmt.Errorf("read at 0 returned different entries")
+	}
+
+	return nil
+}
+
+func flushUnknownTag(s *session) error {
+	_, err := s.rpc(s.tflush(s.newtag()))
+	return err
+}
+
+func flushOrder(s *session) error {
+	tc := s.tstat(s.root)
+	if tc == nil {
+		return errPack
+	}
+
+	oldtag := s.newtag()
+	if err := s.send(tc, oldtag); err != nil {
+		return err
+	}
+
+	if tc = s.tflush(oldtag); tc == nil {
+		return errPack
+	}
+
+	tag := s.newtag()
+	if err := s.send(tc, tag); err != nil {
+		return err
+	}
+
+	for {
+		rc, err := s.recv()
+		if err != nil {
+			return err
+		}
+
+		if rc.Tag == oldtag {
+			continue
+		}
+
+		if rc.Tag != tag {
+			return fmt.Errorf("response tag %d, want %d or %d", rc.Tag, oldtag, tag)
+		}
+
+		if rc.Type != go9p.Rflush {
+			return fmt.Errorf("%s response to Tflush", go9p.MsgName(rc.Type))
+		}
+
+		break
+	}
+
+	// there must be no response for the flushed request after Rflush
+	_, err := s.rpc(s.tflush(oldtag))
+	return err
+}
+
+func clunkUnknown(s *session) error {
+	return wantRerror("clunk of an unknown fid", s.clunk(s.newfid()))
+}
+
+func clunkTwice(s *session) error {
+	fid := s.newfid()
+	if _, err := s.walk(s.root, fid); err != nil {
+		return err
+	}
+
+	if err := s.clunk(fid); err != nil {
+		return err
+	}
+
+	return wantRerror("second clunk", s.clunk(fid))
+}
+
+// Returns an error if the file exists in the working directory.
+func (s *session) wantMissing(name string) error {
+	fid := s.newfid()
+	rc, err := s.walk(s.dir, fid, name)
+	if err != nil {
+		return wantRerror("walk", err)
+	}
+
+	if len(rc.Wqid) != 0 {
+		_ = s.clunk(fid)
+		return fmt.Errorf("%s exists", name)
+	}
+
+	return nil
+}
+
+func removeClunks(s *session) error {
+	name := s.newname("file")
+	fid, err := s.create(name, 0644, go9p.OREAD)
+	if err != nil {
+		return err
+	}
+
+	if _, err = s.rpc(s.tremove(fid)); err != nil {
+		return err
+	}
+
+	if err = wantRerror("clunk after remove", s.clunk(fid)); err != nil {
+		return err
+	}
+
+	return s.wantMissing(name)
+}
+
+func removeFailClunks(s *session) error {
+	dir := s.newname("dir")
+	fid, err := s.create(dir, go9p.DMDIR|0755, go9p.OREAD)
+	if err != nil {
+		return err
+	}
+
+	_ = s.clunk(fid)
+	if fid, err = s.create(dir+"/file", 0644, go9p.OREAD); err != nil {
+		return err
+	}
+
+	_ = s.clunk(fid)
+	if fid, err = s.lookup(dir); err != nil {
+		return err
+	}
+
+	if _, err = s.rpc(s.tremove(fid)); err == nil {
+		return fmt.Errorf("remove of a non-empty directory succeeded")
+	} else if err = wantRerror("remove", err); err != nil {
+		return err
+	}
+
+	return wantRerror("clunk after failed remove", s.clunk(fid))
+}
+
+func orcloseCreate(s *session) error {
+	name := s.newname("file")
+	fid, err := s.create(name, 0644, go9p.ORDWR|go9p.ORCLOSE)
+	if err != nil {
+		return err
+	}
+
+	if err = s.clunk(fid); err != nil {
+		return err
+	}
+
+	return s.wantMissing(name)
+}
+
+func orcloseOpen(s *session) error {
+	name := s.newname("file")
+	fid, err := s.create(name, 0644, go9p.OREAD)
+	if err != nil {
+		return err
+	}
+
+	_ = s.clunk(fid)
+	if fid, err = s.open(name, go9p.OREAD|go9p.ORCLOSE); err != nil {
+		return err
+	}
+
+	if err = s.clunk(fid); err != nil {
+		return err
+	}
+
+	return s.wantMissing(name)
+}
+
+func wstatDontTouch(s *session) error {
+	fid, err := s.create(s.newname("file"), 0644, go9p.ORDWR)
+	if err != nil {
+		return err
+	}
+
+	if _, err = s.rpc(s.twrite(fid, 0, []byte("hello"))); err != nil {
+		return err
+	}
+
+	d1, err := s.stat(fid)
+	if err != nil {
+		return err
+	}
+
+	if _, err = s.rpc(s.twstat(fid, dontTouch())); err != nil {
+		return err
+	}
+
+	d2, err := s.stat(fid)
+	if err != nil {
+		return err
+	}
+
+	if d1.Name != d2.Name || d1.Length != d2.Length || d1.Mode != d2.Mode || d1.Mtime != d2.Mtime ||
+		d1.Uid != d2.Uid || d1.Gid != d2.Gid || d1.Qid.Path != d2.Qid.Path {
+		return fmt.Errorf("stat changed from %v to %v", d1, d2)
+	}
+
+	return nil
+}
+
+func wstatLength(s *session) error {
+	fid, err := s.create(s.newname("file"), 0644, go9p.ORDWR)
+	if err != nil {
+		return err
+	}
+
+	if _, err = s.rpc(s.twrite(fid, 0, []byte("hello"))); err != nil {
+		return err
+	}
+
+	d := dontTouch()
+	d.Length = 2
+	if _, err = s.rpc(s.twstat(fid, d)); err != nil {
+		return err
+	}
+
+	if d, err = s.stat(fid); err != nil {
+		return err
+	}
+
+	if d.Length != 2 {
+		return fmt.Errorf("length %d, want 2", d.Length)
+	}
+
+	return nil
+}
+
+func wstatRename(s *session) error {
+	name := s.newname("file")
+	fid, err := s.create(name, 0644, go9p.OREAD)
+	if err != nil {
+		return err
+	}
+
+	newname := s.newname("renamed")
+	d := dontTouch()
+	d.Name = newname
+	if _, err = s.rpc(s.twstat(fid, d)); err != nil {
+		return err
+	}
+
+	s.names[len(s.names)-1] = newname
+	if d, err = s.stat(fid); err != nil {
+		return err
+	}
+
+	if d.Name != newname {
+		return fmt.Errorf("name %q, want %q", d.Name, newname)
+	}
+
+	if err = s.wantMissing(name); err != nil {
+		return err
+	}
+
+	_ = s.clunk(fid)
+	if fid, err = s.lookup(newname); err != nil {
+		return err
+	}
+
+	return s.clunk(fid)
+}
@@ -0,0 +1,129 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The conformance package checks that a 9P2000 file server follows the
+// protocol. It drives the server through raw messages, one connection
+// per check, and reports which checks passed. It can be used with any
+// server, not only the ones built with go9p.
+package conformance
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/rminnich/go9p"
+)
+
+// The Config type describes the server to check and how.
+type Config struct {
+	Dial    func() (net.Conn, error) // Opens a new connection to the server
+	Msize   uint32                   // Maximum message size, default 8192+IOHDRSZ
+	Dotu    bool                     // If true, 9P2000.u is requested
+	Uname   string                   // User to attach as
+	Uid     uint32                   // Numeric id of the user (9P2000.u)
+	Aname   string                   // File tree to attach to
+	Dir     string                   // Writable directory (relative to the root) the checks create files in
+	Timeout time.Duration            // Time limit for each check, default 10s
+}
+
+// Check status
+const (
+	Pass = iota
+	Fail
+	Skip // the check couldn't run, for example because the server is read-only
+)
+
+// The Result type is the outcome of a check.
+type Result struct {
+	Name   string // Name of the check
+	Status int    // Pass, Fail or Skip
+	Err    error  // Why the check failed or was skipped
+}
+
+// The Check type describes a conformance check.
+type Check struct {
+	Name string // Short name, for example "walk/partial"
+	Desc string // What is checked
+	run  func(*Config, string) error
+}
+
+// An error that skips a check instead of failing it.
+type errSkip string
+
+func (e errSkip) Error() string { return string(e) }
+
+func (r *Result) String() string {
+	switch r.Status {
+	case Pass:
+		return "PASS " + r.Name
+	case Skip:
+		return fmt.Sprintf("SKIP %s: %v", r.Name, r.Err)
+	}
+
+	return fmt.Sprintf("FAIL %s: %v", r.Name, r.Err)
+}
+
+// Runs the check against the server.
+func (c *Check) Run(cfg *Config) Result {
+	cfg2 := *cfg
+	if cfg2.Msize == 0 {
+		cfg2.Msize = 8192 + go9p.IOHDRSZ
+	}
+
+	if cfg2.Timeout == 0 {
+		cfg2.Timeout = 10 * time.Second
+	}
+
+	r := Result{Name: c.Name}
+	r.Err = c.run(&cfg2, c.Name)
+	switch r.Err.(type) {
+	case nil:
+		r.Status = Pass
+	case errSkip:
+		r.Status = Skip
+	default:
+		r.Status = Fail
+	}
+
+	return r
+}
+
+// Runs all checks against the server. Returns the results in the
+// order of Checks.
+func Run(cfg *Config) []Result {
+	res := make([]Result, len(Checks))
+	for i, c := range Checks {
+		res[i] = c.Run(cfg)
+	}
+
+	return res
+}
+
+// Returns a check that runs f on a new session.
+func check(name, desc string, f func(*session) error) *Check {
+	return &Check{name, desc, func(cfg *Config, name string) error {
+		s, err := start(cfg, name)
+		if err != nil {
+			return err
+		}
+
+		defer s.close()
+		return f(s)
+	}}
+}
+
+// Returns a check that runs f on a new connection, before the version
+// is negotiated.
+func checkConn(name, desc string, f func(*session) error) *Check {
+	return &Check{name, desc, func(cfg *Config, name string) error {
+		s, err := dial(cfg, name)
+		if err != nil {
+			return err
+		}
+
+		defer s.close()
+		return f(s)
+	}}
+}
@@ -0,0 +1,149 @@
+//go:build unix && !tinygo
+
+package conformance
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rminnich/go9p"
+)
+
+type testSrv interface {
+	Start(ops interface{}) bool
+	NewConn(c net.Conn)
+}
+
+func pipeDial(srv testSrv) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		srv.NewConn(c1)
+		return c2, nil
+	}
+}
+
+// Runs the checks against the server. The checks in known fail by
+// design of the server.
+func runChecks(t *testing.T, cfg *Config, known ...string) {
+	t.Helper()
+	for _, c := range Checks {
+		t.Run(c.Name, func(t *testing.T) {
+			r := c.Run(cfg)
+			switch {
+			case r.Status == Fail && slices.Contains(known, c.Name):
+				t.Skip("known failure: " + r.String())
+			case r.Status == Fail:
+				t.Error(r.String())
+			case r.Status == Skip:
+				t.Skip(r.String())
+			}
+		})
+	}
+}
+
+func TestRamfs(t *testing.T) {
+	for _, dotu := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dotu=%v", dotu), func(t *testing.T) {
+			fs := go9p.NewRamfs(go9p.OsUsers.Uid2User(0), go9p.OsUsers.Gid2Group(0), 0777)
+			fs.Dotu = true
+			fs.Id = "ramfs"
+			fs.Start(fs)
+			runChecks(t, &Config{Dial: pipeDial(fs), Dotu: dotu, Uname: "root"})
+		})
+	}
+}
+
+func TestRamfsDispatch(t *testing.T) {
+	fs := go9p.NewRamfs(go9p.OsUsers.Uid2User(0), go9p.OsUsers.Gid2Group(0), 0777)
+	fs.Dotu = true
+	fs.Id = "ramfs"
+	fs.Dispatch = go9p.Dispatch{Workers: 4, Queue: 16, PerFid: true}
+	fs.Start(fs)
+	runChecks(t, &Config{Dial: pipeDial(fs), Dotu: true, Uname: "root"})
+}
+
+func TestUfs(t *testing.T) {
+	fs := new(go9p.Ufs)
+	fs.Dotu = true
+	fs.Id = "ufs"
+	fs.Root = t.TempDir()
+	fs.Start(fs)
+	runChecks(t, &Config{Dial: pipeDial(fs), Dotu: true, Uid: go9p.NOUID})
+}
+
+func TestPipefs(t *testing.T) {
+	fs := new(go9p.Pipefs)
+	fs.Dotu = true
+	fs.Id = "pipefs"
+	fs.Root = t.TempDir()
+	fs.Start(fs)
+	// Pipefs files are pipes, read-write blocks reading the empty pipe
+	// until the check times out. Pipefs doesn't support Twstat.
+	runChecks(t, &Config{Dial: pipeDial(fs), Dotu: true, Uid: go9p.NOUID, Timeout: time.Second},
+		"read-write", "wstat/dont-touch", "wstat/length", "wstat/rename")
+}
+
+func TestProxy(t *testing.T) {
+	fs := go9p.NewRamfs(go9p.OsUsers.Uid2User(0), go9p.OsUsers.Gid2Group(0), 0777)
+	fs.Dotu = true
+	fs.Id = "ramfs"
+	fs.Start(fs)
+	c1, c2 := net.Pipe()
+	fs.NewConn(c1)
+	clnt, err := go9p.Connect(c2, 8192+go9p.IOHDRSZ, true)
+	if err != nil {
+		t.Fatalf("Connect error = %v", err)
+	}
+	defer clnt.Unmount()
+
+	p := go9p.NewProxy(clnt)
+	p.Id = "proxy"
+	p.Start(p)
+	runChecks(t, &Config{Dial: pipeDial(p), Dotu: true, Uname: "root"})
+}
+
+func TestNamespace(t *testing.T) {
+	fs := go9p.NewRamfs(go9p.OsUsers.Uid2User(0), go9p.OsUsers.Gid2Group(0), 0777)
+	fs.Dotu = true
+	fs.Id = "ramfs"
+	fs.Start(fs)
+	c1, c2 := net.Pipe()
+	fs.NewConn(c1)
+	clnt, err := go9p.MountConn(c2, "", 8192, go9p.OsUsers.Uid2User(0))
+	if err != nil {
+		t.Fatalf("MountConn error = %v", err)
+	}
+	defer clnt.Unmount()
+
+	ns := go9p.NewNamespace()
+	ns.Id = "namespace"
+	if err := ns.Mount(clnt.Root, "/", go9p.MREPL); err != nil {
+		t.Fatalf("Mount error = %v", err)
+	}
+	ns.Start(ns)
+	for _, dotu := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dotu=%v", dotu), func(t *testing.T) {
+			runChecks(t, &Config{Dial: pipeDial(ns), Dotu: dotu, Uname: "root"})
+		})
+	}
+}
+
+func TestResultString(t *testing.T) {
+	tests := []struct {
+		r    Result
+		want string
+	}{
+		{Result{"walk/clone", Pass, nil}, "PASS walk/clone"},
+		{Result{"walk/clone", Fail, errPack}, "FAIL walk/clone: cannot pack message"},
+		{Result{"walk/clone", Skip, errSkip("read-only")}, "SKIP walk/clone: read-only"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.r.String(); got != tt.want {
+			t.Fatalf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conformance
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rminnich/go9p"
+)
+
+// A connection to the server under test. The messages are packed and
+// sent one by one, so the checks control the tags and fids exactly.
+type session struct {
+	cfg     *Config
+	conn    net.Conn
+	msize   uint32
+	dotu    bool
+	tag     uint16
+	nextfid uint32
+	root    uint32   // fid of the attach root
+	dir     uint32   // fid of the directory the checks work in
+	names   []string // files created in dir, removed when the session is closed
+	prefix  string   // prefix of the names of the files created
+}
+
+// Opens a new connection to the server, without sending anything.
+func dial(cfg *Config, name string) (*session, error) {
+	c, err := cfg.Dial()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Timeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(cfg.Timeout))
+	}
+
+	s := &session{cfg: cfg, conn: c, msize: cfg.Msize, nextfid: 1}
+	s.prefix = fmt.Sprintf("conformance-%s-%d-", strings.ReplaceAll(name, "/", "-"), time.Now().UnixNano())
+	return s, nil
+}
+
+// Opens a new connection to the server, negotiates the version and
+// attaches to it.
+func start(cfg *Config, name string) (*session, error) {
+	s, err := dial(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.version(cfg.Msize); err == nil {
+		err = s.attach()
+	}
+
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Attaches to the server and walks to the working directory.
+func (s *session) attach() error {
+	s.root = s.newfid()
+	if _, err := s.rpc(s.tattach(s.root)); err != nil {
+		return fmt.Errorf("attach: %v", err)
+	}
+
+	s.dir = s.root
+	if s.cfg.Dir != "" {
+		s.dir = s.newfid()
+		names := strings.Split(strings.Trim(s.cfg.Dir, "/"), "/")
+		rc, err := s.walk(s.root, s.dir, names...)
+		if err == nil && len(rc.Wqid) != len(names) {
+			err = fmt.Errorf("%s not found", s.cfg.Dir)
+		}
+
+		if err != nil {
+			return fmt.Errorf("walk to %s: %v", s.cfg.Dir, err)
+		}
+	}
+
+	return nil
+}
+
+// Removes the files created by the session and closes the connection.
+func (s *session) close() {
+	for i := len(s.names) - 1; i >= 0; i-- {
+		fid := s.newfid()
+		rc, err := s.walk(s.dir, fid, strings.Split(s.names[i], "/")...)
+		if err == nil && len(rc.Wqid) > 0 {
+			_, _ = s.rpc(s.tremove(fid))
+		}
+	}
+
+	_ = s.conn.Close()
+}
+
+// Sends a Tversion message and checks the response.
+func (s *session) version(msize uint32) error {
+	ver := "9P2000"
+	if s.cfg.Dotu {
+		ver = "9P2000.u"
+	}
+
+	rc, err := s.rpc(s.tversion(msize, ver))
+	if err != nil {
+		return fmt.Errorf("version: %v", err)
+	}
+
+	if rc.Msize > msize || rc.Msize < go9p.IOHDRSZ {
+		return fmt.Errorf("version: msize %d, requested %d", rc.Msize, msize)
+	}
+
+	s.msize = rc.Msize
+	s.dotu = rc.Version == "9P2000.u"
+	return nil
+}
+
+func (s *session) newfid() uint32 {
+	fid := s.nextfid
+	s.nextfid++
+	return fid
+}
+
+// Returns a name for a new file, unique to the session.
+func (s *session) newname(name string) string {
+	return s.prefix + name
+}
+
+func (s *session) fcall() *go9p.Fcall {
+	return go9p.NewFcall(s.msize)
+}
+
+// Sends a message with the tag.
+func (s *session) send(tc *go9p.Fcall, tag uint16) error {
+	go9p.SetTag(tc, tag)
+	_, err := s.conn.Write(tc.Pkt)
+	return err
+}
+
+// Receives a message.
+func (s *session) recv() (*go9p.Fcall, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	sz, _ := go9p.Gint32(hdr[:])
+	if sz < 7 || sz > s.msize {
+		return nil, fmt.Errorf("invalid message size %d", sz)
+	}
+
+	buf := make([]byte, sz)
+	copy(buf, hdr[:])
+	if _, err := io.ReadFull(s.conn, buf[4:]); err != nil {
+		return nil, err
+	}
+
+	fc, _, err := go9p.Unpack(buf, s.dotu)
+	return fc, err
+}
+
+// Returns a tag that isn't NOTAG.
+func (s *session) newtag() uint16 {
+	s.tag++
+	if s.tag == go9p.NOTAG {
+		s.tag = 0
+	}
+
+	return s.tag
+}
+
+// Sends a message and receives the response. If the server responds
+// with Rerror, returns the error as *go9p.Error. A nil message is a
+// packing error, reported as is.
+func (s *session) rpc(tc *go9p.Fcall) (*go9p.Fcall, error) {
+	if tc == nil {
+		return nil, errPack
+	}
+
+	tag := go9p.NOTAG
+	if tc.Type != go9p.Tversion {
+		tag = s.newtag()
+	}
+
+	if err := s.send(tc, tag); err != nil {
+		return nil, err
+	}
+
+	rc, err := s.recv()
+	if err != nil {
+		return nil, err
+	}
+
+	if rc.Tag != tag {
+		return nil, fmt.Errorf("response tag %d, want %d", rc.Tag, tag)
+	}
+
+	switch rc.Type {
+	case tc.Type + 1:
+		return rc, nil
+	case go9p.Rerror:
+		return rc, &go9p.Error{Err: rc.Error, Errornum: rc.Errornum}
+	}
+
+	return nil, fmt.Errorf("%s response to %s", go9p.MsgName(rc.Type), go9p.MsgName(tc.Type))
+}
+
+var errPack = fmt.Errorf("cannot pack message")
+
+// Returns nil if err is an error returned by the server, and an error
+// describing what happened instead otherwise.
+func wantRerror(what string, err error) error {
+	switch err.(type) {
+	case *go9p.Error:
+		return nil
+	case nil:
+		return fmt.Errorf("%s succeeded, want Rerror", what)
+	}
+
+	return fmt.Errorf("%s: %v", what, err)
+}
+
+// The functions below return the packed messages, or nil if packing fails.
+
+func (s *session) tversion(msize uint32, ver string) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTversion(tc, msize, ver) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+func (s *session) tattach(fid uint32) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTattach(tc, fid, go9p.NOFID, s.cfg.Uname, s.cfg.Aname, s.cfg.Uid, s.dotu) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+func (s *session) tflush(oldtag uint16) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTflush(tc, oldtag) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+func (s *session) twalk(fid, newfid uint32, names ...string) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTwalk(tc, fid, newfid, names) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+func (s *session) topen(fid uint32, mode uint8) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTopen(tc, fid, mode) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+func (s *session) tcreate(fid uint32, name string, perm uint32, mode uint8) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTcreate(tc, fid, name, perm, mode, "", s.dotu) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+func (s *session) tread(fid uint32, offset uint64, count uint32) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTread(tc, fid, offset, count) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+func (s *session) twrite(fid uint32, offset uint64, data []byte) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTwrite(tc, fid, offset, uint32(len(data)), data) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+func (s *session) tclunk(fid uint32) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTclunk(tc, fid) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+func (s *session) tremove(fid uint32) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTremove(tc, fid) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+func (s *session) tstat(fid uint32) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTstat(tc, fid) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+func (s *session) twstat(fid uint32, d *go9p.Dir) *go9p.Fcall {
+	tc := s.fcall()
+	if go9p.PackTwstat(tc, fid, d, s.dotu) != nil {
+		return nil
+	}
+
+	return tc
+}
+
+// Helpers for the common operations.
+
+func (s *session) walk(fid, newfid uint32, names ...string) (*go9p.Fcall, error) {
+	return s.rpc(s.twalk(fid, newfid, names...))
+}
+
+func (s *session) clunk(fid uint32) error {
+	_, err := s.rpc(s.tclunk(fid))
+	return err
+}
+
+func (s *session) stat(fid uint32) (*go9p.Dir, error) {
+	rc, err := s.rpc(s.tstat(fid))
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Dir, nil
+}
+
+// Creates the file at path, relative to the working directory, and
+// returns a fid for it, open with the mode. The file is removed when
+// the session is closed. If the file can't be created, the error
+// skips the check.
+func (s *session) create(path string, perm uint32, mode uint8) (uint32, error) {
+	elems := strings.Split(path, "/")
+	n := len(elems) - 1
+	fid := s.newfid()
+	rc, err := s.walk(s.dir, fid, elems[0:n]...)
+	if err == nil && len(rc.Wqid) != n {
+		err = fmt.Errorf("%s not found", strings.Join(elems[0:n], "/"))
+	}
+
+	if err != nil {
+		return go9p.NOFID, fmt.Errorf("walk: %v", err)
+	}
+
+	if _, err := s.rpc(s.tcreate(fid, elems[n], perm, mode)); err != nil {
+		_ = s.clunk(fid)
+		return go9p.NOFID, errSkip(fmt.Sprintf("cannot create %s: %v", path, err))
+	}
+
+	s.names = append(s.names, path)
+	return fid, nil
+}
+
+// Walks to a file in the working directory and returns a fid for it.
+// Returns an error if the file doesn't exist.
+func (s *session) lookup(path string) (uint32, error) {
+	var names []string
+	if path != "" {
+		names = strings.Split(path, "/")
+	}
+
+	fid := s.newfid()
+	rc, err := s.walk(s.dir, fid, names...)
+	if err == nil && len(rc.Wqid) != len(names) {
+		err = fmt.Errorf("%s not found", path)
+	}
+
+	if err != nil {
+		return go9p.NOFID, fmt.Errorf("walk to %s: %v", path, err)
+	}
+
+	return fid, nil
+}
+
+// Walks to a file in the working directory and opens it with the mode.
+func (s *session) open(path string, mode uint8) (uint32, error) {
+	fid, err := s.lookup(path)
+	if err != nil {
+		return go9p.NOFID, err
+	}
+
+	if _, err = s.rpc(s.topen(fid, mode)); err != nil {
+		return go9p.NOFID, fmt.Errorf("open %s: %v", path, err)
+	}
+
+	return fid, nil
+}
+
+// Returns the Wstat value that doesn't change anything.
+func dontTouch() *go9p.Dir {
+	return &go9p.Dir{
+		Type:    ^uint16(0),
+		Dev:     ^uint32(0),
+		Qid:     go9p.Qid{Type: ^uint8(0), Version: ^uint32(0), Path: ^uint64(0)},
+		Mode:    ^uint32(0),
+		Atime:   ^uint32(0),
+		Mtime:   ^uint32(0),
+		Length:  ^uint64(0),
+		Uidnum:  go9p.NOUID,
+		Gidnum:  go9p.NOUID,
+		Muidnum: go9p.NOUID,
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+// The Dispatch type describes how a Srv runs the requests it receives.
+// The zero value runs each request in its own goroutine, in any order.
+//
+// With PerFid, a request that blocks delays all later requests on the
+// same fid until it is responded or flushed. With Workers, requests that
+// wait for each other may deadlock if there are fewer workers than such
+// requests.
+type Dispatch struct {
+	// Goroutines processing the requests of all connections, 0 for
+	// a goroutine per request.
+	Workers int
+
+	// Requests waiting for a worker. When the queue is full, the
+	// connections stop reading until a worker takes a request.
+	Queue int
+
+	// If true, the requests on the same fid of a connection are
+	// processed one at a time, in the order they are received.
+	// Requests on different fids still run in parallel.
+	PerFid bool
+}
+
+// Requests waiting for the request in progress on a fid.
+type fidQueue struct {
+	reqs []*SrvReq
+}
+
+// Starts the workers, if any.
+func (srv *Srv) startWorkers() {
+	if srv.Dispatch.Workers <= 0 || srv.workq != nil {
+		return
+	}
+
+	srv.workq = make(chan *SrvReq, srv.Dispatch.Queue)
+	for i := 0; i < srv.Dispatch.Workers; i++ {
+		go srv.worker()
+	}
+}
+
+func (srv *Srv) worker() {
+	for req := range srv.workq {
+		req.process()
+	}
+}
+
+// Returns the fid the request is ordered by, and false if it doesn't
+// use a fid.
+func reqFid(tc *Fcall) (uint32, bool) {
+	switch tc.Type {
+	case Tversion, Tflush:
+		return NOFID, false
+	case Tauth:
+		return tc.Afid, true
+	}
+
+	return tc.Fid, true
+}
+
+// Dispatches a request of the connection. If recv is true, the request
+// was just received and the call may block until a worker is available.
+func (conn *Conn) dispatch(req *SrvReq, recv bool) {
+	if conn.Srv.Dispatch.PerFid {
+		if fid, ok := reqFid(req.Tc); ok {
+			conn.Lock()
+			if q := conn.fidqs[fid]; q != nil {
+				// wait for the request in progress
+				q.reqs = append(q.reqs, req)
+				conn.Unlock()
+				return
+			}
+
+			if conn.fidqs == nil {
+				conn.fidqs = make(map[uint32]*fidQueue)
+			}
+
+			conn.fidqs[fid] = new(fidQueue)
+			conn.Unlock()
+			req.Lock()
+			req.ordered, req.ofid = true, fid
+			req.Unlock()
+		}
+	}
+
+	conn.Srv.run(req, recv)
+}
+
+// Runs the request in a worker, or in a goroutine of its own.
+func (srv *Srv) run(req *SrvReq, recv bool) {
+	switch {
+	case srv.workq == nil:
+		go req.process()
+	case recv:
+		srv.workq <- req
+	default:
+		// the workers may be the ones dispatching
+		select {
+		case srv.workq <- req:
+		default:
+			go func() { srv.workq <- req }()
+		}
+	}
+}
+
+// Dispatches the next request waiting for the fid, once the request
+// in progress on it is responded. Skips the requests that were flushed
+// while waiting.
+func (conn *Conn) fidNext(fid uint32) {
+	for {
+		var next *SrvReq
+		conn.Lock()
+		if q := conn.fidqs[fid]; q != nil {
+			if len(q.reqs) == 0 {
+				delete(conn.fidqs, fid)
+			} else {
+				next = q.reqs[0]
+				q.reqs = q.reqs[1:]
+			}
+		}
+		conn.Unlock()
+
+		if next == nil {
+			return
+		}
+
+		next.Lock()
+		responded := (next.status & reqResponded) != 0
+		if !responded {
+			next.ordered, next.ofid = true, fid
+		}
+		next.Unlock()
+
+		if !responded {
+			conn.Srv.run(next, false)
+			return
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package go9p
+
+import (
+	"testing"
+	"time"
+)
+
+// A Ramfs whose reads block until released.
+type dispatchRamfs struct {
+	*Ramfs
+	started chan *SrvReq
+	release chan bool
+}
+
+func (fs *dispatchRamfs) Read(req *SrvReq) {
+	fs.started <- req
+	<-fs.release
+	req.RespondRread(nil)
+}
+
+func (fs *dispatchRamfs) Flush(req *SrvReq) { req.Flush() }
+
+// Starts a dispatchRamfs and returns n open fids of its root.
+func newDispatchRamfs(t *testing.T, d Dispatch, n int) (*dispatchRamfs, []*File) {
+	t.Helper()
+	fs := &dispatchRamfs{newTestRamfs(), make(chan *SrvReq, 16), make(chan bool)}
+	fs.Dispatch = d
+	fs.Dotu = true
+	fs.Start(fs)
+	clnt := mountPipe(t, fs)
+
+	var files []*File
+	for i := 0; i < n; i++ {
+		f, err := clnt.FOpen("/", OREAD)
+		if err != nil {
+			t.Fatalf("FOpen error = %v", err)
+		}
+		files = append(files, f)
+	}
+	return fs, files
+}
+
+// Returns the next request started, or nil if none starts soon.
+func nextStarted(fs *dispatchRamfs) *SrvReq {
+	select {
+	case req := <-fs.started:
+		return req
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestDispatchWorkers(t *testing.T) {
+	fs, files := newDispatchRamfs(t, Dispatch{Workers: 2}, 3)
+	var rs []*Req
+	for _, f := range files {
+		rs = append(rs, startRead(t, f))
+	}
+
+	for i := 0; i < 2; i++ {
+		if nextStarted(fs) == nil {
+			t.Fatalf("read %d didn't start", i)
+		}
+	}
+	if req := nextStarted(fs); req != nil {
+		t.Fatalf("third read started with two workers busy")
+	}
+
+	fs.release <- true
+	if nextStarted(fs) == nil {
+		t.Fatalf("third read didn't start after a worker was free")
+	}
+	fs.release <- true
+	fs.release <- true
+	for _, r := range rs {
+		if r := <-r.Done; r.Err != nil {
+			t.Fatalf("read error = %v", r.Err)
+		}
+	}
+}
+
+func TestDispatchPerFid(t *testing.T) {
+	fs, files := newDispatchRamfs(t, Dispatch{PerFid: true}, 2)
+	r1 := startRead(t, files[0])
+	first := nextStarted(fs)
+	if first == nil || first.Tc.Tag != r1.tag {
+		t.Fatalf("first read on the fid didn't start")
+	}
+	r2 := startRead(t, files[0])
+	if req := nextStarted(fs); req != nil {
+		t.Fatalf("second read on the fid started before the first one finished")
+	}
+
+	// another fid isn't delayed
+	r3 := startRead(t, files[1])
+	if nextStarted(fs) == nil {
+		t.Fatalf("read on another fid didn't start")
+	}
+	fs.release <- true
+	fs.release <- true
+
+	second := nextStarted(fs)
+	if second == nil || second.Tc.Tag != r2.tag {
+		t.Fatalf("second read on the fid didn't start after the first one")
+	}
+	fs.release <- true
+	for _, r := range []*Req{r1, r2, r3} {
+		if r := <-r.Done; r.Err != nil {
+			t.Fatalf("read error = %v", r.Err)
+		}
+	}
+}
+
+// A Ramfs whose reads are responded after the Read operation returns.
+type asyncRamfs struct {
+	*Ramfs
+	started chan *SrvReq
+}
+
+func (fs *asyncRamfs) Read(req *SrvReq) { fs.started <- req }
+
+// A request that is responded asynchronously still delays the next
+// request on its fid until it is responded.
+func TestDispatchPerFidAsync(t *testing.T) {
+	fs := &asyncRamfs{newTestRamfs(), make(chan *SrvReq, 16)}
+	fs.Dispatch = Dispatch{PerFid: true}
+	fs.Dotu = true
+	fs.Start(fs)
+	clnt := mountPipe(t, fs)
+	file, err := clnt.FOpen("/", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	r1 := startRead(t, file)
+	first := <-fs.started
+	r2 := startRead(t, file)
+	select {
+	case <-fs.started:
+		t.Fatalf("second read on the fid started before the first one was responded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.RespondRread(nil)
+	second := <-fs.started
+	second.RespondRread(nil)
+	for _, r := range []*Req{r1, r2} {
+		if r := <-r.Done; r.Err != nil {
+			t.Fatalf("read error = %v", r.Err)
+		}
+	}
+}
+
+// A Tflush doesn't wait for a worker when all of them are busy.
+func TestDispatchFlushBusy(t *testing.T) {
+	fs, files := newDispatchRamfs(t, Dispatch{Workers: 1, Queue: 1}, 2)
+	r1 := startRead(t, files[0])
+	if nextStarted(fs) == nil {
+		t.Fatalf("first read didn't start")
+	}
+	r2 := startRead(t, files[1])
+
+	done := make(chan error, 1)
+	go func() { done <- files[0].Fid.Clnt.Flush(r1) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Flush error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Flush waited for a worker")
+	}
+	if r := <-r1.Done; r.Err != Eflushed {
+		t.Fatalf("flushed request error = %v", r.Err)
+	}
+
+	fs.release <- true
+	if nextStarted(fs) == nil {
+		t.Fatalf("second read didn't start")
+	}
+	fs.release <- true
+	if r := <-r2.Done; r.Err != nil {
+		t.Fatalf("read error = %v", r.Err)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// A connection reading from one file and writing to another, like the
+// standard input and output of a process.
+type fileConn struct {
+	r, w   *os.File
+	addr   fileAddr
+	once   sync.Once
+	closed func() // if not nil, called once the files are closed
+}
+
+// The address of a fileConn is its name.
+type fileAddr string
+
+func (a fileAddr) Network() string { return "file" }
+func (a fileAddr) String() string  { return string(a) }
+
+// Returns a connection reading from r and writing to w. Both files are
+// closed when the connection is closed. The name is used as both the
+// local and the remote address.
+func NewFileConn(r, w *os.File, name string) net.Conn {
+	return &fileConn{r: r, w: w, addr: fileAddr(name)}
+}
+
+func (c *fileConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *fileConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *fileConn) LocalAddr() net.Addr         { return c.addr }
+func (c *fileConn) RemoteAddr() net.Addr        { return c.addr }
+
+func (c *fileConn) Close() error {
+	err := Eclosed
+	c.once.Do(func() {
+		err = c.r.Close()
+		if werr := c.w.Close(); err == nil {
+			err = werr
+		}
+
+		if c.closed != nil {
+			c.closed()
+		}
+	})
+
+	return err
+}
+
+// The deadlines are only supported if the files are pipes or other
+// files that can be polled.
+func (c *fileConn) SetDeadline(t time.Time) error {
+	if err := c.r.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.w.SetWriteDeadline(t)
+}
+
+func (c *fileConn) SetReadDeadline(t time.Time) error  { return c.r.SetReadDeadline(t) }
+func (c *fileConn) SetWriteDeadline(t time.Time) error { return c.w.SetWriteDeadline(t) }
+
+// Starts the command and returns a connection to its standard input and
+// output, for servers started like "ssh host ufs -stdio". The command
+// should exit when its standard input is closed, it is waited for once
+// the connection is closed.
+func CommandConn(cmd *exec.Cmd) (net.Conn, error) {
+	inr, inw, err := os.Pipe()
+	if err != nil {
+		return nil, &Error{err.Error(), EIO}
+	}
+
+	outr, outw, err := os.Pipe()
+	if err != nil {
+		_ = inr.Close()
+		_ = inw.Close()
+		return nil, &Error{err.Error(), EIO}
+	}
+
+	cmd.Stdin = inr
+	cmd.Stdout = outw
+	err = cmd.Start()
+	// the command has its own copies
+	_ = inr.Close()
+	_ = outw.Close()
+	if err != nil {
+		_ = inw.Close()
+		_ = outr.Close()
+		return nil, &Error{err.Error(), EIO}
+	}
+
+	c := &fileConn{r: outr, w: inw, addr: fileAddr(cmd.Path)}
+	c.closed = func() { go func() { _ = cmd.Wait() }() }
+	return c, nil
+}
+
+// Starts the command and attaches to the file server speaking on its
+// standard input and output.
+func MountCommand(cmd *exec.Cmd, aname string, msize uint32, user User) (*Clnt, error) {
+	c, err := CommandConn(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return MountConn(c, aname, msize, user)
+}
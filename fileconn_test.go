@@ -0,0 +1,63 @@
+package go9p
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestServeConn(t *testing.T) {
+	fs := newTestRamfs()
+	addRamFile(t, fs, nil, "file", "hello", 0666)
+	fs.Dotu = true
+	fs.Start(fs)
+
+	// the client writes to w1 and reads from r2
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+
+	served := make(chan bool)
+	go func() {
+		fs.ServeConn(NewFileConn(r1, w2, "server"))
+		close(served)
+	}()
+
+	clnt, err := MountConn(NewFileConn(r2, w1, "client"), "", 8192, OsUsers.Uid2User(0))
+	if err != nil {
+		t.Fatalf("MountConn error = %v", err)
+	}
+	if got := readFile(t, clnt, "/file"); got != "hello" {
+		t.Fatalf("read %q, want %q", got, "hello")
+	}
+
+	clnt.Unmount()
+	<-served
+}
+
+func TestCommandConn(t *testing.T) {
+	path, err := exec.LookPath("cat")
+	if err != nil {
+		t.Skip("no cat command")
+	}
+
+	c, err := CommandConn(exec.Command(path))
+	if err != nil {
+		t.Fatalf("CommandConn error = %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("ReadFull = %q, %v, want %q", buf, err, "ping")
+	}
+}
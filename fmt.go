@@ -49,6 +49,12 @@ func permToString(perm uint32) string {
 	return ret
 }
 
+// Returns the permissions and flags of a file mode as a string, like
+// "d755" for a directory.
+func PermString(perm uint32) string {
+	return permToString(perm)
+}
+
 func (qid *Qid) String() string {
 	b := ""
 	if qid.Type&QTDIR != 0 {
@@ -0,0 +1,226 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+var Etoomanyfids error = &Error{"too many fids", EMFILE}
+var Etoomanyconns error = &Error{"too many connections for user", EUSERS}
+
+// The Limits type describes the resources each client of a file server
+// can use. A zero field means no limit.
+//
+// Srv.Limits is copied to each new Conn, so a file server can change
+// the limits of a connection in ConnOpened. ConnsPerAddr is checked
+// before that.
+type Limits struct {
+	// Fids per connection. Tauth, Tattach and Twalk to a new fid
+	// fail with Etoomanyfids when the connection has that many.
+	Fids int
+
+	// Requests in progress per connection. When the connection has
+	// that many, the server stops reading from it until one of them
+	// is responded. Tflush and Tversion don't count, so the requests
+	// in progress can always be aborted.
+	Requests int
+
+	// Connections from the same host. Further connections are
+	// closed as soon as they are accepted.
+	ConnsPerAddr int
+
+	// Connections attached as the same user. Tattach on another
+	// connection fails with Etoomanyconns.
+	ConnsPerUser int
+
+	// Bytes per second read from and written to a connection.
+	RecvRate int64
+	SendRate int64
+}
+
+// The limits counted by Metrics.
+const (
+	limitFids = iota
+	limitRequests
+	limitConnsPerAddr
+	limitConnsPerUser
+	limitRecvRate
+	limitSendRate
+	nlimits
+)
+
+var limitNames = [nlimits]string{"fids", "requests", "conns_per_addr", "conns_per_user", "recv_rate", "send_rate"}
+
+// The connections of a Srv by host and user.
+type srvConns struct {
+	sync.Mutex
+	addrs map[string]int
+	users map[string]int
+}
+
+func (srv *Srv) limitHit(limit int) {
+	if m := srv.Metrics; m != nil {
+		m.Lock()
+		m.nlimits[limit]++
+		m.Unlock()
+	}
+}
+
+// Returns the host of a remote address, or the whole address if it
+// doesn't have a port.
+func addrHost(addr net.Addr) string {
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+
+	return s
+}
+
+// Adds a connection from the host. Returns false if the host has too
+// many connections.
+func (srv *Srv) addrAcquire(host string) bool {
+	sc := &srv.limitConns
+	sc.Lock()
+	defer sc.Unlock()
+	if sc.addrs == nil {
+		sc.addrs = make(map[string]int)
+	}
+
+	if n := srv.Limits.ConnsPerAddr; n > 0 && sc.addrs[host] >= n {
+		return false
+	}
+
+	sc.addrs[host]++
+	return true
+}
+
+func (srv *Srv) addrRelease(host string) {
+	sc := &srv.limitConns
+	sc.Lock()
+	if n, ok := sc.addrs[host]; ok {
+		if n <= 1 {
+			delete(sc.addrs, host)
+		} else {
+			sc.addrs[host] = n - 1
+		}
+	}
+	sc.Unlock()
+}
+
+// Marks the connection as attached by the user. Returns Etoomanyconns
+// if the user is attached on too many connections already.
+func (conn *Conn) userAcquire(uname string) error {
+	srv := conn.Srv
+	sc := &srv.limitConns
+	sc.Lock()
+	defer sc.Unlock()
+	if conn.users[uname] {
+		return nil
+	}
+
+	if sc.users == nil {
+		sc.users = make(map[string]int)
+	}
+
+	if n := conn.Limits.ConnsPerUser; n > 0 && sc.users[uname] >= n {
+		srv.limitHit(limitConnsPerUser)
+		return Etoomanyconns
+	}
+
+	if conn.users == nil {
+		conn.users = make(map[string]bool)
+	}
+
+	conn.users[uname] = true
+	sc.users[uname]++
+	return nil
+}
+
+// Releases the users and the host of a closed connection.
+func (conn *Conn) limitsRelease() {
+	srv := conn.Srv
+	sc := &srv.limitConns
+	sc.Lock()
+	for uname := range conn.users {
+		if sc.users[uname]--; sc.users[uname] <= 0 {
+			delete(sc.users, uname)
+		}
+	}
+	sc.Unlock()
+
+	srv.addrRelease(conn.host)
+}
+
+// Waits until the connection can have another request in progress.
+// Tflush and Tversion don't wait, they abort the requests in progress.
+// Returns true if the request counts against the limit.
+func (conn *Conn) reqAcquire(tc *Fcall) bool {
+	if conn.reqsem == nil || tc.Type == Tflush || tc.Type == Tversion {
+		return false
+	}
+
+	select {
+	case conn.reqsem <- true:
+	default:
+		conn.Srv.limitHit(limitRequests)
+		conn.reqsem <- true
+	}
+
+	return true
+}
+
+// Called when a request is no longer in progress.
+func (conn *Conn) reqRelease(req *SrvReq) {
+	conn.Lock()
+	conn.npend--
+	conn.Unlock()
+	if req.limited {
+		<-conn.reqsem
+	}
+}
+
+// A token bucket limiting the bytes per second. The bucket holds up to
+// a second worth of bytes.
+type rateLimiter struct {
+	rate   int64
+	tokens int64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// Takes n bytes from the bucket, waiting until they are available.
+// Returns true if it had to wait.
+func (rl *rateLimiter) wait(n int) bool {
+	now := time.Now()
+	if d := now.Sub(rl.last); d < time.Second {
+		rl.tokens += int64(d) * rl.rate / int64(time.Second)
+	} else {
+		rl.tokens = rl.rate
+	}
+
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+
+	rl.last = now
+	rl.tokens -= int64(n)
+	if rl.tokens >= 0 {
+		return false
+	}
+
+	time.Sleep(time.Duration(-rl.tokens * int64(time.Second) / rl.rate))
+	return true
+}
@@ -0,0 +1,218 @@
+package go9p
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns how many times the limit was hit.
+func limitHits(m *Metrics, limit int) uint64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.nlimits[limit]
+}
+
+func TestLimitsFids(t *testing.T) {
+	fs := newTestRamfs()
+	fs.Metrics = NewMetrics()
+	fs.Limits.Fids = 2
+	clnt := newRamfsClnt(t, fs)
+
+	fid, err := clnt.FWalk("/")
+	if err != nil {
+		t.Fatalf("FWalk error = %v", err)
+	}
+	if _, err := clnt.FWalk("/"); err == nil || err.Error() != Etoomanyfids.Error() {
+		t.Fatalf("FWalk over the limit error = %v", err)
+	}
+	if n := limitHits(fs.Metrics, limitFids); n != 1 {
+		t.Fatalf("fids limit hits = %d", n)
+	}
+
+	// walking to the same fid doesn't need a new one
+	if _, err := clnt.Walk(fid, fid, nil); err != nil {
+		t.Fatalf("Walk to the same fid error = %v", err)
+	}
+	_ = clnt.Clunk(fid)
+	if _, err := clnt.FWalk("/"); err != nil {
+		t.Fatalf("FWalk after Clunk error = %v", err)
+	}
+}
+
+func TestLimitsFidsConcurrent(t *testing.T) {
+	req := newSrvReq(Twalk, &testSrvOps{})
+	conn := req.Conn
+	conn.Limits.Fids = 10
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	nfids := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(fidno uint32) {
+			defer wg.Done()
+			if _, err := conn.fidNew(fidno); err == nil {
+				mu.Lock()
+				nfids++
+				mu.Unlock()
+			} else if err != Etoomanyfids {
+				t.Errorf("fidNew(%d) error = %v", fidno, err)
+			}
+		}(uint32(i))
+	}
+	wg.Wait()
+
+	if nfids != 10 || len(conn.fidpool) != 10 {
+		t.Fatalf("created %d fids, pool has %d, want 10", nfids, len(conn.fidpool))
+	}
+	for fidno := range conn.fidpool {
+		if _, err := conn.fidNew(fidno); err != Einuse {
+			t.Fatalf("fidNew of a fid in use error = %v", err)
+		}
+	}
+}
+
+func TestLimitsRequests(t *testing.T) {
+	fs, f := newBlockRamfs(t)
+	fs.Metrics = NewMetrics()
+	fs.Limits.Requests = 1
+	clnt := mountPipe(t, fs)
+
+	file, err := clnt.FOpen("/block", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	r := startRead(t, file)
+	<-f.started
+	done := make(chan error, 1)
+	go func() {
+		_, err := clnt.Stat(file.Fid)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Tstat responded while a request was in progress, error = %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	f.release <- true
+	<-r.Done
+	if err := <-done; err != nil {
+		t.Fatalf("Stat error = %v", err)
+	}
+	if n := limitHits(fs.Metrics, limitRequests); n != 1 {
+		t.Fatalf("requests limit hits = %d", n)
+	}
+}
+
+// The requests filling the limit can be flushed.
+func TestLimitsRequestsFlush(t *testing.T) {
+	fs, f := newBlockRamfs(t)
+	fs.Limits.Requests = 2
+	clnt := mountPipe(t, fs)
+	file, err := clnt.FOpen("/block", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	r1 := startRead(t, file)
+	<-f.started
+	r2 := startRead(t, file)
+	<-f.started
+
+	done := make(chan error, 1)
+	go func() { done <- clnt.Flush(r1) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Flush error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Tflush not read while the limit was reached")
+	}
+	if r := <-r1.Done; r.Err != Eflushed {
+		t.Fatalf("flushed request error = %v", r.Err)
+	}
+
+	f.release <- true
+	f.release <- true
+	if r := <-r2.Done; r.Err != nil {
+		t.Fatalf("second read error = %v", r.Err)
+	}
+}
+
+func TestLimitsConnsPerAddr(t *testing.T) {
+	fs := newTestRamfs()
+	fs.Metrics = NewMetrics()
+	fs.Limits.ConnsPerAddr = 1
+	clnt := newRamfsClnt(t, fs)
+
+	// all net.Pipe connections have the same address
+	c1, c2 := net.Pipe()
+	fs.NewConn(c1)
+	if _, err := MountConn(c2, "", 8192, OsUsers.Uid2User(0)); err == nil {
+		t.Fatalf("second connection from the host succeeded")
+	}
+	if n := limitHits(fs.Metrics, limitConnsPerAddr); n != 1 {
+		t.Fatalf("conns per addr limit hits = %d", n)
+	}
+
+	clnt.Unmount()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		c1, c2 := net.Pipe()
+		fs.NewConn(c1)
+		clnt, err := MountConn(c2, "", 8192, OsUsers.Uid2User(0))
+		if err == nil {
+			clnt.Unmount()
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("connection after the first one closed error = %v", err)
+		}
+	}
+}
+
+func TestLimitsConnsPerUser(t *testing.T) {
+	fs := newTestRamfs()
+	fs.Metrics = NewMetrics()
+	fs.Limits.ConnsPerUser = 1
+	clnt := newRamfsClnt(t, fs)
+
+	// another attach on the same connection
+	if _, err := clnt.Attach(nil, OsUsers.Uid2User(0), ""); err != nil {
+		t.Fatalf("Attach error = %v", err)
+	}
+
+	c1, c2 := net.Pipe()
+	fs.NewConn(c1)
+	_, err := MountConn(c2, "", 8192, OsUsers.Uid2User(0))
+	if err == nil || err.Error() != Etoomanyconns.Error() {
+		t.Fatalf("attach on a second connection error = %v", err)
+	}
+	if n := limitHits(fs.Metrics, limitConnsPerUser); n != 1 {
+		t.Fatalf("conns per user limit hits = %d", n)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(10000)
+	if rl.wait(10000) {
+		t.Fatalf("wait for a full bucket waited")
+	}
+
+	start := time.Now()
+	if !rl.wait(500) {
+		t.Fatalf("wait for an empty bucket didn't wait")
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("waited %v, want 50ms", d)
+	}
+
+	if newRateLimiter(0) != nil {
+		t.Fatalf("newRateLimiter(0) isn't nil")
+	}
+}
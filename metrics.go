@@ -0,0 +1,108 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"sync"
+	"time"
+)
+
+// Upper bounds of the request latency histogram buckets, in seconds.
+var metricsBuckets = [...]float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+// Per message type metrics.
+type msgMetrics struct {
+	count   uint64
+	errors  uint64
+	buckets [len(metricsBuckets)]uint64 // non-cumulative
+	sum     time.Duration
+}
+
+// The Metrics type collects the metrics of a file server or client.
+// It is enabled by setting the Metrics field of Srv (before calling
+// Start) or Clnt (before the requests to be counted are sent), and
+// exported in the Prometheus text format by their MetricsHandler
+// methods.
+type Metrics struct {
+	sync.Mutex
+	msgs   [(Tlast - Tversion) / 2]msgMetrics // by T-message type
+	errnos map[uint32]uint64                  // errors by error code
+	tsz    uint64                             // bytes of T-messages
+	rsz    uint64                             // bytes of R-messages
+	nconns uint64                             // connections accepted (server only)
+	nfids  int64                              // fids in use (client only)
+
+	nlimits [nlimits]uint64 // times each limit was hit (server only)
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{errnos: make(map[uint32]uint64)}
+}
+
+// Records a request and the response to it.
+func (m *Metrics) request(start time.Time, tc, rc *Fcall) {
+	if tc.Type < Tversion || tc.Type >= Tlast {
+		return
+	}
+
+	lat := time.Since(start)
+	b := 0
+	for b < len(metricsBuckets) && lat.Seconds() > metricsBuckets[b] {
+		b++
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	mm := &m.msgs[(tc.Type-Tversion)/2]
+	mm.count++
+	mm.sum += lat
+	if b < len(mm.buckets) {
+		mm.buckets[b]++
+	}
+
+	m.tsz += uint64(tc.Size)
+	if rc == nil {
+		return
+	}
+
+	m.rsz += uint64(rc.Size)
+	if rc.Type == Rerror {
+		mm.errors++
+		m.errnos[rc.Errornum]++
+	}
+}
+
+// Updates the number of fids in use from a request and the response
+// to it. Used by the client, which doesn't keep track of its fids.
+func (m *Metrics) fids(tc, rc *Fcall) {
+	n := int64(0)
+	switch rc.Type {
+	case Rauth, Rattach:
+		n = 1
+	case Rwalk:
+		if tc.Newfid != tc.Fid && len(rc.Wqid) == len(tc.Wname) {
+			n = 1
+		}
+	case Rclunk, Rremove:
+		n = -1
+	case Rerror:
+		// the fid is clunked even if the remove fails
+		if tc.Type == Tremove {
+			n = -1
+		}
+	}
+
+	if n != 0 {
+		m.Lock()
+		m.nfids += n
+		m.Unlock()
+	}
+}
+
+func (m *Metrics) connOpened() {
+	m.Lock()
+	m.nconns++
+	m.Unlock()
+}
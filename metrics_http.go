@@ -0,0 +1,170 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !tinygo
+
+package go9p
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writes metrics in the Prometheus text exposition format. All
+// metrics get the same id label.
+type metricsWriter struct {
+	*bufio.Writer
+	prefix string
+	id     string
+}
+
+func (w *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", w.prefix, name, help, w.prefix, name, typ)
+}
+
+// Writes a sample. labels are name/value pairs.
+func (w *metricsWriter) sample(name string, value interface{}, labels ...string) {
+	fmt.Fprintf(w, "%s_%s{id=\"%s\"", w.prefix, name, labelEscaper.Replace(w.id))
+	for i := 0; i+1 < len(labels); i += 2 {
+		fmt.Fprintf(w, ",%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+
+	fmt.Fprintf(w, "} %v\n", value)
+}
+
+func (w *metricsWriter) gauge(name, help string, value interface{}) {
+	w.header(name, "gauge", help)
+	w.sample(name, value)
+}
+
+// Writes the metrics collected by m.
+func (m *Metrics) write(w *metricsWriter) {
+	m.Lock()
+	defer m.Unlock()
+
+	w.header("requests_total", "counter", "Number of requests by message type.")
+	for i := range m.msgs {
+		if m.msgs[i].count != 0 {
+			w.sample("requests_total", m.msgs[i].count, "type", MsgName(uint8(Tversion+2*i)))
+		}
+	}
+
+	w.header("request_errors_total", "counter", "Number of requests that failed, by message type.")
+	for i := range m.msgs {
+		if m.msgs[i].errors != 0 {
+			w.sample("request_errors_total", m.msgs[i].errors, "type", MsgName(uint8(Tversion+2*i)))
+		}
+	}
+
+	w.header("errors_total", "counter", "Number of errors returned, by error code.")
+	errnos := make([]uint32, 0, len(m.errnos))
+	for e := range m.errnos {
+		errnos = append(errnos, e)
+	}
+	sort.Slice(errnos, func(i, j int) bool { return errnos[i] < errnos[j] })
+	for _, e := range errnos {
+		w.sample("errors_total", m.errnos[e], "errno", strconv.FormatUint(uint64(e), 10))
+	}
+
+	w.header("request_duration_seconds", "histogram", "Request latency by message type.")
+	for i := range m.msgs {
+		mm := &m.msgs[i]
+		if mm.count == 0 {
+			continue
+		}
+
+		name := MsgName(uint8(Tversion + 2*i))
+		n := uint64(0)
+		for b, le := range metricsBuckets {
+			n += mm.buckets[b]
+			w.sample("request_duration_seconds_bucket", n, "type", name, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+
+		w.sample("request_duration_seconds_bucket", mm.count, "type", name, "le", "+Inf")
+		w.sample("request_duration_seconds_sum", mm.sum.Seconds(), "type", name)
+		w.sample("request_duration_seconds_count", mm.count, "type", name)
+	}
+
+	w.header("request_bytes_total", "counter", "Bytes of T-messages.")
+	w.sample("request_bytes_total", m.tsz)
+	w.header("response_bytes_total", "counter", "Bytes of R-messages.")
+	w.sample("response_bytes_total", m.rsz)
+}
+
+// Returns an http.Handler that serves the server metrics in the
+// Prometheus text format. The handler can be mounted on any path.
+func (srv *Srv) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(c http.ResponseWriter, r *http.Request) {
+		c.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := &metricsWriter{bufio.NewWriter(c), "go9p_srv", srv.Id}
+		defer w.Flush()
+
+		nconns, nfids, npend := 0, 0, 0
+		srv.Lock()
+		for conn := range srv.conns {
+			conn.Lock()
+			nconns++
+			nfids += len(conn.fidpool)
+			npend += conn.npend
+			conn.Unlock()
+		}
+		srv.Unlock()
+
+		w.gauge("connections", "Number of open connections.", nconns)
+		w.gauge("fids", "Number of fids in use.", nfids)
+		w.gauge("pending_requests", "Number of requests in progress.", npend)
+		if m := srv.Metrics; m != nil {
+			m.Lock()
+			n := m.nconns
+			m.Unlock()
+			w.header("connections_total", "counter", "Number of connections accepted.")
+			w.sample("connections_total", n)
+			w.header("limits_total", "counter", "Number of times a resource limit was hit, by limit.")
+			m.Lock()
+			for i, n := range m.nlimits {
+				if n != 0 {
+					w.sample("limits_total", n, "limit", limitNames[i])
+				}
+			}
+			m.Unlock()
+			m.write(w)
+		}
+	})
+}
+
+// Returns an http.Handler that serves the client metrics in the
+// Prometheus text format. The handler can be mounted on any path.
+func (clnt *Clnt) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(c http.ResponseWriter, r *http.Request) {
+		c.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := &metricsWriter{bufio.NewWriter(c), "go9p_clnt", clnt.Id}
+		defer w.Flush()
+
+		connected, npend := 1, 0
+		clnt.Lock()
+		if clnt.err != nil {
+			connected = 0
+		}
+		for r := clnt.reqfirst; r != nil; r = r.next {
+			npend++
+		}
+		clnt.Unlock()
+
+		w.gauge("connected", "1 if the client is connected to the server.", connected)
+		w.gauge("pending_requests", "Number of requests in progress.", npend)
+		if m := clnt.Metrics; m != nil {
+			m.Lock()
+			n := m.nfids
+			m.Unlock()
+			w.gauge("fids", "Number of fids in use.", n)
+			m.write(w)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package go9p
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getMetrics(t *testing.T, fn func() string, want ...string) string {
+	t.Helper()
+	var out string
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		out = fn()
+		missing := ""
+		for _, s := range want {
+			if !strings.Contains(out, s) {
+				missing = s
+				break
+			}
+		}
+
+		if missing == "" {
+			return out
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics don't contain %q:\n%s", missing, out)
+		}
+	}
+}
+
+func TestMetricsRequest(t *testing.T) {
+	m := NewMetrics()
+	start := time.Now().Add(-2 * time.Millisecond)
+	m.request(start, &Fcall{Type: Twalk, Size: 20}, &Fcall{Type: Rwalk, Size: 10})
+	m.request(start, &Fcall{Type: Twalk, Size: 20}, &Fcall{Type: Rerror, Size: 15, Errornum: ENOENT})
+	m.request(start, &Fcall{Type: Tlast}, nil)
+
+	mm := &m.msgs[(Twalk-Tversion)/2]
+	if mm.count != 2 || mm.errors != 1 || m.errnos[ENOENT] != 1 {
+		t.Fatalf("walk count = %d errors = %d errnos = %v", mm.count, mm.errors, m.errnos)
+	}
+	if m.tsz != 40 || m.rsz != 25 {
+		t.Fatalf("tsz = %d rsz = %d", m.tsz, m.rsz)
+	}
+	if mm.buckets[3] != 2 || mm.sum < 4*time.Millisecond {
+		t.Fatalf("buckets = %v sum = %v", mm.buckets, mm.sum)
+	}
+}
+
+func TestMetricsFids(t *testing.T) {
+	tests := []struct {
+		name string
+		tc   Fcall
+		rc   Fcall
+		want int64
+	}{
+		{"attach", Fcall{Type: Tattach}, Fcall{Type: Rattach}, 1},
+		{"walk clone", Fcall{Type: Twalk, Fid: 1, Newfid: 2}, Fcall{Type: Rwalk}, 1},
+		{"walk same fid", Fcall{Type: Twalk, Fid: 1, Newfid: 1, Wname: []string{"a"}}, Fcall{Type: Rwalk, Wqid: []Qid{{}}}, 0},
+		{"partial walk", Fcall{Type: Twalk, Fid: 1, Newfid: 2, Wname: []string{"a", "b"}}, Fcall{Type: Rwalk, Wqid: []Qid{{}}}, 0},
+		{"clunk", Fcall{Type: Tclunk}, Fcall{Type: Rclunk}, -1},
+		{"failed remove", Fcall{Type: Tremove}, Fcall{Type: Rerror}, -1},
+		{"failed open", Fcall{Type: Topen}, Fcall{Type: Rerror}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMetrics()
+			m.fids(&tt.tc, &tt.rc)
+			if m.nfids != tt.want {
+				t.Fatalf("nfids = %d, want %d", m.nfids, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	fs := newTestRamfs()
+	fs.Metrics = NewMetrics()
+	clnt := newRamfsClnt(t, fs)
+	clnt.Metrics = NewMetrics()
+
+	if _, err := clnt.FStat("/missing"); err == nil {
+		t.Fatalf("FStat succeeded")
+	}
+	f, err := clnt.FCreate("/file", 0644, OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+
+	srvout := getMetrics(t, func() string {
+		rec := httptest.NewRecorder()
+		fs.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	},
+		`go9p_srv_connections{id="ramfs"} 1`,
+		`go9p_srv_connections_total{id="ramfs"} 1`,
+		`go9p_srv_fids{id="ramfs"} 2`,
+		`go9p_srv_requests_total{id="ramfs",type="Tcreate"} 1`,
+		`go9p_srv_request_errors_total{id="ramfs",type="Twalk"} 1`,
+		`go9p_srv_errors_total{id="ramfs",errno="2"} 1`,
+		`go9p_srv_request_duration_seconds_bucket{id="ramfs",type="Tversion",le="+Inf"} 1`,
+		"# TYPE go9p_srv_request_duration_seconds histogram")
+	if !strings.Contains(srvout, `go9p_srv_pending_requests{id="ramfs"} 0`) {
+		t.Fatalf("pending requests:\n%s", srvout)
+	}
+
+	rec := httptest.NewRecorder()
+	clnt.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	clntout := rec.Body.String()
+	for _, s := range []string{
+		`go9p_clnt_connected{id="` + clnt.Id + `"} 1`,
+		`go9p_clnt_fids{id="` + clnt.Id + `"} 1`,
+		`go9p_clnt_requests_total{id="` + clnt.Id + `",type="Twalk"} 2`,
+	} {
+		if !strings.Contains(clntout, s) {
+			t.Fatalf("client metrics don't contain %q:\n%s", s, clntout)
+		}
+	}
+
+	_ = f.Close()
+	rec = httptest.NewRecorder()
+	clnt.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `go9p_clnt_fids{id="`+clnt.Id+`"} 0`) {
+		t.Fatalf("client metrics after clunk:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+// The Handler type processes the requests of a Srv. Process is called
+// with the decoded request before it is passed to the file server, and
+// Respond with the response, once the request is responded and before
+// the response is sent.
+//
+// The innermost Handler calls the SrvReqProcessOps of the file server,
+// or the (req *SrvReq) Process and PostProcess methods if they are not
+// implemented.
+type Handler interface {
+	Process(req *SrvReq)
+	Respond(req *SrvReq)
+}
+
+// A Middleware wraps a Handler. Its Process method can respond to the
+// request with an error instead of calling next.Process. Its Respond
+// method should always call next.Respond, the inner handlers finalize
+// the request even if they didn't process it. The fid of a Tclunk or
+// Tremove is released whatever the response.
+type Middleware func(next Handler) Handler
+
+// Adds middleware to the server. It should be called before Start. The
+// middleware added first is the outermost, it sees the requests first
+// and the responses last.
+func (srv *Srv) Use(mw ...Middleware) {
+	srv.middleware = append(srv.middleware, mw...)
+}
+
+// The Handler calling the file server operations.
+type opsHandler struct {
+	srv *Srv
+}
+
+func (h opsHandler) Process(req *SrvReq) {
+	if rop, ok := (h.srv.ops).(SrvReqProcessOps); ok {
+		rop.SrvReqProcess(req)
+	} else {
+		req.Process()
+	}
+}
+
+func (h opsHandler) Respond(req *SrvReq) {
+	if rop, ok := (h.srv.ops).(SrvReqProcessOps); ok {
+		rop.SrvReqRespond(req)
+	} else {
+		req.PostProcess()
+	}
+}
+
+// Creates the handler of the server from its middleware.
+func (srv *Srv) buildHandler() {
+	var h Handler = opsHandler{srv}
+	for i := len(srv.middleware) - 1; i >= 0; i-- {
+		h = srv.middleware[i](h)
+	}
+
+	srv.handler = h
+}
+
+// Returns the handler of the server.
+func (srv *Srv) getHandler() Handler {
+	if srv.handler == nil {
+		return opsHandler{srv}
+	}
+
+	return srv.handler
+}
@@ -0,0 +1,89 @@
+package go9p
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// A middleware that records the requests and responses it sees, and
+// denies the requests of type deny.
+type testMiddleware struct {
+	next Handler
+	name string
+	deny uint8
+	mu   *sync.Mutex
+	log  *[]string
+}
+
+func (m *testMiddleware) Process(req *SrvReq) {
+	m.mu.Lock()
+	*m.log = append(*m.log, fmt.Sprintf("%s %s", m.name, MsgName(req.Tc.Type)))
+	m.mu.Unlock()
+	if req.Tc.Type == m.deny {
+		req.RespondError(Eperm)
+		return
+	}
+
+	m.next.Process(req)
+}
+
+func (m *testMiddleware) Respond(req *SrvReq) {
+	m.next.Respond(req)
+	m.mu.Lock()
+	*m.log = append(*m.log, fmt.Sprintf("%s %s", m.name, MsgName(req.Rc.Type)))
+	m.mu.Unlock()
+}
+
+func TestSrvUse(t *testing.T) {
+	var mu sync.Mutex
+	var log []string
+	mw := func(name string, deny uint8) Middleware {
+		return func(next Handler) Handler {
+			return &testMiddleware{next, name, deny, &mu, &log}
+		}
+	}
+
+	fs := newTestRamfs()
+	fs.Use(mw("outer", 0), mw("inner", Tremove))
+	clnt := newRamfsClnt(t, fs)
+	addRamFile(t, fs, nil, "file", "", 0644)
+
+	mu.Lock()
+	log = nil
+	mu.Unlock()
+	if _, err := clnt.FStat("/file"); err != nil {
+		t.Fatalf("FStat error = %v", err)
+	}
+	err := clnt.FRemove("/file")
+	if err == nil || err.Error() != Eperm.Error() {
+		t.Fatalf("FRemove error = %v", err)
+	}
+	if fs.Root.Find("file") == nil {
+		t.Fatalf("denied Tremove removed the file")
+	}
+
+	// the fid of the denied Tremove is clunked, only the root is left
+	fs.Lock()
+	for conn := range fs.conns {
+		conn.Lock()
+		if n := len(conn.fidpool); n != 1 {
+			t.Errorf("%d fids left after the denied Tremove", n)
+		}
+		conn.Unlock()
+	}
+	fs.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"outer Twalk", "inner Twalk", "inner Rwalk", "outer Rwalk",
+		"outer Tstat", "inner Tstat", "inner Rstat", "outer Rstat",
+		"outer Tclunk", "inner Tclunk", "inner Rclunk", "outer Rclunk",
+		"outer Twalk", "inner Twalk", "inner Rwalk", "outer Rwalk",
+		"outer Tremove", "inner Tremove", "inner Rerror", "outer Rerror",
+	}
+	if fmt.Sprint(log) != fmt.Sprint(want) {
+		t.Fatalf("log = %v\nwant %v", log, want)
+	}
+}
@@ -0,0 +1,662 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"path"
+	"strings"
+	"sync"
+)
+
+// Flags for Bind and Mount
+const (
+	MREPL   = 0x0000 // the new tree replaces the old one
+	MBEFORE = 0x0001 // the new tree is searched before the old one
+	MAFTER  = 0x0002 // the new tree is searched after the old one
+	MCREATE = 0x0004 // files can be created in the new tree of a union
+)
+
+var Enotmounted = &Error{"not mounted", EINVAL}
+var Enocreate = &Error{"create prohibited in directory", EPERM}
+var Enoroot = &Error{"nothing mounted on /", ENOENT}
+var Etoomanymounts = &Error{"too many mounts", ENOSPC}
+
+// The Namespace type is a file server that composes the trees of other
+// file servers into a single tree, the way bind and mount do in Plan 9.
+// The file servers are accessed through Clnts, local ones can be
+// connected with net.Pipe. Mount points are kept by path, a mount point
+// with more than one tree is a union directory. The reads of a union
+// directory return the entries of all its trees, the first entry with a
+// given name hides the others.
+//
+// The requests reach the file servers on fids walked from the mounted
+// ones, so they are made as the users that mounted the trees, whatever
+// user attached to the namespace. Only the user that mounted the tree on
+// / can attach, unless AnyUser is set.
+//
+// The Qid paths of the files of each mounted file server are made
+// distinct by storing a device number in their top 8 bits, so at most
+// 256 trees can be mounted.
+type Namespace struct {
+	Srv
+	AnyUser bool // If true, any user of Upool can attach
+
+	mlock  sync.RWMutex
+	mounts nsTable // trees mounted on each path
+	ndev   int     // device number of the next Mount
+}
+
+// The trees mounted on each path. The chans in the mount table are
+// referenced by the table and by the copies of it that are walked.
+type nsTable map[string][]*nsChan
+
+// A file on one of the file servers.
+type nsChan struct {
+	fid    *Fid
+	dev    uint8
+	create bool // MCREATE
+	refs   int  // references to a chan of the mount table, guarded by mlock
+}
+
+type nsFid struct {
+	sync.Mutex
+	path    string    // path in the namespace
+	chans   []*nsChan // more than one for union directories
+	dirents []byte    // directory entries, read at offset 0
+}
+
+// Creates an empty namespace. A tree should be mounted on / before
+// the clients can attach.
+func NewNamespace() *Namespace {
+	ns := new(Namespace)
+	ns.Dotu = true
+	ns.Upool = OsUsers
+	ns.mounts = make(nsTable)
+	return ns
+}
+
+// Mounts the tree rooted at fid on the old path. The fid isn't used by
+// the namespace, it can be clunked after Mount returns.
+func (ns *Namespace) Mount(fid *Fid, old string, flag uint32) error {
+	ns.mlock.Lock()
+	if ns.ndev > 0xFF {
+		ns.mlock.Unlock()
+		return Etoomanymounts
+	}
+
+	dev := uint8(ns.ndev)
+	ns.ndev++
+	ns.mlock.Unlock()
+
+	c, err := nsClone(&nsChan{fid: fid, dev: dev})
+	if err != nil {
+		return err
+	}
+
+	return ns.mount(c, old, flag)
+}
+
+// Makes the file at the new path in the namespace also available at
+// the old path. If new is a union directory, only its first tree is
+// bound.
+func (ns *Namespace) Bind(new, old string, flag uint32) error {
+	m := ns.getMounts()
+	chans, err := m.lookup(nsClean(new))
+	ns.putMounts(m)
+	if err != nil {
+		return err
+	}
+
+	nsClunk(chans[1:])
+	return ns.mount(chans[0], old, flag)
+}
+
+// Removes everything mounted on the old path.
+func (ns *Namespace) Unmount(old string) error {
+	old = nsClean(old)
+	ns.mlock.Lock()
+	chans := ns.mounts[old]
+	delete(ns.mounts, old)
+	ns.mlock.Unlock()
+	if chans == nil {
+		return Enotmounted
+	}
+
+	ns.unref(chans)
+	return nil
+}
+
+func (ns *Namespace) mount(c *nsChan, old string, flag uint32) error {
+	old = nsClean(old)
+	c.create = flag&MCREATE != 0
+	c.refs = 1
+
+	m := ns.getMounts()
+	defer ns.putMounts(m)
+	var chans []*nsChan
+	if _, ok := m["/"]; ok || old != "/" {
+		var err error
+		chans, err = m.lookup(old)
+		if err != nil {
+			nsClunk([]*nsChan{c})
+			return err
+		}
+	}
+
+	union := flag&(MBEFORE|MAFTER) != 0
+	if union && len(chans) > 0 && ((chans[0].fid.Type&QTDIR) == 0 || (c.fid.Type&QTDIR) == 0) {
+		nsClunk(append(chans, c))
+		return Enotdir
+	}
+
+	var replaced []*nsChan
+	ns.mlock.Lock()
+	cur, ok := ns.mounts[old]
+	if !ok && union {
+		// the union starts with the tree that was at old
+		for _, oc := range chans {
+			oc.refs = 1
+		}
+
+		cur, chans = chans, nil
+	}
+
+	switch {
+	case flag&MBEFORE != 0:
+		cur = append([]*nsChan{c}, cur...)
+	case flag&MAFTER != 0:
+		cur = append(append([]*nsChan(nil), cur...), c)
+	default:
+		replaced = cur
+		cur = []*nsChan{c}
+	}
+
+	ns.mounts[old] = cur
+	ns.mlock.Unlock()
+
+	nsClunk(chans)
+	ns.unref(replaced)
+	return nil
+}
+
+// Returns a copy of the mount table, to walk it without holding mlock.
+// Its chans aren't clunked until the copy is released with putMounts.
+func (ns *Namespace) getMounts() nsTable {
+	ns.mlock.Lock()
+	defer ns.mlock.Unlock()
+	m := make(nsTable, len(ns.mounts))
+	for p, chans := range ns.mounts {
+		m[p] = chans
+		for _, c := range chans {
+			c.refs++
+		}
+	}
+
+	return m
+}
+
+func (ns *Namespace) putMounts(m nsTable) {
+	var chans []*nsChan
+	for _, mc := range m {
+		chans = append(chans, mc...)
+	}
+
+	ns.unref(chans)
+}
+
+// Drops a reference to the chans of the mount table, and clunks the ones
+// that aren't referenced anymore.
+func (ns *Namespace) unref(chans []*nsChan) {
+	var unused []*nsChan
+	ns.mlock.Lock()
+	for _, c := range chans {
+		c.refs--
+		if c.refs == 0 {
+			unused = append(unused, c)
+		}
+	}
+	ns.mlock.Unlock()
+
+	nsClunk(unused)
+}
+
+// Walks from the root of the namespace to the file at the path.
+func (m nsTable) lookup(p string) ([]*nsChan, error) {
+	root, ok := m["/"]
+	if !ok {
+		return nil, Enoroot
+	}
+
+	chans, err := nsCloneAll(root)
+	if err != nil || p == "/" {
+		return chans, err
+	}
+
+	// p is clean, so there are no empty names
+	cur := "/"
+	for _, name := range strings.Split(p, "/")[1:] {
+		nchans, npath, err := m.step(chans, cur, name)
+		nsClunk(chans)
+		if err != nil {
+			return nil, err
+		}
+
+		chans, cur = nchans, npath
+	}
+
+	return chans, nil
+}
+
+// Walks one name from the file at the path, returning new chans. A name
+// that is a mount point is replaced by the trees mounted on it.
+func (m nsTable) step(chans []*nsChan, cur, name string) ([]*nsChan, string, error) {
+	npath := path.Join(cur, name)
+	if name == ".." {
+		// lexical, so .. leaves a mount point for the directory it is in
+		chans, err := m.lookup(npath)
+		return chans, npath, err
+	}
+
+	if mc, ok := m[npath]; ok {
+		chans, err := nsCloneAll(mc)
+		return chans, npath, err
+	}
+
+	err := error(Enoent)
+	for _, c := range chans {
+		if (c.fid.Type & QTDIR) == 0 {
+			return nil, "", Enotdir
+		}
+
+		var nc *nsChan
+		if nc, err = nsWalk(c, []string{name}); err == nil {
+			return []*nsChan{nc}, npath, nil
+		}
+	}
+
+	return nil, "", err
+}
+
+// Walks from the file to a new fid on its file server.
+func nsWalk(c *nsChan, wnames []string) (*nsChan, error) {
+	clnt := c.fid.Clnt
+	nfid := clnt.FidAlloc()
+	tc := clnt.NewFcall()
+	if err := PackTwalk(tc, c.fid.Fid, nfid.Fid, wnames); err != nil {
+		clnt.FreeFcall(tc)
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	defer PutFcall(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rc.Wqid) != len(wnames) {
+		return nil, Enoent
+	}
+
+	nfid.walked = true
+	nfid.User = c.fid.User
+	nfid.Qid = c.fid.Qid
+	if len(wnames) > 0 {
+		nfid.Qid = rc.Wqid[len(wnames)-1]
+	}
+
+	return &nsChan{fid: nfid, dev: c.dev, create: c.create}, nil
+}
+
+func nsClone(c *nsChan) (*nsChan, error) { return nsWalk(c, nil) }
+
+func nsCloneAll(chans []*nsChan) ([]*nsChan, error) {
+	nchans := make([]*nsChan, 0, len(chans))
+	for _, c := range chans {
+		nc, err := nsClone(c)
+		if err != nil {
+			nsClunk(nchans)
+			return nil, err
+		}
+
+		nchans = append(nchans, nc)
+	}
+
+	return nchans, nil
+}
+
+func nsClunk(chans []*nsChan) {
+	for _, c := range chans {
+		_ = c.fid.Clnt.Clunk(c.fid)
+	}
+}
+
+// Returns the Qid with the device number in the path.
+func nsQid(q Qid, dev uint8) Qid {
+	q.Path = q.Path&(1<<56-1) | uint64(dev)<<56
+	return q
+}
+
+// Returns true if the user is the one that mounted the tree of the chan.
+func nsMounter(user User, c *nsChan) bool {
+	return user != nil && c.fid.User != nil && user.Id() == c.fid.User.Id()
+}
+
+func (c *nsChan) qid() Qid { return nsQid(c.fid.Qid, c.dev) }
+
+func nsClean(p string) string { return path.Clean("/" + p) }
+
+func (ns *Namespace) FidDestroy(sfid *SrvFid) {
+	if fid, ok := sfid.Aux.(*nsFid); ok {
+		nsClunk(fid.chans)
+	}
+}
+
+func (ns *Namespace) Attach(req *SrvReq) {
+	m := ns.getMounts()
+	defer ns.putMounts(m)
+	if root, ok := m["/"]; ok && !ns.AnyUser && !nsMounter(req.Fid.User, root[0]) {
+		req.RespondError(Eperm)
+		return
+	}
+
+	chans, err := m.lookup("/")
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.Fid.Aux = &nsFid{path: "/", chans: chans}
+	qid := chans[0].qid()
+	req.RespondRattach(&qid)
+}
+
+func (ns *Namespace) Walk(req *SrvReq) {
+	tc := req.Tc
+	fid := req.Fid.Aux.(*nsFid)
+	if len(tc.Wname) == 0 && req.Newfid == req.Fid {
+		req.RespondRwalk(nil)
+		return
+	}
+
+	m := ns.getMounts()
+	defer ns.putMounts(m)
+	chans, cur := fid.chans, fid.path
+	if len(tc.Wname) == 0 {
+		var err error
+		if chans, err = nsCloneAll(chans); err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	var wqids []Qid
+	for i, name := range tc.Wname {
+		nchans, npath, err := m.step(chans, cur, name)
+		if i > 0 {
+			nsClunk(chans)
+		}
+
+		if err != nil {
+			if i == 0 {
+				req.RespondError(err)
+				return
+			}
+
+			req.RespondRwalk(wqids)
+			return
+		}
+
+		chans, cur = nchans, npath
+		wqids = append(wqids, chans[0].qid())
+	}
+
+	if req.Newfid == req.Fid {
+		nsClunk(fid.chans)
+		fid.chans, fid.path = chans, cur
+	} else {
+		req.Newfid.Aux = &nsFid{path: cur, chans: chans}
+	}
+
+	req.RespondRwalk(wqids)
+}
+
+// Returns the iounit to send to the client.
+func nsIounit(req *SrvReq, iounit uint32) uint32 {
+	if max := req.Conn.Msize - IOHDRSZ; iounit > max {
+		iounit = max
+	}
+
+	return iounit
+}
+
+func (ns *Namespace) Open(req *SrvReq) {
+	fid := req.Fid.Aux.(*nsFid)
+	chans := fid.chans
+	union := (req.Fid.Type&QTDIR) != 0 && len(chans) > 1
+	if !union {
+		chans = chans[0:1]
+	} else {
+		// the trees of a union are opened on clones, so the ones
+		// opened before a tree fails to open can be clunked
+		var err error
+		if chans, err = nsCloneAll(chans); err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	for _, c := range chans {
+		if err := c.fid.Clnt.Open(c.fid, req.Tc.Mode); err != nil {
+			if union {
+				nsClunk(chans)
+			}
+
+			req.RespondError(err)
+			return
+		}
+	}
+
+	if union {
+		fid.Lock()
+		nsClunk(fid.chans)
+		fid.chans = chans
+		fid.Unlock()
+	}
+
+	qid := chans[0].qid()
+	req.RespondRopen(&qid, nsIounit(req, chans[0].fid.Iounit))
+}
+
+func (ns *Namespace) Create(req *SrvReq) {
+	tc := req.Tc
+	fid := req.Fid.Aux.(*nsFid)
+
+	// the first tree of a union that allows it
+	c := fid.chans[0]
+	if len(fid.chans) > 1 {
+		c = nil
+		for _, uc := range fid.chans {
+			if uc.create {
+				c = uc
+				break
+			}
+		}
+	}
+
+	if c == nil {
+		req.RespondError(Enocreate)
+		return
+	}
+
+	err := c.fid.Clnt.Create(c.fid, tc.Name, tc.Perm, tc.Mode, tc.Ext)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	// the fid is now the new file
+	for _, uc := range fid.chans {
+		if uc != c {
+			nsClunk([]*nsChan{uc})
+		}
+	}
+
+	fid.chans = []*nsChan{c}
+	fid.path = path.Join(fid.path, tc.Name)
+	qid := c.qid()
+	req.RespondRcreate(&qid, nsIounit(req, c.fid.Iounit))
+}
+
+func (ns *Namespace) Read(req *SrvReq) {
+	tc := req.Tc
+	fid := req.Fid.Aux.(*nsFid)
+	if (req.Fid.Type & QTDIR) != 0 {
+		ns.readDir(req, fid)
+		return
+	}
+
+	c := fid.chans[0]
+	data, err := c.fid.Clnt.Read(c.fid, tc.Offset, tc.Count)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRread(data)
+}
+
+// Reads the directory. At offset 0 the entries of all trees of the
+// directory are read and converted to the dialect of the client.
+func (ns *Namespace) readDir(req *SrvReq, fid *nsFid) {
+	tc := req.Tc
+	fid.Lock()
+	defer fid.Unlock()
+	if tc.Offset == 0 {
+		dirents, err := ns.dirents(req, fid)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+
+		fid.dirents = dirents
+	}
+
+	n := direntsCount(fid.dirents, tc.Offset, tc.Count)
+	if n == 0 && tc.Offset < uint64(len(fid.dirents)) {
+		req.RespondError(&Error{"too small read size for dir entry", EINVAL})
+		return
+	}
+
+	var data []byte
+	if n > 0 {
+		data = fid.dirents[tc.Offset : int(tc.Offset)+n]
+	}
+
+	req.RespondRread(data)
+}
+
+func (ns *Namespace) dirents(req *SrvReq, fid *nsFid) ([]byte, error) {
+	var dirents []byte
+	seen := make(map[string]bool)
+	for _, c := range fid.chans {
+		clnt := c.fid.Clnt
+		for offset := uint64(0); ; {
+			buf, err := clnt.Read(c.fid, offset, clnt.Msize-IOHDRSZ)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(buf) == 0 {
+				break
+			}
+
+			offset += uint64(len(buf))
+			for len(buf) > 0 {
+				d, rest, _, err := UnpackDir(buf, clnt.Dotu)
+				if err != nil {
+					return nil, err
+				}
+
+				buf = rest
+				if seen[d.Name] {
+					continue
+				}
+
+				seen[d.Name] = true
+				d.Qid = nsQid(d.Qid, c.dev)
+				dirents = append(dirents, PackDir(d, req.Conn.Dotu)...)
+			}
+		}
+	}
+
+	return dirents, nil
+}
+
+func (ns *Namespace) Write(req *SrvReq) {
+	tc := req.Tc
+	c := req.Fid.Aux.(*nsFid).chans[0]
+	n, err := c.fid.Clnt.Write(c.fid, tc.Data, tc.Offset)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRwrite(uint32(n))
+}
+
+func (ns *Namespace) Clunk(req *SrvReq) { req.RespondRclunk() }
+
+func (ns *Namespace) Remove(req *SrvReq) {
+	fid := req.Fid.Aux.(*nsFid)
+	c := fid.chans[0]
+	err := c.fid.Clnt.Remove(c.fid)
+
+	// Tremove clunks the fid even if it fails
+	fid.chans = fid.chans[1:]
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRremove()
+}
+
+func (ns *Namespace) Stat(req *SrvReq) {
+	fid := req.Fid.Aux.(*nsFid)
+	c := fid.chans[0]
+	d, err := c.fid.Clnt.Stat(c.fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	// a mounted tree has the name of its mount point
+	d.Qid = c.qid()
+	ns.mlock.RLock()
+	if _, ok := ns.mounts[fid.path]; ok && fid.path != "/" {
+		d.Name = path.Base(fid.path)
+	}
+	ns.mlock.RUnlock()
+
+	req.RespondRstat(d)
+}
+
+func (ns *Namespace) Wstat(req *SrvReq) {
+	d := &req.Tc.Dir
+	fid := req.Fid.Aux.(*nsFid)
+	c := fid.chans[0]
+	if err := c.fid.Clnt.Wstat(c.fid, d); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if d.Name != "" && fid.path != "/" {
+		fid.Lock()
+		fid.path = path.Join(path.Dir(fid.path), d.Name)
+		fid.Unlock()
+	}
+
+	req.RespondRwstat()
+}
@@ -0,0 +1,360 @@
+package go9p
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Adds a file, or a directory if mode has DMDIR, to the Ramfs.
+func addRamFile(t *testing.T, fs *Ramfs, dir *srvFile, name, data string, mode uint32) *srvFile {
+	t.Helper()
+	if dir == nil {
+		dir = fs.Root
+	}
+
+	f := &ramFile{fs: fs, data: []byte(data)}
+	if err := f.Add(dir, name, OsUsers.Uid2User(0), nil, mode, f); err != nil {
+		t.Fatalf("Add(%s) error = %v", name, err)
+	}
+	f.Length = uint64(len(data))
+	return &f.srvFile
+}
+
+// Returns the root of the started Ramfs, attached through a Clnt.
+func attachRamfs(t *testing.T, fs *Ramfs) *Fid {
+	t.Helper()
+	fs.Dotu = true
+	fs.Start(fs)
+	return mountPipe(t, fs).Root
+}
+
+// Starts the namespace and mounts it.
+func mountNamespace(t *testing.T, ns *Namespace) *Clnt {
+	t.Helper()
+	ns.Start(ns)
+	return mountPipe(t, ns)
+}
+
+func readDirNames(t *testing.T, clnt *Clnt, path string) []string {
+	t.Helper()
+	f, err := clnt.FOpen(path, OREAD)
+	if err != nil {
+		t.Fatalf("FOpen(%s) error = %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	dirs, err := f.Readdir(0)
+	if err != nil {
+		t.Fatalf("Readdir(%s) error = %v", path, err)
+	}
+
+	var names []string
+	for _, d := range dirs {
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func walkQids(t *testing.T, clnt *Clnt, names ...string) []Qid {
+	t.Helper()
+	fid := clnt.FidAlloc()
+	qids, err := clnt.Walk(clnt.Root, fid, names)
+	if err != nil {
+		t.Fatalf("Walk(%v) error = %v", names, err)
+	}
+	_ = clnt.Clunk(fid)
+	return qids
+}
+
+func TestNamespaceMount(t *testing.T) {
+	a := newTestRamfs()
+	addRamFile(t, a, nil, "b", "", DMDIR|0777)
+	b := newTestRamfs()
+	addRamFile(t, b, nil, "x", "in b", 0644)
+
+	ns := NewNamespace()
+	if err := ns.Mount(attachRamfs(t, a), "/", MREPL); err != nil {
+		t.Fatalf("Mount(/) error = %v", err)
+	}
+	if err := ns.Mount(attachRamfs(t, b), "/b", MREPL); err != nil {
+		t.Fatalf("Mount(/b) error = %v", err)
+	}
+	if err := ns.Mount(attachRamfs(t, b), "/missing", MREPL); err == nil {
+		t.Fatalf("Mount on a missing file succeeded")
+	}
+
+	clnt := mountNamespace(t, ns)
+	if got := readFile(t, clnt, "/b/x"); got != "in b" {
+		t.Fatalf("/b/x = %q", got)
+	}
+
+	// the mount point has the Qid of the mounted root, .. leaves it
+	qids := walkQids(t, clnt, "b", "x", "..", "..")
+	if qids[0].Path>>56 != 1 || qids[0].Path&0xffffff != b.Root.Qid.Path {
+		t.Fatalf("qid of /b = %v", qids[0])
+	}
+	if qids[1].Path>>56 != 1 {
+		t.Fatalf("qid of /b/x = %v", qids[1])
+	}
+	if qids[2] != qids[0] {
+		t.Fatalf("qid of /b/x/.. = %v, want %v", qids[2], qids[0])
+	}
+	if qids[3] != clnt.Root.Qid || qids[3].Path>>56 != 0 {
+		t.Fatalf("qid of /b/x/../.. = %v, want %v", qids[3], clnt.Root.Qid)
+	}
+
+	st, err := clnt.FStat("/b")
+	if err != nil {
+		t.Fatalf("FStat(/b) error = %v", err)
+	}
+	if st.Name != "b" || st.Qid != qids[0] {
+		t.Fatalf("FStat(/b) = %v", st)
+	}
+
+	if err := ns.Unmount("/b"); err != nil {
+		t.Fatalf("Unmount error = %v", err)
+	}
+	if _, err := clnt.FStat("/b/x"); err == nil {
+		t.Fatalf("FStat(/b/x) after Unmount succeeded")
+	}
+	if err := ns.Unmount("/b"); err != Enotmounted {
+		t.Fatalf("second Unmount error = %v", err)
+	}
+}
+
+func TestNamespaceUnion(t *testing.T) {
+	tests := []struct {
+		flag   uint32
+		dup    string // content of the file in both trees
+		create bool   // create in the new tree
+	}{
+		{MBEFORE, "new", false},
+		{MBEFORE | MCREATE, "new", true},
+		{MAFTER, "old", false},
+		{MAFTER | MCREATE, "old", true},
+	}
+
+	for _, tt := range tests {
+		a := newTestRamfs()
+		u := addRamFile(t, a, nil, "u", "", DMDIR|0777)
+		addRamFile(t, a, u, "1", "", 0644)
+		addRamFile(t, a, u, "dup", "old", 0644)
+		b := newTestRamfs()
+		addRamFile(t, b, nil, "2", "", 0644)
+		addRamFile(t, b, nil, "dup", "new", 0644)
+
+		ns := NewNamespace()
+		if err := ns.Mount(attachRamfs(t, a), "/", MREPL); err != nil {
+			t.Fatalf("Mount(/) error = %v", err)
+		}
+		if err := ns.Mount(attachRamfs(t, b), "/u", tt.flag); err != nil {
+			t.Fatalf("Mount(/u) error = %v", err)
+		}
+
+		clnt := mountNamespace(t, ns)
+		names := readDirNames(t, clnt, "/u")
+		if len(names) != 3 || names[0] != "1" || names[1] != "2" || names[2] != "dup" {
+			t.Fatalf("flag %#x: entries = %v", tt.flag, names)
+		}
+		if got := readFile(t, clnt, "/u/dup"); got != tt.dup {
+			t.Fatalf("flag %#x: /u/dup = %q, want %q", tt.flag, got, tt.dup)
+		}
+
+		f, err := clnt.FCreate("/u/created", 0644, OWRITE)
+		if !tt.create {
+			if err == nil {
+				t.Fatalf("flag %#x: create in a union without MCREATE succeeded", tt.flag)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("flag %#x: FCreate error = %v", tt.flag, err)
+		}
+		_ = f.Close()
+		if b.Root.Find("created") == nil || u.Find("created") != nil {
+			t.Fatalf("flag %#x: file not created in the new tree", tt.flag)
+		}
+	}
+}
+
+func TestNamespaceBind(t *testing.T) {
+	a := newTestRamfs()
+	d := addRamFile(t, a, nil, "d", "", DMDIR|0777)
+	addRamFile(t, a, d, "f", "in d", 0644)
+	addRamFile(t, a, nil, "e", "", DMDIR|0777)
+
+	ns := NewNamespace()
+	if err := ns.Mount(attachRamfs(t, a), "/", MREPL); err != nil {
+		t.Fatalf("Mount(/) error = %v", err)
+	}
+	if err := ns.Bind("/d", "/e", MREPL); err != nil {
+		t.Fatalf("Bind error = %v", err)
+	}
+	if err := ns.Bind("/d/f", "/e", MAFTER); err != Enotdir {
+		t.Fatalf("union Bind of a file error = %v", err)
+	}
+
+	clnt := mountNamespace(t, ns)
+	if got := readFile(t, clnt, "/e/f"); got != "in d" {
+		t.Fatalf("/e/f = %q", got)
+	}
+
+	// the bound directory is the same file
+	qids := walkQids(t, clnt, "e", "..", "d")
+	if qids[2] != qids[0] {
+		t.Fatalf("qid of /d = %v, want %v", qids[2], qids[0])
+	}
+}
+
+func TestNamespaceUsers(t *testing.T) {
+	ns := NewNamespace()
+	if err := ns.Mount(attachRamfs(t, newTestRamfs()), "/", MREPL); err != nil {
+		t.Fatalf("Mount(/) error = %v", err)
+	}
+	ns.Start(ns)
+
+	// the upstream fids belong to the user that mounted them
+	attach := func() error {
+		c1, c2 := net.Pipe()
+		ns.NewConn(c1)
+		clnt, err := MountConn(c2, "", 8192, OsUsers.Uid2User(1))
+		if err == nil {
+			clnt.Unmount()
+		}
+		return err
+	}
+	if err := attach(); err == nil || err.Error() != Eperm.Error() {
+		t.Fatalf("attach as another user error = %v", err)
+	}
+
+	ns.AnyUser = true
+	if err := attach(); err != nil {
+		t.Fatalf("attach with AnyUser error = %v", err)
+	}
+}
+
+func TestNamespaceMountLimit(t *testing.T) {
+	ns := NewNamespace()
+	root := attachRamfs(t, newTestRamfs())
+	ns.ndev = 0xFF
+	if err := ns.Mount(root, "/", MREPL); err != nil {
+		t.Fatalf("Mount(/) error = %v", err)
+	}
+	if err := ns.Mount(root, "/", MREPL); err != Etoomanymounts {
+		t.Fatalf("Mount of device 256 error = %v", err)
+	}
+}
+
+func TestNamespaceOpenUnion(t *testing.T) {
+	a := newTestRamfs()
+	addRamFile(t, a, nil, "u", "", DMDIR|0777)
+	b := newTestRamfs()
+	var mu sync.Mutex
+	var log []string
+	b.Use(func(next Handler) Handler {
+		return &testMiddleware{next, "b", Topen, &mu, &log}
+	})
+
+	ns := NewNamespace()
+	if err := ns.Mount(attachRamfs(t, a), "/", MREPL); err != nil {
+		t.Fatalf("Mount(/) error = %v", err)
+	}
+	if err := ns.Mount(attachRamfs(t, b), "/u", MAFTER); err != nil {
+		t.Fatalf("Mount(/u) error = %v", err)
+	}
+
+	clnt := mountNamespace(t, ns)
+	if _, err := clnt.FOpen("/u", OREAD); err == nil || err.Error() != Eperm.Error() {
+		t.Fatalf("FOpen(/u) error = %v", err)
+	}
+
+	// the tree opened before the one that failed isn't left open
+	for _, cs := range a.stats("").Conns {
+		for _, fs := range cs.Fids {
+			if fs.Omode != "" {
+				t.Fatalf("fid %d of the first tree left open", fs.Fid)
+			}
+		}
+	}
+}
+
+// A middleware that blocks the Twalks while block is set, until release
+// is closed.
+type blockWalks struct {
+	next    Handler
+	block   *bool
+	mu      *sync.Mutex
+	entered chan bool
+	release chan bool
+}
+
+func (m *blockWalks) Process(req *SrvReq) {
+	m.mu.Lock()
+	block := *m.block
+	m.mu.Unlock()
+	if block && req.Tc.Type == Twalk {
+		m.entered <- true
+		<-m.release
+	}
+
+	m.next.Process(req)
+}
+
+func (m *blockWalks) Respond(req *SrvReq) { m.next.Respond(req) }
+
+func TestNamespaceWalkUnmount(t *testing.T) {
+	a := newTestRamfs()
+	addRamFile(t, a, nil, "b", "", DMDIR|0777)
+	b := newTestRamfs()
+	addRamFile(t, b, nil, "x", "in b", 0644)
+	var mu sync.Mutex
+	block := false
+	entered, release := make(chan bool, 1), make(chan bool)
+	b.Use(func(next Handler) Handler {
+		return &blockWalks{next, &block, &mu, entered, release}
+	})
+
+	ns := NewNamespace()
+	if err := ns.Mount(attachRamfs(t, a), "/", MREPL); err != nil {
+		t.Fatalf("Mount(/) error = %v", err)
+	}
+	if err := ns.Mount(attachRamfs(t, b), "/b", MREPL); err != nil {
+		t.Fatalf("Mount(/b) error = %v", err)
+	}
+
+	clnt := mountNamespace(t, ns)
+	mu.Lock()
+	block = true
+	mu.Unlock()
+	walked := make(chan error, 1)
+	go func() {
+		fid := clnt.FidAlloc()
+		_, err := clnt.Walk(clnt.Root, fid, []string{"b", "x"})
+		walked <- err
+	}()
+	<-entered
+	mu.Lock()
+	block = false
+	mu.Unlock()
+
+	// the mounts can change while a walk waits for a file server
+	unmounted := make(chan error, 1)
+	go func() { unmounted <- ns.Unmount("/b") }()
+	select {
+	case err := <-unmounted:
+		if err != nil {
+			t.Fatalf("Unmount error = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Unmount blocked by a walk in progress")
+	}
+
+	close(release)
+	if err := <-walked; err != nil {
+		t.Fatalf("Walk error = %v", err)
+	}
+}
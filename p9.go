@@ -9,7 +9,8 @@
 package go9p
 
 import (
-	"fmt"
+	"math/bits"
+	"sync"
 )
 
 // 9P2000 message types
@@ -46,9 +47,10 @@ const (
 )
 
 const (
-	MSIZE   = 1048576 + IOHDRSZ // default message size (1048576+IOHdrSz)
-	IOHDRSZ = 24                // the non-data size of the Twrite messages
-	PORT    = 564               // default port for 9P file servers
+	MSIZE    = 1048576 + IOHDRSZ // default message size (1048576+IOHdrSz)
+	IOHDRSZ  = 24                // the non-data size of the Twrite messages
+	PORT     = 564               // default port for 9P file servers
+	MAXWELEM = 16                // maximum number of names in Twalk and qids in Rwalk
 )
 
 // Qid types
@@ -103,12 +105,19 @@ const (
 
 // Error values
 const (
-	EPERM   = 1
-	ENOENT  = 2
-	EIO     = 5
-	EEXIST  = 17
-	ENOTDIR = 20
-	EINVAL  = 22
+	EPERM     = 1
+	ENOENT    = 2
+	EINTR     = 4
+	EIO       = 5
+	EEXIST    = 17
+	ENOTDIR   = 20
+	EINVAL    = 22
+	EMFILE    = 24
+	EFBIG     = 27
+	ENOSPC    = 28
+	EPIPE     = 32
+	EUSERS    = 87
+	ETIMEDOUT = 110
 )
 
 // Error represents a 9P2000 (and 9P2000.u) error
@@ -117,6 +126,16 @@ type Error struct {
 	Errornum uint32 // numeric representation of the error (9P2000.u)
 }
 
+// Errors returned for messages that can't be packed or unpacked.
+var (
+	Eshortmsg     error = &Error{"buffer too short", EINVAL}
+	Ebadmsgsize   error = &Error{"invalid size", EINVAL}
+	Ebadmsgtype   error = &Error{"invalid message type", EINVAL}
+	Ebadstat      error = &Error{"invalid stat", EINVAL}
+	Etoomanywelem error = &Error{"too many names in walk", EINVAL}
+	Estrtoolong   error = &Error{"string too long", EINVAL}
+)
+
 // File identifier
 type Qid struct {
 	Type    uint8  // type of the file (high 8 bits of the mode)
@@ -271,6 +290,7 @@ var minFcusize = [...]uint32{
 	4,  /* Tstat fid[4] */
 	4,  /* Rstat stat[n] */
 	8,  /* Twstat fid[4] stat[n] */
+	0,  /* Rwstat */
 	20, /* Tbread fileid[8] offset[8] count[4] */
 	4,  /* Rbread count[4] */
 	20, /* Tbwrite fileid[8] offset[8] count[4] */
@@ -279,13 +299,31 @@ var minFcusize = [...]uint32{
 	0,  /* Rbtrunc */
 }
 
-func gint8(buf []byte) (uint8, []byte) { return buf[0], buf[1:] }
+// The g* functions decode a value from the beginning of buf, and return
+// it together with the rest of the buffer. If buf is too short, they
+// return nil instead of the rest, and so do all subsequent calls on it,
+// so the callers have to check for nil only after the last one.
+func gint8(buf []byte) (uint8, []byte) {
+	if len(buf) < 1 {
+		return 0, nil
+	}
+
+	return buf[0], buf[1:]
+}
 
 func gint16(buf []byte) (uint16, []byte) {
+	if len(buf) < 2 {
+		return 0, nil
+	}
+
 	return uint16(buf[0]) | (uint16(buf[1]) << 8), buf[2:]
 }
 
 func gint32(buf []byte) (uint32, []byte) {
+	if len(buf) < 4 {
+		return 0, nil
+	}
+
 	return uint32(buf[0]) | (uint32(buf[1]) << 8) | (uint32(buf[2]) << 16) |
 			(uint32(buf[3]) << 24),
 		buf[4:]
@@ -294,6 +332,10 @@ func gint32(buf []byte) (uint32, []byte) {
 func Gint32(buf []byte) (uint32, []byte) { return gint32(buf) }
 
 func gint64(buf []byte) (uint64, []byte) {
+	if len(buf) < 8 {
+		return 0, nil
+	}
+
 	return uint64(buf[0]) | (uint64(buf[1]) << 8) | (uint64(buf[2]) << 16) |
 			(uint64(buf[3]) << 24) | (uint64(buf[4]) << 32) | (uint64(buf[5]) << 40) |
 			(uint64(buf[6]) << 48) | (uint64(buf[7]) << 56),
@@ -303,12 +345,7 @@ func gint64(buf []byte) (uint64, []byte) {
 func gstr(buf []byte) (string, []byte) {
 	var n uint16
 
-	if len(buf) < 2 {
-		return "", nil
-	}
-
 	n, buf = gint16(buf)
-
 	if int(n) > len(buf) {
 		return "", nil
 	}
@@ -324,9 +361,17 @@ func gqid(buf []byte, qid *Qid) []byte {
 	return buf
 }
 
+// Decodes a stat from buf. The stat is decoded only from the size[2]
+// bytes that follow its size, the bytes left after its fields (if any)
+// are skipped. Returns the rest of the buffer.
 func gstat(buf []byte, d *Dir, dotu bool) ([]byte, error) {
-	sz := len(buf)
 	d.Size, buf = gint16(buf)
+	if buf == nil || int(d.Size) > len(buf) {
+		return nil, Eshortmsg
+	}
+
+	rest := buf[d.Size:]
+	buf = buf[0:d.Size]
 	d.Type, buf = gint16(buf)
 	d.Dev, buf = gint32(buf)
 	buf = gqid(buf, &d.Qid)
@@ -335,32 +380,11 @@ func gstat(buf []byte, d *Dir, dotu bool) ([]byte, error) {
 	d.Mtime, buf = gint32(buf)
 	d.Length, buf = gint64(buf)
 	d.Name, buf = gstr(buf)
-	if buf == nil {
-		s := fmt.Sprintf("Buffer too short for basic 9p: need %d, have %d",
-			49, sz)
-		return nil, &Error{s, EINVAL}
-	}
-
 	d.Uid, buf = gstr(buf)
-	if buf == nil {
-		return nil, &Error{"d.Uid failed", EINVAL}
-	}
 	d.Gid, buf = gstr(buf)
-	if buf == nil {
-		return nil, &Error{"d.Gid failed", EINVAL}
-	}
-
 	d.Muid, buf = gstr(buf)
-	if buf == nil {
-		return nil, &Error{"d.Muid failed", EINVAL}
-	}
-
 	if dotu {
 		d.Ext, buf = gstr(buf)
-		if buf == nil {
-			return nil, &Error{"d.Ext failed", EINVAL}
-		}
-
 		d.Uidnum, buf = gint32(buf)
 		d.Gidnum, buf = gint32(buf)
 		d.Muidnum, buf = gint32(buf)
@@ -370,7 +394,22 @@ func gstat(buf []byte, d *Dir, dotu bool) ([]byte, error) {
 		d.Muidnum = NOUID
 	}
 
-	return buf, nil
+	if buf == nil {
+		return nil, Ebadstat
+	}
+
+	return rest, nil
+}
+
+// Returns an error if any of the strings is too long to be packed.
+func checkStrs(strs ...string) error {
+	for _, s := range strs {
+		if len(s) > 0xFFFF {
+			return Estrtoolong
+		}
+	}
+
+	return nil
 }
 
 func pint8(val uint8, buf []byte) []byte {
@@ -466,19 +505,6 @@ func PackDir(d *Dir, dotu bool) []byte {
 // Returns an error if the conversion is impossible, otherwise
 // a pointer to a Stat value.
 func UnpackDir(buf []byte, dotu bool) (d *Dir, b []byte, amt int, err error) {
-	sz := 2 + 2 + 4 + 13 + 4 + /* size[2] type[2] dev[4] qid[13] mode[4] */
-		4 + 4 + 8 + /* atime[4] mtime[4] length[8] */
-		2 + 2 + 2 + 2 /* name[s] uid[s] gid[s] muid[s] */
-
-	if dotu {
-		sz += 2 + 4 + 4 + 4 /* extension[s] n_uid[4] n_gid[4] n_muid[4] */
-	}
-
-	if len(buf) < sz {
-		s := fmt.Sprintf("short buffer: Need %d and have %v", sz, len(buf))
-		return nil, nil, 0, &Error{s, EINVAL}
-	}
-
 	d = new(Dir)
 	b, err = gstat(buf, d, dotu)
 	if err != nil {
@@ -486,7 +512,6 @@ func UnpackDir(buf []byte, dotu bool) (d *Dir, b []byte, amt int, err error) {
 	}
 
 	return d, b, len(buf) - len(b), nil
-
 }
 
 // Allocates a new Fcall.
@@ -497,6 +522,59 @@ func NewFcall(sz uint32) *Fcall {
 	return fc
 }
 
+// Pools of Fcalls, by buffer size. The buffers of the Fcalls in
+// fcallPools[n] have capacity 1<<n.
+var fcallPools [32]sync.Pool
+
+// Returns a Fcall with a buffer of sz bytes. The Fcall is taken from a
+// pool if possible, and should be returned to it by calling PutFcall
+// once it isn't used anymore.
+func GetFcall(sz uint32) *Fcall {
+	n := bits.Len32(sz - 1)
+	if sz == 0 || n >= len(fcallPools) {
+		return NewFcall(sz)
+	}
+
+	if fc, ok := fcallPools[n].Get().(*Fcall); ok {
+		fc.Buf = fc.Buf[0:sz]
+		return fc
+	}
+
+	fc := new(Fcall)
+	fc.Buf = make([]byte, sz, 1<<n)
+	return fc
+}
+
+// Returns a Fcall allocated by GetFcall to the pool. Neither the Fcall,
+// nor any slice pointing to its buffer, may be used after that. Fcalls
+// not allocated by GetFcall, and nil, are ignored.
+func PutFcall(fc *Fcall) {
+	if fc == nil {
+		return
+	}
+
+	c := cap(fc.Buf)
+	if c == 0 || c&(c-1) != 0 {
+		return
+	}
+
+	*fc = Fcall{Buf: fc.Buf[0:c], Wname: fc.Wname[:0], Wqid: fc.Wqid[:0]}
+	fcallPools[bits.Len32(uint32(c)-1)].Put(fc)
+}
+
+// Returns a copy of the Fcall that doesn't share any memory with it,
+// without the raw packet.
+func (fc *Fcall) clone() *Fcall {
+	f := new(Fcall)
+	*f = *fc
+	f.Buf = nil
+	f.Pkt = nil
+	f.Data = append([]byte(nil), fc.Data...)
+	f.Wname = append([]string(nil), fc.Wname...)
+	f.Wqid = append([]Qid(nil), fc.Wqid...)
+	return f
+}
+
 // Sets the tag of a Fcall.
 func SetTag(fc *Fcall, tag uint16) {
 	fc.Tag = tag
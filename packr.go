@@ -4,10 +4,12 @@
 
 package go9p
 
-import "fmt"
-
 // Create a Rversion message in the specified Fcall.
 func PackRversion(fc *Fcall, msize uint32, version string) error {
+	if err := checkStrs(version); err != nil {
+		return err
+	}
+
 	size := 4 + 2 + len(version) /* msize[4] version[s] */
 	p, err := packCommon(fc, size, Rversion)
 	if err != nil {
@@ -37,14 +39,11 @@ func PackRauth(fc *Fcall, aqid *Qid) error {
 
 // Create a Rerror message in the specified Fcall. If dotu is true,
 // the function will create a 9P2000.u message. If false, errornum is
-// ignored.
-// The Akaros global is hurl-inducing but this whole blob of code
-// needs a redo. dotu is even worse, since it bakes in ONE PARTICULAR
-// EXTENSION ...
-
+// ignored. The error is packed as is, see ProtocolOptions for
+// the error formats used by some clients.
 func PackRerror(fc *Fcall, error string, errornum uint32, dotu bool) error {
-	if *Akaros {
-		error = fmt.Sprintf("%04X %v", errornum, error)
+	if err := checkStrs(error); err != nil {
+		return err
 	}
 
 	size := 2 + len(error) /* ename[s] */
@@ -89,6 +88,10 @@ func PackRattach(fc *Fcall, aqid *Qid) error {
 
 // Create a Rwalk message in the specified Fcall.
 func PackRwalk(fc *Fcall, wqids []Qid) error {
+	if len(wqids) > MAXWELEM {
+		return Etoomanywelem
+	}
+
 	nwqid := len(wqids)
 	size := 2 + nwqid*13 /* nwqid[2] nwname*wqid[13] */
 	p, err := packCommon(fc, size, Rwalk)
@@ -167,6 +170,27 @@ func SetRreadCount(fc *Fcall, count uint32) {
 	fc.Size = size
 }
 
+// Creates the header of a Rread message with count bytes of data in the
+// specified Fcall. The data is not part of fc.Pkt, and has to be sent
+// right after it.
+func packRreadHeader(fc *Fcall, count uint32) error {
+	size := 4 + 1 + 2 + 4 + count /* size[4] id[1] tag[2] count[4] data[count] */
+	if len(fc.Buf) < int(size) {
+		return &Error{"buffer too small", EINVAL}
+	}
+
+	if err := InitRread(fc, 0); err != nil {
+		return err
+	}
+
+	pint32(size, fc.Pkt)
+	pint32(count, fc.Pkt[7:])
+	fc.Size = size
+	fc.Count = count
+	fc.Data = nil
+	return nil
+}
+
 // Create a Rread message in the specified Fcall.
 func PackRread(fc *Fcall, data []byte) error {
 	count := uint32(len(data))
@@ -210,6 +234,10 @@ func PackRremove(fc *Fcall) error {
 // ignored.
 func PackRstat(fc *Fcall, d *Dir, dotu bool) error {
 	stsz := statsz(d, dotu)
+	if stsz > 0xFFFF {
+		return Ebadstat
+	}
+
 	size := 2 + stsz /* stat[n] */
 	p, err := packCommon(fc, size, Rstat)
 	if err != nil {
@@ -130,14 +130,9 @@ func TestPackRsimpleOps(t *testing.T) {
 }
 
 func TestPackRerrorAkaros(t *testing.T) {
-	previous := *Akaros
-	*Akaros = true
-	t.Cleanup(func() {
-		*Akaros = previous
-	})
-
+	opts := AkarosOptions
 	fc := NewFcall(128)
-	err := PackRerror(fc, "boom", 1, true)
+	err := PackRerror(fc, opts.ename("boom", 1), 1, true)
 	if err != nil {
 		t.Fatalf("PackRerror() error = %v", err)
 	}
@@ -147,4 +142,13 @@ func TestPackRerrorAkaros(t *testing.T) {
 	if !strings.HasPrefix(fc.Error, "0001 ") {
 		t.Fatalf("PackRerror() error = %q", fc.Error)
 	}
+
+	// the standard protocol doesn't touch the message
+	fc = NewFcall(128)
+	if err := PackRerror(fc, new(ProtocolOptions).ename("boom", 1), 1, true); err != nil {
+		t.Fatalf("PackRerror() error = %v", err)
+	}
+	if fc.Error != "boom" {
+		t.Fatalf("PackRerror() error = %q", fc.Error)
+	}
 }
@@ -6,6 +6,10 @@ package go9p
 
 // Create a Tversion message in the specified Fcall.
 func PackTversion(fc *Fcall, msize uint32, version string) error {
+	if err := checkStrs(version); err != nil {
+		return err
+	}
+
 	size := 4 + 2 + len(version) /* msize[4] version[s] */
 	p, err := packCommon(fc, size, Tversion)
 	if err != nil {
@@ -22,6 +26,10 @@ func PackTversion(fc *Fcall, msize uint32, version string) error {
 
 // Create a Tauth message in the specified Fcall.
 func PackTauth(fc *Fcall, fid uint32, uname string, aname string, unamenum uint32, dotu bool) error {
+	if err := checkStrs(uname, aname); err != nil {
+		return err
+	}
+
 	size := 4 + 2 + 2 + len(uname) + len(aname) /* fid[4] uname[s] aname[s] */
 	if dotu {
 		size += 4 /* n_uname[4] */
@@ -62,6 +70,10 @@ func PackTflush(fc *Fcall, oldtag uint16) error {
 // the function will create 9P2000.u including the nuname value, otherwise
 // nuname is ignored.
 func PackTattach(fc *Fcall, fid uint32, afid uint32, uname string, aname string, unamenum uint32, dotu bool) error {
+	if err := checkStrs(uname, aname); err != nil {
+		return err
+	}
+
 	size := 4 + 4 + 2 + len(uname) + 2 + len(aname) /* fid[4] afid[4] uname[s] aname[s] */
 	if dotu {
 		size += 4
@@ -90,6 +102,14 @@ func PackTattach(fc *Fcall, fid uint32, afid uint32, uname string, aname string,
 
 // Create a Twalk message in the specified Fcall.
 func PackTwalk(fc *Fcall, fid uint32, newfid uint32, wnames []string) error {
+	if len(wnames) > MAXWELEM {
+		return Etoomanywelem
+	}
+
+	if err := checkStrs(wnames...); err != nil {
+		return err
+	}
+
 	nwname := len(wnames)
 	size := 4 + 4 + 2 + nwname*2 /* fid[4] newfid[4] nwname[2] nwname*wname[s] */
 	for i := 0; i < nwname; i++ {
@@ -134,6 +154,10 @@ func PackTopen(fc *Fcall, fid uint32, mode uint8) error {
 // the function will create a 9P2000.u message that includes ext.
 // Otherwise the ext value is ignored.
 func PackTcreate(fc *Fcall, fid uint32, name string, perm uint32, mode uint8, ext string, dotu bool) error {
+	if err := checkStrs(name, ext); err != nil {
+		return err
+	}
+
 	size := 4 + 2 + len(name) + 4 + 1 /* fid[4] name[s] perm[4] mode[1] */
 
 	if dotu {
@@ -240,6 +264,10 @@ func PackTstat(fc *Fcall, fid uint32) error {
 // specific fields from the Stat value will be ignored.
 func PackTwstat(fc *Fcall, fid uint32, d *Dir, dotu bool) error {
 	stsz := statsz(d, dotu)
+	if stsz > 0xFFFF {
+		return Ebadstat
+	}
+
 	size := 4 + 2 + stsz /* fid[4] stat[n] */
 	p, err := packCommon(fc, size, Twstat)
 	if err != nil {
@@ -0,0 +1,62 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// The ProtocolOptions type describes the deviations from the standard
+// 9P2000 (and 9P2000.u) protocol spoken by some clients and servers.
+// The zero value is the standard protocol.
+//
+// Srv.Options is copied to each new Conn, so a file server can select
+// a different dialect per connection, for example in ConnOpened.
+type ProtocolOptions struct {
+	// Error messages are prefixed with the error number as four
+	// hexadecimal digits ("%04X message").
+	AkarosErrors bool
+
+	// Directory reads may return partial directory entries. If
+	// false, reads return whole entries only, and fail if count is
+	// too small for the next entry.
+	SplitDirents bool
+
+	// The target of a symbolic link is returned in Muid, and the
+	// mode has DMSYMLINK set. Used only if 9P2000.u is not spoken.
+	SymlinkMuid bool
+}
+
+// The options used by Akaros clients.
+var AkarosOptions = ProtocolOptions{
+	AkarosErrors: true,
+	SplitDirents: true,
+	SymlinkMuid:  true,
+}
+
+// Returns the error message as sent on the wire.
+func (o *ProtocolOptions) ename(ename string, errornum uint32) string {
+	if o.AkarosErrors {
+		ename = fmt.Sprintf("%04X %v", errornum, ename)
+	}
+
+	return ename
+}
+
+// Returns the error described by a received Rerror message.
+func (o *ProtocolOptions) rerror(fc *Fcall) *Error {
+	ename, errornum := fc.Error, fc.Errornum
+	if o.AkarosErrors && len(ename) > 5 && ename[4] == ' ' {
+		if n, err := strconv.ParseUint(ename[0:4], 16, 16); err == nil {
+			ename = ename[5:]
+			if errornum == 0 {
+				errornum = uint32(n)
+			}
+		}
+	}
+
+	return &Error{ename, errornum}
+}
@@ -0,0 +1,67 @@
+package go9p
+
+import "testing"
+
+func TestRespondErrorOptions(t *testing.T) {
+	req := newTestReq(Twalk)
+	req.Conn.Options = AkarosOptions
+	req.RespondError(Enoent)
+	if req.Rc.Error != "0002 file not found" || req.Rc.Errornum != ENOENT {
+		t.Fatalf("RespondError = %q %d", req.Rc.Error, req.Rc.Errornum)
+	}
+}
+
+func TestProtocolOptionsRerror(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     ProtocolOptions
+		fc       Fcall
+		wantErr  string
+		wantErrn uint32
+	}{
+		{"plain", ProtocolOptions{}, Fcall{Error: "0002 gone", Errornum: 0}, "0002 gone", 0},
+		{"akaros", AkarosOptions, Fcall{Error: "0002 gone"}, "gone", ENOENT},
+		{"akaros dotu", AkarosOptions, Fcall{Error: "000D denied", Errornum: EPERM}, "denied", EPERM},
+		{"akaros bad", AkarosOptions, Fcall{Error: "zzzz gone"}, "zzzz gone", 0},
+		{"akaros short", AkarosOptions, Fcall{Error: "gone"}, "gone", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.rerror(&tt.fc)
+			if err.Err != tt.wantErr || err.Errornum != tt.wantErrn {
+				t.Fatalf("rerror = %q %d, want %q %d", err.Err, err.Errornum, tt.wantErr, tt.wantErrn)
+			}
+		})
+	}
+}
+
+func TestFsrvReadSplitDirents(t *testing.T) {
+	for _, split := range []bool{false, true} {
+		fs := newTestRamfs()
+		fs.Options.SplitDirents = split
+		for _, name := range []string{"a", "b"} {
+			f := &ramFile{fs: fs}
+			if err := f.Add(fs.Root, name, OsUsers.Uid2User(0), nil, 0644, f); err != nil {
+				t.Fatalf("Add error = %v", err)
+			}
+		}
+
+		clnt := newRamfsClnt(t, fs)
+
+		fid, err := clnt.FOpen("/", OREAD)
+		if err != nil {
+			t.Fatalf("FOpen error = %v", err)
+		}
+
+		buf := make([]byte, 10)
+		n, err := fid.ReadAt(buf, 0)
+		_ = fid.Close()
+		if split && (err != nil || n != len(buf)) {
+			t.Fatalf("split read = %d, %v", n, err)
+		}
+		if !split && err == nil {
+			t.Fatalf("whole-entry read of %d bytes succeeded", n)
+		}
+	}
+}
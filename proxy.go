@@ -0,0 +1,414 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import "sync"
+
+// The Proxy type is a file server that forwards the requests it receives
+// to an upstream file server through a Clnt. Each SrvFid is mapped to a
+// Fid on the upstream server, and Tflush is forwarded as a Tflush of the
+// upstream request. The authentication, if any, is done by the proxy
+// (see AuthOps), the upstream server is attached to without it.
+//
+// A file server that embeds Proxy can implement ProxyFilterOp and
+// ProxyAuditOp to rewrite, reject or log the requests.
+type Proxy struct {
+	Srv
+	Clnt *Clnt // Client connected to the upstream file server
+
+	reqlock sync.Mutex
+	reqs    map[*SrvReq]*proxyReq // requests waiting for the upstream response
+}
+
+// Filter operation. If implemented, ProxyFilter is called for each
+// request before it is forwarded upstream. It can change the request's
+// Tc, for example the names of a Twalk, or the Uname and Aname of a
+// Tattach. If it returns an error, the request isn't forwarded and the
+// error is sent to the client.
+type ProxyFilterOp interface {
+	ProxyFilter(req *SrvReq) error
+}
+
+// Audit operation. If implemented, ProxyAudit is called when the upstream
+// server responds to a forwarded request, before the response is sent to
+// the client. rc is the upstream response, err is not nil if it is an
+// error. The method shouldn't retain rc after it returns.
+type ProxyAuditOp interface {
+	ProxyAudit(req *SrvReq, rc *Fcall, err error)
+}
+
+type proxyFid struct {
+	sync.Mutex
+	fid     *Fid
+	clunked bool   // the upstream fid was clunked or removed
+	doff    uint64 // next offset of a directory read from the client
+	uoff    uint64 // upstream offset matching doff
+}
+
+// A request forwarded upstream.
+type proxyReq struct {
+	sync.Mutex
+	r    *Req
+	done bool // the upstream request is completed and r may be reused
+}
+
+// The proxy accepts any user, access is checked by the upstream server.
+type proxyUser struct {
+	name string
+	id   int
+}
+
+type proxyUsers struct{}
+
+func (u *proxyUser) Name() string          { return u.name }
+func (u *proxyUser) Id() int               { return u.id }
+func (u *proxyUser) Groups() []Group       { return nil }
+func (u *proxyUser) IsMember(g Group) bool { return false }
+
+func (*proxyUsers) Uid2User(uid int) User          { return &proxyUser{id: uid} }
+func (*proxyUsers) Uname2User(uname string) User   { return &proxyUser{name: uname, id: -1} }
+func (*proxyUsers) Gid2Group(gid int) Group        { return nil }
+func (*proxyUsers) Gname2Group(gname string) Group { return nil }
+
+// Size of the stat of a file with empty names, without and with the
+// 9P2000.u fields.
+const (
+	statFixLen  = 49
+	statFixLenu = statFixLen + 2 + 3*4
+)
+
+// Creates a proxy for the file server the client is connected to. The
+// proxy speaks 9P2000.u if the client does, and accepts all users.
+func NewProxy(clnt *Clnt) *Proxy {
+	p := new(Proxy)
+	p.Clnt = clnt
+	p.Dotu = clnt.Dotu
+	p.Msize = clnt.Msize
+	p.Upool = new(proxyUsers)
+	return p
+}
+
+// Sends the message upstream and waits for the response. The request
+// can be flushed while waiting.
+func (p *Proxy) rpc(req *SrvReq, tc *Fcall) (*Fcall, error) {
+	clnt := p.Clnt
+	pr := &proxyReq{r: clnt.ReqAlloc()}
+	r := pr.r
+	r.Tc = tc
+	if r.rpcdone == nil {
+		r.rpcdone = make(chan *Req)
+	}
+
+	r.Done = r.rpcdone
+	p.reqlock.Lock()
+	if p.reqs == nil {
+		p.reqs = make(map[*SrvReq]*proxyReq)
+	}
+	p.reqs[req] = pr
+	p.reqlock.Unlock()
+
+	err := clnt.Rpcnb(r)
+	if err == nil {
+		<-r.Done
+		err = r.Err
+	}
+
+	rc := r.Rc
+	p.reqlock.Lock()
+	delete(p.reqs, req)
+	p.reqlock.Unlock()
+
+	// wait for Flush to finish before the tag is reused
+	pr.Lock()
+	pr.done = true
+	pr.Unlock()
+	clnt.ReqFree(r)
+	return rc, err
+}
+
+// Forwards the request upstream, pack creates the upstream message. If
+// the request fails, responds with the error and returns nil. Otherwise
+// returns the response, which should be freed with PutFcall.
+func (p *Proxy) forward(req *SrvReq, pack func(tc *Fcall) error) *Fcall {
+	ops := req.Conn.Srv.ops
+	if fop, ok := ops.(ProxyFilterOp); ok {
+		if err := fop.ProxyFilter(req); err != nil {
+			req.RespondError(err)
+			return nil
+		}
+	}
+
+	tc := p.Clnt.NewFcall()
+	if err := pack(tc); err != nil {
+		p.Clnt.FreeFcall(tc)
+		req.RespondError(err)
+		return nil
+	}
+
+	rc, err := p.rpc(req, tc)
+	if aop, ok := ops.(ProxyAuditOp); ok {
+		aop.ProxyAudit(req, rc, err)
+	}
+
+	switch {
+	case err == Eflushed:
+		req.Flush()
+	case err != nil:
+		req.RespondError(err)
+	default:
+		return rc
+	}
+
+	PutFcall(rc)
+	return nil
+}
+
+// Returns the iounit to send to the client.
+func (p *Proxy) iounit(req *SrvReq, iounit uint32) uint32 {
+	if max := req.Conn.Msize - IOHDRSZ; iounit > max {
+		iounit = max
+	}
+
+	return iounit
+}
+
+// Returns the maximum count of a Tread or Twrite sent upstream.
+func (p *Proxy) maxcount(count uint32) uint32 {
+	if max := p.Clnt.Msize - IOHDRSZ; count > max {
+		count = max
+	}
+
+	return count
+}
+
+func (p *Proxy) FidDestroy(sfid *SrvFid) {
+	fid, ok := sfid.Aux.(*proxyFid)
+	if !ok || fid.clunked {
+		return
+	}
+
+	fid.clunked = true
+	_ = p.Clnt.Clunk(fid.fid)
+}
+
+func (p *Proxy) Attach(req *SrvReq) {
+	tc := req.Tc
+	fid := p.Clnt.FidAlloc()
+	rc := p.forward(req, func(utc *Fcall) error {
+		return PackTattach(utc, fid.Fid, NOFID, tc.Uname, tc.Aname, tc.Unamenum, p.Clnt.Dotu)
+	})
+	if rc == nil {
+		return
+	}
+
+	defer PutFcall(rc)
+	fid.Qid = rc.Qid
+	fid.walked = true
+	req.Fid.Aux = &proxyFid{fid: fid}
+	req.RespondRattach(&rc.Qid)
+}
+
+func (p *Proxy) Flush(req *SrvReq) {
+	p.reqlock.Lock()
+	pr := p.reqs[req]
+	p.reqlock.Unlock()
+	if pr == nil {
+		// not forwarded yet, or already responded
+		return
+	}
+
+	pr.Lock()
+	if !pr.done {
+		_ = p.Clnt.Flush(pr.r)
+	}
+	pr.Unlock()
+}
+
+func (p *Proxy) Walk(req *SrvReq) {
+	tc := req.Tc
+	fid := req.Fid.Aux.(*proxyFid)
+	nfid := fid
+	if req.Newfid != req.Fid {
+		nfid = &proxyFid{fid: p.Clnt.FidAlloc()}
+	}
+
+	rc := p.forward(req, func(utc *Fcall) error {
+		return PackTwalk(utc, fid.fid.Fid, nfid.fid.Fid, tc.Wname)
+	})
+	if rc == nil {
+		return
+	}
+
+	defer PutFcall(rc)
+	if len(rc.Wqid) == len(tc.Wname) {
+		nfid.fid.walked = true
+		req.Newfid.Aux = nfid
+	}
+
+	req.RespondRwalk(rc.Wqid)
+}
+
+func (p *Proxy) Open(req *SrvReq) {
+	fid := req.Fid.Aux.(*proxyFid)
+	rc := p.forward(req, func(utc *Fcall) error {
+		return PackTopen(utc, fid.fid.Fid, req.Tc.Mode)
+	})
+	if rc == nil {
+		return
+	}
+
+	defer PutFcall(rc)
+	req.RespondRopen(&rc.Qid, p.iounit(req, rc.Iounit))
+}
+
+func (p *Proxy) Create(req *SrvReq) {
+	tc := req.Tc
+	fid := req.Fid.Aux.(*proxyFid)
+	rc := p.forward(req, func(utc *Fcall) error {
+		return PackTcreate(utc, fid.fid.Fid, tc.Name, tc.Perm, tc.Mode, tc.Ext, p.Clnt.Dotu)
+	})
+	if rc == nil {
+		return
+	}
+
+	defer PutFcall(rc)
+	req.RespondRcreate(&rc.Qid, p.iounit(req, rc.Iounit))
+}
+
+func (p *Proxy) Read(req *SrvReq) {
+	tc := req.Tc
+	fid := req.Fid.Aux.(*proxyFid)
+	if (req.Fid.Type&QTDIR) != 0 && req.Conn.Dotu != p.Clnt.Dotu {
+		p.readDir(req, fid)
+		return
+	}
+
+	rc := p.forward(req, func(utc *Fcall) error {
+		return PackTread(utc, fid.fid.Fid, tc.Offset, p.maxcount(tc.Count))
+	})
+	if rc == nil {
+		return
+	}
+
+	defer PutFcall(rc)
+	req.RespondRread(rc.Data)
+}
+
+// Reads a directory if the client and the upstream server speak different
+// dialects. The entries are converted, so the offsets of the client
+// differ from the upstream ones. Only sequential reads are supported.
+func (p *Proxy) readDir(req *SrvReq, fid *proxyFid) {
+	tc := req.Tc
+	fid.Lock()
+	defer fid.Unlock()
+	if tc.Offset == 0 {
+		fid.doff = 0
+		fid.uoff = 0
+	} else if tc.Offset != fid.doff {
+		req.RespondError(Ebadoffset)
+		return
+	}
+
+	// make sure the entries fit in count if they grow
+	count := p.maxcount(tc.Count)
+	if req.Conn.Dotu {
+		count = uint32(uint64(count) * statFixLen / statFixLenu)
+	}
+
+	rc := p.forward(req, func(utc *Fcall) error {
+		return PackTread(utc, fid.fid.Fid, fid.uoff, count)
+	})
+	if rc == nil {
+		return
+	}
+
+	defer PutFcall(rc)
+	var data []byte
+	for buf := rc.Data; len(buf) > 0; {
+		d, rest, _, err := UnpackDir(buf, p.Clnt.Dotu)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+
+		data = append(data, PackDir(d, req.Conn.Dotu)...)
+		buf = rest
+	}
+
+	fid.uoff += uint64(len(rc.Data))
+	fid.doff += uint64(len(data))
+	req.RespondRread(data)
+}
+
+func (p *Proxy) Write(req *SrvReq) {
+	tc := req.Tc
+	fid := req.Fid.Aux.(*proxyFid)
+	data := tc.Data[0:p.maxcount(uint32(len(tc.Data)))]
+	rc := p.forward(req, func(utc *Fcall) error {
+		return PackTwrite(utc, fid.fid.Fid, tc.Offset, uint32(len(data)), data)
+	})
+	if rc == nil {
+		return
+	}
+
+	defer PutFcall(rc)
+	req.RespondRwrite(rc.Count)
+}
+
+func (p *Proxy) Clunk(req *SrvReq) {
+	fid := req.Fid.Aux.(*proxyFid)
+	rc := p.forward(req, func(utc *Fcall) error {
+		// the upstream fid is clunked even if Tclunk fails
+		fid.clunked = true
+		return PackTclunk(utc, fid.fid.Fid)
+	})
+	if rc == nil {
+		return
+	}
+
+	PutFcall(rc)
+	req.RespondRclunk()
+}
+
+func (p *Proxy) Remove(req *SrvReq) {
+	fid := req.Fid.Aux.(*proxyFid)
+	rc := p.forward(req, func(utc *Fcall) error {
+		// the upstream fid is clunked even if Tremove fails
+		fid.clunked = true
+		return PackTremove(utc, fid.fid.Fid)
+	})
+	if rc == nil {
+		return
+	}
+
+	PutFcall(rc)
+	req.RespondRremove()
+}
+
+func (p *Proxy) Stat(req *SrvReq) {
+	fid := req.Fid.Aux.(*proxyFid)
+	rc := p.forward(req, func(utc *Fcall) error {
+		return PackTstat(utc, fid.fid.Fid)
+	})
+	if rc == nil {
+		return
+	}
+
+	defer PutFcall(rc)
+	req.RespondRstat(&rc.Dir)
+}
+
+func (p *Proxy) Wstat(req *SrvReq) {
+	fid := req.Fid.Aux.(*proxyFid)
+	rc := p.forward(req, func(utc *Fcall) error {
+		return PackTwstat(utc, fid.fid.Fid, &req.Tc.Dir, p.Clnt.Dotu)
+	})
+	if rc == nil {
+		return
+	}
+
+	PutFcall(rc)
+	req.RespondRwstat()
+}
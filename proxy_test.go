@@ -0,0 +1,237 @@
+package go9p
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testUpstream interface {
+	NewConn(c net.Conn)
+}
+
+// Connects a client to the upstream server and returns a proxy for it.
+func newTestProxy(t *testing.T, up testUpstream) *Proxy {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	up.NewConn(c1)
+	uclnt, err := Connect(c2, 8192+IOHDRSZ, true)
+	if err != nil {
+		t.Fatalf("Connect error = %v", err)
+	}
+	t.Cleanup(uclnt.Unmount)
+	return NewProxy(uclnt)
+}
+
+// Starts the proxy and mounts it.
+func mountProxy(t *testing.T, p *Proxy, ops interface{}) *Clnt {
+	t.Helper()
+	if !p.Start(ops) {
+		t.Fatalf("Start failed")
+	}
+
+	return mountPipe(t, p)
+}
+
+func startRamfs(fs *Ramfs, dotu bool) *Ramfs {
+	fs.Dotu = dotu
+	fs.Start(fs)
+	return fs
+}
+
+func TestProxy(t *testing.T) {
+	fs := startRamfs(newTestRamfs(), true)
+	p := newTestProxy(t, fs)
+	clnt := mountProxy(t, p, p)
+
+	f, err := clnt.FCreate("/file", 0644, ORDWR)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	_ = f.Close()
+
+	if got := readFile(t, clnt, "/file"); got != "hello" {
+		t.Fatalf("read = %q", got)
+	}
+	if fs.Root.Find("file") == nil {
+		t.Fatalf("file not created upstream")
+	}
+
+	d := newWstatDir()
+	d.Name = "renamed"
+	fid, err := clnt.FWalk("/file")
+	if err != nil {
+		t.Fatalf("FWalk error = %v", err)
+	}
+	if err := clnt.Wstat(fid, d); err != nil {
+		t.Fatalf("Wstat error = %v", err)
+	}
+	_ = clnt.Clunk(fid)
+
+	st, err := clnt.FStat("/renamed")
+	if err != nil {
+		t.Fatalf("FStat error = %v", err)
+	}
+	if st.Name != "renamed" || st.Length != 5 {
+		t.Fatalf("FStat = %v", st)
+	}
+
+	if err := clnt.FRemove("/renamed"); err != nil {
+		t.Fatalf("FRemove error = %v", err)
+	}
+	if _, err := clnt.FStat("/renamed"); err == nil {
+		t.Fatalf("FStat of a removed file succeeded")
+	}
+}
+
+func TestProxyReaddirDialects(t *testing.T) {
+	for _, updotu := range []bool{false, true} {
+		fs := startRamfs(newTestRamfs(), updotu)
+		for _, name := range []string{"a", "b", "c"} {
+			f := &ramFile{fs: fs}
+			if err := f.Add(fs.Root, name, OsUsers.Uid2User(0), nil, 0644, f); err != nil {
+				t.Fatalf("Add error = %v", err)
+			}
+		}
+
+		p := newTestProxy(t, fs)
+		p.Dotu = !updotu
+		clnt := mountProxy(t, p, p)
+		if clnt.Dotu == updotu {
+			t.Fatalf("dotu %v upstream and downstream", updotu)
+		}
+
+		f, err := clnt.FOpen("/", OREAD)
+		if err != nil {
+			t.Fatalf("FOpen error = %v", err)
+		}
+
+		var names []string
+		for {
+			dirs, err := f.Readdir(0)
+			if err != nil || len(dirs) == 0 {
+				break
+			}
+			for _, d := range dirs {
+				names = append(names, d.Name)
+			}
+		}
+		_ = f.Close()
+
+		sort.Strings(names)
+		if len(names) != 3 || names[0] != "a" || names[2] != "c" {
+			t.Fatalf("upstream dotu %v: names = %v", updotu, names)
+		}
+	}
+}
+
+// A proxy that hides /secret and records the requests.
+type auditProxy struct {
+	*Proxy
+	sync.Mutex
+	log []string
+}
+
+func (p *auditProxy) ProxyFilter(req *SrvReq) error {
+	for _, name := range req.Tc.Wname {
+		if name == "secret" {
+			return Eperm
+		}
+	}
+
+	return nil
+}
+
+func (p *auditProxy) ProxyAudit(req *SrvReq, rc *Fcall, err error) {
+	p.Lock()
+	p.log = append(p.log, MsgName(req.Tc.Type))
+	p.Unlock()
+}
+
+func TestProxyFilterAudit(t *testing.T) {
+	fs := startRamfs(newTestRamfs(), true)
+	f := &ramFile{fs: fs}
+	if err := f.Add(fs.Root, "secret", OsUsers.Uid2User(0), nil, 0644, f); err != nil {
+		t.Fatalf("Add error = %v", err)
+	}
+
+	p := &auditProxy{Proxy: newTestProxy(t, fs)}
+	clnt := mountProxy(t, p.Proxy, p)
+	if _, err := clnt.FStat("/secret"); err == nil || err.Error() != Eperm.Error() {
+		t.Fatalf("FStat(/secret) error = %v", err)
+	}
+	if _, err := clnt.FStat("/"); err != nil {
+		t.Fatalf("FStat(/) error = %v", err)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	want := []string{"Tattach", "Twalk", "Tstat", "Tclunk"}
+	if len(p.log) != len(want) {
+		t.Fatalf("audit log = %v, want %v", p.log, want)
+	}
+	for i := range want {
+		if p.log[i] != want[i] {
+			t.Fatalf("audit log = %v, want %v", p.log, want)
+		}
+	}
+}
+
+func TestProxyFlush(t *testing.T) {
+	fs, f := newBlockRamfs(t)
+	p := newTestProxy(t, fs)
+	clnt := mountProxy(t, p, p)
+
+	file, err := clnt.FOpen("/block", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	r := startRead(t, file)
+	<-f.started
+	if err := clnt.Flush(r); err != nil {
+		t.Fatalf("Flush error = %v", err)
+	}
+	if r := <-r.Done; r.Err != Eflushed {
+		t.Fatalf("flushed request error = %v", r.Err)
+	}
+	f.release <- true
+
+	// the proxy still works
+	if _, err := clnt.FStat("/block"); err != nil {
+		t.Fatalf("FStat error = %v", err)
+	}
+}
+
+func TestProxyFidDestroy(t *testing.T) {
+	fs := startRamfs(newTestRamfs(), true)
+	p := newTestProxy(t, fs)
+	clnt := mountProxy(t, p, p)
+	if _, err := clnt.FWalk("/"); err != nil {
+		t.Fatalf("FWalk error = %v", err)
+	}
+
+	nfids := func() int {
+		n := 0
+		for _, cs := range fs.stats("").Conns {
+			n += len(cs.Fids)
+		}
+		return n
+	}
+	if n := nfids(); n != 2 {
+		t.Fatalf("upstream fids = %d, want 2", n)
+	}
+
+	// the upstream fids are clunked when the client goes away
+	clnt.Unmount()
+	for start := time.Now(); nfids() != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("upstream fids = %d, want 0", nfids())
+		}
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !tinygo
+
+package go9p
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+var Enospc = &Error{"no space left on device", ENOSPC}
+var Eremoved = &Error{"file has been removed", ENOENT}
+var Efbig = &Error{"file too large", EFBIG}
+
+// The default maximum size of a Ramfs file.
+const RamfsMaxFileSize = 256 << 20
+
+// The Ramfs type implements a file server that keeps all files and
+// directories in memory. It is built on Fsrv and supports creating,
+// reading, writing, truncating and removing files, as well as the
+// ORCLOSE and DMAPPEND semantics. DMEXCL is enforced by the server core.
+type Ramfs struct {
+	Fsrv
+	Quota    uint64 // maximum number of bytes stored in all files, 0 for no limit
+	Maxfiles int    // maximum number of files and directories, 0 for no limit
+
+	// Maximum size of a file, 0 for RamfsMaxFileSize
+	MaxFileSize uint64
+
+	qlock  sync.Mutex
+	nbytes uint64 // number of bytes stored in all files
+	nfiles int    // number of files and directories (not counting the root)
+}
+
+// The ramFile type is the per-file state of Ramfs. It is used as the
+// ops value of the srvFile it embeds.
+type ramFile struct {
+	srvFile
+	fs   *Ramfs
+	data []byte // guarded by srvFile.Lock
+
+	released bool // the resources are freed, guarded by srvFile.Lock
+}
+
+// Creates a RAM file server. The root directory is owned by user and
+// group and has permissions perm.
+func NewRamfs(user User, group Group, perm uint32) *Ramfs {
+	fs := new(Ramfs)
+	root := &ramFile{fs: fs}
+	_ = root.Add(nil, "/", user, group, DMDIR|(perm&0777), root)
+	fs.Root = &root.srvFile
+
+	return fs
+}
+
+// Reserves n more bytes of file data. Returns Enospc if that
+// would exceed the quota.
+func (fs *Ramfs) alloc(n uint64) error {
+	fs.qlock.Lock()
+	defer fs.qlock.Unlock()
+	if fs.Quota != 0 && fs.nbytes+n > fs.Quota {
+		return Enospc
+	}
+
+	fs.nbytes += n
+	return nil
+}
+
+func (fs *Ramfs) free(n uint64) {
+	fs.qlock.Lock()
+	fs.nbytes -= n
+	fs.qlock.Unlock()
+}
+
+// Returns the number of bytes stored in all files.
+func (fs *Ramfs) Used() uint64 {
+	fs.qlock.Lock()
+	defer fs.qlock.Unlock()
+	return fs.nbytes
+}
+
+func (fs *Ramfs) fileAlloc() error {
+	fs.qlock.Lock()
+	defer fs.qlock.Unlock()
+	if fs.Maxfiles != 0 && fs.nfiles >= fs.Maxfiles {
+		return Enospc
+	}
+
+	fs.nfiles++
+	return nil
+}
+
+func (fs *Ramfs) fileFree() {
+	fs.qlock.Lock()
+	fs.nfiles--
+	fs.qlock.Unlock()
+}
+
+func (fs *Ramfs) maxFileSize() uint64 {
+	if fs.MaxFileSize == 0 {
+		return RamfsMaxFileSize
+	}
+
+	return fs.MaxFileSize
+}
+
+// Changes the size of the file data to sz. Returns Efbig if sz is
+// over the maximum file size. Should be called with the file locked.
+func (f *ramFile) resize(sz uint64) error {
+	n := uint64(len(f.data))
+	switch {
+	case sz > n:
+		max := f.fs.maxFileSize()
+		if sz > max {
+			return Efbig
+		}
+
+		if err := f.fs.alloc(sz - n); err != nil {
+			return err
+		}
+
+		if sz > uint64(cap(f.data)) {
+			c := 2 * uint64(cap(f.data))
+			if c > max {
+				c = max
+			}
+
+			if c < sz {
+				c = sz
+			}
+
+			b := make([]byte, sz, c)
+			copy(b, f.data)
+			f.data = b
+		} else {
+			f.data = f.data[0:sz]
+			clear(f.data[n:])
+		}
+
+	case sz < n:
+		f.fs.free(n - sz)
+		f.data = f.data[0:sz]
+	}
+
+	f.Length = sz
+	return nil
+}
+
+// Marks the file as modified by user. Should be called with the
+// file locked.
+func (f *ramFile) modified(user User) {
+	f.Version++
+	f.touch(user)
+}
+
+// Sets the modification time and user. Should be called with the
+// file locked.
+func (f *ramFile) touch(user User) {
+	f.Mtime = uint32(time.Now().Unix())
+	if user != nil {
+		f.Muid = user.Name()
+		f.Muidnum = uint32(user.Id())
+	}
+}
+
+func (dir *ramFile) Create(fid *FFid, name string, perm uint32) (*srvFile, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return nil, Eperm
+	}
+
+	if (perm & DMDIR) != 0 {
+		perm &= ^uint32(0777) | (dir.Mode & 0777)
+	} else {
+		perm &= ^uint32(0666) | (dir.Mode & 0666)
+	}
+
+	if err := dir.fs.fileAlloc(); err != nil {
+		return nil, err
+	}
+
+	user := fid.Fid.User
+	f := &ramFile{fs: dir.fs}
+	if err := f.Add(&dir.srvFile, name, user, nil, perm, f); err != nil {
+		dir.fs.fileFree()
+		return nil, err
+	}
+
+	f.Lock()
+	f.Gid = dir.Gid
+	f.Gidnum = dir.Gidnum
+	if user != nil {
+		f.Muid = user.Name()
+		f.Muidnum = uint32(user.Id())
+	}
+	f.Unlock()
+
+	return &f.srvFile, nil
+}
+
+func (f *ramFile) Open(fid *FFid, mode uint8) error {
+	if (mode&ORCLOSE) != 0 && !f.Parent.CheckPerm(fid.Fid.User, DMWRITE) {
+		return Eperm
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if (mode&OTRUNC) != 0 && (f.Mode&(DMDIR|DMAPPEND)) == 0 && len(f.data) > 0 {
+		_ = f.resize(0)
+		f.modified(fid.Fid.User)
+	}
+
+	return nil
+}
+
+func (f *ramFile) Read(fid *FFid, buf []byte, offset uint64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if (f.flags & Fremoved) != 0 {
+		return 0, Eremoved
+	}
+
+	if offset >= uint64(len(f.data)) {
+		return 0, nil
+	}
+
+	return copy(buf, f.data[offset:]), nil
+}
+
+func (f *ramFile) Write(fid *FFid, data []byte, offset uint64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.released || (f.flags&Fremoved) != 0 {
+		return 0, Eremoved
+	}
+
+	if (f.Mode & DMAPPEND) != 0 {
+		offset = uint64(len(f.data))
+	}
+
+	end := offset + uint64(len(data))
+	if end < offset || int(end) < 0 {
+		return 0, Etoolarge
+	}
+
+	if end > uint64(len(f.data)) {
+		if err := f.resize(end); err != nil {
+			return 0, err
+		}
+	}
+
+	copy(f.data[offset:], data)
+	f.modified(fid.Fid.User)
+	return len(data), nil
+}
+
+func (f *ramFile) Wstat(fid *FFid, d *Dir) error {
+	f.Lock()
+	removed := f.released || (f.flags&Fremoved) != 0
+	f.Unlock()
+	if removed {
+		return Eremoved
+	}
+
+	user := fid.Fid.User
+	resized := false
+	err := f.wstat(user, d, func(sz uint64) error {
+		resized = true
+		return f.resize(sz)
+	})
+	if err != nil {
+		return err
+	}
+
+	if resized && d.Mtime == ^uint32(0) {
+		f.Lock()
+		f.touch(user)
+		f.Unlock()
+	}
+
+	return nil
+}
+
+func (f *ramFile) Remove(fid *FFid) error {
+	if f.Parent == &f.srvFile {
+		return Eperm
+	}
+
+	if !f.Parent.CheckPerm(fid.Fid.User, DMWRITE) {
+		return Eperm
+	}
+
+	f.release()
+	return nil
+}
+
+// Frees the resources used by a file that is removed. Does nothing
+// if they are already freed.
+func (f *ramFile) release() {
+	f.Lock()
+	released := f.released
+	f.released = true
+	if !released {
+		_ = f.resize(0)
+	}
+	f.Unlock()
+
+	if !released {
+		f.fs.fileFree()
+	}
+}
+
+func (f *ramFile) FidDestroy(fid *FFid) {
+	sfid := fid.Fid
+	if sfid == nil || !sfid.opened || (sfid.Omode&ORCLOSE) == 0 || f.Parent == &f.srvFile {
+		return
+	}
+
+	f.Lock()
+	removed := f.released || (f.flags&Fremoved) != 0
+	empty := f.cfirst == nil
+	f.Unlock()
+	if !removed && empty {
+		f.release()
+		f.srvFile.Remove()
+	}
+}
@@ -0,0 +1,351 @@
+package go9p
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Connects a client to the started server over a pipe and attaches to
+// it as root. The client is unmounted when the test ends.
+func mountPipe(t testing.TB, srv interface{ NewConn(net.Conn) }) *Clnt {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	srv.NewConn(c1)
+	clnt, err := MountConn(c2, "", 8192, OsUsers.Uid2User(0))
+	if err != nil {
+		t.Fatalf("MountConn error = %v", err)
+	}
+	t.Cleanup(clnt.Unmount)
+	return clnt
+}
+
+func newRamfsClnt(t *testing.T, fs *Ramfs) *Clnt {
+	t.Helper()
+	fs.Dotu = true
+	fs.Id = "ramfs"
+	if !fs.Start(fs) {
+		t.Fatalf("Start failed")
+	}
+
+	return mountPipe(t, fs)
+}
+
+func newTestRamfs() *Ramfs {
+	return NewRamfs(OsUsers.Uid2User(0), OsUsers.Gid2Group(0), 0777)
+}
+
+func readFile(t *testing.T, clnt *Clnt, path string) string {
+	t.Helper()
+	f, err := clnt.FOpen(path, OREAD)
+	if err != nil {
+		t.Fatalf("FOpen(%s) error = %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll(%s) error = %v", path, err)
+	}
+	return string(b)
+}
+
+func TestRamfsCreateWriteRead(t *testing.T) {
+	fs := newTestRamfs()
+	clnt := newRamfsClnt(t, fs)
+
+	f, err := clnt.FCreate("/file", 0644, ORDWR)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	if _, err := f.WriteAt([]byte("J"), 0); err != nil {
+		t.Fatalf("WriteAt error = %v", err)
+	}
+	if _, err := f.WriteAt([]byte("!"), 8); err != nil {
+		t.Fatalf("WriteAt error = %v", err)
+	}
+	_ = f.Close()
+
+	if got := readFile(t, clnt, "/file"); got != "Jello\x00\x00\x00!" {
+		t.Fatalf("read = %q", got)
+	}
+
+	d, err := clnt.FStat("/file")
+	if err != nil {
+		t.Fatalf("FStat error = %v", err)
+	}
+	if d.Length != 9 || d.Version != 3 {
+		t.Fatalf("FStat length = %d version = %d", d.Length, d.Version)
+	}
+	if fs.Used() != 9 {
+		t.Fatalf("Used = %d", fs.Used())
+	}
+}
+
+func TestRamfsDirectories(t *testing.T) {
+	fs := newTestRamfs()
+	clnt := newRamfsClnt(t, fs)
+
+	d, err := clnt.FCreate("/dir", DMDIR|0755, OREAD)
+	if err != nil {
+		t.Fatalf("FCreate dir error = %v", err)
+	}
+	_ = d.Close()
+
+	for _, name := range []string{"a", "b", "c"} {
+		f, err := clnt.FCreate("/dir/"+name, 0644, OWRITE)
+		if err != nil {
+			t.Fatalf("FCreate %s error = %v", name, err)
+		}
+		_ = f.Close()
+	}
+
+	dir, err := clnt.FOpen("/dir", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen dir error = %v", err)
+	}
+	dirs, err := dir.Readdir(0)
+	_ = dir.Close()
+	if err != nil {
+		t.Fatalf("Readdir error = %v", err)
+	}
+	if len(dirs) != 3 || dirs[0].Name != "a" || dirs[2].Name != "c" {
+		t.Fatalf("Readdir = %v", dirs)
+	}
+
+	if err := clnt.FRemove("/dir"); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Fatalf("FRemove non-empty error = %v", err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := clnt.FRemove("/dir/" + name); err != nil {
+			t.Fatalf("FRemove %s error = %v", name, err)
+		}
+	}
+	if err := clnt.FRemove("/dir"); err != nil {
+		t.Fatalf("FRemove dir error = %v", err)
+	}
+	if fs.nfiles != 0 {
+		t.Fatalf("nfiles = %d", fs.nfiles)
+	}
+}
+
+func TestRamfsAppendAndExcl(t *testing.T) {
+	fs := newTestRamfs()
+	clnt := newRamfsClnt(t, fs)
+
+	f, err := clnt.FCreate("/log", DMAPPEND|0644, OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	for _, s := range []string{"one", "two"} {
+		if _, err := f.WriteAt([]byte(s), 0); err != nil {
+			t.Fatalf("WriteAt error = %v", err)
+		}
+	}
+	_ = f.Close()
+	if got := readFile(t, clnt, "/log"); got != "onetwo" {
+		t.Fatalf("append read = %q", got)
+	}
+
+	excl, err := clnt.FCreate("/excl", DMEXCL|0644, ORDWR)
+	if err != nil {
+		t.Fatalf("FCreate excl error = %v", err)
+	}
+	if _, err := clnt.FOpen("/excl", OREAD); err == nil || !strings.Contains(err.Error(), "exclusive") {
+		t.Fatalf("second open error = %v", err)
+	}
+	_ = excl.Close()
+	excl, err = clnt.FOpen("/excl", OREAD)
+	if err != nil {
+		t.Fatalf("open after close error = %v", err)
+	}
+	_ = excl.Close()
+}
+
+func TestRamfsTruncateAndOrclose(t *testing.T) {
+	fs := newTestRamfs()
+	clnt := newRamfsClnt(t, fs)
+
+	f, err := clnt.FCreate("/file", 0644, OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+
+	d := newWstatDir()
+	d.Length = 2
+	if err := clnt.Wstat(f.Fid, d); err != nil {
+		t.Fatalf("Wstat error = %v", err)
+	}
+	_ = f.Close()
+	if got := readFile(t, clnt, "/file"); got != "he" {
+		t.Fatalf("truncated read = %q", got)
+	}
+
+	f, err = clnt.FOpen("/file", OWRITE|OTRUNC)
+	if err != nil {
+		t.Fatalf("FOpen OTRUNC error = %v", err)
+	}
+	_ = f.Close()
+	if got := readFile(t, clnt, "/file"); got != "" {
+		t.Fatalf("OTRUNC read = %q", got)
+	}
+
+	f, err = clnt.FCreate("/tmp", 0644, ORDWR|ORCLOSE)
+	if err != nil {
+		t.Fatalf("FCreate ORCLOSE error = %v", err)
+	}
+	if _, err := f.Write([]byte("scratch")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	_ = f.Close()
+	if _, err := clnt.FStat("/tmp"); err == nil {
+		t.Fatalf("ORCLOSE file still exists")
+	}
+	if fs.Used() != 0 {
+		t.Fatalf("Used = %d", fs.Used())
+	}
+}
+
+func TestRamfsQuota(t *testing.T) {
+	fs := newTestRamfs()
+	fs.Quota = 8
+	fs.Maxfiles = 1
+	clnt := newRamfsClnt(t, fs)
+
+	f, err := clnt.FCreate("/file", 0644, OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := f.Write([]byte("12345678")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	if _, err := f.Write([]byte("9")); err == nil || !strings.Contains(err.Error(), "no space") {
+		t.Fatalf("Write over quota error = %v", err)
+	}
+
+	d := newWstatDir()
+	d.Length = 9
+	if err := clnt.Wstat(f.Fid, d); err == nil {
+		t.Fatalf("Wstat over quota succeeded")
+	}
+
+	if _, err := clnt.FCreate("/other", 0644, OWRITE); err == nil || !strings.Contains(err.Error(), "no space") {
+		t.Fatalf("FCreate over maxfiles error = %v", err)
+	}
+}
+
+func TestRamfsMaxFileSize(t *testing.T) {
+	fs := newTestRamfs()
+	clnt := newRamfsClnt(t, fs)
+
+	f, err := clnt.FCreate("/file", 0644, OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := f.WriteAt([]byte("hi"), 1<<40); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("WriteAt huge offset error = %v", err)
+	}
+
+	d := newWstatDir()
+	d.Length = 1 << 40
+	if err := clnt.Wstat(f.Fid, d); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("Wstat huge length error = %v", err)
+	}
+
+	fs.MaxFileSize = 4
+	if _, err := f.WriteAt([]byte("12345"), 0); err == nil {
+		t.Fatalf("Write over MaxFileSize succeeded")
+	}
+	if _, err := f.WriteAt([]byte("1234"), 0); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	if fs.Used() != 4 {
+		t.Fatalf("Used = %d, want 4", fs.Used())
+	}
+}
+
+func TestRamfsWstatAtomic(t *testing.T) {
+	fs := newTestRamfs()
+	fs.Quota = 4
+	clnt := newRamfsClnt(t, fs)
+
+	f, err := clnt.FCreate("/file", 0644, OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := clnt.FCreate("/other", 0644, OREAD); err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+
+	// the resize fails, nothing is changed
+	d := newWstatDir()
+	d.Name = "renamed"
+	d.Mode = 0600
+	d.Length = 5
+	if err := clnt.Wstat(f.Fid, d); err == nil {
+		t.Fatalf("Wstat over quota succeeded")
+	}
+	st, err := clnt.FStat("/file")
+	if err != nil {
+		t.Fatalf("FStat error = %v", err)
+	}
+	if st.Mode != 0644 || st.Length != 0 || st.Version != 0 {
+		t.Fatalf("failed Wstat changed mode %o length %d version %d", st.Mode, st.Length, st.Version)
+	}
+
+	// the rename fails, the file is not resized
+	d = newWstatDir()
+	d.Name = "other"
+	d.Length = 4
+	if err := clnt.Wstat(f.Fid, d); err == nil {
+		t.Fatalf("Wstat rename over existing file succeeded")
+	}
+	if st, err = clnt.FStat("/file"); err != nil || st.Length != 0 || st.Version != 0 {
+		t.Fatalf("failed Wstat stat = %v, %v", st, err)
+	}
+	if fs.Used() != 0 {
+		t.Fatalf("Used = %d, want 0", fs.Used())
+	}
+
+	d.Name = "renamed"
+	if err := clnt.Wstat(f.Fid, d); err != nil {
+		t.Fatalf("Wstat error = %v", err)
+	}
+	if st, err = clnt.FStat("/renamed"); err != nil || st.Length != 4 || st.Version != 1 {
+		t.Fatalf("Wstat stat = %v, %v", st, err)
+	}
+}
+
+func TestRamfsReleaseOnce(t *testing.T) {
+	fs := newTestRamfs()
+	root := fs.Root.ops.(*ramFile)
+	fid := &FFid{Fid: &SrvFid{User: OsUsers.Uid2User(0)}}
+	sf, err := root.Create(fid, "file", 0644)
+	if err != nil {
+		t.Fatalf("Create error = %v", err)
+	}
+
+	f := sf.ops.(*ramFile)
+	if err := f.Remove(fid); err != nil {
+		t.Fatalf("Remove error = %v", err)
+	}
+	f.release()
+	if fs.nfiles != 0 {
+		t.Fatalf("nfiles = %d, want 0", fs.nfiles)
+	}
+	if _, err := f.Write(fid, []byte("x"), 0); err != Eremoved {
+		t.Fatalf("Write after Remove error = %v, want %v", err, Eremoved)
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Directions of the recorded messages, as seen by the side of the
+// connection that was recorded.
+const (
+	RecordRecv = 0 // the message was read from the connection
+	RecordSend = 1 // the message was written to the connection
+)
+
+// The largest message accepted in a recording.
+const recordMaxMsg = 1 << 24
+
+var recordMagic = []byte("9Prec001")
+
+var Ebadrecord error = &Error{"invalid recording", EINVAL}
+
+// A Record is a 9P2000 message in a recording.
+type Record struct {
+	Time time.Time // time the message was read or written
+	Dir  uint8     // RecordRecv or RecordSend
+	Msg  []byte    // the message, including its size
+}
+
+// The Recorder type writes the messages sent and received on a
+// connection to a file. A recording starts with a magic string,
+// followed by a record for each message: time[8] dir[1] and the message
+// itself. The time is in nanoseconds since the Unix epoch.
+type Recorder struct {
+	sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// Creates a recorder that writes to w.
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	if _, err := w.Write(recordMagic); err != nil {
+		return nil, err
+	}
+
+	return &Recorder{w: w}, nil
+}
+
+// Writes a record for the message. Returns the first error that
+// happened while writing the recording.
+func (rec *Recorder) Record(dir uint8, msg []byte) error {
+	buf := make([]byte, 9, 9+len(msg))
+	pint64(uint64(time.Now().UnixNano()), buf)
+	buf[8] = dir
+	buf = append(buf, msg...)
+
+	rec.Lock()
+	defer rec.Unlock()
+	if rec.err == nil {
+		_, rec.err = rec.w.Write(buf)
+	}
+
+	return rec.err
+}
+
+// Returns a connection that records all messages read from and written
+// to c. It can be used on both the client (NewClnt) and the server
+// (Srv.NewConn) side.
+func (rec *Recorder) Conn(c net.Conn) net.Conn {
+	return &recordConn{Conn: c, rec: rec}
+}
+
+type recordConn struct {
+	net.Conn
+	rec  *Recorder
+	rbuf []byte // incomplete message read
+	wbuf []byte // incomplete message written
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.rbuf = c.frame(RecordRecv, append(c.rbuf, p[:n]...))
+	return n, err
+}
+
+// The messages are recorded before they are written, the response to
+// a message can be read before the write returns.
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.wbuf = c.frame(RecordSend, append(c.wbuf, p...))
+	return c.Conn.Write(p)
+}
+
+// Records the complete messages in buf and returns the rest.
+func (c *recordConn) frame(dir uint8, buf []byte) []byte {
+	for len(buf) >= 4 {
+		sz, _ := gint32(buf)
+		if uint32(len(buf)) < sz {
+			break
+		}
+
+		if sz < 7 {
+			// not 9P, record the rest as is
+			sz = uint32(len(buf))
+		}
+
+		_ = c.rec.Record(dir, buf[:sz])
+		buf = buf[sz:]
+	}
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	return append([]byte(nil), buf...)
+}
+
+// Reads all records from a recording.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, recordMagic) {
+		return nil, Ebadrecord
+	}
+
+	var recs []Record
+	for {
+		hdr := make([]byte, 13)
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			if err == io.EOF {
+				return recs, nil
+			}
+
+			return recs, Ebadrecord
+		}
+
+		t, _ := gint64(hdr)
+		sz, _ := gint32(hdr[9:])
+		if sz < 7 || sz > recordMaxMsg || hdr[8] > RecordSend {
+			return recs, Ebadrecord
+		}
+
+		msg := make([]byte, sz)
+		copy(msg, hdr[9:])
+		if _, err := io.ReadFull(br, msg[4:]); err != nil {
+			return recs, Ebadrecord
+		}
+
+		recs = append(recs, Record{time.Unix(0, int64(t)), hdr[8], msg})
+	}
+}
+
+// Writes the records as text, one message per line.
+func DumpRecords(w io.Writer, recs []Record) error {
+	dotu := false
+	for i := range recs {
+		r := &recs[i]
+		dir := "<-"
+		if r.Dir == RecordSend {
+			dir = "->"
+		}
+
+		s := "invalid message"
+		if fc, _, err := Unpack(r.Msg, dotu); err == nil {
+			s = fc.String()
+			if fc.Type == Rversion {
+				dotu = fc.Version == "9P2000.u"
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "%s %s %s\n", r.Time.Format(time.RFC3339Nano), dir, s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A difference found while replaying a recording.
+type ReplayDiff struct {
+	Record int    // index of the recorded message
+	Want   string // the recorded message
+	Got    string // the message received instead, "" if none
+}
+
+func (d *ReplayDiff) String() string {
+	return fmt.Sprintf("record %d: want %s, got %s", d.Record, d.Want, d.Got)
+}
+
+// The Replayer type replays one side of a recorded session and compares
+// the messages the other side sends with the recorded ones. The session
+// is replayed as fast as possible, the times of the records are not used.
+type Replayer struct {
+	Records []Record
+	Timeout time.Duration // how long to wait for each message, 0 for no limit
+
+	// If not nil, reports whether a received message matches the
+	// recorded one. By default the type and the fields that don't
+	// depend on the time, the Qid paths and the fid and tag numbers
+	// are compared.
+	Equal func(want, got *Fcall) bool
+}
+
+// Sends the client messages of the recording to the server connected to
+// c, and compares the responses. Returns the differences found, and an
+// error if the server stopped responding.
+func (rp *Replayer) Client(c net.Conn) ([]*ReplayDiff, error) {
+	var diffs []*ReplayDiff
+
+	rd := bufio.NewReader(c)
+	dirs := make(map[uint32]bool) // fids of the open directories
+	tcs := make(map[uint16]*Fcall)
+	pending := make(map[uint16][]byte) // responses received before needed
+	dotu := false
+	for i := range rp.Records {
+		msg := rp.Records[i].Msg
+		want, _, err := Unpack(msg, dotu)
+		if err != nil {
+			return diffs, err
+		}
+
+		if want.Type%2 == 0 {
+			tcs[want.Tag] = want
+			delete(pending, want.Tag)
+			if _, err := c.Write(msg); err != nil {
+				return diffs, err
+			}
+
+			continue
+		}
+
+		got := pending[want.Tag]
+		delete(pending, want.Tag)
+		for got == nil {
+			buf, err := rp.read(c, rd)
+			if err != nil {
+				return append(diffs, &ReplayDiff{i, want.String(), ""}), err
+			}
+
+			tag := uint16(buf[5]) | uint16(buf[6])<<8
+			if tag == want.Tag {
+				got = buf
+			} else {
+				pending[tag] = buf
+			}
+		}
+
+		tc := tcs[want.Tag]
+		diffs = rp.compare(diffs, i, want, got, dotu, tc != nil && tc.Type == Tread && dirs[tc.Fid])
+		if tc != nil && (want.Type == Ropen || want.Type == Rcreate) && want.Qid.Type&QTDIR != 0 {
+			dirs[tc.Fid] = true
+		}
+
+		if want.Type == Rversion {
+			dotu = want.Version == "9P2000.u"
+		}
+	}
+
+	return diffs, nil
+}
+
+// Sends the server messages of the recording to the client connected
+// to c, and compares the requests. The requests should be sent in the
+// recorded order. Returns the differences found, and an error if the
+// client stopped sending requests.
+func (rp *Replayer) Server(c net.Conn) ([]*ReplayDiff, error) {
+	var diffs []*ReplayDiff
+
+	rd := bufio.NewReader(c)
+	tags := make(map[uint16]uint16) // the client's tag for each recorded tag
+	dotu := false
+	for i := range rp.Records {
+		msg := rp.Records[i].Msg
+		want, _, err := Unpack(msg, dotu)
+		if err != nil {
+			return diffs, err
+		}
+
+		if want.Type%2 == 0 {
+			got, err := rp.read(c, rd)
+			if err != nil {
+				return append(diffs, &ReplayDiff{i, want.String(), ""}), err
+			}
+
+			tags[want.Tag] = uint16(got[5]) | uint16(got[6])<<8
+			diffs = rp.compare(diffs, i, want, got, dotu, false)
+			continue
+		}
+
+		if want.Type == Rversion {
+			dotu = want.Version == "9P2000.u"
+		}
+
+		rc := append([]byte(nil), msg...)
+		if tag, ok := tags[want.Tag]; ok {
+			pint16(tag, rc[5:])
+		}
+
+		if _, err := c.Write(rc); err != nil {
+			return diffs, err
+		}
+	}
+
+	return diffs, nil
+}
+
+// Reads a message from the connection.
+func (rp *Replayer) read(c net.Conn, rd *bufio.Reader) ([]byte, error) {
+	if rp.Timeout > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(rp.Timeout))
+	}
+
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(rd, hdr); err != nil {
+		return nil, err
+	}
+
+	sz, _ := gint32(hdr)
+	if sz < 7 || sz > recordMaxMsg {
+		return nil, Ebadmsgsize
+	}
+
+	buf := make([]byte, sz)
+	copy(buf, hdr)
+	if _, err := io.ReadFull(rd, buf[4:]); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// Compares the received message with the recorded one, and adds a
+// difference to diffs if they don't match.
+func (rp *Replayer) compare(diffs []*ReplayDiff, i int, want *Fcall, buf []byte, dotu, dir bool) []*ReplayDiff {
+	got, _, err := Unpack(buf, dotu)
+	if err != nil {
+		return append(diffs, &ReplayDiff{i, want.String(), err.Error()})
+	}
+
+	var eq bool
+	if rp.Equal != nil {
+		eq = rp.Equal(want, got)
+	} else {
+		eq = want.Type == got.Type && replayKey(want, dotu, dir) == replayKey(got, dotu, dir)
+	}
+
+	if !eq {
+		diffs = append(diffs, &ReplayDiff{i, want.String(), got.String()})
+	}
+
+	return diffs
+}
+
+// Returns the fields of the message compared by default. The entries of
+// directory reads are compared by name.
+func replayKey(fc *Fcall, dotu, dir bool) string {
+	switch fc.Type {
+	case Tversion, Rversion:
+		return fmt.Sprint(fc.Msize, fc.Version)
+	case Tauth, Tattach:
+		return fmt.Sprint(fc.Uname, fc.Aname, fc.Unamenum)
+	case Rauth, Rattach, Ropen, Rcreate:
+		return fmt.Sprint(fc.Qid.Type, fc.Iounit)
+	case Rerror:
+		return fmt.Sprint(fc.Error, fc.Errornum)
+	case Twalk:
+		return fmt.Sprint(fc.Wname)
+	case Rwalk:
+		var types []uint8
+		for _, q := range fc.Wqid {
+			types = append(types, q.Type)
+		}
+		return fmt.Sprint(types)
+	case Topen:
+		return fmt.Sprint(fc.Mode)
+	case Tcreate:
+		return fmt.Sprint(fc.Name, fc.Perm, fc.Mode, fc.Ext)
+	case Tread:
+		return fmt.Sprint(fc.Offset, fc.Count)
+	case Rread:
+		if !dir {
+			return string(fc.Data)
+		}
+
+		var names []string
+		for buf := fc.Data; len(buf) > 0; {
+			d, rest, _, err := UnpackDir(buf, dotu)
+			if err != nil {
+				break
+			}
+			names = append(names, d.Name)
+			buf = rest
+		}
+		return fmt.Sprint(names)
+	case Twrite:
+		return fmt.Sprint(fc.Offset, string(fc.Data))
+	case Rwrite:
+		return fmt.Sprint(fc.Count)
+	case Rstat, Twstat:
+		d := &fc.Dir
+		return fmt.Sprint(d.Name, d.Mode, d.Length, d.Uid, d.Gid)
+	}
+
+	return ""
+}
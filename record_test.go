@@ -0,0 +1,150 @@
+package go9p
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The session that is recorded and replayed.
+func recordSession(t *testing.T, clnt *Clnt) {
+	t.Helper()
+	f, err := clnt.FCreate("/file", 0644, OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	if _, err := f.Write([]byte("recorded")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	_ = f.Close()
+
+	if got := readFile(t, clnt, "/file"); got != "recorded" {
+		t.Fatalf("read = %q", got)
+	}
+	if names := readDirNames(t, clnt, "/"); len(names) != 1 || names[0] != "file" {
+		t.Fatalf("entries = %v", names)
+	}
+	if _, err := clnt.FStat("/missing"); err == nil {
+		t.Fatalf("FStat of a missing file succeeded")
+	}
+	if err := clnt.FRemove("/file"); err != nil {
+		t.Fatalf("FRemove error = %v", err)
+	}
+}
+
+// Records the session on the server side of a Ramfs connection.
+func recordRamfs(t *testing.T) []Record {
+	t.Helper()
+	var buf bytes.Buffer
+	rec, err := NewRecorder(&buf)
+	if err != nil {
+		t.Fatalf("NewRecorder error = %v", err)
+	}
+
+	fs := newTestRamfs()
+	fs.Dotu = true
+	fs.Start(fs)
+	c1, c2 := net.Pipe()
+	fs.NewConn(rec.Conn(c1))
+	clnt, err := MountConn(c2, "", 8192, OsUsers.Uid2User(0))
+	if err != nil {
+		t.Fatalf("MountConn error = %v", err)
+	}
+	recordSession(t, clnt)
+	clnt.Unmount()
+
+	recs, err := ReadRecords(&buf)
+	if err != nil {
+		t.Fatalf("ReadRecords error = %v", err)
+	}
+	return recs
+}
+
+func TestRecord(t *testing.T) {
+	recs := recordRamfs(t)
+	if len(recs) == 0 || len(recs)%2 != 0 {
+		t.Fatalf("%d records", len(recs))
+	}
+	for _, r := range recs {
+		if want := uint8(RecordSend); r.Msg[4]%2 == 0 {
+			want = RecordRecv
+			if r.Dir != want {
+				t.Fatalf("%s direction = %d", MsgName(r.Msg[4]), r.Dir)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := DumpRecords(&out, recs); err != nil {
+		t.Fatalf("DumpRecords error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(recs) || !strings.Contains(lines[0], "<- Tversion") ||
+		!strings.Contains(lines[1], "-> Rversion") {
+		t.Fatalf("dump:\n%s", out.String())
+	}
+
+	if _, err := ReadRecords(strings.NewReader("not a recording")); err != Ebadrecord {
+		t.Fatalf("ReadRecords of garbage error = %v", err)
+	}
+}
+
+func TestReplayClient(t *testing.T) {
+	recs := recordRamfs(t)
+	tests := []struct {
+		name  string
+		setup func(fs *Ramfs)
+		diffs bool
+	}{
+		{"same", func(fs *Ramfs) {}, false},
+		{"changed", func(fs *Ramfs) { addRamFile(t, fs, nil, "missing", "", 0644) }, true},
+	}
+
+	for _, tt := range tests {
+		fs := newTestRamfs()
+		tt.setup(fs)
+		fs.Dotu = true
+		fs.Start(fs)
+		c1, c2 := net.Pipe()
+		fs.NewConn(c1)
+
+		rp := &Replayer{Records: recs}
+		diffs, err := rp.Client(c2)
+		_ = c2.Close()
+		if err != nil {
+			t.Fatalf("%s: Client error = %v", tt.name, err)
+		}
+		if (len(diffs) > 0) != tt.diffs {
+			t.Fatalf("%s: diffs = %v", tt.name, diffs)
+		}
+	}
+}
+
+func TestReplayServer(t *testing.T) {
+	recs := recordRamfs(t)
+	c1, c2 := net.Pipe()
+	type result struct {
+		diffs []*ReplayDiff
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		rp := &Replayer{Records: recs, Timeout: 2 * time.Second}
+		diffs, err := rp.Server(c1)
+		_ = c1.Close()
+		done <- result{diffs, err}
+	}()
+
+	clnt, err := MountConn(c2, "", 8192, OsUsers.Uid2User(0))
+	if err != nil {
+		t.Fatalf("MountConn error = %v", err)
+	}
+	recordSession(t, clnt)
+	r := <-done
+	clnt.Unmount()
+	if r.err != nil || len(r.diffs) != 0 {
+		t.Fatalf("Server diffs = %v, error = %v", r.diffs, r.err)
+	}
+}
@@ -5,23 +5,47 @@
 package go9p
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"sync"
+	"time"
 )
 
 func (srv *Srv) NewConn(c net.Conn) {
+	host := addrHost(c.RemoteAddr())
+	if !srv.addrAcquire(host) {
+		srv.limitHit(limitConnsPerAddr)
+		_ = c.Close()
+		return
+	}
+
 	conn := new(Conn)
 	conn.Srv = srv
 	conn.Msize = srv.Msize
 	conn.Dotu = srv.Dotu
 	conn.Debuglevel = srv.Debuglevel
+	conn.Options = srv.Options
+	conn.Limits = srv.Limits
+	conn.Timeout = srv.Timeout
+	conn.IdleTimeout = srv.IdleTimeout
+	conn.ReadTimeout = srv.ReadTimeout
+	conn.WriteTimeout = srv.WriteTimeout
+	conn.host = host
 	conn.conn = c
 	conn.fidpool = make(map[uint32]*SrvFid)
 	conn.reqs = make(map[uint16]*SrvReq)
 	conn.reqout = make(chan *SrvReq, srv.Maxpend)
 	conn.done = make(chan bool)
-	conn.rchan = make(chan *Fcall, 64)
+	conn.ctx, conn.cancel = context.WithCancelCause(context.Background())
+
+	if uid, ok := peerUid(c); ok {
+		conn.Peer = srv.Upool.Uid2User(uid)
+	}
 
 	srv.Lock()
 	if srv.conns == nil {
@@ -30,13 +54,26 @@ func (srv *Srv) NewConn(c net.Conn) {
 	srv.conns[conn] = conn
 	srv.Unlock()
 
+	if srv.Metrics != nil {
+		srv.Metrics.connOpened()
+	}
+
 	conn.Id = c.RemoteAddr().String()
 	if op, ok := (conn.Srv.ops).(ConnOps); ok {
 		op.ConnOpened(conn)
 	}
 
-	if sop, ok := (interface{}(conn)).(StatsOps); ok {
-		sop.statsRegister()
+	if conn.Limits.Requests > 0 {
+		conn.reqsem = make(chan bool, conn.Limits.Requests)
+	}
+
+	conn.rrate = newRateLimiter(conn.Limits.RecvRate)
+	conn.srate = newRateLimiter(conn.Limits.SendRate)
+	if conn.IdleTimeout > 0 {
+		conn.Lock()
+		conn.lastUse = time.Now()
+		conn.idle = time.AfterFunc(conn.IdleTimeout, conn.idleCheck)
+		conn.Unlock()
 	}
 
 	go conn.recv()
@@ -44,125 +81,134 @@ func (srv *Srv) NewConn(c net.Conn) {
 }
 
 func (conn *Conn) close() {
+	_ = conn.conn.Close()
+	if conn.idle != nil {
+		conn.idle.Stop()
+	}
+
+	conn.cancel(Eclosed)
 	conn.done <- true
 	conn.Srv.Lock()
 	delete(conn.Srv.conns, conn)
 	conn.Srv.Unlock()
 
-	if sop, ok := (interface{}(conn)).(StatsOps); ok {
-		sop.statsUnregister()
-	}
 	if op, ok := (conn.Srv.ops).(ConnOps); ok {
 		op.ConnClosed(conn)
 	}
 
+	conn.limitsRelease()
+
 	/* call FidDestroy for all remaining fids */
-	if op, ok := (conn.Srv.ops).(SrvFidOps); ok {
-		for _, fid := range conn.fidpool {
+	conn.Lock()
+	fids := conn.fidpool
+	conn.fidpool = make(map[uint32]*SrvFid)
+	conn.Unlock()
+
+	op, ok := (conn.Srv.ops).(SrvFidOps)
+	for _, fid := range fids {
+		conn.Srv.exclRelease(fid)
+		if ok {
 			op.FidDestroy(fid)
 		}
 	}
 }
 
 func (conn *Conn) recv() {
-	var err error
-	var n int
-
-	buf := make([]byte, conn.Msize*8)
-	pos := 0
+	r := bufio.NewReaderSize(conn.conn, int(conn.Msize))
 	for {
-		if len(buf) < int(conn.Msize) {
-			b := make([]byte, conn.Msize*8)
-			copy(b, buf[0:pos])
-			buf = b
+		// Each message is read into the buffer of its own Fcall,
+		// so the Fcall (including Data) can be used until the
+		// request is responded, and then returned to the pool.
+		fc := GetFcall(conn.Msize)
+		if _, err := io.ReadFull(r, fc.Buf[0:4]); err != nil {
+			conn.close()
+			return
 		}
 
-		n, err = conn.conn.Read(buf[pos:])
-		if err != nil || n == 0 {
+		sz, _ := Gint32(fc.Buf)
+		if sz > conn.Msize || sz < 7 {
+			log.Println("bad client connection: ", conn.conn.RemoteAddr())
 			conn.close()
 			return
 		}
 
-		pos += n
-		for pos > 4 {
-			sz, _ := Gint32(buf)
-			if sz > conn.Msize {
-				log.Println("bad client connection: ", conn.conn.RemoteAddr())
-				_ = conn.conn.Close()
-				conn.close()
-				return
-			}
-			if pos < int(sz) {
-				if len(buf) < int(sz) {
-					b := make([]byte, conn.Msize*8)
-					copy(b, buf[0:pos])
-					buf = b
-				}
+		if conn.ReadTimeout > 0 {
+			_ = conn.conn.SetReadDeadline(time.Now().Add(conn.ReadTimeout))
+		}
 
-				break
-			}
-			fc, fcsize, err := Unpack(buf, conn.Dotu)
-			if err != nil {
-				log.Printf("invalid packet : %v %v", err, buf)
-				_ = conn.conn.Close()
-				conn.close()
-				return
-			}
+		if _, err := io.ReadFull(r, fc.Buf[4:sz]); err != nil {
+			conn.close()
+			return
+		}
 
-			tag := fc.Tag
-			req := new(SrvReq)
-			select {
-			case req.Rc = <-conn.rchan:
-			default:
-				req.Rc = NewFcall(conn.Msize)
-			}
+		if conn.ReadTimeout > 0 {
+			_ = conn.conn.SetReadDeadline(time.Time{})
+		}
 
-			req.Conn = conn
-			req.Tc = fc
-			//			req.Rc = rc
-			if conn.Debuglevel > 0 {
-				conn.logFcall(req.Tc)
-				if conn.Debuglevel&DbgPrintPackets != 0 {
-					log.Println(">->", conn.Id, fmt.Sprintf("%v", req.Tc.Pkt))
-				}
+		// the size, type and tag are always decoded, a message
+		// that is invalid otherwise is answered with an Rerror
+		_, uerr := UnpackInto(fc, fc.Buf[0:sz], conn.Dotu)
+		if uerr != nil {
+			log.Printf("invalid packet from %v: %v", conn.conn.RemoteAddr(), uerr)
+		}
 
-				if conn.Debuglevel&DbgPrintFcalls != 0 {
-					log.Println(">>>", conn.Id, req.Tc.String())
-				}
-			}
+		if conn.rrate != nil && conn.rrate.wait(int(sz)) {
+			conn.Srv.limitHit(limitRecvRate)
+		}
 
-			conn.Lock()
-			conn.nreqs++
-			conn.tsz += uint64(fc.Size)
-			conn.npend++
-			if conn.npend > conn.maxpend {
-				conn.maxpend = conn.npend
+		// stop reading while too many requests are in progress
+		limited := conn.reqAcquire(fc)
+
+		tag := fc.Tag
+		req := new(SrvReq)
+		req.limited = limited
+		req.Rc = GetFcall(conn.Msize)
+		req.Conn = conn
+		req.Tc = fc
+		req.uerr = uerr
+		req.start = time.Now()
+		conn.reqContext(req)
+		if conn.Debuglevel > 0 {
+			conn.logFcall(req.Tc)
+			if conn.Debuglevel&DbgPrintPackets != 0 {
+				log.Println(">->", conn.Id, fmt.Sprintf("%v", req.Tc.Pkt))
 			}
 
-			req.next = conn.reqs[tag]
-			conn.reqs[tag] = req
-			process := req.next == nil
-			if req.next != nil {
-				req.next.prev = req
-			}
-			conn.Unlock()
-			if process {
-				// Tversion may change some attributes of the
-				// connection, so we block on it. Otherwise,
-				// we may loop back to reading and that is a race.
-				// This fix brought to you by the race detector.
-				if req.Tc.Type == Tversion {
-					req.process()
-				} else {
-					go req.process()
-				}
+			if conn.Debuglevel&DbgPrintFcalls != 0 {
+				log.Println(">>>", conn.Id, req.Tc.String())
 			}
+		}
 
-			buf = buf[fcsize:]
-			pos -= fcsize
+		conn.Lock()
+		conn.nreqs++
+		conn.tsz += uint64(fc.Size)
+		conn.lastUse = req.start
+		conn.npend++
+		if conn.npend > conn.maxpend {
+			conn.maxpend = conn.npend
 		}
-	}
 
+		req.next = conn.reqs[tag]
+		conn.reqs[tag] = req
+		process := req.next == nil
+		if req.next != nil {
+			req.next.prev = req
+		}
+		conn.Unlock()
+		if process {
+			// Tversion may change some attributes of the
+			// connection, so we block on it. Otherwise,
+			// we may loop back to reading and that is a race.
+			// This fix brought to you by the race detector.
+			// Tflush doesn't wait for a worker, so that it
+			// isn't stuck behind the requests it flushes.
+			if req.Tc.Type == Tversion || req.Tc.Type == Tflush {
+				req.process()
+			} else {
+				conn.dispatch(req, true)
+			}
+		}
+	}
 }
 
 func (conn *Conn) send() {
@@ -175,8 +221,9 @@ func (conn *Conn) send() {
 			SetTag(req.Rc, req.Tc.Tag)
 			conn.Lock()
 			conn.rsz += uint64(req.Rc.Size)
-			conn.npend--
+			conn.lastUse = time.Now()
 			conn.Unlock()
+			conn.reqRelease(req)
 			if conn.Debuglevel > 0 {
 				conn.logFcall(req.Rc)
 				if conn.Debuglevel&DbgPrintPackets != 0 {
@@ -188,27 +235,101 @@ func (conn *Conn) send() {
 				}
 			}
 
-			for buf := req.Rc.Pkt; len(buf) > 0; {
-				n, err := conn.conn.Write(buf)
-				if err != nil {
-					/* just close the socket, will get signal on conn.done */
-					log.Println("error while writing")
-					_ = conn.conn.Close()
-					break
-				}
+			if conn.srate != nil && conn.srate.wait(int(req.Rc.Size)) {
+				conn.Srv.limitHit(limitSendRate)
+			}
+
+			if conn.WriteTimeout > 0 {
+				_ = conn.conn.SetWriteDeadline(time.Now().Add(conn.WriteTimeout))
+			}
+
+			if err := conn.write(req); err != nil {
+				/* just close the socket, will get signal on conn.done */
+				log.Println("error while writing")
+				_ = conn.conn.Close()
+			}
+
+			req.releaseData()
+
+			if conn.Srv.Trace != nil {
+				var ev TraceEvent
+				ev.set(conn.Id, req.start, req.Tc, req.Rc)
+				conn.Srv.Trace.Trace(&ev)
+			}
+
+			// the request is done, its messages can be reused
+			PutFcall(req.Tc)
+			PutFcall(req.Rc)
+		}
+	}
+}
+
+// Closes the connection if it is idle, or checks again once it could
+// be. A connection waiting for the response to a request isn't idle.
+func (conn *Conn) idleCheck() {
+	conn.Lock()
+	wait := conn.IdleTimeout
+	if conn.npend == 0 {
+		wait -= time.Since(conn.lastUse)
+	}
+	if wait > 0 {
+		conn.idle.Reset(wait)
+	}
+	conn.Unlock()
+
+	if wait > 0 {
+		return
+	}
+
+	// recv fails and closes the connection, destroying its fids
+	_ = conn.conn.Close()
+}
+
+// Writes the response to the request, followed by its Rread data if it
+// isn't part of the response packet.
+func (conn *Conn) write(req *SrvReq) error {
+	switch {
+	case req.rfile != nil:
+		if _, err := conn.conn.Write(req.Rc.Pkt); err != nil {
+			return err
+		}
+
+		rf := req.rfile
+		n, err := sendFile(conn.conn, rf.f, rf.off, rf.n)
+		if err != nil {
+			return err
+		}
 
-				buf = buf[n:]
+		// The file was truncated after the response was
+		// prepared. The size of the message can't change anymore,
+		// so the rest is sent as zeros.
+		for n < rf.n {
+			m := int64(len(zeroes))
+			if rf.n-n < m {
+				m = rf.n - n
 			}
 
-			select {
-			case conn.rchan <- req.Rc:
-				break
-			default:
+			if _, err := conn.conn.Write(zeroes[0:m]); err != nil {
+				return err
 			}
+
+			n += m
 		}
+
+		return nil
+
+	case req.payload != nil:
+		bufs := net.Buffers{req.Rc.Pkt, req.payload}
+		_, err := bufs.WriteTo(conn.conn)
+		return err
 	}
+
+	_, err := conn.conn.Write(req.Rc.Pkt)
+	return err
 }
 
+var zeroes [4096]byte
+
 func (conn *Conn) RemoteAddr() net.Addr {
 	return conn.conn.RemoteAddr()
 }
@@ -225,10 +346,7 @@ func (conn *Conn) logFcall(fc *Fcall) {
 	}
 
 	if conn.Debuglevel&DbgLogFcalls != 0 {
-		f := new(Fcall)
-		*f = *fc
-		f.Pkt = nil
-		conn.Srv.Log.Log(f, conn, DbgLogFcalls)
+		conn.Srv.Log.Log(fc.clone(), conn, DbgLogFcalls)
 	}
 }
 
@@ -241,6 +359,52 @@ func (srv *Srv) StartNetListener(ntype, addr string) error {
 	return srv.StartListener(l)
 }
 
+// Serves the connection, and returns once it is closed.
+func (srv *Srv) ServeConn(c net.Conn) {
+	sc := &servedConn{Conn: c, closed: make(chan bool)}
+	srv.NewConn(sc)
+	<-sc.closed
+}
+
+// A connection notifying ServeConn once it is closed.
+type servedConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan bool
+}
+
+// Returns the wrapped connection, see unixConn.
+func (c *servedConn) NetConn() net.Conn { return c.Conn }
+
+func (c *servedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
+
+// Returns the Unix socket of the connection, looking through the
+// connections wrapping another one with a NetConn method, like the
+// ones of ServeConn and tls.Conn. Returns nil if it isn't one.
+func unixConn(c net.Conn) *net.UnixConn {
+	for {
+		switch cc := c.(type) {
+		case *net.UnixConn:
+			return cc
+		case interface{ NetConn() net.Conn }:
+			c = cc.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// Serves a single connection on the standard input and output, like a
+// server started by "ssh host ufs -stdio". Returns once the client
+// closes it. Nothing else should be written to the standard output.
+func (srv *Srv) ServeStdio() {
+	srv.ServeConn(NewFileConn(os.Stdin, os.Stdout, "stdio"))
+}
+
 // Start listening on the specified network and address for incoming
 // connections. Once a connection is established, create a new Conn
 // value, read messages from the socket, send them to the specified
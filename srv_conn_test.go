@@ -1,9 +1,11 @@
 package go9p
 
 import (
+	"io"
 	"net"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestConnAddressesAndLogFcall(t *testing.T) {
@@ -34,3 +36,215 @@ func TestStartNetListenerError(t *testing.T) {
 		t.Fatalf("error = %v", err)
 	}
 }
+
+// Sends the T-message on c and reads the response into buf. Returns
+// the type of the response.
+func rawRpc(tb testing.TB, c net.Conn, tc *Fcall, buf []byte) uint8 {
+	if _, err := c.Write(tc.Pkt); err != nil {
+		tb.Fatalf("Write error = %v", err)
+	}
+
+	if _, err := io.ReadFull(c, buf[0:4]); err != nil {
+		tb.Fatalf("ReadFull error = %v", err)
+	}
+
+	sz, _ := gint32(buf)
+	if _, err := io.ReadFull(c, buf[4:sz]); err != nil {
+		tb.Fatalf("ReadFull error = %v", err)
+	}
+
+	return buf[4]
+}
+
+// Starts a Ramfs with a 4k /file, and returns the client side of a
+// connection that has the file open as fid 2.
+func newRawRamfsConn(tb testing.TB) (net.Conn, []byte) {
+	fs := newTestRamfs()
+	f := &ramFile{fs: fs, data: make([]byte, 4096)}
+	if err := f.Add(fs.Root, "file", OsUsers.Uid2User(0), nil, 0666, f); err != nil {
+		tb.Fatalf("Add error = %v", err)
+	}
+	f.Length = 4096
+	fs.Dotu = true
+	fs.Start(fs)
+
+	c1, c2 := net.Pipe()
+	fs.NewConn(c1)
+	tb.Cleanup(func() { _ = c2.Close() })
+
+	buf := make([]byte, 8192+IOHDRSZ)
+	tc := NewFcall(8192 + IOHDRSZ)
+	steps := []func() error{
+		func() error { return PackTversion(tc, 8192+IOHDRSZ, "9P2000.u") },
+		func() error { return PackTattach(tc, 1, NOFID, "", "", 0, true) },
+		func() error { return PackTwalk(tc, 1, 2, []string{"file"}) },
+		func() error { return PackTopen(tc, 2, ORDWR) },
+	}
+	for _, pack := range steps {
+		if err := pack(); err != nil {
+			tb.Fatalf("pack error = %v", err)
+		}
+		if rtype := rawRpc(tb, c2, tc, buf); rtype != tc.Type+1 {
+			tb.Fatalf("%s failed", MsgName(tc.Type))
+		}
+	}
+
+	return c2, buf
+}
+
+func BenchmarkSrvRead(b *testing.B) {
+	c, buf := newRawRamfsConn(b)
+	tc := NewFcall(IOHDRSZ)
+	if err := PackTread(tc, 2, 0, 4096); err != nil {
+		b.Fatalf("PackTread error = %v", err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rawRpc(b, c, tc, buf)
+	}
+}
+
+func BenchmarkSrvWrite(b *testing.B) {
+	c, buf := newRawRamfsConn(b)
+	tc := NewFcall(4096 + IOHDRSZ)
+	if err := PackTwrite(tc, 2, 0, 4096, make([]byte, 4096)); err != nil {
+		b.Fatalf("PackTwrite error = %v", err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rawRpc(b, c, tc, buf)
+	}
+}
+
+// Fails unless the server closes c soon, without sending anything.
+func expectClosed(t *testing.T, c net.Conn) {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf [64]byte
+	if n, err := c.Read(buf[:]); err != io.EOF {
+		t.Fatalf("Read = %d, %v, want EOF", n, err)
+	}
+}
+
+func TestConnTimeouts(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(srv *Srv)
+		run   func(t *testing.T, c net.Conn)
+	}{
+		{"idle", func(srv *Srv) { srv.IdleTimeout = 20 * time.Millisecond }, func(t *testing.T, c net.Conn) {
+			tc := NewFcall(8192)
+			if err := PackTversion(tc, 8192, "9P2000"); err != nil {
+				t.Fatalf("PackTversion error = %v", err)
+			}
+			if rtype := rawRpc(t, c, tc, make([]byte, 8192)); rtype != Rversion {
+				t.Fatalf("Tversion failed")
+			}
+		}},
+		{"read", func(srv *Srv) { srv.ReadTimeout = 20 * time.Millisecond }, func(t *testing.T, c net.Conn) {
+			// the size of a message that never arrives
+			if _, err := c.Write([]byte{20, 0, 0, 0}); err != nil {
+				t.Fatalf("Write error = %v", err)
+			}
+		}},
+		{"write", func(srv *Srv) { srv.WriteTimeout = 20 * time.Millisecond }, func(t *testing.T, c net.Conn) {
+			tc := NewFcall(8192)
+			if err := PackTversion(tc, 8192, "9P2000"); err != nil {
+				t.Fatalf("PackTversion error = %v", err)
+			}
+			if _, err := c.Write(tc.Pkt); err != nil {
+				t.Fatalf("Write error = %v", err)
+			}
+			// the response is never read
+			time.Sleep(100 * time.Millisecond)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestRamfs()
+			tt.setup(&fs.Srv)
+			fs.Start(fs)
+			c1, c2 := net.Pipe()
+			t.Cleanup(func() { _ = c2.Close() })
+			fs.NewConn(c1)
+			tt.run(t, c2)
+			expectClosed(t, c2)
+		})
+	}
+}
+
+func TestConnIdlePending(t *testing.T) {
+	fs := &dispatchRamfs{newTestRamfs(), make(chan *SrvReq, 16), make(chan bool)}
+	fs.IdleTimeout = 200 * time.Millisecond
+	fs.Dotu = true
+	fs.Start(fs)
+	clnt := mountPipe(t, fs)
+
+	f, err := clnt.FOpen("/", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	// a connection waiting for a response isn't idle
+	r := startRead(t, f)
+	<-fs.started
+	time.Sleep(400 * time.Millisecond)
+	fs.release <- true
+	if r := <-r.Done; r.Err != nil {
+		t.Fatalf("read error = %v", r.Err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if _, err := clnt.FStat("/"); err == nil {
+		t.Fatalf("FStat on an idle connection succeeded")
+	}
+
+	fs.Lock()
+	n := len(fs.conns)
+	fs.Unlock()
+	if n != 0 {
+		t.Fatalf("%d connections after the idle timeout", n)
+	}
+}
+
+func TestConnInvalidMsg(t *testing.T) {
+	c, buf := newRawRamfsConn(t)
+	names := [][]byte{le32(2), le32(3), le16(MAXWELEM + 1)}
+	for i := 0; i <= MAXWELEM; i++ {
+		names = append(names, str("a"))
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"twalk names", testMsg(Twalk, names...)},
+		{"type", testMsg(Tlast, le32(2))},
+		{"trailing", testMsg(Tclunk, le32(2), []byte{0})},
+	}
+
+	for _, tt := range tests {
+		// the request is answered on its tag, the connection stays open
+		if rtype := rawRpc(t, c, &Fcall{Pkt: tt.msg}, buf); rtype != Rerror {
+			t.Fatalf("%s: response type = %d", tt.name, rtype)
+		}
+		if tag, _ := gint16(buf[5:]); tag != 1 {
+			t.Fatalf("%s: response tag = %d", tt.name, tag)
+		}
+	}
+
+	tc := NewFcall(IOHDRSZ)
+	if err := PackTread(tc, 2, 0, 4); err != nil {
+		t.Fatalf("PackTread error = %v", err)
+	}
+	if rtype := rawRpc(t, c, tc, buf); rtype != Rread {
+		t.Fatalf("read after invalid messages type = %d", rtype)
+	}
+}
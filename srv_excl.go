@@ -0,0 +1,102 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+// Marks the file the fid points to as opened for exclusive use by the
+// fid. Returns false if another fid already has it open.
+func (srv *Srv) exclAcquire(fid *SrvFid) bool {
+	path := fid.qid.Path
+	srv.Lock()
+	defer srv.Unlock()
+	if f, ok := srv.excl[path]; ok {
+		return f == fid
+	}
+
+	if srv.excl == nil {
+		srv.excl = make(map[uint64]*SrvFid)
+	}
+
+	srv.excl[path] = fid
+	fid.excl = true
+	return true
+}
+
+// Releases the exclusive-use file held open by the fid, if any.
+func (srv *Srv) exclRelease(fid *SrvFid) {
+	if !fid.excl {
+		return
+	}
+
+	srv.Lock()
+	if srv.excl[fid.qid.Path] == fid {
+		delete(srv.excl, fid.qid.Path)
+	}
+	fid.excl = false
+	srv.Unlock()
+}
+
+// Locks the append-only file with the specified Qid.Path so
+// its end doesn't move while a write is in progress.
+func (srv *Srv) appendLock(path uint64) *pathLock {
+	srv.Lock()
+	if srv.appends == nil {
+		srv.appends = make(map[uint64]*pathLock)
+	}
+
+	l := srv.appends[path]
+	if l == nil {
+		l = &pathLock{path: path}
+		srv.appends[path] = l
+	}
+	l.ref++
+	srv.Unlock()
+
+	l.Lock()
+	return l
+}
+
+func (srv *Srv) appendUnlock(l *pathLock) {
+	l.Unlock()
+	srv.Lock()
+	l.ref--
+	if l.ref == 0 {
+		delete(srv.appends, l.path)
+	}
+	srv.Unlock()
+}
+
+// Runs a request generated by the server through the handlers and
+// waits until it is responded. The response is not sent to the client,
+// the caller should release it with PutFcall.
+func (srv *Srv) internal(conn *Conn, tc *Fcall) *Fcall {
+	req := new(SrvReq)
+	req.Conn = conn
+	req.ctx = conn.ctx
+	req.status = reqInternal
+	req.done = make(chan bool)
+	req.Tc = tc
+	req.Rc = GetFcall(conn.Msize)
+	srv.getHandler().Process(req)
+	<-req.done
+
+	return req.Rc
+}
+
+// Returns the metadata of the file the fid points to by sending a Tstat
+// through the handlers of the server.
+func (srv *Srv) fidStat(conn *Conn, fid *SrvFid) (*Dir, error) {
+	rc := srv.internal(conn, &Fcall{Type: Tstat, Tag: NOTAG, Fid: fid.fid})
+	var d *Dir
+	var err error
+	if rc.Type == Rerror {
+		err = &Error{rc.Error, rc.Errornum}
+	} else {
+		d = new(Dir)
+		*d = rc.Dir
+	}
+
+	PutFcall(rc)
+	return d, err
+}
@@ -0,0 +1,229 @@
+package go9p
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type appendSrvOps struct {
+	testSrvOps
+	length  uint64
+	offset  uint64
+	statErr error
+}
+
+func (ops *appendSrvOps) Stat(req *SrvReq) {
+	if ops.statErr != nil {
+		req.RespondError(ops.statErr)
+		return
+	}
+	req.RespondRstat(&Dir{Name: "file", Length: ops.length})
+}
+
+func (ops *appendSrvOps) Write(req *SrvReq) {
+	ops.offset = req.Tc.Offset
+	req.RespondRwrite(req.Tc.Count)
+}
+
+func TestSrvOpenExclusive(t *testing.T) {
+	ops := &testSrvOps{}
+	req := newSrvReq(Topen, ops)
+	srv := req.Conn.Srv
+	other := &SrvFid{Fconn: req.Conn, qid: Qid{Path: 7}}
+	if !srv.exclAcquire(other) {
+		t.Fatalf("exclAcquire failed")
+	}
+
+	fid := req.Conn.FidNew(1)
+	fid.Type = QTEXCL
+	fid.qid = Qid{Type: QTEXCL, Path: 7}
+	req.Fid = fid
+	req.Tc.Fid = 1
+	srv.open(req)
+	if req.Rc.Type != Rerror || !strings.Contains(req.Rc.Error, "exclusive") {
+		t.Fatalf("open type = %d error = %q", req.Rc.Type, req.Rc.Error)
+	}
+
+	srv.exclRelease(other)
+	req = newSrvReq(Topen, ops)
+	req.Conn.Srv = srv
+	fid.Fconn = req.Conn
+	fid.IncRef()
+	req.Fid = fid
+	srv.open(req)
+	if req.Rc.Type != Ropen {
+		t.Fatalf("open type = %d error = %q", req.Rc.Type, req.Rc.Error)
+	}
+	if !fid.opened || fid.excl {
+		t.Fatalf("non-exclusive qid from server kept the file locked")
+	}
+	if len(srv.excl) != 0 {
+		t.Fatalf("excl = %v", srv.excl)
+	}
+}
+
+func TestSrvCreateExclusive(t *testing.T) {
+	ops := &testSrvOps{}
+	req := newSrvReq(Tcreate, ops)
+	srv := req.Conn.Srv
+	fid := req.Conn.FidNew(1)
+	fid.IncRef()
+	req.Fid = fid
+	req.Rc.Type = Rcreate
+	req.Rc.Qid = Qid{Type: QTEXCL, Path: 9}
+	srv.createPost(req)
+	if !fid.excl || srv.excl[9] != fid {
+		t.Fatalf("created exclusive file not locked")
+	}
+
+	other := &SrvFid{Fconn: req.Conn, qid: Qid{Path: 9}}
+	if srv.exclAcquire(other) {
+		t.Fatalf("second exclAcquire succeeded")
+	}
+
+	fid.DecRef()
+	fid.DecRef()
+	if len(srv.excl) != 0 {
+		t.Fatalf("destroyed fid still holds the file: %v", srv.excl)
+	}
+}
+
+func TestSrvOpenPostExclusive(t *testing.T) {
+	for _, typ := range []uint8{Topen, Tcreate} {
+		ops := &testSrvOps{}
+		req := newSrvReq(typ, ops)
+		srv := req.Conn.Srv
+		other := &SrvFid{Fconn: req.Conn, qid: Qid{Path: 7}}
+		if !srv.exclAcquire(other) {
+			t.Fatalf("exclAcquire failed")
+		}
+
+		// the walked qid isn't exclusive, the one the server opened is
+		fid := req.Conn.FidNew(1)
+		fid.IncRef()
+		fid.qid = Qid{Path: 7}
+		fid.Omode = ORCLOSE
+		req.Fid = fid
+		req.Tc.Fid = 1
+		req.Rc.Qid = Qid{Type: QTEXCL, Path: 7}
+		if typ == Topen {
+			req.Rc.Type = Ropen
+			srv.openPost(req)
+		} else {
+			req.Rc.Type = Rcreate
+			srv.createPost(req)
+		}
+
+		if req.Rc.Type != Rerror || !strings.Contains(req.Rc.Error, "exclusive") {
+			t.Fatalf("%d response type = %d error = %q", typ, req.Rc.Type, req.Rc.Error)
+		}
+		if fid.opened || fid.excl || srv.excl[7] != other {
+			t.Fatalf("%d opened = %v excl = %v holder = %p", typ, fid.opened, fid.excl, srv.excl[7])
+		}
+
+		// what the server opened is released, a created file is removed
+		if typ == Topen && (!ops.clunkCalled || ops.removeCalled) {
+			t.Fatalf("open clunk = %v remove = %v", ops.clunkCalled, ops.removeCalled)
+		}
+		if typ == Tcreate && !ops.removeCalled {
+			t.Fatalf("created file not removed")
+		}
+		fid.DecRef()
+		if req.Conn.FidGet(1) != nil {
+			t.Fatalf("%d fid not clunked", typ)
+		}
+	}
+}
+
+func TestSrvWriteAppendUse(t *testing.T) {
+	var mu sync.Mutex
+	var log []string
+	ops := &appendSrvOps{length: 42}
+	req := newSrvReq(Twrite, &ops.testSrvOps)
+	srv := req.Conn.Srv
+	srv.ops = ops
+	srv.Use(func(next Handler) Handler {
+		return &testMiddleware{next, "mw", 0, &mu, &log}
+	})
+	srv.buildHandler()
+	fid := req.Conn.FidNew(1)
+	fid.IncRef()
+	fid.Type = QTAPPEND
+	fid.qid = Qid{Type: QTAPPEND, Path: 3}
+	fid.opened = true
+	fid.Omode = OWRITE
+	req.Fid = fid
+	req.Tc.Fid = 1
+	req.Tc.Data = []byte("data")
+	req.Tc.Count = uint32(len(req.Tc.Data))
+
+	srv.write(req)
+	if req.Rc.Type != Rwrite || ops.offset != 42 {
+		t.Fatalf("write type = %d offset = %d", req.Rc.Type, ops.offset)
+	}
+
+	// the Tstat for the end of the file goes through the middleware
+	want := []string{"mw Tstat", "mw Rstat", "mw Rwrite"}
+	if fmt.Sprint(log) != fmt.Sprint(want) {
+		t.Fatalf("log = %v, want %v", log, want)
+	}
+}
+
+func TestSrvWriteAppend(t *testing.T) {
+	tests := []struct {
+		name    string
+		statErr error
+		wantErr string
+	}{
+		{
+			name: "ok",
+		},
+		{
+			name:    "stat-error",
+			statErr: &Error{"stat boom", EIO},
+			wantErr: "stat boom",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := &appendSrvOps{length: 42, offset: 1, statErr: tt.statErr}
+			req := newSrvReq(Twrite, &ops.testSrvOps)
+			srv := req.Conn.Srv
+			srv.ops = ops
+			fid := req.Conn.FidNew(1)
+			fid.IncRef()
+			fid.Type = QTAPPEND
+			fid.qid = Qid{Type: QTAPPEND, Path: 3}
+			fid.opened = true
+			fid.Omode = OWRITE
+			req.Fid = fid
+			req.Tc.Fid = 1
+			req.Tc.Offset = 0
+			req.Tc.Data = []byte("data")
+			req.Tc.Count = uint32(len(req.Tc.Data))
+
+			srv.write(req)
+			if tt.wantErr != "" {
+				if req.Rc.Type != Rerror || !strings.Contains(req.Rc.Error, tt.wantErr) {
+					t.Fatalf("write type = %d error = %q", req.Rc.Type, req.Rc.Error)
+				}
+			} else {
+				if req.Rc.Type != Rwrite {
+					t.Fatalf("write type = %d error = %q", req.Rc.Type, req.Rc.Error)
+				}
+				if ops.offset != 42 {
+					t.Fatalf("write offset = %d, want 42", ops.offset)
+				}
+			}
+			if len(srv.appends) != 0 {
+				t.Fatalf("append lock not released")
+			}
+			if fid.refcount != 1 {
+				t.Fatalf("fid refcount = %d", fid.refcount)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@
 
 package go9p
 
+import "strings"
+
 func (srv *Srv) version(req *SrvReq) {
 	tc := req.Tc
 	conn := req.Conn
@@ -17,6 +19,12 @@ func (srv *Srv) version(req *SrvReq) {
 		conn.Msize = tc.Msize
 	}
 
+	/* only the part of the version before the period matters */
+	if v, _, _ := strings.Cut(tc.Version, "."); v != "9P2000" {
+		req.RespondRversion(conn.Msize, "unknown")
+		return
+	}
+
 	conn.Dotu = tc.Version == "9P2000.u" && srv.Dotu
 	ver := "9P2000"
 	if conn.Dotu {
@@ -49,21 +57,15 @@ func (srv *Srv) auth(req *SrvReq) {
 		return
 	}
 
-	req.Afid = conn.FidNew(tc.Afid)
-	if req.Afid == nil {
-		req.RespondError(Einuse)
+	var err error
+	if req.Afid, err = conn.fidNew(tc.Afid); err != nil {
+		req.RespondError(err)
 		return
 	}
 
-	var user User
-	if tc.Unamenum != NOUID || conn.Dotu {
-		user = srv.Upool.Uid2User(int(tc.Unamenum))
-	} else if tc.Uname != "" {
-		user = srv.Upool.Uname2User(tc.Uname)
-	}
-
-	if user == nil {
-		req.RespondError(Enouser)
+	user, err := conn.reqUser(tc)
+	if err != nil {
+		req.RespondError(err)
 		return
 	}
 
@@ -89,6 +91,33 @@ func (srv *Srv) authPost(req *SrvReq) {
 	}
 }
 
+// Returns the user of a Tauth or Tattach.
+func (conn *Conn) reqUser(tc *Fcall) (User, error) {
+	srv := conn.Srv
+	var user User
+	if tc.Unamenum != NOUID || conn.Dotu {
+		user = srv.Upool.Uid2User(int(tc.Unamenum))
+	} else if tc.Uname != "" {
+		user = srv.Upool.Uname2User(tc.Uname)
+	}
+
+	if user == nil {
+		return nil, Enouser
+	}
+
+	if srv.PeerUsers && unixConn(conn.conn) != nil && !peerAllows(conn.Peer, user) {
+		return nil, Enotpeer
+	}
+
+	return user, nil
+}
+
+// Returns true if the peer of a Unix socket can attach as the user. The
+// peer root can attach as anyone. If the peer isn't known, nobody can.
+func peerAllows(peer, user User) bool {
+	return peer != nil && (peer.Id() == 0 || peer.Id() == user.Id())
+}
+
 func (srv *Srv) attach(req *SrvReq) {
 	tc := req.Tc
 	conn := req.Conn
@@ -97,9 +126,9 @@ func (srv *Srv) attach(req *SrvReq) {
 		return
 	}
 
-	req.Fid = conn.FidNew(tc.Fid)
-	if req.Fid == nil {
-		req.RespondError(Einuse)
+	var err error
+	if req.Fid, err = conn.fidNew(tc.Fid); err != nil {
+		req.RespondError(err)
 		return
 	}
 
@@ -110,15 +139,14 @@ func (srv *Srv) attach(req *SrvReq) {
 		}
 	}
 
-	var user User
-	if tc.Unamenum != NOUID || conn.Dotu {
-		user = srv.Upool.Uid2User(int(tc.Unamenum))
-	} else if tc.Uname != "" {
-		user = srv.Upool.Uname2User(tc.Uname)
+	user, err := conn.reqUser(tc)
+	if err != nil {
+		req.RespondError(err)
+		return
 	}
 
-	if user == nil {
-		req.RespondError(Enouser)
+	if err := conn.userAcquire(user.Name()); err != nil {
+		req.RespondError(err)
 		return
 	}
 
@@ -136,7 +164,7 @@ func (srv *Srv) attach(req *SrvReq) {
 
 func (srv *Srv) attachPost(req *SrvReq) {
 	if req.Rc != nil && req.Rc.Type == Rattach {
-		req.Fid.Type = req.Rc.Qid.Type
+		req.Fid.setQid(req.Rc.Qid)
 		req.Fid.IncRef()
 	}
 }
@@ -167,6 +195,10 @@ func (srv *Srv) flush(req *SrvReq) {
 	}
 	r.Unlock()
 
+	if r.cancel != nil {
+		r.cancel(Eflushed)
+	}
+
 	if (status & (reqWork | reqSaved)) == 0 {
 		r.Respond()
 	} else {
@@ -194,14 +226,14 @@ func (srv *Srv) walk(req *SrvReq) {
 	}
 
 	if tc.Fid != tc.Newfid {
-		req.Newfid = conn.FidNew(tc.Newfid)
-		if req.Newfid == nil {
-			req.RespondError(Einuse)
+		var err error
+		if req.Newfid, err = conn.fidNew(tc.Newfid); err != nil {
+			req.RespondError(err)
 			return
 		}
 
 		req.Newfid.User = fid.User
-		req.Newfid.Type = fid.Type
+		req.Newfid.setQid(fid.qid)
 	} else {
 		req.Newfid = req.Fid
 		req.Newfid.IncRef()
@@ -218,9 +250,9 @@ func (srv *Srv) walkPost(req *SrvReq) {
 
 	n := len(rc.Wqid)
 	if n > 0 {
-		req.Newfid.Type = rc.Wqid[n-1].Type
+		req.Newfid.setQid(rc.Wqid[n-1])
 	} else {
-		req.Newfid.Type = req.Fid.Type
+		req.Newfid.setQid(req.Fid.qid)
 	}
 
 	// Don't retain the fid if only a partial walk succeeded
@@ -246,13 +278,36 @@ func (srv *Srv) open(req *SrvReq) {
 		return
 	}
 
+	if (fid.Type&QTEXCL) != 0 && !srv.exclAcquire(fid) {
+		req.RespondError(Eexcl)
+		return
+	}
+
+	fid.Lock()
 	fid.Omode = tc.Mode
+	fid.Unlock()
 	(req.Conn.Srv.ops).(SrvReqOps).Open(req)
 }
 
 func (srv *Srv) openPost(req *SrvReq) {
-	if req.Fid != nil {
-		req.Fid.opened = req.Rc != nil && req.Rc.Type == Ropen
+	fid := req.Fid
+	if fid == nil {
+		return
+	}
+
+	fid.setOpened(req.Rc != nil && req.Rc.Type == Ropen)
+	if !fid.opened {
+		srv.exclRelease(fid)
+		return
+	}
+
+	if (req.Rc.Qid.Type&QTEXCL) == 0 || req.Rc.Qid.Path != fid.qid.Path {
+		srv.exclRelease(fid)
+	}
+
+	fid.setQid(req.Rc.Qid)
+	if (fid.Type&QTEXCL) != 0 && !srv.exclAcquire(fid) {
+		srv.exclFail(req)
 	}
 }
 
@@ -281,15 +336,40 @@ func (srv *Srv) create(req *SrvReq) {
 		return
 	}
 
+	fid.Lock()
 	fid.Omode = tc.Mode
+	fid.Unlock()
 	(req.Conn.Srv.ops).(SrvReqOps).Create(req)
 }
 
 func (srv *Srv) createPost(req *SrvReq) {
 	if req.Rc != nil && req.Rc.Type == Rcreate && req.Fid != nil {
-		req.Fid.Type = req.Rc.Qid.Type
-		req.Fid.opened = true
+		req.Fid.setQid(req.Rc.Qid)
+		req.Fid.setOpened(true)
+		if (req.Fid.Type&QTEXCL) != 0 && !srv.exclAcquire(req.Fid) {
+			srv.exclFail(req)
+		}
+	}
+}
+
+// Turns the response to a Topen or Tcreate into Eexcl, if the file
+// server returned the qid of an exclusive-use file that another fid
+// already has open. What the file server opened is released by clunking
+// the fid, a created file is removed, so the fid is gone after Eexcl.
+func (srv *Srv) exclFail(req *SrvReq) {
+	fid := req.Fid
+	conn := req.Conn
+
+	// an ORCLOSE fid isn't removed by the clunk
+	fid.setOpened(false)
+	typ := uint8(Tclunk)
+	if req.Tc.Type == Tcreate {
+		typ = Tremove
 	}
+
+	PutFcall(srv.internal(conn, &Fcall{Type: typ, Tag: NOTAG, Fid: fid.fid}))
+	e := Eexcl.(*Error)
+	_ = PackRerror(req.Rc, conn.Options.ename(e.Err, e.Errornum), e.Errornum, conn.Dotu)
 }
 
 func (srv *Srv) read(req *SrvReq) {
@@ -372,9 +452,32 @@ func (srv *Srv) write(req *SrvReq) {
 		return
 	}
 
+	/* writes to append-only files always go to the end of the file.
+	   The lock is held until the write is responded, so concurrent
+	   appends don't get the same offset. A file server that blocks in
+	   Write delays the other appends to the file until it responds or
+	   the write is flushed. */
+	if (fid.Type & QTAPPEND) != 0 {
+		req.alock = srv.appendLock(fid.qid.Path)
+		d, err := srv.fidStat(req.Conn, fid)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+
+		tc.Offset = d.Length
+	}
+
 	(req.Conn.Srv.ops).(SrvReqOps).Write(req)
 }
 
+func (srv *Srv) writePost(req *SrvReq) {
+	if req.alock != nil {
+		srv.appendUnlock(req.alock)
+		req.alock = nil
+	}
+}
+
 func (srv *Srv) clunk(req *SrvReq) {
 	fid := req.Fid
 	if (fid.Type & QTAUTH) != 0 {
@@ -392,7 +495,9 @@ func (srv *Srv) clunk(req *SrvReq) {
 }
 
 func (srv *Srv) clunkPost(req *SrvReq) {
-	if req.Rc != nil && req.Rc.Type == Rclunk && req.Fid != nil {
+	if req.Fid == nil {
+		srv.fidRelease(req)
+	} else if req.Rc != nil && req.Rc.Type == Rclunk {
 		req.Fid.DecRef()
 	}
 }
@@ -400,11 +505,30 @@ func (srv *Srv) clunkPost(req *SrvReq) {
 func (srv *Srv) remove(req *SrvReq) { (req.Conn.Srv.ops).(SrvReqOps).Remove(req) }
 
 func (srv *Srv) removePost(req *SrvReq) {
-	if req.Rc != nil && req.Fid != nil {
+	if req.Fid == nil {
+		srv.fidRelease(req)
+	} else if req.Rc != nil {
 		req.Fid.DecRef()
 	}
 }
 
+// Releases the fid of a Tclunk or Tremove that was responded without
+// being processed, e.g. by a middleware. The fid is gone whatever the
+// response, unless the request was flushed.
+func (srv *Srv) fidRelease(req *SrvReq) {
+	req.Lock()
+	flushed := (req.status & reqFlush) != 0
+	req.Unlock()
+	if flushed || req.uerr != nil || req.Tc.Fid == NOFID {
+		return
+	}
+
+	if fid := req.Conn.FidGet(req.Tc.Fid); fid != nil {
+		fid.DecRef()
+		fid.DecRef()
+	}
+}
+
 func (srv *Srv) stat(req *SrvReq) { (req.Conn.Srv.ops).(SrvReqOps).Stat(req) }
 
 func (srv *Srv) wstat(req *SrvReq) {
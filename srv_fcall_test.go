@@ -1,6 +1,7 @@
 package go9p
 
 import (
+	"net"
 	"strings"
 	"testing"
 )
@@ -130,6 +131,62 @@ func TestSrvAuth(t *testing.T) {
 	}
 }
 
+func TestSrvVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{"9P2000", "9P2000"},
+		{"9P2000.u", "9P2000.u"},
+		{"9P2000.L", "9P2000"},
+		{"9P2001", "unknown"},
+		{"", "unknown"},
+	}
+
+	for _, tt := range tests {
+		req := newSrvReq(Tversion, &testSrvOps{})
+		req.Tc.Tag = NOTAG
+		req.Tc.Msize = 8192
+		req.Tc.Version = tt.version
+
+		req.Conn.Srv.version(req)
+		if req.Rc.Type != Rversion || req.Rc.Version != tt.want {
+			t.Fatalf("version(%q) = %d %q, want %q", tt.version, req.Rc.Type, req.Rc.Version, tt.want)
+		}
+	}
+}
+
+// A connection that asked for an unknown version can negotiate again.
+func TestSrvVersionUnknown(t *testing.T) {
+	fs := newTestRamfs()
+	fs.Start(fs)
+	c1, c2 := net.Pipe()
+	fs.NewConn(c1)
+	t.Cleanup(func() { _ = c2.Close() })
+
+	buf := make([]byte, 8192)
+	tc := NewFcall(8192)
+	for _, v := range []struct{ version, want string }{{"9P2001", "unknown"}, {"9P2000", "9P2000"}} {
+		if err := PackTversion(tc, 8192, v.version); err != nil {
+			t.Fatalf("PackTversion error = %v", err)
+		}
+		if rtype := rawRpc(t, c2, tc, buf); rtype != Rversion {
+			t.Fatalf("Tversion %q response type = %d", v.version, rtype)
+		}
+		rc, _, err := Unpack(buf, false)
+		if err != nil || rc.Version != v.want {
+			t.Fatalf("Tversion %q = %v, %v, want %q", v.version, rc, err, v.want)
+		}
+	}
+
+	if err := PackTattach(tc, 1, NOFID, "", "", NOUID, false); err != nil {
+		t.Fatalf("PackTattach error = %v", err)
+	}
+	if rtype := rawRpc(t, c2, tc, buf); rtype != Rattach {
+		t.Fatalf("Tattach response type = %d", rtype)
+	}
+}
+
 func TestSrvFlushNoRequest(t *testing.T) {
 	ops := &testSrvOps{}
 	req := newSrvReq(Tflush, ops)
@@ -8,6 +8,7 @@ package go9p
 
 import (
 	"log"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,7 +23,7 @@ type FStatOp interface {
 // The FWstatOp interface provides a single operation (Wstat) that will be
 // called when the client requests the srvFile metadata to be modified. If
 // implemented, the operation will be called when Twstat message is received.
-// If not implemented, "permission denied" error will be sent back. If the
+// If not implemented, the default (*srvFile) Wstat handling is applied. If the
 // operation returns an Error, the error is send back to the client.
 type FWstatOp interface {
 	Wstat(*FFid, *Dir) error
@@ -77,7 +78,8 @@ type FDestroyOp interface {
 type FFlags int
 
 const (
-	Fremoved FFlags = 1 << iota
+	Fremoved  FFlags = 1 << iota
+	Fremoving        // the directory is being removed, no files can be added to it
 )
 
 // The srvFile type represents a file (or directory) served by the file server.
@@ -111,6 +113,12 @@ var qnext uint64
 var Eexist = &Error{"file already exists", EEXIST}
 var Enoent = &Error{"file not found", ENOENT}
 var Enotempty = &Error{"directory not empty", EPERM}
+var Emoveloop = &Error{"cannot move a directory into itself", EINVAL}
+var Ebadname = &Error{"bad file name", EINVAL}
+
+// Serializes Move operations, so concurrent moves can't create loops
+// in the tree.
+var mvlock sync.Mutex
 
 // Creates a file server with root as root directory
 func NewsrvFileSrv(root *srvFile) *Fsrv {
@@ -161,6 +169,11 @@ func (f *srvFile) Add(dir *srvFile, name string, uid User, gid Group, mode uint3
 	if dir != nil {
 		f.Parent = dir
 		dir.Lock()
+		if (dir.flags & (Fremoved | Fremoving)) != 0 {
+			dir.Unlock()
+			return Enoent
+		}
+
 		for p := dir.cfirst; p != nil; p = p.next {
 			if name == p.Name {
 				dir.Unlock()
@@ -177,6 +190,7 @@ func (f *srvFile) Add(dir *srvFile, name string, uid User, gid Group, mode uint3
 		f.prev = dir.clast
 		f.next = nil
 		dir.clast = f
+		dir.Version++
 		dir.Unlock()
 	} else {
 		f.Parent = f
@@ -213,20 +227,240 @@ func (f *srvFile) Remove() {
 
 	f.next = nil
 	f.prev = nil
+	p.Version++
 	p.Unlock()
 }
 
+// Renames the file within its current directory.
 func (f *srvFile) Rename(name string) error {
+	return f.Move(f.Parent, name)
+}
+
+// Moves the file to directory dir and gives it a new name. The versions
+// of both the old and the new directory are increased. Returns Eexist if
+// dir already contains a file with that name, or Emoveloop if the file
+// is a directory and dir is inside it.
+func (f *srvFile) Move(dir *srvFile, name string) error {
+	mvlock.Lock()
+	defer mvlock.Unlock()
+
+	f.Lock()
+	removed := (f.flags & Fremoved) != 0
+	f.Unlock()
+	if removed || f.Parent == nil || f.Parent == f {
+		return Enoent
+	}
+
+	if (dir.Mode & DMDIR) == 0 {
+		return Enotdir
+	}
+
+	for d := dir; ; d = d.Parent {
+		if d == f {
+			return Emoveloop
+		}
+
+		if d.Parent == nil || d.Parent == d {
+			break
+		}
+	}
+
+	// lock the directories in Qid.Path order to avoid deadlocks
 	p := f.Parent
-	p.Lock()
-	defer p.Unlock()
-	for c := p.cfirst; c != nil; c = c.next {
-		if name == c.Name {
+	first, second := p, dir
+	if p != dir && dir.Path < p.Path {
+		first, second = dir, p
+	}
+
+	first.Lock()
+	if second != first {
+		second.Lock()
+		defer second.Unlock()
+	}
+	defer first.Unlock()
+
+	if p != dir && (dir.flags&(Fremoved|Fremoving)) != 0 {
+		return Enoent
+	}
+
+	for c := dir.cfirst; c != nil; c = c.next {
+		if c != f && name == c.Name {
 			return Eexist
 		}
 	}
 
+	if p != dir {
+		if f.next != nil {
+			f.next.prev = f.prev
+		} else {
+			p.clast = f.prev
+		}
+
+		if f.prev != nil {
+			f.prev.next = f.next
+		} else {
+			p.cfirst = f.next
+		}
+
+		if dir.clast != nil {
+			dir.clast.next = f
+		} else {
+			dir.cfirst = f
+		}
+
+		f.prev = dir.clast
+		f.next = nil
+		dir.clast = f
+		f.Parent = dir
+		dir.Version++
+	}
+
 	f.Name = name
+	p.Version++
+	return nil
+}
+
+// Changes the metadata of the file on behalf of user according to the
+// Twstat rules. Only the name, mode, gid, mtime and length can be
+// changed, fields set to the "don't touch" values (~0 or empty string)
+// are left unchanged. All checks are done before anything is modified,
+// so either all changes are applied or none.
+//
+// As in 9P2000, the name only renames the file within its directory,
+// a name that contains a '/' fails with Ebadname. Use Move to move a
+// file to another directory.
+func (f *srvFile) Wstat(user User, d *Dir) error {
+	return f.wstat(user, d, nil)
+}
+
+// Implements Wstat. If resize isn't nil, it is called with the file
+// locked to change the length of a file with data: before anything
+// else is changed if the file grows, so that a failure leaves the file
+// untouched, and after the other changes if it shrinks, which must not
+// fail. resize is expected to set the file's Length.
+func (f *srvFile) wstat(user User, d *Dir, resize func(uint64) error) error {
+	owner := user != nil && (f.Uid == user.Name() ||
+		(f.Uidnum != NOUID && user.Id() != -1 && f.Uidnum == uint32(user.Id())))
+
+	var dir *srvFile
+	var name string
+	if d.Name != "" {
+		if f.Parent == nil || f.Parent == f {
+			return Eperm
+		}
+
+		if d.Name == "." || d.Name == ".." || strings.Contains(d.Name, "/") {
+			return Ebadname
+		}
+
+		if !f.Parent.CheckPerm(user, DMWRITE) {
+			return Eperm
+		}
+
+		dir, name = f.Parent, d.Name
+	}
+
+	if d.Mode != ^uint32(0) {
+		if !owner {
+			return Eperm
+		}
+
+		if (d.Mode & DMDIR) != (f.Mode & DMDIR) {
+			return Edirchange
+		}
+	}
+
+	var gidnum uint32 = NOUID
+	if d.Gid != "" && d.Gid != f.Gid {
+		if !owner {
+			return Eperm
+		}
+
+		member := false
+		for _, g := range user.Groups() {
+			if g.Name() == d.Gid {
+				member = true
+				gidnum = uint32(g.Id())
+				break
+			}
+		}
+
+		if !member {
+			return Eperm
+		}
+	}
+
+	if d.Mtime != ^uint32(0) && !owner {
+		return Eperm
+	}
+
+	if d.Length != ^uint64(0) {
+		if (f.Mode & DMDIR) != 0 {
+			if d.Length != f.Length {
+				return Eperm
+			}
+		} else if !f.CheckPerm(user, DMWRITE) {
+			return Eperm
+		}
+	}
+
+	var oldlen uint64
+	grown := false
+	if resize != nil && d.Length != ^uint64(0) && (f.Mode&DMDIR) == 0 {
+		f.Lock()
+		oldlen = f.Length
+		if d.Length > f.Length {
+			if err := resize(d.Length); err != nil {
+				f.Unlock()
+				return err
+			}
+
+			grown = true
+		}
+		f.Unlock()
+	}
+
+	if dir != nil && (dir != f.Parent || name != f.Name) {
+		if err := f.Move(dir, name); err != nil {
+			if grown {
+				f.Lock()
+				_ = resize(oldlen)
+				f.Unlock()
+			}
+
+			return err
+		}
+	}
+
+	f.Lock()
+	if d.Mode != ^uint32(0) {
+		f.Mode = d.Mode
+		f.Qid.Type = uint8(d.Mode >> 24)
+	}
+
+	if d.Gid != "" && d.Gid != f.Gid {
+		f.Gid = d.Gid
+		f.Gidnum = gidnum
+	}
+
+	if d.Mtime != ^uint32(0) {
+		f.Mtime = d.Mtime
+	}
+
+	if d.Length != ^uint64(0) {
+		switch {
+		case grown:
+			f.Version++
+		case resize == nil && d.Length != f.Length:
+			f.Length = d.Length
+			f.Version++
+		case resize != nil && d.Length < f.Length:
+			_ = resize(d.Length)
+			f.Version++
+		}
+	}
+	f.Unlock()
+
 	return nil
 }
 
@@ -287,6 +521,31 @@ func (f *srvFile) CheckPerm(user User, perm uint32) bool {
 	return false
 }
 
+// Returns the path of the file from the root of its tree.
+func (f *srvFile) path() string {
+	mvlock.Lock()
+	defer mvlock.Unlock()
+
+	p := ""
+	for ; f.Parent != nil && f.Parent != f; f = f.Parent {
+		p = "/" + f.Name + p
+	}
+
+	if p == "" {
+		p = "/"
+	}
+
+	return p
+}
+
+func (*Fsrv) FidPath(sfid *SrvFid) string {
+	if fid, ok := sfid.Aux.(*FFid); ok && fid.F != nil {
+		return fid.F.path()
+	}
+
+	return ""
+}
+
 func (s *Fsrv) Attach(req *SrvReq) {
 	fid := new(FFid)
 	fid.F = s.Root
@@ -431,14 +690,23 @@ func (*Fsrv) Read(req *SrvReq) {
 		}
 
 		switch {
-		case tc.Offset > uint64(len(fid.dirents)):
+		case tc.Offset >= uint64(len(fid.dirents)):
 			n = 0
-		case len(fid.dirents[tc.Offset:]) > int(tc.Size):
-			n = int(tc.Size)
+		case req.Conn.Options.SplitDirents:
+			n = len(fid.dirents) - int(tc.Offset)
+			if n > int(tc.Count) {
+				n = int(tc.Count)
+			}
 		default:
-			n = len(fid.dirents[tc.Offset:])
+			n = direntsCount(fid.dirents, tc.Offset, tc.Count)
 		}
-		copy(rc.Data, fid.dirents[tc.Offset:int(tc.Offset)+1+n])
+
+		if n == 0 && tc.Offset < uint64(len(fid.dirents)) {
+			req.RespondError(&Error{"too small read size for dir entry", EINVAL})
+			return
+		}
+
+		copy(rc.Data, fid.dirents[tc.Offset:int(tc.Offset)+n])
 
 	} else {
 		// file
@@ -458,6 +726,27 @@ func (*Fsrv) Read(req *SrvReq) {
 	req.Respond()
 }
 
+// Returns the size of the whole directory entries starting at offset
+// that fit in count bytes.
+func direntsCount(dirents []byte, offset uint64, count uint32) int {
+	if offset >= uint64(len(dirents)) {
+		return 0
+	}
+
+	b := dirents[offset:]
+	n := 0
+	for len(b)-n >= 2 {
+		sz, _ := gint16(b[n:])
+		if n+int(sz)+2 > int(count) || n+int(sz)+2 > len(b) {
+			break
+		}
+
+		n += int(sz) + 2
+	}
+
+	return n
+}
+
 func (*Fsrv) Write(req *SrvReq) {
 	fid := req.Fid.Aux.(*FFid)
 	f := fid.F
@@ -491,25 +780,35 @@ func (*Fsrv) Clunk(req *SrvReq) {
 func (*Fsrv) Remove(req *SrvReq) {
 	fid := req.Fid.Aux.(*FFid)
 	f := fid.F
+	rop, ok := (f.ops).(FRemoveOp)
+	if !ok {
+		log.Println("remove not implemented")
+		req.RespondError(Eperm)
+		return
+	}
+
+	// no file can be added once the directory is found empty
 	f.Lock()
 	if f.cfirst != nil {
 		f.Unlock()
 		req.RespondError(Enotempty)
 		return
 	}
+	f.flags |= Fremoving
 	f.Unlock()
 
-	if rop, ok := (f.ops).(FRemoveOp); ok {
-		err := rop.Remove(fid)
-		if err != nil {
-			req.RespondError(err)
-		} else {
-			f.Remove()
-			req.RespondRremove()
-		}
+	err := rop.Remove(fid)
+	if err == nil {
+		f.Remove()
+	}
+
+	f.Lock()
+	f.flags &= ^Fremoving
+	f.Unlock()
+	if err != nil {
+		req.RespondError(err)
 	} else {
-		log.Println("remove not implemented")
-		req.RespondError(Eperm)
+		req.RespondRremove()
 	}
 }
 
@@ -518,15 +817,17 @@ func (*Fsrv) Stat(req *SrvReq) {
 	f := fid.F
 
 	if sop, ok := (f.ops).(FStatOp); ok {
-		err := sop.Stat(fid)
-		if err != nil {
+		if err := sop.Stat(fid); err != nil {
 			req.RespondError(err)
-		} else {
-			req.RespondRstat(&f.Dir)
+			return
 		}
-	} else {
-		req.RespondRstat(&f.Dir)
 	}
+
+	// the Dir of a directory changes when files are added to it
+	f.Lock()
+	d := f.Dir
+	f.Unlock()
+	req.RespondRstat(&d)
 }
 
 func (*Fsrv) Wstat(req *SrvReq) {
@@ -534,15 +835,17 @@ func (*Fsrv) Wstat(req *SrvReq) {
 	fid := req.Fid.Aux.(*FFid)
 	f := fid.F
 
+	var err error
 	if wop, ok := (f.ops).(FWstatOp); ok {
-		err := wop.Wstat(fid, &tc.Dir)
-		if err != nil {
-			req.RespondError(err)
-		} else {
-			req.RespondRwstat()
-		}
+		err = wop.Wstat(fid, &tc.Dir)
 	} else {
-		req.RespondError(Eperm)
+		err = f.Wstat(req.Fid.User, &tc.Dir)
+	}
+
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.RespondRwstat()
 	}
 }
 
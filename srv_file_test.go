@@ -580,6 +580,54 @@ func TestFsrvRemove(t *testing.T) {
 	}
 }
 
+// The operations of a directory whose Remove adds a file to it, as a
+// concurrent Tcreate could.
+type addingOps struct {
+	testFileOps
+	dir    *srvFile
+	addErr error
+}
+
+func (ops *addingOps) Remove(fid *FFid) error {
+	ops.addErr = (&srvFile{}).Add(ops.dir, "late", nil, nil, 0644, nil)
+	return ops.removeErr
+}
+
+// No file can be added to a directory between the check that it is
+// empty and its removal.
+func TestFsrvRemoveAdd(t *testing.T) {
+	owner := testUser{name: "owner", id: 1}
+	for _, removeErr := range []error{nil, Eperm} {
+		root := &srvFile{}
+		if err := root.Add(nil, "root", owner, nil, DMDIR|0777, nil); err != nil {
+			t.Fatalf("Add root error = %v", err)
+		}
+		dir := &srvFile{}
+		ops := &addingOps{dir: dir}
+		ops.removeErr = removeErr
+		if err := dir.Add(root, "dir", owner, nil, DMDIR|0777, ops); err != nil {
+			t.Fatalf("Add dir error = %v", err)
+		}
+
+		req := newFsrvReq(Tremove)
+		req.Fid = &SrvFid{Fconn: req.Conn, User: owner}
+		req.Fid.Aux = &FFid{F: dir, Fid: req.Fid}
+		(&Fsrv{}).Remove(req)
+		if ops.addErr != Enoent || dir.cfirst != nil {
+			t.Fatalf("Add during Remove = %v, want %v", ops.addErr, Enoent)
+		}
+
+		// a directory that wasn't removed can be used again
+		err := (&srvFile{}).Add(dir, "after", nil, nil, 0644, nil)
+		if removeErr == nil && err != Enoent {
+			t.Fatalf("Add to the removed directory error = %v, want %v", err, Enoent)
+		}
+		if removeErr != nil && err != nil {
+			t.Fatalf("Add after a failed Remove error = %v", err)
+		}
+	}
+}
+
 func TestFsrvStatAndWstat(t *testing.T) {
 	owner := testUser{name: "owner", id: 1}
 	file := &srvFile{Dir: Dir{Mode: 0644, Uid: owner.name, Uidnum: uint32(owner.id)}}
@@ -705,3 +753,291 @@ func TestFsrvClunkAndFidDestroy(t *testing.T) {
 		t.Fatalf("FidDestroy not called")
 	}
 }
+
+func newWstatDir() *Dir {
+	return &Dir{
+		Type:   ^uint16(0),
+		Dev:    ^uint32(0),
+		Qid:    Qid{Type: ^uint8(0), Version: ^uint32(0), Path: ^uint64(0)},
+		Mode:   ^uint32(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}
+}
+
+func TestSrvFileMove(t *testing.T) {
+	owner := testUser{name: "owner", id: 1}
+	group := testGroup{name: "group", id: 2}
+	root := &srvFile{}
+	if err := root.Add(nil, "root", owner, group, DMDIR|0755, nil); err != nil {
+		t.Fatalf("Add root error = %v", err)
+	}
+	a := &srvFile{}
+	if err := a.Add(root, "a", owner, group, DMDIR|0755, nil); err != nil {
+		t.Fatalf("Add a error = %v", err)
+	}
+	b := &srvFile{}
+	if err := b.Add(a, "b", owner, group, DMDIR|0755, nil); err != nil {
+		t.Fatalf("Add b error = %v", err)
+	}
+	file := &srvFile{}
+	if err := file.Add(a, "file", owner, group, 0644, nil); err != nil {
+		t.Fatalf("Add file error = %v", err)
+	}
+
+	if err := a.Move(b, "a"); err != Emoveloop {
+		t.Fatalf("Move into child error = %v, want %v", err, Emoveloop)
+	}
+	if err := a.Move(a, "x"); err != Emoveloop {
+		t.Fatalf("Move into self error = %v, want %v", err, Emoveloop)
+	}
+	if err := file.Move(a, "b"); err != Eexist {
+		t.Fatalf("Move existing error = %v, want %v", err, Eexist)
+	}
+	if err := file.Move(file, "x"); err != Enotdir {
+		t.Fatalf("Move to file error = %v, want %v", err, Enotdir)
+	}
+	if err := root.Move(a, "root"); err != Enoent {
+		t.Fatalf("Move root error = %v, want %v", err, Enoent)
+	}
+
+	av, bv := a.Version, b.Version
+	if err := file.Move(b, "moved"); err != nil {
+		t.Fatalf("Move error = %v", err)
+	}
+	if a.Find("file") != nil {
+		t.Fatalf("Move left file in old directory")
+	}
+	if b.Find("moved") != file || file.Parent != b || file.Name != "moved" {
+		t.Fatalf("Move did not attach file to new directory")
+	}
+	if a.Version != av+1 || b.Version != bv+1 {
+		t.Fatalf("Move versions = %d %d, want %d %d", a.Version, b.Version, av+1, bv+1)
+	}
+
+	if err := file.Move(root, "file"); err != nil {
+		t.Fatalf("Move to root error = %v", err)
+	}
+	if root.Find("file") != file || b.cfirst != nil || b.clast != nil {
+		t.Fatalf("Move did not relink file")
+	}
+
+	file.Remove()
+	if err := file.Move(a, "file"); err != Enoent {
+		t.Fatalf("Move removed error = %v, want %v", err, Enoent)
+	}
+}
+
+func TestSrvFileWstat(t *testing.T) {
+	staff := testGroup{name: "staff", id: 2}
+	wheel := testGroup{name: "wheel", id: 3}
+	owner := testUser{name: "owner", id: 1, groups: []Group{staff, wheel}}
+	other := testUser{name: "other", id: 4}
+
+	newTree := func(t *testing.T) (root, dir, file *srvFile) {
+		root = &srvFile{}
+		if err := root.Add(nil, "root", owner, staff, DMDIR|0777, nil); err != nil {
+			t.Fatalf("Add root error = %v", err)
+		}
+		dir = &srvFile{}
+		if err := dir.Add(root, "dir", owner, staff, DMDIR|0755, nil); err != nil {
+			t.Fatalf("Add dir error = %v", err)
+		}
+		file = &srvFile{}
+		if err := file.Add(dir, "file", owner, staff, 0644, nil); err != nil {
+			t.Fatalf("Add file error = %v", err)
+		}
+		return root, dir, file
+	}
+
+	tests := []struct {
+		name    string
+		user    User
+		setup   func(d *Dir)
+		wantErr error
+		check   func(t *testing.T, root, dir, file *srvFile)
+	}{
+		{
+			name:  "nop",
+			user:  other,
+			setup: func(d *Dir) {},
+		},
+		{
+			name:  "rename",
+			user:  owner,
+			setup: func(d *Dir) { d.Name = "renamed" },
+			check: func(t *testing.T, root, dir, file *srvFile) {
+				if dir.Find("renamed") != file {
+					t.Fatalf("file not renamed")
+				}
+			},
+		},
+		{
+			name:    "rename-other",
+			user:    other,
+			setup:   func(d *Dir) { d.Name = "renamed" },
+			wantErr: Eperm,
+		},
+		{
+			name:    "rename-absolute",
+			user:    owner,
+			setup:   func(d *Dir) { d.Name = "/moved" },
+			wantErr: Ebadname,
+		},
+		{
+			name:    "rename-relative",
+			user:    owner,
+			setup:   func(d *Dir) { d.Name = "../moved" },
+			wantErr: Ebadname,
+		},
+		{
+			name:    "rename-dotdot",
+			user:    owner,
+			setup:   func(d *Dir) { d.Name = ".." },
+			wantErr: Ebadname,
+		},
+		{
+			name:  "mode",
+			user:  owner,
+			setup: func(d *Dir) { d.Mode = DMAPPEND | 0600 },
+			check: func(t *testing.T, root, dir, file *srvFile) {
+				if file.Mode != DMAPPEND|0600 || file.Qid.Type != QTAPPEND {
+					t.Fatalf("mode = %o type = %x", file.Mode, file.Qid.Type)
+				}
+			},
+		},
+		{
+			name:    "mode-other",
+			user:    other,
+			setup:   func(d *Dir) { d.Mode = 0600 },
+			wantErr: Eperm,
+		},
+		{
+			name:    "mode-dirchange",
+			user:    owner,
+			setup:   func(d *Dir) { d.Mode = DMDIR | 0755 },
+			wantErr: Edirchange,
+		},
+		{
+			name:  "gid",
+			user:  owner,
+			setup: func(d *Dir) { d.Gid = "wheel" },
+			check: func(t *testing.T, root, dir, file *srvFile) {
+				if file.Gid != "wheel" || file.Gidnum != 3 {
+					t.Fatalf("gid = %q %d", file.Gid, file.Gidnum)
+				}
+			},
+		},
+		{
+			name:    "gid-not-member",
+			user:    owner,
+			setup:   func(d *Dir) { d.Gid = "nogroup" },
+			wantErr: Eperm,
+		},
+		{
+			name:  "mtime",
+			user:  owner,
+			setup: func(d *Dir) { d.Mtime = 1234 },
+			check: func(t *testing.T, root, dir, file *srvFile) {
+				if file.Mtime != 1234 {
+					t.Fatalf("mtime = %d", file.Mtime)
+				}
+			},
+		},
+		{
+			name:    "mtime-other",
+			user:    other,
+			setup:   func(d *Dir) { d.Mtime = 1234 },
+			wantErr: Eperm,
+		},
+		{
+			name:  "length",
+			user:  owner,
+			setup: func(d *Dir) { d.Length = 10 },
+			check: func(t *testing.T, root, dir, file *srvFile) {
+				if file.Length != 10 || file.Version != 1 {
+					t.Fatalf("length = %d version = %d", file.Length, file.Version)
+				}
+			},
+		},
+		{
+			name:    "length-other",
+			user:    other,
+			setup:   func(d *Dir) { d.Length = 10 },
+			wantErr: Eperm,
+		},
+		{
+			name: "atomic",
+			user: owner,
+			setup: func(d *Dir) {
+				d.Name = "renamed"
+				d.Mode = DMDIR | 0755
+			},
+			wantErr: Edirchange,
+			check: func(t *testing.T, root, dir, file *srvFile) {
+				if dir.Find("file") != file {
+					t.Fatalf("failed wstat renamed the file")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, dir, file := newTree(t)
+			d := newWstatDir()
+			tt.setup(d)
+			if err := file.Wstat(tt.user, d); err != tt.wantErr {
+				t.Fatalf("Wstat error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, root, dir, file)
+			}
+		})
+	}
+}
+
+func TestSrvFileWstatNouid(t *testing.T) {
+	nobody := testUser{name: "nobody", id: -1}
+	file := &srvFile{}
+	if err := file.Add(nil, "file", nil, nil, 0644, nil); err != nil {
+		t.Fatalf("Add error = %v", err)
+	}
+
+	// a user without a uid doesn't own the files without one
+	d := newWstatDir()
+	d.Mode = 0777
+	if err := file.Wstat(nobody, d); err != Eperm {
+		t.Fatalf("Wstat error = %v, want %v", err, Eperm)
+	}
+	if file.Mode != 0644 {
+		t.Fatalf("mode = %o, want 644", file.Mode)
+	}
+}
+
+func TestFsrvWstatDefault(t *testing.T) {
+	owner := testUser{name: "owner", id: 1}
+	group := testGroup{name: "group", id: 2}
+	root := &srvFile{}
+	if err := root.Add(nil, "root", owner, group, DMDIR|0755, nil); err != nil {
+		t.Fatalf("Add root error = %v", err)
+	}
+	file := &srvFile{}
+	if err := file.Add(root, "file", owner, group, 0644, nil); err != nil {
+		t.Fatalf("Add file error = %v", err)
+	}
+
+	req := newFsrvReq(Twstat)
+	req.Fid = &SrvFid{Fconn: req.Conn, User: owner}
+	req.Fid.Aux = &FFid{F: file, Fid: req.Fid}
+	req.Tc.Dir = *newWstatDir()
+	req.Tc.Dir.Name = "renamed"
+	(&Fsrv{}).Wstat(req)
+	if req.Rc.Type != Rwstat {
+		t.Fatalf("Wstat type = %d %q", req.Rc.Type, req.Rc.Error)
+	}
+	if root.Find("renamed") != file {
+		t.Fatalf("Wstat did not rename")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !tinygo
+
+package go9p
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var Enolisteners = &Error{"no activated listeners", EINVAL}
+
+// Listens on a Unix socket at path, removing a stale socket left there.
+// A socket some server still listens on is left alone, and the listen
+// fails. On Linux, Conn.Peer is the user of the client process, see
+// Srv.PeerUsers.
+func (srv *Srv) StartUnixListener(path string) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		c, err := net.Dial("unix", path)
+		if err == nil {
+			_ = c.Close()
+		} else if errors.Is(err, syscall.ECONNREFUSED) {
+			_ = os.Remove(path)
+		}
+	}
+
+	return srv.StartNetListener("unix", path)
+}
+
+// The first file descriptor passed by socket activation.
+const listenFdsStart = 3
+
+// Returns the listeners inherited with systemd-style socket activation,
+// as described by the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES
+// environment variables, or nil if there are none. The variables are
+// unset so that child processes don't inherit them.
+func ActivatedListeners() ([]net.Listener, error) {
+	ls, err := activatedListeners(os.Getenv, listenFdsStart)
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+	return ls, err
+}
+
+func activatedListeners(getenv func(string) string, first int) ([]net.Listener, error) {
+	pid, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	var ls []net.Listener
+	for i := 0; i < n; i++ {
+		fd := first + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// the listener has its own copy of the descriptor
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, l := range ls {
+				_ = l.Close()
+			}
+
+			return nil, &Error{name + ": " + err.Error(), EIO}
+		}
+
+		ls = append(ls, l)
+	}
+
+	return ls, nil
+}
+
+// Serves the connections of the listeners inherited with socket
+// activation. Returns Enolisteners if there are none, e.g. if the
+// variables are for another process, or an error once a listener fails.
+func (srv *Srv) StartActivatedListeners() error {
+	ls, err := ActivatedListeners()
+	if err != nil {
+		return err
+	}
+
+	if len(ls) == 0 {
+		return Enolisteners
+	}
+
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l net.Listener) { errs <- srv.StartListener(l) }(l)
+	}
+
+	return <-errs
+}
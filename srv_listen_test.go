@@ -0,0 +1,220 @@
+//go:build unix && !tinygo
+
+package go9p
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStartUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sock")
+	// a stale socket left by an earlier server
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen error = %v", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = l.Close()
+
+	fs := newTestRamfs()
+	fs.Dotu = true
+	fs.PeerUsers = true
+	fs.Start(fs)
+	go func() { _ = fs.StartUnixListener(path) }()
+
+	var clnt *Clnt
+	for i := 0; i < 100; i++ {
+		if clnt, err = MountUnix(path, "", 8192, OsUsers.Uid2User(os.Getuid())); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("MountUnix error = %v", err)
+	}
+	t.Cleanup(clnt.Unmount)
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	fs.Lock()
+	var peer User
+	for conn := range fs.conns {
+		peer = conn.Peer
+	}
+	fs.Unlock()
+	if peer == nil || peer.Id() != os.Getuid() {
+		t.Fatalf("Peer = %v, want uid %d", peer, os.Getuid())
+	}
+}
+
+func TestStartUnixListenerLive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen error = %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+
+	// the socket of a running server isn't removed
+	fs := newTestRamfs()
+	fs.Start(fs)
+	if err := fs.StartUnixListener(path); err == nil {
+		t.Fatalf("StartUnixListener on a live socket succeeded")
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial after StartUnixListener error = %v", err)
+	}
+	_ = c.Close()
+}
+
+func TestServeConnPeer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen error = %v", err)
+	}
+	defer l.Close()
+
+	fs := newTestRamfs()
+	fs.Dotu = true
+	fs.PeerUsers = true
+	fs.Start(fs)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			fs.ServeConn(c)
+		}
+	}()
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial error = %v", err)
+	}
+	defer c.Close()
+
+	var peer User
+	for i := 0; i < 100; i++ {
+		fs.Lock()
+		for conn := range fs.conns {
+			peer = conn.Peer
+		}
+		fs.Unlock()
+		if peer != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runtime.GOOS == "linux" && (peer == nil || peer.Id() != os.Getuid()) {
+		t.Fatalf("Peer = %v, want uid %d", peer, os.Getuid())
+	}
+
+	// the Unix socket wrapped by ServeConn is checked too
+	clnt, err := MountConn(c, "", 8192, OsUsers.Uid2User(os.Getuid()+1))
+	if err == nil {
+		clnt.Unmount()
+		if os.Getuid() != 0 {
+			t.Fatalf("attach as another user than the peer succeeded")
+		}
+	}
+}
+
+func TestReqUserWrapped(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Socketpair error = %v", err)
+	}
+	_ = syscall.Close(fds[1])
+	f := os.NewFile(uintptr(fds[0]), "sock")
+	c, err := net.FileConn(f)
+	_ = f.Close()
+	if err != nil {
+		t.Fatalf("FileConn error = %v", err)
+	}
+	defer c.Close()
+
+	srv := &Srv{Upool: OsUsers, PeerUsers: true}
+	conn := &Conn{Srv: srv, Dotu: true, Peer: OsUsers.Uid2User(1000)}
+	conn.conn = &servedConn{Conn: c}
+	if _, err := conn.reqUser(&Fcall{Unamenum: 1001}); err != Enotpeer {
+		t.Fatalf("reqUser on a wrapped Unix socket error = %v", err)
+	}
+	if _, err := conn.reqUser(&Fcall{Unamenum: 1000}); err != nil {
+		t.Fatalf("reqUser as the peer error = %v", err)
+	}
+}
+
+func TestPeerAllows(t *testing.T) {
+	tests := []struct {
+		peer User
+		user int
+		want bool
+	}{
+		{nil, 1000, false},
+		{OsUsers.Uid2User(1000), 1000, true},
+		{OsUsers.Uid2User(1000), 1001, false},
+		{OsUsers.Uid2User(0), 1001, true},
+	}
+
+	for _, tt := range tests {
+		if got := peerAllows(tt.peer, OsUsers.Uid2User(tt.user)); got != tt.want {
+			t.Errorf("peerAllows(%v, %d) = %v, want %v", tt.peer, tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestActivatedListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error = %v", err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File error = %v", err)
+	}
+	// activatedListeners closes the descriptor it is passed
+	fd, err := syscall.Dup(int(f.Fd()))
+	_ = f.Close()
+	if err != nil {
+		t.Fatalf("Dup error = %v", err)
+	}
+
+	env := map[string]string{
+		"LISTEN_PID":     strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS":     "1",
+		"LISTEN_FDNAMES": "9p",
+	}
+	ls, err := activatedListeners(func(k string) string { return env[k] }, fd)
+	if err != nil {
+		t.Fatalf("activatedListeners error = %v", err)
+	}
+	if len(ls) != 1 || ls[0].Addr().String() != l.Addr().String() {
+		t.Fatalf("activatedListeners = %v, want a listener on %v", ls, l.Addr())
+	}
+	_ = ls[0].Close()
+
+	// for another process
+	env["LISTEN_PID"] = "1"
+	if ls, err := activatedListeners(func(k string) string { return env[k] }, 3); ls != nil || err != nil {
+		t.Fatalf("activatedListeners = %v, %v for another process", ls, err)
+	}
+}
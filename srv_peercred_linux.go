@@ -0,0 +1,37 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && !tinygo
+
+package go9p
+
+import (
+	"net"
+	"syscall"
+)
+
+// Returns the user id of the process on the other end of a Unix socket,
+// and false if it isn't known.
+func peerUid(c net.Conn) (int, bool) {
+	uc := unixConn(c)
+	if uc == nil {
+		return 0, false
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var cred *syscall.Ucred
+	var cerr error
+	err = raw.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cerr != nil {
+		return 0, false
+	}
+
+	return int(cred.Uid), true
+}
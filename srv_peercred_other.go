@@ -2,9 +2,15 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+//go:build !linux || tinygo
+
 package go9p
 
-type StatsOps interface {
-	statsRegister()
-	statsUnregister()
+import (
+	"net"
+)
+
+// The peer credentials are only supported on Linux.
+func peerUid(c net.Conn) (int, bool) {
+	return 0, false
 }
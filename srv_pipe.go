@@ -7,25 +7,56 @@
 package go9p
 
 import (
+	"context"
 	"log"
 	"os"
 	"strconv"
+	"sync"
 	"syscall"
 )
 
+// The size of the pipe buffers if Pipefs.Pipesize is 0.
+const DefaultPipesize = 256 * 1024
+
+var Epipe error = &Error{"write on closed pipe", EPIPE}
+
 type pipeFid struct {
 	path    string
+	root    string // path of the attach root
 	file    *os.File
 	dirs    []os.FileInfo
 	dirents []byte
 	st      os.FileInfo
-	data    []uint8
-	eof     bool
+	pipe    *pipeBuf // the pipe of the open file
+	mode    uint8    // the mode the pipe is open with
 }
 
+// A pipeBuf is shared by all fids that have the same file open. The data
+// written by any of them can be read by any of them.
+type pipeBuf struct {
+	path    uint64 // Qid.Path of the file
+	refs    int    // fids that have the pipe open
+	readers int    // fids open for reading
+	writers int    // fids open for writing
+	ropened bool   // the pipe was opened for reading
+	wopened bool   // the pipe was opened for writing
+	data    []byte
+	wait    chan bool // closed when the pipe changes
+}
+
+// The Pipefs type serves the files of a directory as pipes. The files
+// and directories are created on disk, but the data written to a file
+// is kept in a buffer shared by all fids that have it open, until one of
+// them reads it. Reads block until there is data, or return 0 bytes once
+// all writers have clunked the file. Writes block while the buffer is
+// full.
 type Pipefs struct {
 	Srv
-	Root string
+	Root     string
+	Pipesize int // size of the pipe buffers
+
+	plock sync.Mutex
+	pipes map[uint64]*pipeBuf // open pipes by Qid.Path
 }
 
 func (fid *pipeFid) stat() *Error {
@@ -51,7 +82,137 @@ func (*Pipefs) ConnClosed(conn *Conn) {
 	}
 }
 
-func (*Pipefs) FidDestroy(sfid *SrvFid) {
+// Called with plock held when the pipe changes.
+func (p *pipeBuf) changed() {
+	close(p.wait)
+	p.wait = make(chan bool)
+}
+
+// Opens the pipe of the file for the fid.
+func (pfs *Pipefs) pipeOpen(fid *pipeFid, path uint64, mode uint8) {
+	pfs.plock.Lock()
+	defer pfs.plock.Unlock()
+	if pfs.pipes == nil {
+		pfs.pipes = make(map[uint64]*pipeBuf)
+	}
+
+	p := pfs.pipes[path]
+	if p == nil {
+		p = &pipeBuf{path: path, wait: make(chan bool)}
+		pfs.pipes[path] = p
+	}
+
+	p.refs++
+	if mode&3 != OWRITE {
+		p.readers++
+		p.ropened = true
+	}
+
+	if mode&3 == OWRITE || mode&3 == ORDWR {
+		p.writers++
+		p.wopened = true
+	}
+
+	p.changed()
+	fid.pipe = p
+	fid.mode = mode
+}
+
+// Closes the pipe of the fid.
+func (pfs *Pipefs) pipeClose(fid *pipeFid) {
+	pfs.plock.Lock()
+	defer pfs.plock.Unlock()
+	p := fid.pipe
+	if p == nil {
+		return
+	}
+
+	if p.refs--; p.refs == 0 {
+		delete(pfs.pipes, p.path)
+	}
+
+	if fid.mode&3 != OWRITE {
+		p.readers--
+	}
+
+	if fid.mode&3 == OWRITE || fid.mode&3 == ORDWR {
+		p.writers--
+	}
+
+	p.changed()
+	fid.pipe = nil
+}
+
+// Waits until the pipe changes. Called with plock held. Returns false if
+// the context is done.
+func (pfs *Pipefs) wait(p *pipeBuf, ctx context.Context) bool {
+	ch := p.wait
+	pfs.plock.Unlock()
+	defer pfs.plock.Lock()
+	select {
+	case <-ch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Reads from the pipe into buf. Returns 0 if the pipe is empty and all
+// writers are gone. Fails with the context error if it is done first.
+func (pfs *Pipefs) pipeRead(ctx context.Context, p *pipeBuf, buf []byte) (int, error) {
+	pfs.plock.Lock()
+	defer pfs.plock.Unlock()
+	for len(p.data) == 0 {
+		if p.wopened && p.writers == 0 {
+			return 0, nil
+		}
+
+		if !pfs.wait(p, ctx) {
+			return 0, ctx.Err()
+		}
+	}
+
+	n := copy(buf, p.data)
+	if p.data = p.data[n:]; len(p.data) == 0 {
+		p.data = nil
+	}
+
+	p.changed()
+	return n, nil
+}
+
+// Writes data to the pipe. Fails with Epipe if all readers are gone, or
+// with the context error if it is done first.
+func (pfs *Pipefs) pipeWrite(ctx context.Context, p *pipeBuf, data []byte) (int, error) {
+	size := pfs.Pipesize
+	if size <= 0 {
+		size = DefaultPipesize
+	}
+
+	pfs.plock.Lock()
+	defer pfs.plock.Unlock()
+	n := 0
+	for n < len(data) {
+		if p.ropened && p.readers == 0 {
+			return n, Epipe
+		}
+
+		if m := min(size-len(p.data), len(data)-n); m > 0 {
+			p.data = append(p.data, data[n:n+m]...)
+			n += m
+			p.changed()
+			continue
+		}
+
+		if !pfs.wait(p, ctx) {
+			return n, ctx.Err()
+		}
+	}
+
+	return n, nil
+}
+
+func (pfs *Pipefs) FidDestroy(sfid *SrvFid) {
 	var fid *pipeFid
 
 	if sfid.Aux == nil {
@@ -59,9 +220,14 @@ func (*Pipefs) FidDestroy(sfid *SrvFid) {
 	}
 
 	fid = sfid.Aux.(*pipeFid)
+	pfs.pipeClose(fid)
 	if fid.file != nil {
 		_ = fid.file.Close()
 	}
+
+	if sfid.opened && (sfid.Omode&ORCLOSE) != 0 {
+		_ = os.Remove(fid.path)
+	}
 }
 
 func (pipe *Pipefs) Attach(req *SrvReq) {
@@ -78,6 +244,8 @@ func (pipe *Pipefs) Attach(req *SrvReq) {
 		fid.path = tc.Aname
 	}
 
+	fid.root = fid.path
+
 	req.Fid.Aux = fid
 	err := fid.stat()
 	if err != nil {
@@ -110,7 +278,7 @@ func (*Pipefs) Walk(req *SrvReq) {
 	path := fid.path
 	i := 0
 	for ; i < len(tc.Wname); i++ {
-		p := path + "/" + tc.Wname[i]
+		p := joinRoot(fid.root, path, tc.Wname[i])
 		st, err := os.Lstat(p)
 		if err != nil {
 			if i == 0 {
@@ -126,10 +294,11 @@ func (*Pipefs) Walk(req *SrvReq) {
 	}
 
 	nfid.path = path
+	nfid.root = fid.root
 	req.RespondRwalk(wqids[0:i])
 }
 
-func (*Pipefs) Open(req *SrvReq) {
+func (pfs *Pipefs) Open(req *SrvReq) {
 	fid := req.Fid.Aux.(*pipeFid)
 	tc := req.Tc
 	err := fid.stat()
@@ -138,6 +307,12 @@ func (*Pipefs) Open(req *SrvReq) {
 		return
 	}
 
+	if !fid.st.IsDir() {
+		pfs.pipeOpen(fid, dir2Qid(fid.st).Path, tc.Mode)
+		req.RespondRopen(dir2Qid(fid.st), 0)
+		return
+	}
+
 	var e error
 	fid.file, e = os.OpenFile(fid.path, omode2uflags(tc.Mode), 0)
 	if e != nil {
@@ -148,7 +323,7 @@ func (*Pipefs) Open(req *SrvReq) {
 	req.RespondRopen(dir2Qid(fid.st), 0)
 }
 
-func (*Pipefs) Create(req *SrvReq) {
+func (pfs *Pipefs) Create(req *SrvReq) {
 	fid := req.Fid.Aux.(*pipeFid)
 	tc := req.Tc
 	err := fid.stat()
@@ -184,6 +359,8 @@ func (*Pipefs) Create(req *SrvReq) {
 		ofid.DecRef()
 
 	case tc.Perm&DMNAMEDPIPE != 0:
+		e = syscall.Mkfifo(path, tc.Perm&0777)
+
 	case tc.Perm&DMDEVICE != 0:
 		req.RespondError(&Error{"not implemented", EIO})
 		return
@@ -198,11 +375,11 @@ func (*Pipefs) Create(req *SrvReq) {
 				mode |= syscall.S_ISGID
 			}
 		}
-		file, e = os.OpenFile(path, omode2uflags(tc.Mode)|os.O_CREATE, os.FileMode(mode))
-	}
-
-	if file == nil && e == nil {
-		file, e = os.OpenFile(path, omode2uflags(tc.Mode), 0)
+		file, e = os.OpenFile(path, omode2uflags(tc.Mode)|os.O_CREATE|os.O_EXCL, os.FileMode(mode))
+		if e == nil {
+			// the data goes to the pipe
+			_ = file.Close()
+		}
 	}
 
 	if e != nil {
@@ -211,24 +388,25 @@ func (*Pipefs) Create(req *SrvReq) {
 	}
 
 	fid.path = path
-	fid.file = file
 	err = fid.stat()
 	if err != nil {
 		req.RespondError(err)
 		return
 	}
 
-	req.RespondRcreate(dir2Qid(fid.st), 0)
-}
-
-func min(a, b int) int {
-	if a < b {
-		return a
+	if fid.st.IsDir() {
+		if fid.file, e = os.OpenFile(path, omode2uflags(tc.Mode), 0); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	} else {
+		pfs.pipeOpen(fid, dir2Qid(fid.st).Path, tc.Mode)
 	}
-	return b
+
+	req.RespondRcreate(dir2Qid(fid.st), 0)
 }
 
-func (*Pipefs) Read(req *SrvReq) {
+func (pfs *Pipefs) Read(req *SrvReq) {
 	fid := req.Fid.Aux.(*pipeFid)
 	tc := req.Tc
 	rc := req.Rc
@@ -260,42 +438,34 @@ func (*Pipefs) Read(req *SrvReq) {
 
 			for i := 0; i < len(fid.dirs); i++ {
 				path := fid.path + "/" + fid.dirs[i].Name()
-				st, _ := dir2Dir(path, fid.dirs[i], req.Conn.Dotu, req.Conn.Srv.Upool)
+				st, _ := dir2Dir(path, fid.dirs[i], req.Conn.Dotu, req.Conn.Srv.Upool, &req.Conn.Options)
 				if st == nil {
 					continue
 				}
 				b := PackDir(st, req.Conn.Dotu)
 				fid.dirents = append(fid.dirents, b...)
-				count += len(b)
 			}
 		}
-		switch {
-		case tc.Offset > uint64(len(fid.dirents)):
-			count = 0
-		case len(fid.dirents[tc.Offset:]) > int(tc.Count):
-			count = int(tc.Count)
-		default:
-			count = len(fid.dirents[tc.Offset:])
-		}
 
-		copy(rc.Data, fid.dirents[tc.Offset:int(tc.Offset)+count])
+		// only whole entries
+		count = direntsCount(fid.dirents, tc.Offset, tc.Count)
+		if count > 0 {
+			copy(rc.Data, fid.dirents[tc.Offset:int(tc.Offset)+count])
+		}
 
 	} else {
-		if fid.eof {
-			req.RespondError(toError(e))
+		count, e = pfs.pipeRead(req.Context(), fid.pipe, rc.Data)
+		if e != nil {
+			req.RespondCanceled()
 			return
 		}
-		length := min(len(rc.Data), len(fid.data))
-		count = length
-		copy(rc.Data, fid.data[:length])
-		fid.data = fid.data[length:]
 	}
 
 	SetRreadCount(rc, uint32(count))
 	req.Respond()
 }
 
-func (*Pipefs) Write(req *SrvReq) {
+func (pfs *Pipefs) Write(req *SrvReq) {
 	fid := req.Fid.Aux.(*pipeFid)
 	tc := req.Tc
 	err := fid.stat()
@@ -304,9 +474,15 @@ func (*Pipefs) Write(req *SrvReq) {
 		return
 	}
 
-	fid.data = append(fid.data, tc.Data...)
-
-	req.RespondRwrite(uint32(len(tc.Data)))
+	n, e := pfs.pipeWrite(req.Context(), fid.pipe, tc.Data)
+	switch {
+	case e == Epipe && n == 0:
+		req.RespondError(e)
+	case e != nil && e != Epipe:
+		req.RespondCanceled()
+	default:
+		req.RespondRwrite(uint32(n))
+	}
 }
 
 func (*Pipefs) Clunk(req *SrvReq) { req.RespondRclunk() }
@@ -336,7 +512,7 @@ func (*Pipefs) Stat(req *SrvReq) {
 		return
 	}
 
-	st, derr := dir2Dir(fid.path, fid.st, req.Conn.Dotu, req.Conn.Srv.Upool)
+	st, derr := dir2Dir(fid.path, fid.st, req.Conn.Dotu, req.Conn.Srv.Upool, &req.Conn.Options)
 	if st == nil {
 		req.RespondError(derr)
 		return
@@ -5,8 +5,10 @@ package go9p
 import (
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 func newPipeReq(msgType uint8) *SrvReq {
@@ -135,7 +137,7 @@ func TestPipefsReadDirAndFile(t *testing.T) {
 				if err := os.WriteFile(filePath, []byte("data"), 0644); err != nil {
 					t.Fatalf("WriteFile error = %v", err)
 				}
-				fid := &pipeFid{path: filePath, data: []uint8("hello")}
+				fid := &pipeFid{path: filePath, pipe: &pipeBuf{data: []byte("hello"), wait: make(chan bool)}}
 				req.Tc.Count = 5
 				req.Tc.Offset = 0
 				return fid
@@ -162,7 +164,7 @@ func TestPipefsReadDirAndFile(t *testing.T) {
 				if string(req.Rc.Data[:req.Rc.Count]) != "hello" {
 					t.Fatalf("file read = %q", string(req.Rc.Data[:req.Rc.Count]))
 				}
-				if len(fid.data) != 0 {
+				if len(fid.pipe.data) != 0 {
 					t.Fatalf("file data not drained")
 				}
 			}
@@ -319,3 +321,232 @@ func TestPipefsErrorPaths(t *testing.T) {
 		})
 	}
 }
+
+// Starts a Pipefs serving a temporary directory, and returns a function
+// that mounts it.
+func newTestPipefs(t *testing.T, size int) func() *Clnt {
+	t.Helper()
+	fs := &Pipefs{Root: t.TempDir(), Pipesize: size}
+	fs.Dotu = true
+	fs.Start(fs)
+	return func() *Clnt {
+		return mountPipe(t, fs)
+	}
+}
+
+// Reads from the file in the background.
+func pipeRead(clnt *Clnt, file *File, count uint32) chan string {
+	ch := make(chan string, 1)
+	go func() {
+		data, err := clnt.Read(file.Fid, 0, count)
+		if err != nil {
+			ch <- err.Error()
+			return
+		}
+		ch <- string(data)
+	}()
+	return ch
+}
+
+func notDone[T any](t *testing.T, ch chan T, what string) {
+	t.Helper()
+	select {
+	case v := <-ch:
+		t.Fatalf("%s didn't block, got %v", what, v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPipefsPipe(t *testing.T) {
+	mount := newTestPipefs(t, 0)
+	wclnt, rclnt := mount(), mount()
+	w, err := wclnt.FCreate("/p", 0666, OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	r, err := rclnt.FOpen("/p", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	ch := pipeRead(rclnt, r, 100)
+	notDone(t, ch, "read of an empty pipe")
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	if got := <-ch; got != "hello" {
+		t.Fatalf("read = %q", got)
+	}
+
+	ch = pipeRead(rclnt, r, 100)
+	_ = w.Close()
+	if got := <-ch; got != "" {
+		t.Fatalf("read after the writer clunked = %q", got)
+	}
+}
+
+func TestPipefsFullPipe(t *testing.T) {
+	mount := newTestPipefs(t, 4)
+	clnt := mount()
+	w, err := clnt.FCreate("/p", 0666, OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	r, err := clnt.FOpen("/p", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	ch := make(chan int, 1)
+	go func() {
+		n, _ := w.Write([]byte("abcdefgh"))
+		ch <- n
+	}()
+	notDone(t, ch, "write to a full pipe")
+	for _, want := range []string{"abcd", "efgh"} {
+		if got := <-pipeRead(clnt, r, 100); got != want {
+			t.Fatalf("read = %q, want %q", got, want)
+		}
+	}
+	if n := <-ch; n != 8 {
+		t.Fatalf("Write = %d", n)
+	}
+
+	_ = r.Close()
+	if _, err := w.Write([]byte("x")); err == nil || err.Error() != Epipe.Error() {
+		t.Fatalf("Write without readers error = %v", err)
+	}
+}
+
+func TestPipefsFlushRead(t *testing.T) {
+	mount := newTestPipefs(t, 0)
+	clnt := mount()
+	w, err := clnt.FCreate("/p", 0666, OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	r, err := clnt.FOpen("/p", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	req := startRead(t, r)
+	notDone(t, req.Done, "read of an empty pipe")
+	if err := clnt.Flush(req); err != nil {
+		t.Fatalf("Flush error = %v", err)
+	}
+	if req := <-req.Done; req.Err != Eflushed {
+		t.Fatalf("flushed read error = %v", req.Err)
+	}
+
+	// the flushed read didn't take the data
+	if _, err := w.Write([]byte("after")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	if got := <-pipeRead(clnt, r, 100); got != "after" {
+		t.Fatalf("read = %q", got)
+	}
+}
+
+// Returns true if a goroutine is running a function named fn.
+func goroutineIn(fn string) bool {
+	buf := make([]byte, 1<<20)
+	return strings.Contains(string(buf[:runtime.Stack(buf, true)]), fn)
+}
+
+// A flushed read doesn't keep its handler blocked on the empty pipe.
+func TestPipefsFlushReadExits(t *testing.T) {
+	mount := newTestPipefs(t, 0)
+	clnt := mount()
+	if _, err := clnt.FCreate("/p", 0666, OWRITE); err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	r, err := clnt.FOpen("/p", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	req := startRead(t, r)
+	for start := time.Now(); !goroutineIn("(*Pipefs).pipeRead"); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the read didn't block")
+		}
+	}
+
+	// the Rflush is sent once the handler is done with the read
+	done := make(chan error, 1)
+	go func() { done <- clnt.Flush(req) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Flush error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the handler of the flushed read is still blocked")
+	}
+	<-req.Done
+	for start := time.Now(); goroutineIn("(*Pipefs).pipeRead"); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the handler of the flushed read is still blocked")
+		}
+	}
+}
+
+// Creating a file that exists fails and leaves the file alone.
+func TestPipefsCreateExisting(t *testing.T) {
+	fs := &Pipefs{Root: t.TempDir()}
+	fs.Dotu = true
+	fs.Start(fs)
+	clnt := mountPipe(t, fs)
+	if err := os.WriteFile(filepath.Join(fs.Root, "file"), []byte("data"), 0644); err != nil {
+		t.Fatalf("WriteFile error = %v", err)
+	}
+
+	if f, err := clnt.FCreate("/file", 0644, OWRITE|OTRUNC); err == nil {
+		_ = f.Close()
+		t.Fatalf("FCreate of an existing file succeeded")
+	}
+	if b, err := os.ReadFile(filepath.Join(fs.Root, "file")); err != nil || string(b) != "data" {
+		t.Fatalf("ReadFile = %q, %v", b, err)
+	}
+}
+
+// A file opened with ORCLOSE is removed when the fid is clunked.
+func TestPipefsOrclose(t *testing.T) {
+	fs := &Pipefs{Root: t.TempDir()}
+	fs.Dotu = true
+	fs.Start(fs)
+	clnt := mountPipe(t, fs)
+	f, err := clnt.FCreate("/tmp", 0644, OWRITE|ORCLOSE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.Root, "tmp")); err != nil {
+		t.Fatalf("Stat of the open file error = %v", err)
+	}
+
+	_ = f.Close()
+	if _, err := os.Stat(filepath.Join(fs.Root, "tmp")); !os.IsNotExist(err) {
+		t.Fatalf("Stat after Clunk error = %v, want not exist", err)
+	}
+}
+
+// Walking .. from the root of the tree stays at the root.
+func TestPipefsWalkDotdotRoot(t *testing.T) {
+	fs := &Pipefs{Root: t.TempDir()}
+	fs.Dotu = true
+	fs.Start(fs)
+	clnt := mountPipe(t, fs)
+	if err := os.Mkdir(filepath.Join(fs.Root, "dir"), 0755); err != nil {
+		t.Fatalf("Mkdir error = %v", err)
+	}
+
+	fid := clnt.FidAlloc()
+	qids, err := clnt.Walk(clnt.Root, fid, []string{"dir", "..", "..", "dir"})
+	if err != nil || len(qids) != 4 {
+		t.Fatalf("Walk = %v, %v", qids, err)
+	}
+	if qids[1] != qids[2] || qids[0] != qids[3] {
+		t.Fatalf("Walk qids = %v, .. left the root", qids)
+	}
+}
@@ -4,7 +4,13 @@
 
 package go9p
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
 
 // SrvRequest operations. This interface should be implemented by all file servers.
 // The operations correspond directly to most of the 9P2000 message types.
@@ -23,15 +29,24 @@ type SrvReqOps interface {
 
 // Respond to the request with Rerror message
 func (req *SrvReq) RespondError(err interface{}) {
+	var ename string
+	errornum := uint32(EIO)
 	switch e := err.(type) {
 	case *Error:
-		_ = PackRerror(req.Rc, e.Error(), uint32(e.Errornum), req.Conn.Dotu)
+		ename, errornum = e.Error(), e.Errornum
 	case error:
-		_ = PackRerror(req.Rc, e.Error(), uint32(EIO), req.Conn.Dotu)
+		ename = e.Error()
+		var errno syscall.Errno
+		if errors.As(e, &errno) {
+			errornum = uint32(errno)
+		}
 	default:
-		_ = PackRerror(req.Rc, fmt.Sprintf("%v", e), uint32(EIO), req.Conn.Dotu)
+		ename = fmt.Sprintf("%v", e)
 	}
 
+	conn := req.Conn
+	_ = PackRerror(req.Rc, conn.Options.ename(ename, errornum), errornum, conn.Dotu)
+
 	req.Respond()
 }
 
@@ -115,6 +130,69 @@ func (req *SrvReq) RespondRread(data []byte) {
 	}
 }
 
+// Respond to the request with Rread message. Unlike RespondRread, data
+// isn't copied to the response, but written to the connection right
+// after it (with writev(2) where available). data must not be modified
+// until the response is sent.
+func (req *SrvReq) RespondRreadData(data []byte) {
+	err := packRreadHeader(req.Rc, uint32(len(data)))
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.Rc.Data = data
+	req.payload = data
+	req.Respond()
+}
+
+// Respond to the request with Rread message with up to count bytes
+// read from r at offset. If r is a regular *os.File and the connection
+// a socket, the data is sent with sendfile(2) where available, without
+// copying it through the server. Otherwise it is read into the
+// response. The file has to stay open until the response is sent, so
+// the request fid is referenced until then.
+func (req *SrvReq) RespondRreadAt(r io.ReaderAt, offset int64, count uint32) {
+	if f, ok := r.(*os.File); ok && req.Fid != nil && canSendfile(req.Conn.conn) {
+		if st, err := f.Stat(); err == nil && st.Mode().IsRegular() {
+			n := st.Size() - offset
+			switch {
+			case n < 0:
+				n = 0
+			case n > int64(count):
+				n = int64(count)
+			}
+
+			err = packRreadHeader(req.Rc, uint32(n))
+			if err != nil {
+				req.RespondError(err)
+				return
+			}
+
+			req.Fid.IncRef()
+			req.rfile = &rreadFile{f, offset, n, req.Fid}
+			req.Respond()
+			return
+		}
+	}
+
+	rc := req.Rc
+	err := InitRread(rc, count)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	n, err := r.ReadAt(rc.Data, offset)
+	if err != nil && err != io.EOF {
+		req.RespondError(err)
+		return
+	}
+
+	SetRreadCount(rc, uint32(n))
+	req.Respond()
+}
+
 // Respond to the request with Rwrite message
 func (req *SrvReq) RespondRwrite(count uint32) {
 	err := PackRwrite(req.Rc, count)
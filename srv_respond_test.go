@@ -2,6 +2,9 @@ package go9p
 
 import (
 	"errors"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -40,6 +43,11 @@ func TestRespondError(t *testing.T) {
 			err:     errors.New("bad"),
 			wantNum: EIO,
 		},
+		{
+			name:    "errno",
+			err:     &os.PathError{Op: "open", Path: "x", Err: syscall.ENOENT},
+			wantNum: ENOENT,
+		},
 		{
 			name:    "string",
 			err:     "plain",
@@ -170,3 +178,52 @@ func TestRespondMessages(t *testing.T) {
 		})
 	}
 }
+
+func newTestReadReq() *SrvReq {
+	req := newTestReq(Tread)
+	req.Fid = &SrvFid{Fconn: req.Conn, refcount: 2}
+	return req
+}
+
+func TestRespondRreadData(t *testing.T) {
+	req := newTestReadReq()
+	data := []byte("payload")
+	req.RespondRreadData(data)
+	rc := req.Rc
+	if rc.Type != Rread || rc.Count != 7 || rc.Size != 18 || len(rc.Pkt) != 11 {
+		t.Fatalf("RespondRreadData = %v, packet %d bytes", rc, len(rc.Pkt))
+	}
+	if &req.payload[0] != &data[0] {
+		t.Fatalf("RespondRreadData copied the data")
+	}
+
+	// the message is the same as the one sent by RespondRread
+	req2 := newTestReadReq()
+	req2.RespondRread(data)
+	if pkt := append(rc.Pkt, data...); string(pkt) != string(req2.Rc.Pkt) {
+		t.Fatalf("RespondRreadData packet %v, want %v", pkt, req2.Rc.Pkt)
+	}
+}
+
+func TestRespondRreadAt(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int64
+		count  uint32
+		want   string
+	}{
+		{"middle", 6, 3, "wor"},
+		{"end", 6, 100, "world"},
+		{"eof", 20, 10, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestReadReq()
+			req.RespondRreadAt(strings.NewReader("hello world"), tt.offset, tt.count)
+			if req.Rc.Type != Rread || string(req.Rc.Data) != tt.want {
+				t.Fatalf("RespondRreadAt = %v, data %q, want %q", req.Rc, req.Rc.Data, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && !tinygo
+
+package go9p
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// Returns true if sendFile can send data to the connection.
+func canSendfile(c net.Conn) bool {
+	_, ok := c.(syscall.Conn)
+	return ok
+}
+
+// Sends n bytes of the file starting from offset to the connection,
+// using sendfile(2). The file offset is not changed. Returns the number
+// of bytes sent, which is less than n only if the end of the file is
+// reached.
+func sendFile(c net.Conn, f *os.File, offset, n int64) (int64, error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return 0, syscall.EINVAL
+	}
+
+	dst, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	src, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var sent int64
+	var serr error
+	err = src.Control(func(infd uintptr) {
+		err := dst.Write(func(outfd uintptr) bool {
+			for sent < n {
+				m, err := syscall.Sendfile(int(outfd), int(infd), &offset, int(n-sent))
+				if m > 0 {
+					sent += int64(m)
+				}
+
+				switch err {
+				case nil:
+					if m == 0 {
+						// end of file
+						return true
+					}
+				case syscall.EINTR:
+				case syscall.EAGAIN:
+					// wait until the socket is writable
+					return false
+				default:
+					serr = os.NewSyscallError("sendfile", err)
+					return true
+				}
+			}
+
+			return true
+		})
+
+		if serr == nil {
+			serr = err
+		}
+	})
+
+	if serr == nil {
+		serr = err
+	}
+
+	return sent, serr
+}
@@ -0,0 +1,89 @@
+//go:build linux
+
+package go9p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTCPPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error = %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial error = %v", err)
+	}
+
+	c2, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept error = %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = c1.Close()
+		_ = c2.Close()
+	})
+	return c1, c2
+}
+
+func TestConnWriteFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(name, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("WriteFile error = %v", err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("Open error = %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	c1, c2 := newTCPPair(t)
+	if !canSendfile(c1) {
+		t.Fatalf("canSendfile(%T) = false", c1)
+	}
+
+	n, err := sendFile(c1, f, 6, 3)
+	if n != 3 || err != nil {
+		t.Fatalf("sendFile = %d, %v", n, err)
+	}
+
+	// the file was truncated after the response was prepared
+	conn := &Conn{conn: c1}
+	req := &SrvReq{Rc: NewFcall(256), rfile: &rreadFile{f, 6, 8, nil}}
+	if err := packRreadHeader(req.Rc, 8); err != nil {
+		t.Fatalf("packRreadHeader error = %v", err)
+	}
+	if err := conn.write(req); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+
+	buf := make([]byte, 3+11+8)
+	if _, err := io.ReadFull(c2, buf); err != nil {
+		t.Fatalf("ReadFull error = %v", err)
+	}
+	if string(buf[0:3]) != "wor" {
+		t.Fatalf("sendFile sent %q", buf[0:3])
+	}
+
+	fc, _, err := Unpack(buf[3:], false)
+	if err != nil {
+		t.Fatalf("Unpack error = %v", err)
+	}
+	if fc.Type != Rread || !bytes.Equal(fc.Data, []byte("world\x00\x00\x00")) {
+		t.Fatalf("response = %v, data %q", fc, fc.Data)
+	}
+
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != 0 {
+		t.Fatalf("file offset = %d, want 0", pos)
+	}
+}
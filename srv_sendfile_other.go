@@ -0,0 +1,22 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux || tinygo
+
+package go9p
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// Returns true if sendFile can send data to the connection.
+func canSendfile(c net.Conn) bool {
+	return false
+}
+
+func sendFile(c net.Conn, f *os.File, offset, n int64) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
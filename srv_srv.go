@@ -7,8 +7,11 @@
 package go9p
 
 import (
+	"context"
 	"net"
+	"os"
 	"sync"
+	"time"
 )
 
 type reqStatus int
@@ -18,6 +21,7 @@ const (
 	reqWork                              /* goroutine is currently working on it */
 	reqResponded                         /* response is already produced */
 	reqSaved                             /* no response was produced after the request is worked on */
+	reqInternal                          /* request is generated by the server, no response is sent */
 )
 
 var Eunknownfid error = &Error{"unknown fid", EINVAL}
@@ -32,6 +36,10 @@ var Ebadoffset error = &Error{"bad offset in directory read", EINVAL}
 var Edirchange error = &Error{"cannot convert between files and directories", EINVAL}
 var Enouser error = &Error{"unknown user", EINVAL}
 var Enotimpl error = &Error{"not implemented", EINVAL}
+var Eexcl error = &Error{"exclusive use file already open", EPERM}
+var Eclosed error = &Error{"connection closed", EIO}
+var Etimedout error = &Error{"request timed out", ETIMEDOUT}
+var Enotpeer error = &Error{"user is not the peer user", EPERM}
 
 // Authentication operations. The file server should implement them if
 // it requires user authentication. The authentication in 9P2000 is
@@ -77,6 +85,13 @@ type SrvFidOps interface {
 	FidDestroy(*SrvFid)
 }
 
+// Fid path operation. This interface can be implemented if the file
+// server can name the file a SrvFid points to. The name is shown by the
+// stats handler.
+type FidPathOps interface {
+	FidPath(*SrvFid) string
+}
+
 // Request operations. This interface should be implemented if the file server
 // needs to bypass the default request process, or needs to perform certain
 // operations before the (any) request is processed, or before (any) response
@@ -101,7 +116,8 @@ type SrvReqProcessOps interface {
 
 // Flush operation. This interface should be implemented if the file server
 // can flush pending requests. If the interface is not implemented, requests
-// that were passed to the file server implementation won't be flushed.
+// that were passed to the file server implementation are only flushed if
+// the file server responds to them when their Context is canceled.
 // The flush method should call the (req *SrvReq) srv.Flush() method if the flush
 // was successful so the request can be marked appropriately.
 type FlushOp interface {
@@ -122,9 +138,37 @@ type Srv struct {
 	Upool      Users  // Interface for finding users and groups known to the file server
 	Maxpend    int    // Maximum pending outgoing requests
 	Log        *Logger
+	Trace      TraceSink       // If not nil, receives an event for each request
+	Metrics    *Metrics        // If not nil, collects the server metrics
+	Options    ProtocolOptions // Protocol dialect, copied to each new connection
+	Limits     Limits          // Resource limits, copied to each new connection
+	Timeout    time.Duration   // Time limit of each request, copied to each new connection
+	Dispatch   Dispatch        // How the requests are run, used by Start
+	PeerUsers  bool            // If true, users attaching on a Unix socket must be the peer user, see Conn.Peer
+
+	// Connection time limits, copied to each new connection. 0 for none.
+	// ReadTimeout only runs once the size of a message is read, so a
+	// peer that went away while no requests were in progress is only
+	// detected if IdleTimeout is set.
+	IdleTimeout  time.Duration // close a connection with no requests in progress for this long
+	ReadTimeout  time.Duration // time limit to receive a message once its size is read
+	WriteTimeout time.Duration // time limit to send a message
+
+	ops        interface{}          // operations
+	conns      map[*Conn]*Conn      // List of connections
+	excl       map[uint64]*SrvFid   // fids of the open exclusive-use files, by Qid.Path
+	appends    map[uint64]*pathLock // locks serializing writes to append-only files, by Qid.Path
+	limitConns srvConns             // connections by host and user, for Limits
+	workq      chan *SrvReq         // requests waiting for a worker
+	middleware []Middleware         // added by Use
+	handler    Handler              // the middleware and the file server
+}
 
-	ops   interface{}     // operations
-	conns map[*Conn]*Conn // List of connections
+// A lock for all files with a given Qid.Path. Deleted once nobody uses it.
+type pathLock struct {
+	sync.Mutex
+	path uint64
+	ref  int
 }
 
 // The Conn type represents a connection from a client to the file server
@@ -135,15 +179,33 @@ type Conn struct {
 	Dotu       bool   // if true, both the client and the server speak 9P2000.u
 	Id         string // used for debugging and stats
 	Debuglevel int
+	Options    ProtocolOptions // protocol dialect spoken by the client
+	Limits     Limits          // resource limits of the connection
+	Timeout    time.Duration   // time limit of each request, 0 for none
+	Peer       User            // user of the peer process of a Unix socket, nil if unknown
+
+	IdleTimeout  time.Duration // close the connection when idle for this long, 0 for never
+	ReadTimeout  time.Duration // time limit to receive a message once its size is read
+	WriteTimeout time.Duration // time limit to send a message
 
 	conn    net.Conn
+	idle    *time.Timer     // closes the connection after IdleTimeout
+	lastUse time.Time       // when the last message was received or sent
+	ctx     context.Context // canceled when the connection is closed
+	cancel  context.CancelCauseFunc
 	fidpool map[uint32]*SrvFid
-	reqs    map[uint16]*SrvReq // all outstanding requests
+	reqs    map[uint16]*SrvReq   // all outstanding requests
+	fidqs   map[uint32]*fidQueue // requests waiting for another on the same fid
 
 	reqout chan *SrvReq
-	rchan  chan *Fcall
 	done   chan bool
 
+	// limits
+	host         string          // remote host
+	users        map[string]bool // users attached on the connection
+	reqsem       chan bool       // a value for each request in progress
+	rrate, srate *rateLimiter
+
 	// stats
 	nreqs   int    // number of requests processed by the server
 	tsz     uint64 // total size of the T messages received
@@ -158,10 +220,13 @@ type Conn struct {
 // automatically by the srv implementation. The SrvFidDestroy operation is called
 // when a SrvFid is destroyed.
 type SrvFid struct {
+	// protects refcount, and opened, qid and Omode for the stats
 	sync.Mutex
 	fid       uint32
 	refcount  int
 	opened    bool        // True if the SrvFid is opened
+	excl      bool        // True if the SrvFid holds an exclusive-use file open
+	qid       Qid         // Qid of the file, as last reported by the file server
 	Fconn     *Conn       // Connection the SrvFid belongs to
 	Omode     uint8       // Open mode (O* flags), if the fid is opened
 	Type      uint8       // SrvFid type (QT* flags)
@@ -188,6 +253,25 @@ type SrvReq struct {
 	status     reqStatus
 	flushreq   *SrvReq
 	prev, next *SrvReq
+	alock      *pathLock  // held while writing to an append-only file
+	done       chan bool  // closed when an internal request is responded
+	start      time.Time  // time the request was received
+	payload    []byte     // Rread data sent after Rc, see RespondRreadData
+	rfile      *rreadFile // Rread data sent from a file, see RespondRreadAt
+	limited    bool       // holds a slot of Conn.reqsem
+	ordered    bool       // holds the queue of ofid in Conn.fidqs, guarded by Lock
+	ofid       uint32
+	uerr       error // error decoding Tc, responded instead of processing it
+	ctx        context.Context
+	cancel     context.CancelCauseFunc
+}
+
+// The data of a Rread response that is sent from a file.
+type rreadFile struct {
+	f   *os.File
+	off int64
+	n   int64
+	fid *SrvFid // referenced until the data is sent
 }
 
 // The Start method should be called once the file server implementer
@@ -214,10 +298,8 @@ func (srv *Srv) Start(ops interface{}) bool {
 		srv.Log = NewLogger(1024)
 	}
 
-	if sop, ok := (interface{}(srv)).(StatsOps); ok {
-		sop.statsRegister()
-	}
-
+	srv.buildHandler()
+	srv.startWorkers()
 	return true
 }
 
@@ -235,12 +317,13 @@ func (req *SrvReq) process() {
 
 	if flushed {
 		req.Respond()
+		return
 	}
 
-	if rop, ok := (req.Conn.Srv.ops).(SrvReqProcessOps); ok {
-		rop.SrvReqProcess(req)
+	if req.uerr != nil {
+		req.RespondError(req.uerr)
 	} else {
-		req.Process()
+		req.Conn.Srv.getHandler().Process(req)
 	}
 
 	req.Lock()
@@ -269,6 +352,10 @@ func (req *SrvReq) Process() {
 			req.RespondError(Eunknownfid)
 			return
 		}
+	} else if tc.Type >= Twalk && tc.Type <= Twstat {
+		// the message needs a fid
+		req.RespondError(Eunknownfid)
+		return
 	}
 
 	switch req.Tc.Type {
@@ -343,6 +430,9 @@ func (req *SrvReq) PostProcess() {
 	case Tread:
 		srv.readPost(req)
 
+	case Twrite:
+		srv.writePost(req)
+
 	case Tclunk:
 		srv.clunkPost(req)
 
@@ -378,12 +468,23 @@ func (req *SrvReq) Respond() {
 	status := req.status
 	req.status |= reqResponded
 	req.status &= ^reqWork
+	ordered, ofid := req.ordered, req.ofid
 	req.Unlock()
 
 	if (status & reqResponded) != 0 {
 		return
 	}
 
+	if req.cancel != nil {
+		req.cancel(context.Canceled)
+	}
+
+	if (status & reqInternal) != 0 {
+		conn.Srv.getHandler().Respond(req)
+		close(req.done)
+		return
+	}
+
 	/* remove the request and all requests flushing it */
 	conn.Lock()
 	nextreq := req.prev
@@ -410,19 +511,26 @@ func (req *SrvReq) Respond() {
 	}
 	conn.Unlock()
 
-	if rop, ok := (req.Conn.Srv.ops).(SrvReqProcessOps); ok {
-		rop.SrvReqRespond(req)
-	} else {
-		req.PostProcess()
+	conn.Srv.getHandler().Respond(req)
+
+	if m := conn.Srv.Metrics; m != nil {
+		m.request(req.start, req.Tc, req.Rc)
 	}
 
 	if (status & reqFlush) == 0 {
 		conn.reqout <- req
+	} else {
+		req.releaseData()
+		conn.reqRelease(req)
+	}
+
+	if ordered {
+		conn.fidNext(ofid)
 	}
 
 	// process the next request with the same tag (if available)
 	if nextreq != nil {
-		go nextreq.process()
+		conn.dispatch(nextreq, false)
 	}
 
 	// respond to the flush messages
@@ -433,6 +541,57 @@ func (req *SrvReq) Respond() {
 	}
 }
 
+// Releases the Rread data of a request that isn't going to be sent anymore.
+func (req *SrvReq) releaseData() {
+	req.payload = nil
+	if req.rfile != nil {
+		req.rfile.fid.DecRef()
+		req.rfile = nil
+	}
+}
+
+// Returns the context of the request. It is canceled when the request
+// is flushed, its connection is closed, or Conn.Timeout elapses since the
+// request was received. context.Cause returns Eflushed, Eclosed or
+// Etimedout respectively. File servers should pass it to blocking
+// calls, and call RespondCanceled if the context is done before they
+// can respond.
+func (req *SrvReq) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+
+	return req.ctx
+}
+
+// Responds to a request whose context is done. If the request was
+// flushed or its connection closed, no response is sent, otherwise it
+// responds with the cause.
+func (req *SrvReq) RespondCanceled() {
+	switch err := context.Cause(req.Context()); err {
+	case nil, Eflushed, Eclosed:
+		req.Flush()
+	default:
+		req.RespondError(err)
+	}
+}
+
+// Creates the context of a request received on the connection.
+func (conn *Conn) reqContext(req *SrvReq) {
+	ctx, cancel := context.WithCancelCause(conn.ctx)
+	if conn.Timeout <= 0 {
+		req.ctx, req.cancel = ctx, cancel
+		return
+	}
+
+	tctx, tcancel := context.WithTimeoutCause(ctx, conn.Timeout, Etimedout)
+	req.ctx = tctx
+	req.cancel = func(err error) {
+		cancel(err)
+		tcancel()
+	}
+}
+
 // Should be called to cancel a request. Should only be called
 // from the Flush operation if the FlushOp is implemented.
 func (req *SrvReq) Flush() {
@@ -458,14 +617,27 @@ func (conn *Conn) FidGet(fidno uint32) *SrvFid {
 }
 
 // Creates a new SrvFid struct for the fidno integer. Returns nil
-// if the SrvFid for that number already exists. The returned fid
-// has reference count set to 1.
+// if the SrvFid for that number already exists, or the connection
+// has Limits.Fids fids. The returned fid has reference count set to 1.
 func (conn *Conn) FidNew(fidno uint32) *SrvFid {
+	fid, _ := conn.fidNew(fidno)
+	return fid
+}
+
+// Same as FidNew, but returns Einuse or Etoomanyfids if the fid can't
+// be created. The limit is checked with the fid added under the same
+// lock, so concurrent requests can't exceed it.
+func (conn *Conn) fidNew(fidno uint32) (*SrvFid, error) {
 	conn.Lock()
-	_, present := conn.fidpool[fidno]
-	if present {
+	if _, present := conn.fidpool[fidno]; present {
 		conn.Unlock()
-		return nil
+		return nil, Einuse
+	}
+
+	if n := conn.Limits.Fids; n > 0 && len(conn.fidpool) >= n {
+		conn.Unlock()
+		conn.Srv.limitHit(limitFids)
+		return nil, Etoomanyfids
 	}
 
 	fid := new(SrvFid)
@@ -475,7 +647,7 @@ func (conn *Conn) FidNew(fidno uint32) *SrvFid {
 	conn.fidpool[fidno] = fid
 	conn.Unlock()
 
-	return fid
+	return fid, nil
 }
 
 func (conn *Conn) String() string {
@@ -491,6 +663,21 @@ func (fid *SrvFid) IncRef() {
 
 // Decrease the reference count for the fid. When the
 // reference count reaches 0, the fid is no longer valid.
+// Sets the qid and the type of the fid.
+func (fid *SrvFid) setQid(qid Qid) {
+	fid.Lock()
+	fid.Type = qid.Type
+	fid.qid = qid
+	fid.Unlock()
+}
+
+// Sets the open state of the fid.
+func (fid *SrvFid) setOpened(opened bool) {
+	fid.Lock()
+	fid.opened = opened
+	fid.Unlock()
+}
+
 func (fid *SrvFid) DecRef() {
 	fid.Lock()
 	fid.refcount--
@@ -501,11 +688,19 @@ func (fid *SrvFid) DecRef() {
 		return
 	}
 
+	// the fid isn't in the pool if the connection was closed
 	conn := fid.Fconn
 	conn.Lock()
-	delete(conn.fidpool, fid.fid)
+	pooled := conn.fidpool[fid.fid] == fid
+	if pooled {
+		delete(conn.fidpool, fid.fid)
+	}
 	conn.Unlock()
+	if !pooled {
+		return
+	}
 
+	conn.Srv.exclRelease(fid)
 	if fop, ok := (conn.Srv.ops).(SrvFidOps); ok {
 		fop.FidDestroy(fid)
 	}
@@ -1,8 +1,10 @@
 package go9p
 
 import (
+	"context"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSrvAndConnString(t *testing.T) {
@@ -49,6 +51,14 @@ func TestSrvReqProcessErrors(t *testing.T) {
 			},
 			wantErr: "unknown fid",
 		},
+		{
+			name: "nofid",
+			setup: func(t *testing.T, req *SrvReq) {
+				req.Tc.Type = Topen
+				req.Tc.Fid = NOFID
+			},
+			wantErr: "unknown fid",
+		},
 	}
 
 	for _, tt := range tests {
@@ -65,3 +75,60 @@ func TestSrvReqProcessErrors(t *testing.T) {
 		})
 	}
 }
+
+// A Ramfs whose reads wait until the request's context is done.
+type ctxRamfs struct {
+	*Ramfs
+	reqs chan *SrvReq
+}
+
+func (fs *ctxRamfs) Read(req *SrvReq) {
+	fs.reqs <- req
+	<-req.Context().Done()
+	req.RespondCanceled()
+}
+
+func TestSrvReqContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		cause   error
+		err     error // error of the client's read
+	}{
+		{"flush", 0, Eflushed, Eflushed},
+		{"timeout", 10 * time.Millisecond, Etimedout, Etimedout},
+		{"close", 0, Eclosed, nil},
+	}
+
+	for _, tt := range tests {
+		fs := &ctxRamfs{newTestRamfs(), make(chan *SrvReq, 1)}
+		fs.Timeout = tt.timeout
+		fs.Dotu = true
+		fs.Start(fs)
+		clnt := mountPipe(t, fs)
+
+		file, err := clnt.FOpen("/", OREAD)
+		if err != nil {
+			t.Fatalf("%s: FOpen error = %v", tt.name, err)
+		}
+		r := startRead(t, file)
+		req := <-fs.reqs
+		switch tt.name {
+		case "flush":
+			if err := clnt.Flush(r); err != nil {
+				t.Fatalf("%s: Flush error = %v", tt.name, err)
+			}
+		case "close":
+			clnt.Unmount()
+		}
+
+		<-req.Context().Done()
+		if cause := context.Cause(req.Context()); cause != tt.cause {
+			t.Fatalf("%s: cause = %v, want %v", tt.name, cause, tt.cause)
+		}
+		r = <-r.Done
+		if tt.err != nil && (r.Err == nil || r.Err.Error() != tt.err.Error()) {
+			t.Fatalf("%s: read error = %v, want %v", tt.name, r.Err, tt.err)
+		}
+	}
+}
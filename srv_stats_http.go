@@ -2,90 +2,239 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build httpstats && !tinygo
+//go:build !tinygo
 
 package go9p
 
 import (
+	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"net/http"
-	"sync"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
 )
 
-var mux sync.RWMutex
-var stat map[string]http.Handler
-var httponce sync.Once
+// The state of a fid, as reported by the stats handler.
+type fidStats struct {
+	Fid      uint32 `json:"fid"`
+	User     string `json:"user"`
+	Path     string `json:"path,omitempty"`
+	Qid      string `json:"qid"`
+	Omode    string `json:"omode,omitempty"`
+	Refcount int    `json:"refcount"`
+}
+
+// A pending request, as reported by the stats handler.
+type reqStats struct {
+	Tag  uint16        `json:"tag"`
+	Type string        `json:"type"`
+	Fid  uint32        `json:"fid"`
+	Age  time.Duration `json:"age_ns"`
+}
+
+type connStats struct {
+	Id         string     `json:"id"`
+	Msize      uint32     `json:"msize"`
+	Dotu       bool       `json:"dotu"`
+	Requests   int        `json:"requests"`
+	Received   uint64     `json:"received_bytes"`
+	Sent       uint64     `json:"sent_bytes"`
+	Pending    int        `json:"pending"`
+	MaxPending int        `json:"max_pending"`
+	Fids       []fidStats `json:"fids"`
+	Reqs       []reqStats `json:"pending_requests"`
 
-func register(s string, h http.Handler) {
-	mux.Lock()
-	if stat == nil {
-		stat = make(map[string]http.Handler)
+	conn *Conn
+}
+
+type srvStats struct {
+	Id    string      `json:"id"`
+	Conns []connStats `json:"conns"`
+}
+
+// Returns the name of the open mode, for example "ORDWR|OTRUNC".
+func omodeString(mode uint8) string {
+	s := [...]string{"OREAD", "OWRITE", "ORDWR", "OEXEC"}[mode&3]
+	if (mode & OTRUNC) != 0 {
+		s += "|OTRUNC"
 	}
 
-	if h == nil {
-		delete(stat, s)
-	} else {
-		stat[s] = h
+	if (mode & ORCLOSE) != 0 {
+		s += "|ORCLOSE"
 	}
-	mux.Unlock()
+
+	return s
 }
-func (srv *Srv) statsRegister() {
-	httponce.Do(func() {
-		http.HandleFunc("/go9p/", StatsHandler)
-		go http.ListenAndServe(":6060", nil) // nosemgrep: go.lang.security.audit.net.use-tls.use-tls
-	})
 
-	register("/go9p/srv/"+srv.Id, srv)
+func userString(u User) string {
+	switch {
+	case u == nil:
+		return ""
+	case u.Name() != "":
+		return u.Name()
+	}
+
+	return strconv.Itoa(u.Id())
 }
 
-func (srv *Srv) statsUnregister() {
-	register("/go9p/srv/"+srv.Id, nil)
+func newReqStats(tc *Fcall, start, now time.Time) reqStats {
+	return reqStats{tc.Tag, MsgName(tc.Type), traceFid(tc), now.Sub(start)}
 }
 
-func (srv *Srv) ServeHTTP(c http.ResponseWriter, r *http.Request) {
-	io.WriteString(c, fmt.Sprintf("<html><body><h1>Server %s</h1>", srv.Id))
-	defer io.WriteString(c, "</body></html>")
+// Returns a snapshot of the connection state.
+func (conn *Conn) stats() *connStats {
+	now := time.Now()
+	cs := &connStats{Id: conn.Id, Msize: conn.Msize, Dotu: conn.Dotu, conn: conn}
+
+	var fids []*SrvFid
+	conn.Lock()
+	cs.Requests = conn.nreqs
+	cs.Received = conn.tsz
+	cs.Sent = conn.rsz
+	cs.Pending = conn.npend
+	cs.MaxPending = conn.maxpend
+	for _, fid := range conn.fidpool {
+		fids = append(fids, fid)
+	}
+
+	for _, req := range conn.reqs {
+		for ; req != nil; req = req.next {
+			cs.Reqs = append(cs.Reqs, newReqStats(req.Tc, req.start, now))
+		}
+	}
+	conn.Unlock()
+
+	sort.Slice(fids, func(i, j int) bool { return fids[i].fid < fids[j].fid })
+	sort.Slice(cs.Reqs, func(i, j int) bool { return cs.Reqs[i].Age > cs.Reqs[j].Age })
+
+	pop, _ := (conn.Srv.ops).(FidPathOps)
+	cs.Fids = make([]fidStats, len(fids))
+	for i, fid := range fids {
+		fs := &cs.Fids[i]
+		fs.Fid = fid.fid
+		fid.Lock()
+		fs.Refcount = fid.refcount
+		qid, opened, omode := fid.qid, fid.opened, fid.Omode
+		fid.Unlock()
+		fs.User = userString(fid.User)
+		fs.Qid = qid.String()
+		if opened {
+			fs.Omode = omodeString(omode)
+		}
+
+		if pop != nil {
+			fs.Path = pop.FidPath(fid)
+		}
+	}
 
-	// connections
-	io.WriteString(c, "<h2>Connections</h2><p>")
+	return cs
+}
+
+// Returns a snapshot of the state of the server connections. If id is
+// not empty, only the connection with that Id is included.
+func (srv *Srv) stats(id string) *srvStats {
+	var conns []*Conn
 	srv.Lock()
-	defer srv.Unlock()
-	if len(srv.conns) == 0 {
-		io.WriteString(c, "none")
-		return
+	for conn := range srv.conns {
+		if id == "" || conn.Id == id {
+			conns = append(conns, conn)
+		}
 	}
+	srv.Unlock()
 
-	for _, conn := range srv.conns {
-		io.WriteString(c, fmt.Sprintf("<a href='/go9p/srv/%s/conn/%s'>%s</a><br>", srv.Id, conn.Id, conn.Id))
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Id < conns[j].Id })
+	ss := &srvStats{Id: srv.Id, Conns: make([]connStats, len(conns))}
+	for i, conn := range conns {
+		ss.Conns[i] = *conn.stats()
 	}
+
+	return ss
 }
 
-func (conn *Conn) statsRegister() {
-	register("/go9p/srv/"+conn.Srv.Id+"/conn/"+conn.Id, conn)
+// Returns true if the stats should be served as JSON.
+func wantJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || r.Header.Get("Accept") == "application/json"
 }
 
-func (conn *Conn) statsUnregister() {
-	register("/go9p/srv/"+conn.Srv.Id+"/conn/"+conn.Id, nil)
+func serveJSON(c http.ResponseWriter, v interface{}) {
+	c.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(c)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
 }
 
-func (conn *Conn) ServeHTTP(c http.ResponseWriter, r *http.Request) {
-	io.WriteString(c, fmt.Sprintf("<html><body><h1>Connection %s/%s</h1>", conn.Srv.Id, conn.Id))
-	defer io.WriteString(c, "</body></html>")
+// Returns an http.Handler that serves the state of the server: its
+// connections, their fids and pending requests. The handler can be
+// mounted on any path. The state is served as HTML, or as JSON if the
+// "format=json" query parameter is given or the request accepts
+// "application/json". The "conn" query parameter selects a single
+// connection.
+func (srv *Srv) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(c http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("conn")
+		ss := srv.stats(id)
+		if id != "" && len(ss.Conns) == 0 {
+			http.NotFound(c, r)
+			return
+		}
+
+		if wantJSON(r) {
+			serveJSON(c, ss)
+			return
+		}
 
-	// statistics
-	conn.Lock()
-	io.WriteString(c, fmt.Sprintf("<p>Number of processed requests: %d", conn.nreqs))
-	io.WriteString(c, fmt.Sprintf("<br>Sent %v bytes", conn.rsz))
-	io.WriteString(c, fmt.Sprintf("<br>Received %v bytes", conn.tsz))
-	io.WriteString(c, fmt.Sprintf("<br>Pending requests: %d max %d", conn.npend, conn.maxpend))
-	io.WriteString(c, fmt.Sprintf("<br>Number of reads: %d", conn.nreads))
-	io.WriteString(c, fmt.Sprintf("<br>Number of writes: %d", conn.nwrites))
-	conn.Unlock()
+		c.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(c, fmt.Sprintf("<html><body><h1>Server %s</h1>", html.EscapeString(ss.Id)))
+		defer io.WriteString(c, "</body></html>")
+		if id == "" {
+			srv.writeConns(c, ss)
+			return
+		}
+
+		srv.writeConn(c, &ss.Conns[0])
+	})
+}
+
+func (srv *Srv) writeConns(c io.Writer, ss *srvStats) {
+	io.WriteString(c, "<h2>Connections</h2>")
+	if len(ss.Conns) == 0 {
+		io.WriteString(c, "<p>none")
+		return
+	}
+
+	io.WriteString(c, "<table><tr><th>Connection<th>Requests<th>Received<th>Sent<th>Pending<th>Max pending<th>Fids</tr>")
+	for _, cs := range ss.Conns {
+		io.WriteString(c, fmt.Sprintf("<tr><td><a href='?conn=%s'>%s</a><td>%d<td>%d<td>%d<td>%d<td>%d<td>%d</tr>",
+			url.QueryEscape(cs.Id), html.EscapeString(cs.Id), cs.Requests, cs.Received, cs.Sent,
+			cs.Pending, cs.MaxPending, len(cs.Fids)))
+	}
+	io.WriteString(c, "</table>")
+}
+
+func (srv *Srv) writeConn(c io.Writer, cs *connStats) {
+	io.WriteString(c, fmt.Sprintf("<h2>Connection %s</h2>", html.EscapeString(cs.Id)))
+	io.WriteString(c, fmt.Sprintf("<p>Number of processed requests: %d", cs.Requests))
+	io.WriteString(c, fmt.Sprintf("<br>Sent %v bytes", cs.Sent))
+	io.WriteString(c, fmt.Sprintf("<br>Received %v bytes", cs.Received))
+	io.WriteString(c, fmt.Sprintf("<br>Pending requests: %d max %d", cs.Pending, cs.MaxPending))
+	io.WriteString(c, fmt.Sprintf("<br>Msize %d, 9P2000.u %v", cs.Msize, cs.Dotu))
+
+	io.WriteString(c, "<h2>Fids</h2><table><tr><th>Fid<th>User<th>Path<th>Qid<th>Open mode<th>Refcount</tr>")
+	for _, fs := range cs.Fids {
+		io.WriteString(c, fmt.Sprintf("<tr><td>%d<td>%s<td>%s<td>%s<td>%s<td>%d</tr>", fs.Fid,
+			html.EscapeString(fs.User), html.EscapeString(fs.Path), html.EscapeString(fs.Qid),
+			fs.Omode, fs.Refcount))
+	}
+	io.WriteString(c, "</table>")
+	writeReqs(c, cs.Reqs)
 
 	// fcalls
-	if conn.Debuglevel&DbgLogFcalls != 0 {
-		fs := conn.Srv.Log.Filter(conn, DbgLogFcalls)
+	if cs.conn.Debuglevel&DbgLogFcalls != 0 {
+		fs := srv.Log.Filter(cs.conn, DbgLogFcalls)
 		io.WriteString(c, fmt.Sprintf("<h2>Last %d 9P messages</h2>", len(fs)))
 		for i, l := range fs {
 			fc := l.Data.(*Fcall)
@@ -114,21 +263,15 @@ func (conn *Conn) ServeHTTP(c http.ResponseWriter, r *http.Request) {
 				}
 			}
 
-			io.WriteString(c, fmt.Sprintf("<br id='fc%d'>%d: %s%s", i, i, fc, lbl))
+			io.WriteString(c, fmt.Sprintf("<br id='fc%d'>%d: %s%s", i, i, html.EscapeString(fc.String()), lbl))
 		}
 	}
 }
 
-func StatsHandler(c http.ResponseWriter, r *http.Request) {
-	mux.RLock()
-	if v, ok := stat[r.URL.Path]; ok {
-		v.ServeHTTP(c, r)
-	} else if r.URL.Path == "/go9p/" {
-		io.WriteString(c, fmt.Sprintf("<html><body><br><h1>On offer: </h1><br>"))
-		for v := range stat {
-			io.WriteString(c, fmt.Sprintf("<a href='%s'>%s</a><br>", v, v))
-		}
-		io.WriteString(c, "</body></html>")
+func writeReqs(c io.Writer, reqs []reqStats) {
+	io.WriteString(c, "<h2>Pending requests</h2><table><tr><th>Tag<th>Type<th>Fid<th>Age</tr>")
+	for _, rs := range reqs {
+		io.WriteString(c, fmt.Sprintf("<tr><td>%d<td>%s<td>%d<td>%v</tr>", rs.Tag, rs.Type, rs.Fid, rs.Age))
 	}
-	mux.RUnlock()
+	io.WriteString(c, "</table>")
 }
@@ -0,0 +1,146 @@
+package go9p
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOmodeString(t *testing.T) {
+	tests := []struct {
+		mode uint8
+		want string
+	}{
+		{OREAD, "OREAD"},
+		{OWRITE | OTRUNC, "OWRITE|OTRUNC"},
+		{ORDWR | ORCLOSE, "ORDWR|ORCLOSE"},
+		{OEXEC, "OEXEC"},
+	}
+
+	for _, tt := range tests {
+		if got := omodeString(tt.mode); got != tt.want {
+			t.Errorf("omodeString(%d) = %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestConnStatsPending(t *testing.T) {
+	req := newTestReq(Tread)
+	req.Tc.Fid = 5
+	req.start = time.Now().Add(-time.Second)
+	older := &SrvReq{Tc: &Fcall{Type: Twalk, Tag: 1, Fid: 6}, start: req.start.Add(-time.Second)}
+	req.next = older
+
+	cs := req.Conn.stats()
+	if len(cs.Reqs) != 2 {
+		t.Fatalf("pending = %+v", cs.Reqs)
+	}
+	if cs.Reqs[0].Type != "Twalk" || cs.Reqs[1].Type != "Tread" || cs.Reqs[1].Fid != 5 || cs.Reqs[1].Age < time.Second {
+		t.Fatalf("pending = %+v", cs.Reqs)
+	}
+}
+
+func TestSrvStatsHandler(t *testing.T) {
+	fs := newTestRamfs()
+	clnt := newRamfsClnt(t, fs)
+	f, err := clnt.FCreate("/file", 0644, OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	h := fs.StatsHandler()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/stats?format=json", nil))
+	var ss srvStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &ss); err != nil {
+		t.Fatalf("Unmarshal error = %v: %s", err, rec.Body.String())
+	}
+	if ss.Id != "ramfs" || len(ss.Conns) != 1 {
+		t.Fatalf("stats = %+v", ss)
+	}
+
+	var file *fidStats
+	cs := &ss.Conns[0]
+	for i := range cs.Fids {
+		if cs.Fids[i].Fid == f.Fid.Fid {
+			file = &cs.Fids[i]
+		}
+	}
+	if file == nil || file.Path != "/file" || file.Omode != "OWRITE" || file.Refcount != 1 {
+		t.Fatalf("fids = %+v", cs.Fids)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "<a href='?conn=") {
+		t.Fatalf("html = %s", body)
+	}
+
+	req := httptest.NewRequest("GET", "/stats?conn="+cs.Id, nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if body := rec.Body.String(); !strings.Contains(body, "<td>/file<td>") || !strings.Contains(body, "Pending requests") {
+		t.Fatalf("conn html = %s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/stats?conn=nosuch", nil))
+	if rec.Code != 404 {
+		t.Fatalf("unknown conn code = %d", rec.Code)
+	}
+}
+
+func TestSrvStatsOpen(t *testing.T) {
+	fs := newTestRamfs()
+	clnt := newRamfsClnt(t, fs)
+	addRamFile(t, fs, nil, "file", "", 0644)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			f, err := clnt.FOpen("/file", OREAD)
+			if err != nil {
+				t.Errorf("FOpen error = %v", err)
+				return
+			}
+			_ = f.Close()
+		}
+	}()
+
+	// run with -race, the stats read the fids while they are opened
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			fs.stats("")
+		}
+	}
+}
+
+func TestClntStatsHandler(t *testing.T) {
+	clnt := newRamfsClnt(t, newTestRamfs())
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	clnt.StatsHandler().ServeHTTP(rec, req)
+
+	var cs clntStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &cs); err != nil {
+		t.Fatalf("Unmarshal error = %v: %s", err, rec.Body.String())
+	}
+	if cs.Id != clnt.Id || !cs.Connected || len(cs.Reqs) != 0 {
+		t.Fatalf("stats = %+v", cs)
+	}
+
+	clnt.Unmount()
+	rec = httptest.NewRecorder()
+	clnt.StatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(rec.Body.String(), "Connected: false") {
+		t.Fatalf("html = %s", rec.Body.String())
+	}
+}
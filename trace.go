@@ -0,0 +1,262 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A TraceEvent describes a 9P2000 request and the response to it.
+type TraceEvent struct {
+	Time     time.Time     // time the T-message was received (server) or sent (client)
+	Conn     string        // identifier of the connection (Conn.Id or Clnt.Id)
+	Tag      uint16        // request tag
+	Fid      uint32        // fid the request operates on, NOFID if none
+	Type     uint8         // T-message type
+	Latency  time.Duration // time until the response was sent (server) or received (client)
+	Tsize    uint32        // size of the T-message
+	Rsize    uint32        // size of the R-message
+	Error    string        // error returned, if the response is Rerror
+	Errornum uint32        // error code returned, 9P2000.u only
+}
+
+// A TraceSink receives the events produced when tracing is enabled
+// by setting the Trace field of Srv or Clnt. The Trace method may be
+// called concurrently and shouldn't retain ev after it returns.
+type TraceSink interface {
+	Trace(ev *TraceEvent)
+}
+
+// A TraceQuery selects trace events. The zero value matches all events.
+type TraceQuery struct {
+	Conn   string    // connection identifier, "" for any
+	Fid    uint32    // fid, if HasFid is set
+	HasFid bool      // match only the events for Fid
+	Type   uint8     // T-message type, 0 for any
+	Since  time.Time // earliest event time, zero for no limit
+	Until  time.Time // latest event time, zero for no limit
+}
+
+var msgNames = [...]string{
+	"Tversion", "Rversion", "Tauth", "Rauth", "Tattach", "Rattach",
+	"Terror", "Rerror", "Tflush", "Rflush", "Twalk", "Rwalk",
+	"Topen", "Ropen", "Tcreate", "Rcreate", "Tread", "Rread",
+	"Twrite", "Rwrite", "Tclunk", "Rclunk", "Tremove", "Rremove",
+	"Tstat", "Rstat", "Twstat", "Rwstat",
+}
+
+// Returns the name of the 9P2000 message type, for example "Twalk".
+func MsgName(mtype uint8) string {
+	if mtype < Tversion || mtype >= Tlast {
+		return "unknown"
+	}
+
+	return msgNames[mtype-Tversion]
+}
+
+// Returns the fid the message operates on.
+func traceFid(fc *Fcall) uint32 {
+	switch fc.Type {
+	case Tversion, Tflush:
+		return NOFID
+	case Tauth:
+		return fc.Afid
+	}
+
+	return fc.Fid
+}
+
+// Fills in the fields of the event from a request and its response.
+func (ev *TraceEvent) set(conn string, start time.Time, tc, rc *Fcall) {
+	ev.Time = start
+	ev.Conn = conn
+	ev.Tag = tc.Tag
+	ev.Fid = traceFid(tc)
+	ev.Type = tc.Type
+	ev.Latency = time.Since(start)
+	ev.Tsize = tc.Size
+	if rc != nil {
+		ev.Rsize = rc.Size
+		if rc.Type == Rerror {
+			ev.Error = rc.Error
+			ev.Errornum = rc.Errornum
+		}
+	}
+}
+
+// Returns true if the event is selected by the query.
+func (q *TraceQuery) Match(ev *TraceEvent) bool {
+	return (q.Conn == "" || q.Conn == ev.Conn) &&
+		(!q.HasFid || q.Fid == ev.Fid) &&
+		(q.Type == 0 || q.Type == ev.Type) &&
+		(q.Since.IsZero() || !ev.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || !ev.Time.After(q.Until))
+}
+
+type multiTrace []TraceSink
+
+// Returns a TraceSink that passes the events to all specified sinks.
+func MultiTrace(sinks ...TraceSink) TraceSink {
+	return multiTrace(append([]TraceSink(nil), sinks...))
+}
+
+func (m multiTrace) Trace(ev *TraceEvent) {
+	for _, s := range m {
+		s.Trace(ev)
+	}
+}
+
+// The TraceRing type is a TraceSink that keeps the last N events
+// in memory and can be queried.
+type TraceRing struct {
+	sync.Mutex
+	events []TraceEvent
+	idx    int // position of the next event
+	n      int // number of valid events
+}
+
+// Creates a TraceRing that keeps the last sz events. If sz is less
+// than 1, the ring keeps the last event.
+func NewTraceRing(sz int) *TraceRing {
+	if sz < 1 {
+		sz = 1
+	}
+
+	return &TraceRing{events: make([]TraceEvent, sz)}
+}
+
+func (r *TraceRing) Trace(ev *TraceEvent) {
+	r.Lock()
+	r.events[r.idx] = *ev
+	r.idx++
+	if r.idx >= len(r.events) {
+		r.idx = 0
+	}
+
+	if r.n < len(r.events) {
+		r.n++
+	}
+	r.Unlock()
+}
+
+// Returns the events selected by the query, oldest first. If q is nil,
+// all events are returned.
+func (r *TraceRing) Query(q *TraceQuery) []TraceEvent {
+	r.Lock()
+	defer r.Unlock()
+
+	var evs []TraceEvent
+	i := r.idx - r.n
+	if i < 0 {
+		i += len(r.events)
+	}
+
+	for m := 0; m < r.n; m++ {
+		ev := &r.events[i]
+		if q == nil || q.Match(ev) {
+			evs = append(evs, *ev)
+		}
+
+		i++
+		if i >= len(r.events) {
+			i = 0
+		}
+	}
+
+	return evs
+}
+
+// The format of the events written by TraceJSON.
+type jsonEvent struct {
+	Time     time.Time `json:"time"`
+	Conn     string    `json:"conn"`
+	Tag      uint16    `json:"tag"`
+	Fid      uint32    `json:"fid"`
+	Type     string    `json:"type"`
+	Latency  int64     `json:"latency_ns"`
+	Tsize    uint32    `json:"tsize"`
+	Rsize    uint32    `json:"rsize"`
+	Error    string    `json:"error,omitempty"`
+	Errornum uint32    `json:"errno,omitempty"`
+}
+
+func (ev *TraceEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonEvent{ev.Time, ev.Conn, ev.Tag, ev.Fid,
+		MsgName(ev.Type), int64(ev.Latency), ev.Tsize, ev.Rsize,
+		ev.Error, ev.Errornum})
+}
+
+// The TraceJSON type is a TraceSink that writes the events as JSON
+// objects, one per line.
+type TraceJSON struct {
+	sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// Creates a TraceJSON that writes the events to w.
+func NewTraceJSON(w io.Writer) *TraceJSON {
+	return &TraceJSON{enc: json.NewEncoder(w)}
+}
+
+func (t *TraceJSON) Trace(ev *TraceEvent) {
+	t.Lock()
+	if t.err == nil {
+		t.err = t.enc.Encode(ev)
+	}
+	t.Unlock()
+}
+
+// Returns the first error encountered while writing the events.
+// No events are written after an error.
+func (t *TraceJSON) Err() error {
+	t.Lock()
+	defer t.Unlock()
+	return t.err
+}
+
+// The TraceSlog type is a TraceSink that passes the events to a
+// log/slog handler.
+type TraceSlog struct {
+	Level slog.Level // level of the records for successful requests
+	h     slog.Handler
+}
+
+// Creates a TraceSlog that passes the events to h. Requests that
+// failed are logged at slog.LevelWarn.
+func NewTraceSlog(h slog.Handler) *TraceSlog {
+	return &TraceSlog{Level: slog.LevelDebug, h: h}
+}
+
+func (t *TraceSlog) Trace(ev *TraceEvent) {
+	level := t.Level
+	if ev.Error != "" {
+		level = slog.LevelWarn
+	}
+
+	ctx := context.Background()
+	if !t.h.Enabled(ctx, level) {
+		return
+	}
+
+	r := slog.NewRecord(ev.Time, level, MsgName(ev.Type), 0)
+	r.AddAttrs(slog.String("conn", ev.Conn),
+		slog.Int("tag", int(ev.Tag)),
+		slog.Uint64("fid", uint64(ev.Fid)),
+		slog.Duration("latency", ev.Latency),
+		slog.Uint64("tsize", uint64(ev.Tsize)),
+		slog.Uint64("rsize", uint64(ev.Rsize)))
+	if ev.Error != "" {
+		r.AddAttrs(slog.String("error", ev.Error),
+			slog.Uint64("errno", uint64(ev.Errornum)))
+	}
+
+	_ = t.h.Handle(ctx, r)
+}
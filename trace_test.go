@@ -0,0 +1,164 @@
+package go9p
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMsgName(t *testing.T) {
+	tests := []struct {
+		mtype uint8
+		want  string
+	}{
+		{Tversion, "Tversion"},
+		{Rerror, "Rerror"},
+		{Twalk, "Twalk"},
+		{Rwstat, "Rwstat"},
+		{Tlast, "unknown"},
+		{0, "unknown"},
+	}
+
+	for _, tt := range tests {
+		if got := MsgName(tt.mtype); got != tt.want {
+			t.Errorf("MsgName(%d) = %q, want %q", tt.mtype, got, tt.want)
+		}
+	}
+}
+
+func TestTraceRingQuery(t *testing.T) {
+	ring := NewTraceRing(3)
+	base := time.Unix(1000, 0)
+	for i, ev := range []TraceEvent{
+		{Conn: "a", Fid: 1, Type: Twalk},
+		{Conn: "a", Fid: 2, Type: Topen},
+		{Conn: "b", Fid: 1, Type: Tread},
+		{Conn: "b", Fid: NOFID, Type: Tversion},
+	} {
+		ev.Time = base.Add(time.Duration(i) * time.Second)
+		ring.Trace(&ev)
+	}
+
+	tests := []struct {
+		name string
+		q    *TraceQuery
+		want []uint8
+	}{
+		{"all", nil, []uint8{Topen, Tread, Tversion}},
+		{"zero", &TraceQuery{}, []uint8{Topen, Tread, Tversion}},
+		{"conn", &TraceQuery{Conn: "b"}, []uint8{Tread, Tversion}},
+		{"fid", &TraceQuery{Fid: 1, HasFid: true}, []uint8{Tread}},
+		{"fid-0", &TraceQuery{HasFid: true}, nil},
+		{"type", &TraceQuery{Type: Topen}, []uint8{Topen}},
+		{"since", &TraceQuery{Since: base.Add(2 * time.Second)}, []uint8{Tread, Tversion}},
+		{"until", &TraceQuery{Until: base.Add(2 * time.Second)}, []uint8{Topen, Tread}},
+		{"none", &TraceQuery{Conn: "c"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evs := ring.Query(tt.q)
+			if len(evs) != len(tt.want) {
+				t.Fatalf("Query = %v, want types %v", evs, tt.want)
+			}
+			for i, ev := range evs {
+				if ev.Type != tt.want[i] {
+					t.Fatalf("Query[%d].Type = %d, want %d", i, ev.Type, tt.want[i])
+				}
+			}
+		})
+	}
+
+	ring = NewTraceRing(0)
+	ring.Trace(&TraceEvent{Type: Tstat})
+	ring.Trace(&TraceEvent{Type: Tread})
+	if evs := ring.Query(nil); len(evs) != 1 || evs[0].Type != Tread {
+		t.Fatalf("NewTraceRing(0) events = %v", evs)
+	}
+}
+
+func TestTraceJSON(t *testing.T) {
+	var buf bytes.Buffer
+	tj := NewTraceJSON(&buf)
+	sink := MultiTrace(tj, NewTraceRing(1))
+	sink.Trace(&TraceEvent{Conn: "c", Tag: 3, Fid: 7, Type: Twalk, Latency: 5, Tsize: 20, Rsize: 9})
+	sink.Trace(&TraceEvent{Conn: "c", Tag: 4, Fid: 7, Type: Topen, Error: "no", Errornum: EPERM})
+	if err := tj.Err(); err != nil {
+		t.Fatalf("Err = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines = %q", lines)
+	}
+
+	var ev map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &ev); err != nil {
+		t.Fatalf("Unmarshal error = %v", err)
+	}
+	if ev["type"] != "Twalk" || ev["tag"] != 3.0 || ev["latency_ns"] != 5.0 || ev["rsize"] != 9.0 {
+		t.Fatalf("event = %v", ev)
+	}
+	if _, ok := ev["error"]; ok {
+		t.Fatalf("successful event has error: %v", ev)
+	}
+	if !strings.Contains(lines[1], `"error":"no"`) || !strings.Contains(lines[1], `"errno":1`) {
+		t.Fatalf("error event = %s", lines[1])
+	}
+}
+
+func TestTraceSlog(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	ts := NewTraceSlog(h)
+
+	ts.Trace(&TraceEvent{Conn: "c", Type: Tstat})
+	if buf.Len() != 0 {
+		t.Fatalf("debug event logged: %s", buf.String())
+	}
+
+	ts.Trace(&TraceEvent{Conn: "c", Fid: 4, Type: Tremove, Error: "denied", Errornum: EPERM})
+	out := buf.String()
+	for _, s := range []string{"level=WARN", "msg=Tremove", "fid=4", "error=denied"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("output %q doesn't contain %q", out, s)
+		}
+	}
+}
+
+func TestTraceSrvClnt(t *testing.T) {
+	fs := newTestRamfs()
+	srvring := NewTraceRing(64)
+	fs.Trace = srvring
+	clnt := newRamfsClnt(t, fs)
+	clntring := NewTraceRing(64)
+	clnt.Trace = clntring
+
+	if _, err := clnt.FStat("/missing"); err == nil {
+		t.Fatalf("FStat succeeded")
+	}
+
+	evs := clntring.Query(&TraceQuery{Type: Twalk})
+	if len(evs) != 1 || evs[0].Error == "" || evs[0].Rsize == 0 || evs[0].Latency <= 0 {
+		t.Fatalf("client walk events = %+v", evs)
+	}
+
+	// the server traces after the response is written
+	var sevs []TraceEvent
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if sevs = srvring.Query(&TraceQuery{Type: Twalk}); len(sevs) > 0 {
+			break
+		}
+	}
+
+	if len(sevs) != 1 || sevs[0].Error != evs[0].Error || sevs[0].Tag != evs[0].Tag || sevs[0].Fid != evs[0].Fid {
+		t.Fatalf("server walk events = %+v, client %+v", sevs, evs)
+	}
+
+	if vevs := srvring.Query(&TraceQuery{Type: Tversion}); len(vevs) != 1 || vevs[0].Fid != NOFID {
+		t.Fatalf("server version events = %+v", vevs)
+	}
+}
@@ -8,7 +8,6 @@ package go9p
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/user"
@@ -159,7 +158,7 @@ type ufsDir struct {
 	Dir
 }
 
-func dir2Dir(path string, d os.FileInfo, dotu bool, upool Users) (*Dir, error) {
+func dir2Dir(path string, d os.FileInfo, dotu bool, upool Users, opts *ProtocolOptions) (*Dir, error) {
 	if r := recover(); r != nil {
 		fmt.Print("stat failed: ", r)
 		return nil, &os.PathError{Op: "dir2Dir", Path: path, Err: nil}
@@ -200,7 +199,7 @@ func dir2Dir(path string, d os.FileInfo, dotu bool, upool Users) (*Dir, error) {
 	}
 
 	/* For Akaros, we use the Muid as the link value. */
-	if *Akaros && (d.Mode()&os.ModeSymlink != 0) {
+	if opts.SymlinkMuid && (d.Mode()&os.ModeSymlink != 0) {
 		dir.Muid, err = os.Readlink(path)
 		if err == nil {
 			dir.Mode |= DMSYMLINK
@@ -263,6 +262,24 @@ func (*Ufs) FidDestroy(sfid *SrvFid) {
 	if fid.file != nil {
 		_ = fid.file.Close()
 	}
+
+	if sfid.opened && (sfid.Omode&ORCLOSE) != 0 {
+		_ = os.Remove(fid.path)
+	}
+}
+
+func (ufs *Ufs) FidPath(sfid *SrvFid) string {
+	fid, ok := sfid.Aux.(*ufsFid)
+	if !ok {
+		return ""
+	}
+
+	p, err := filepath.Rel(ufs.Root, fid.path)
+	if err != nil {
+		return fid.path
+	}
+
+	return filepath.Join("/", p)
 }
 
 func (ufs *Ufs) Attach(req *SrvReq) {
@@ -291,7 +308,23 @@ func (ufs *Ufs) Attach(req *SrvReq) {
 
 func (*Ufs) Flush(req *SrvReq) {}
 
-func (*Ufs) Walk(req *SrvReq) {
+// Returns the path of the name in the directory. Walking .. from the
+// root stays at the root. An empty root is the root of the file system.
+func joinRoot(root, dir, name string) string {
+	if root == "" {
+		root = "/"
+	}
+
+	p := filepath.Join(dir, name)
+	r, err := filepath.Rel(root, p)
+	if err != nil || r == ".." || strings.HasPrefix(r, "../") {
+		return filepath.Clean(root)
+	}
+
+	return p
+}
+
+func (ufs *Ufs) Walk(req *SrvReq) {
 	fid := req.Fid.Aux.(*ufsFid)
 	tc := req.Tc
 
@@ -310,7 +343,7 @@ func (*Ufs) Walk(req *SrvReq) {
 	path := fid.path
 	i := 0
 	for ; i < len(tc.Wname); i++ {
-		p := path + "/" + tc.Wname[i]
+		p := joinRoot(ufs.Root, path, tc.Wname[i])
 		st, err := os.Lstat(p)
 		if err != nil {
 			if i == 0 {
@@ -398,7 +431,7 @@ func (*Ufs) Create(req *SrvReq) {
 				mode |= syscall.S_ISGID
 			}
 		}
-		file, e = os.OpenFile(path, omode2uflags(tc.Mode)|os.O_CREATE, os.FileMode(mode))
+		file, e = os.OpenFile(path, omode2uflags(tc.Mode)|os.O_CREATE|os.O_EXCL, os.FileMode(mode))
 	}
 
 	if file == nil && e == nil {
@@ -424,86 +457,81 @@ func (*Ufs) Create(req *SrvReq) {
 func (*Ufs) Read(req *SrvReq) {
 	fid := req.Fid.Aux.(*ufsFid)
 	tc := req.Tc
-	rc := req.Rc
 	err := fid.stat()
 	if err != nil {
 		req.RespondError(err)
 		return
 	}
 
-	_ = InitRread(rc, tc.Count)
+	if !fid.st.IsDir() {
+		req.RespondRreadAt(fid.file, int64(tc.Offset), tc.Count)
+		return
+	}
+
 	var count int
-	var e error
-	if fid.st.IsDir() {
-		if tc.Offset == 0 {
-			var e error
-			// If we got here, it was open. Can't really seek
-			// in most cases, just close and reopen it.
-			_ = fid.file.Close()
-			if fid.file, e = os.OpenFile(fid.path, omode2uflags(req.Fid.Omode), 0); e != nil {
-				req.RespondError(toError(e))
-				return
-			}
+	if tc.Offset == 0 {
+		var e error
+		// If we got here, it was open. Can't really seek
+		// in most cases, just close and reopen it.
+		_ = fid.file.Close()
+		if fid.file, e = os.OpenFile(fid.path, omode2uflags(req.Fid.Omode), 0); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
 
-			if fid.dirs, e = fid.file.Readdir(-1); e != nil {
-				req.RespondError(toError(e))
-				return
-			}
+		if fid.dirs, e = fid.file.Readdir(-1); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
 
-			fid.dirents = nil
-			fid.direntends = nil
-			for i := 0; i < len(fid.dirs); i++ {
-				path := fid.path + "/" + fid.dirs[i].Name()
-				st, _ := dir2Dir(path, fid.dirs[i], req.Conn.Dotu, req.Conn.Srv.Upool)
-				if st == nil {
-					continue
-				}
-				b := PackDir(st, req.Conn.Dotu)
-				fid.dirents = append(fid.dirents, b...)
-				count += len(b)
-				fid.direntends = append(fid.direntends, count)
+		fid.dirents = nil
+		fid.direntends = nil
+		for i := 0; i < len(fid.dirs); i++ {
+			path := fid.path + "/" + fid.dirs[i].Name()
+			st, _ := dir2Dir(path, fid.dirs[i], req.Conn.Dotu, req.Conn.Srv.Upool, &req.Conn.Options)
+			if st == nil {
+				continue
 			}
+			b := PackDir(st, req.Conn.Dotu)
+			fid.dirents = append(fid.dirents, b...)
+			count += len(b)
+			fid.direntends = append(fid.direntends, count)
 		}
+	}
 
-		switch {
-		case tc.Offset > uint64(len(fid.dirents)):
-			count = 0
-		case len(fid.dirents[tc.Offset:]) > int(tc.Count):
-			count = int(tc.Count)
-		default:
-			count = len(fid.dirents[tc.Offset:])
-		}
+	switch {
+	case tc.Offset > uint64(len(fid.dirents)):
+		count = 0
+	case len(fid.dirents[tc.Offset:]) > int(tc.Count):
+		count = int(tc.Count)
+	default:
+		count = len(fid.dirents[tc.Offset:])
+	}
 
-		if !*Akaros {
-			nextend := sort.SearchInts(fid.direntends, int(tc.Offset)+count)
-			if nextend < len(fid.direntends) {
-				if fid.direntends[nextend] > int(tc.Offset)+count {
-					if nextend > 0 {
-						count = fid.direntends[nextend-1] - int(tc.Offset)
-					} else {
-						count = 0
-					}
+	if !req.Conn.Options.SplitDirents {
+		nextend := sort.SearchInts(fid.direntends, int(tc.Offset)+count)
+		if nextend < len(fid.direntends) {
+			if fid.direntends[nextend] > int(tc.Offset)+count {
+				if nextend > 0 {
+					count = fid.direntends[nextend-1] - int(tc.Offset)
+				} else {
+					count = 0
 				}
 			}
-			if count == 0 && int(tc.Offset) < len(fid.dirents) && len(fid.dirents) > 0 {
-				req.RespondError(&Error{"too small read size for dir entry", EINVAL})
-				return
-			}
 		}
-
-		copy(rc.Data, fid.dirents[tc.Offset:int(tc.Offset)+count])
-
-	} else {
-		count, e = fid.file.ReadAt(rc.Data, int64(tc.Offset))
-		if e != nil && e != io.EOF {
-			req.RespondError(toError(e))
+		if count == 0 && int(tc.Offset) < len(fid.dirents) && len(fid.dirents) > 0 {
+			req.RespondError(&Error{"too small read size for dir entry", EINVAL})
 			return
 		}
+	}
 
+	if count == 0 {
+		req.RespondRread(nil)
+		return
 	}
 
-	SetRreadCount(rc, uint32(count))
-	req.Respond()
+	// the dirents are replaced, not modified, when the directory is read again
+	req.RespondRreadData(fid.dirents[tc.Offset : int(tc.Offset)+count])
 }
 
 func (*Ufs) Write(req *SrvReq) {
@@ -551,7 +579,7 @@ func (*Ufs) Stat(req *SrvReq) {
 		return
 	}
 
-	st, derr := dir2Dir(fid.path, fid.st, req.Conn.Dotu, req.Conn.Srv.Upool)
+	st, derr := dir2Dir(fid.path, fid.st, req.Conn.Dotu, req.Conn.Srv.Upool, &req.Conn.Options)
 	if st == nil {
 		req.RespondError(derr)
 		return
@@ -8,13 +8,18 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 
 	"github.com/rminnich/go9p"
 )
 
 var addr = flag.String("addr", ":5640", "network address")
+var ntype = flag.String("net", "tcp", "network type of addr, tcp or unix")
+var stdio = flag.Bool("stdio", false, "serve a single connection on the standard input and output")
 var debug = flag.Int("debug", 0, "print debug messages")
 var root = flag.String("root", "/", "root filesystem")
+var akaros = flag.Bool("akaros", false, "Akaros extensions")
+var httpaddr = flag.String("http", "", "network address for the stats and metrics pages, and 9P over WebSocket at /9p")
 
 func main() {
 	flag.Parse()
@@ -23,12 +28,38 @@ func main() {
 	ufs.Id = "ufs"
 	ufs.Root = *root
 	ufs.Debuglevel = *debug
+	if *akaros {
+		ufs.Options = go9p.AkarosOptions
+	}
+	ufs.Metrics = go9p.NewMetrics()
 	ufs.Start(ufs)
+	if *httpaddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/go9p/", ufs.StatsHandler())
+		mux.Handle("/metrics", ufs.MetricsHandler())
+		mux.Handle("/9p", ufs.WebSocketHandler())
+		go func() {
+			log.Println(http.ListenAndServe(*httpaddr, mux)) // nosemgrep: go.lang.security.audit.net.use-tls.use-tls
+		}()
+	}
+
+	if *stdio {
+		ufs.ServeStdio()
+		return
+	}
 
 	fmt.Print("ufs starting\n")
 	// determined by build tags
 	// extraFuncs()
-	err := ufs.StartNetListener("tcp", *addr)
+	// started by socket activation, or listening on addr
+	err := ufs.StartActivatedListeners()
+	switch {
+	case err != go9p.Enolisteners:
+	case *ntype == "unix":
+		err = ufs.StartUnixListener(*addr)
+	default:
+		err = ufs.StartNetListener(*ntype, *addr)
+	}
 	if err != nil {
 		log.Println(err)
 	}
@@ -1,7 +1,10 @@
 package go9p
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"net"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -163,7 +166,7 @@ func TestDir2Dir(t *testing.T) {
 		t.Fatalf("Lstat link error = %v", err)
 	}
 
-	plain, err := dir2Dir(filePath, fileInfo, false, OsUsers)
+	plain, err := dir2Dir(filePath, fileInfo, false, OsUsers, &ProtocolOptions{})
 	if err != nil {
 		t.Fatalf("dir2Dir plain error = %v", err)
 	}
@@ -171,7 +174,7 @@ func TestDir2Dir(t *testing.T) {
 		t.Fatalf("dir2Dir plain name = %q", plain.Name)
 	}
 
-	dotu, err := dir2Dir(linkPath, linkInfo, true, OsUsers)
+	dotu, err := dir2Dir(linkPath, linkInfo, true, OsUsers, &ProtocolOptions{})
 	if err != nil {
 		t.Fatalf("dir2Dir dotu error = %v", err)
 	}
@@ -370,3 +373,200 @@ func TestUfsConnLifecycle(t *testing.T) {
 	ufs.ConnOpened(conn)
 	ufs.ConnClosed(conn)
 }
+
+func TestDir2DirSymlinkMuid(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("target", link); err != nil {
+		t.Skipf("Symlink error = %v", err)
+	}
+
+	fi, err := os.Lstat(link)
+	if err != nil {
+		t.Fatalf("Lstat error = %v", err)
+	}
+
+	d, err := dir2Dir(link, fi, false, OsUsers, &AkarosOptions)
+	if err != nil {
+		t.Fatalf("dir2Dir error = %v", err)
+	}
+	if d.Muid != "target" || (d.Mode&DMSYMLINK) == 0 {
+		t.Fatalf("dir2Dir muid = %q mode = %o", d.Muid, d.Mode)
+	}
+
+	d, err = dir2Dir(link, fi, false, OsUsers, &ProtocolOptions{})
+	if err != nil {
+		t.Fatalf("dir2Dir error = %v", err)
+	}
+	if d.Muid == "target" {
+		t.Fatalf("dir2Dir set Muid without SymlinkMuid")
+	}
+}
+
+func TestUfsReadFile(t *testing.T) {
+	root := t.TempDir()
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file"), data, 0644); err != nil {
+		t.Fatalf("WriteFile error = %v", err)
+	}
+
+	ufs := &Ufs{Root: root}
+	ufs.Id = "ufs"
+	if !ufs.Start(ufs) {
+		t.Fatalf("Start failed")
+	}
+
+	// over TCP, the file data is sent with sendfile where available
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error = %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	go func() { _ = ufs.StartListener(l) }()
+
+	clnt, err := Mount("tcp", l.Addr().String(), "", 8192, OsUsers.Uid2User(0))
+	if err != nil {
+		t.Fatalf("Mount error = %v", err)
+	}
+	defer clnt.Unmount()
+
+	f, err := clnt.FOpen("/file", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, not equal to the %d written", len(got), len(data))
+	}
+
+	b, err := clnt.Read(f.Fid, uint64(len(data)-10), 100)
+	if err != nil || !bytes.Equal(b, data[len(data)-10:]) {
+		t.Fatalf("Read at the end = %v, %v", b, err)
+	}
+}
+
+// Starts a Ufs serving a temporary directory and mounts it. Returns the
+// directory and the client.
+func newUfsClnt(t *testing.T) (string, *Clnt) {
+	t.Helper()
+	ufs := &Ufs{Root: t.TempDir()}
+	ufs.Dotu = true
+	ufs.Id = "ufs"
+	if !ufs.Start(ufs) {
+		t.Fatalf("Start failed")
+	}
+
+	return ufs.Root, mountPipe(t, ufs)
+}
+
+// Creating a file that exists fails and leaves the file alone.
+func TestUfsCreateExisting(t *testing.T) {
+	root, clnt := newUfsClnt(t)
+	if err := os.WriteFile(filepath.Join(root, "file"), []byte("data"), 0644); err != nil {
+		t.Fatalf("WriteFile error = %v", err)
+	}
+
+	if f, err := clnt.FCreate("/file", 0644, OWRITE|OTRUNC); err == nil {
+		_ = f.Close()
+		t.Fatalf("FCreate of an existing file succeeded")
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "file")); err != nil || string(b) != "data" {
+		t.Fatalf("ReadFile = %q, %v", b, err)
+	}
+}
+
+// A file opened with ORCLOSE is removed when the fid is clunked.
+func TestUfsOrclose(t *testing.T) {
+	root, clnt := newUfsClnt(t)
+	f, err := clnt.FCreate("/tmp", 0644, OWRITE|ORCLOSE)
+	if err != nil {
+		t.Fatalf("FCreate error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "tmp")); err != nil {
+		t.Fatalf("Stat of the open file error = %v", err)
+	}
+
+	_ = f.Close()
+	if _, err := os.Stat(filepath.Join(root, "tmp")); !os.IsNotExist(err) {
+		t.Fatalf("Stat after Clunk error = %v, want not exist", err)
+	}
+}
+
+func TestJoinRoot(t *testing.T) {
+	tests := []struct {
+		root, dir, name string
+		want            string
+	}{
+		{"/srv", "/srv", "a", "/srv/a"},
+		{"/srv", "/srv/a", "..", "/srv"},
+		{"/srv", "/srv", "..", "/srv"},
+		{"/srv", "/srv/", "..", "/srv"},
+		{"/srv", "/srv/a", "../..", "/srv"},
+		{"", "/srv", "a", "/srv/a"},
+		{"", "/srv", "..", "/"},
+		{"", "/", "..", "/"},
+	}
+
+	for _, tt := range tests {
+		if got := joinRoot(tt.root, tt.dir, tt.name); got != tt.want {
+			t.Errorf("joinRoot(%q, %q, %q) = %q, want %q", tt.root, tt.dir, tt.name, got, tt.want)
+		}
+	}
+}
+
+// Walking .. from the root of the tree stays at the root.
+func TestUfsWalkDotdotRoot(t *testing.T) {
+	root, clnt := newUfsClnt(t)
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatalf("Mkdir error = %v", err)
+	}
+
+	fid := clnt.FidAlloc()
+	qids, err := clnt.Walk(clnt.Root, fid, []string{"dir", "..", "..", "dir"})
+	if err != nil || len(qids) != 4 {
+		t.Fatalf("Walk = %v, %v", qids, err)
+	}
+	if qids[1] != qids[2] || qids[0] != qids[3] {
+		t.Fatalf("Walk qids = %v, .. left the root", qids)
+	}
+}
+
+// A Ufs with an empty Root resolves the walks from the root of the file
+// system.
+func TestUfsEmptyRoot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatalf("WriteFile error = %v", err)
+	}
+
+	ufs := new(Ufs)
+	ufs.Dotu = true
+	ufs.Id = "ufs"
+	if !ufs.Start(ufs) {
+		t.Fatalf("Start failed")
+	}
+	c1, c2 := net.Pipe()
+	ufs.NewConn(c1)
+	clnt, err := MountConn(c2, dir, 8192, OsUsers.Uid2User(0))
+	if err != nil {
+		t.Fatalf("MountConn error = %v", err)
+	}
+	t.Cleanup(clnt.Unmount)
+
+	f, err := clnt.FOpen("/file", OREAD)
+	if err != nil {
+		t.Fatalf("FOpen error = %v", err)
+	}
+	defer f.Close()
+	buf := make([]byte, 10)
+	if n, err := f.Read(buf); err != nil || string(buf[:n]) != "data" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+}
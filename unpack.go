@@ -4,21 +4,35 @@
 
 package go9p
 
-import (
-	"fmt"
-)
-
 // Creates a Fcall value from the on-the-wire representation. If
 // dotu is true, reads 9P2000.u messages. Returns the unpacked message,
 // how many bytes from the buffer were used by the message, and any error.
-func Unpack(buf []byte, dotu bool) (fc *Fcall, fcsz int, err error) {
+// Malformed messages never cause a panic, they return Eshortmsg,
+// Ebadmsgsize, Ebadmsgtype, Ebadstat or Etoomanywelem.
+func Unpack(buf []byte, dotu bool) (*Fcall, int, error) {
+	fc := new(Fcall)
+	fcsz, err := UnpackInto(fc, buf, dotu)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return fc, fcsz, nil
+}
+
+// Same as Unpack, but unpacks the message into an existing Fcall value.
+// All fields of fc are overwritten, except for Buf. The Wname and Wqid
+// slices are reused if they are large enough. Pkt and, for Twrite and
+// Rread messages, Data point to buf and are valid only while buf is not
+// modified. Returns how many bytes from the buffer were used by the
+// message, and any error.
+func UnpackInto(fc *Fcall, buf []byte, dotu bool) (fcsz int, err error) {
 	var m uint16
 
 	if len(buf) < 7 {
-		return nil, 0, &Error{"buffer too short", EINVAL}
+		return 0, Eshortmsg
 	}
 
-	fc = new(Fcall)
+	*fc = Fcall{Buf: fc.Buf, Wname: fc.Wname[:0], Wqid: fc.Wqid[:0]}
 	fc.Fid = NOFID
 	fc.Afid = NOFID
 	fc.Newfid = NOFID
@@ -28,62 +42,49 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, fcsz int, err error) {
 	fc.Type, p = gint8(p)
 	fc.Tag, p = gint16(p)
 
-	if int(fc.Size) > len(buf) || fc.Size < 7 {
-		return nil, 0, &Error{fmt.Sprintf("buffer too short: %d expected %d",
-			len(buf), fc.Size),
-			EINVAL}
+	if int(fc.Size) > len(buf) {
+		return 0, Eshortmsg
+	}
+
+	if fc.Size < 7 {
+		return 0, Ebadmsgsize
 	}
 
 	p = p[0 : fc.Size-7]
 	fc.Pkt = buf[0:fc.Size]
 	fcsz = int(fc.Size)
 	if fc.Type < Tversion || fc.Type >= Tlast {
-		return nil, 0, &Error{"invalid id", EINVAL}
+		return 0, Ebadmsgtype
 	}
 
 	var sz uint32
 	if dotu {
-		sz = minFcsize[fc.Type-Tversion]
-	} else {
 		sz = minFcusize[fc.Type-Tversion]
+	} else {
+		sz = minFcsize[fc.Type-Tversion]
 	}
 
 	if fc.Size < sz {
 		goto szerror
 	}
 
-	err = nil
+	// The g* functions return a nil p if the message is too short,
+	// which is checked at the end.
 	switch fc.Type {
 	default:
-		return nil, 0, &Error{"invalid message id", EINVAL}
+		return 0, Ebadmsgtype
 
 	case Tversion, Rversion:
 		fc.Msize, p = gint32(p)
 		fc.Version, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
 
 	case Tauth:
 		fc.Afid, p = gint32(p)
 		fc.Uname, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
-
 		fc.Aname, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
-
-		if dotu {
-			if len(p) > 0 {
-				fc.Unamenum, p = gint32(p)
-			} else {
-				fc.Unamenum = NOUID
-			}
-		} else {
-			fc.Unamenum = NOUID
+		fc.Unamenum = NOUID
+		if dotu && len(p) > 0 {
+			fc.Unamenum, p = gint32(p)
 		}
 
 	case Rauth, Rattach:
@@ -96,49 +97,50 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, fcsz int, err error) {
 		fc.Fid, p = gint32(p)
 		fc.Afid, p = gint32(p)
 		fc.Uname, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
-
 		fc.Aname, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
-
 		if dotu {
+			fc.Unamenum = NOUID
 			if len(p) > 0 {
 				fc.Unamenum, p = gint32(p)
-			} else {
-				fc.Unamenum = NOUID
 			}
 		}
 
 	case Rerror:
 		fc.Error, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
 		if dotu {
 			fc.Errornum, p = gint32(p)
-		} else {
-			fc.Errornum = 0
 		}
 
 	case Twalk:
 		fc.Fid, p = gint32(p)
 		fc.Newfid, p = gint32(p)
 		m, p = gint16(p)
-		fc.Wname = make([]string, m)
+		if m > MAXWELEM {
+			return 0, Etoomanywelem
+		}
+
+		if cap(fc.Wname) < int(m) {
+			fc.Wname = make([]string, m)
+		} else {
+			fc.Wname = fc.Wname[0:m]
+		}
+
 		for i := 0; i < int(m); i++ {
 			fc.Wname[i], p = gstr(p)
-			if p == nil {
-				goto szerror
-			}
 		}
 
 	case Rwalk:
 		m, p = gint16(p)
-		fc.Wqid = make([]Qid, m)
+		if m > MAXWELEM {
+			return 0, Etoomanywelem
+		}
+
+		if cap(fc.Wqid) < int(m) {
+			fc.Wqid = make([]Qid, m)
+		} else {
+			fc.Wqid = fc.Wqid[0:m]
+		}
+
 		for i := 0; i < int(m); i++ {
 			p = gqid(p, &fc.Wqid[i])
 		}
@@ -154,16 +156,10 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, fcsz int, err error) {
 	case Tcreate:
 		fc.Fid, p = gint32(p)
 		fc.Name, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
 		fc.Perm, p = gint32(p)
 		fc.Mode, p = gint8(p)
 		if dotu {
 			fc.Ext, p = gstr(p)
-			if p == nil {
-				goto szerror
-			}
 		}
 
 	case Tread:
@@ -173,9 +169,10 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, fcsz int, err error) {
 
 	case Rread:
 		fc.Count, p = gint32(p)
-		if len(p) < int(fc.Count) {
+		if len(p) != int(fc.Count) {
 			goto szerror
 		}
+
 		fc.Data = p
 		p = p[fc.Count:]
 
@@ -184,14 +181,12 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, fcsz int, err error) {
 		fc.Offset, p = gint64(p)
 		fc.Count, p = gint32(p)
 		if len(p) != int(fc.Count) {
-			fc.Data = make([]byte, fc.Count)
-			copy(fc.Data, p)
-			p = p[len(p):]
-		} else {
-			fc.Data = p
-			p = p[fc.Count:]
+			goto szerror
 		}
 
+		fc.Data = p
+		p = p[fc.Count:]
+
 	case Rwrite:
 		fc.Count, p = gint32(p)
 
@@ -199,26 +194,47 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, fcsz int, err error) {
 		fc.Fid, p = gint32(p)
 
 	case Rstat:
-		_, p = gint16(p)
-		p, err = gstat(p, &fc.Dir, dotu)
+		p, err = gstatn(p, &fc.Dir, dotu)
 		if err != nil {
-			return nil, 0, err
+			return 0, err
 		}
 
 	case Twstat:
 		fc.Fid, p = gint32(p)
-		_, p = gint16(p)
-		p, _ = gstat(p, &fc.Dir, dotu)
+		p, err = gstatn(p, &fc.Dir, dotu)
+		if err != nil {
+			return 0, err
+		}
 
 	case Rflush, Rclunk, Rremove, Rwstat:
 	}
 
-	if len(p) > 0 {
+	if p == nil || len(p) > 0 {
 		goto szerror
 	}
 
 	return
 
 szerror:
-	return nil, 0, &Error{"invalid size", EINVAL}
+	return 0, Ebadmsgsize
+}
+
+// Decodes a stat[n] field, a stat preceded by its size. The size has to
+// match the rest of the message, and the size of the stat itself.
+func gstatn(buf []byte, d *Dir, dotu bool) ([]byte, error) {
+	n, buf := gint16(buf)
+	if buf == nil || int(n) != len(buf) {
+		return nil, Ebadmsgsize
+	}
+
+	rest, err := gstat(buf, d, dotu)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) != 0 {
+		return nil, Ebadstat
+	}
+
+	return rest, nil
 }
@@ -0,0 +1,308 @@
+package go9p
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnpackInto(t *testing.T) {
+	walk := NewFcall(256)
+	if err := PackTwalk(walk, 1, 2, []string{"a", "b", "c"}); err != nil {
+		t.Fatalf("PackTwalk error = %v", err)
+	}
+
+	read := NewFcall(256)
+	if err := PackTread(read, 3, 100, 10); err != nil {
+		t.Fatalf("PackTread error = %v", err)
+	}
+
+	fc := GetFcall(256)
+	defer PutFcall(fc)
+	if _, err := UnpackInto(fc, walk.Pkt, true); err != nil {
+		t.Fatalf("UnpackInto(walk) error = %v", err)
+	}
+	if fc.Type != Twalk || !reflect.DeepEqual(fc.Wname, []string{"a", "b", "c"}) {
+		t.Fatalf("UnpackInto(walk) = %v", fc)
+	}
+
+	// the Wname slice is reused and the fields of the previous
+	// message are cleared
+	wname := &fc.Wname[0]
+	if err := PackTwalk(walk, 1, 2, []string{"d"}); err != nil {
+		t.Fatalf("PackTwalk error = %v", err)
+	}
+	if _, err := UnpackInto(fc, walk.Pkt, true); err != nil {
+		t.Fatalf("UnpackInto(walk) error = %v", err)
+	}
+	if &fc.Wname[0] != wname || !reflect.DeepEqual(fc.Wname, []string{"d"}) {
+		t.Fatalf("UnpackInto(walk) Wname = %v, not reused", fc.Wname)
+	}
+
+	sz, err := UnpackInto(fc, read.Pkt, true)
+	if err != nil {
+		t.Fatalf("UnpackInto(read) error = %v", err)
+	}
+	if sz != len(read.Pkt) || fc.Type != Tread || fc.Fid != 3 || fc.Offset != 100 || fc.Count != 10 {
+		t.Fatalf("UnpackInto(read) = %d, %v", sz, fc)
+	}
+	if len(fc.Wname) != 0 || fc.Newfid != NOFID {
+		t.Fatalf("UnpackInto(read) kept walk fields: %v", fc)
+	}
+
+	for _, pkt := range [][]byte{read.Pkt[0:5], read.Pkt[0 : len(read.Pkt)-1]} {
+		if _, err := UnpackInto(fc, pkt, true); err == nil {
+			t.Fatalf("UnpackInto(%v) succeeded", pkt)
+		}
+	}
+}
+
+func TestGetFcall(t *testing.T) {
+	fc := GetFcall(100)
+	if len(fc.Buf) != 100 || cap(fc.Buf) != 128 {
+		t.Fatalf("GetFcall(100) buffer len %d cap %d", len(fc.Buf), cap(fc.Buf))
+	}
+
+	fc.Type = Rread
+	PutFcall(fc)
+	fc = GetFcall(128)
+	if len(fc.Buf) != 128 || fc.Type != 0 {
+		t.Fatalf("GetFcall(128) = %v, buffer len %d", fc, len(fc.Buf))
+	}
+
+	// Fcalls not allocated by GetFcall are ignored
+	PutFcall(NewFcall(100))
+	PutFcall(nil)
+}
+
+// Returns a message of the type with the body.
+func testMsg(mtype uint8, body ...[]byte) []byte {
+	b := []byte{0, 0, 0, 0, mtype, 1, 0}
+	for _, p := range body {
+		b = append(b, p...)
+	}
+
+	pint32(uint32(len(b)), b)
+	return b
+}
+
+func le16(v uint16) []byte { return []byte{byte(v), byte(v >> 8)} }
+func le32(v uint32) []byte { return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)} }
+func str(s string) []byte  { return append(le16(uint16(len(s))), s...) }
+
+func TestUnpackMalformed(t *testing.T) {
+	stat := PackDir(&Dir{Name: "name", Uid: "u", Gid: "g", Muid: "m"}, false)
+	names := [][]byte{le32(1), le32(2), le16(MAXWELEM + 1)}
+	for i := 0; i <= MAXWELEM; i++ {
+		names = append(names, str("a"))
+	}
+
+	tests := []struct {
+		name string
+		buf  []byte
+		dotu bool
+		want error
+	}{
+		{"short", []byte{7, 0, 0}, false, Eshortmsg},
+		{"truncated", testMsg(Tclunk, le32(1))[0:9], false, Eshortmsg},
+		{"small size", []byte{6, 0, 0, 0, Tclunk, 1, 0}, false, Ebadmsgsize},
+		{"type", testMsg(Tlast, le32(1)), false, Ebadmsgtype},
+		{"trailing", testMsg(Tclunk, le32(1), []byte{0}), false, Ebadmsgsize},
+		{"string", testMsg(Tversion, le32(8192), le16(10), []byte("9P")), false, Ebadmsgsize},
+		{"twalk names", testMsg(Twalk, names...), false, Etoomanywelem},
+		{"rwalk qids", testMsg(Rwalk, le16(0xFFFF)), false, Etoomanywelem},
+		{"rwalk short", testMsg(Rwalk, le16(2), make([]byte, 13)), false, Ebadmsgsize},
+		{"rerror errno", testMsg(Rerror, str("error"), []byte{1, 0}), true, Ebadmsgsize},
+		{"tcreate perm", testMsg(Tcreate, le32(1), str("abcdefgh")), false, Ebadmsgsize},
+		{"tattach uid", testMsg(Tattach, le32(1), le32(NOFID), str("u"), str("a"), []byte{1}), true, Ebadmsgsize},
+		{"twrite count", testMsg(Twrite, le32(1), make([]byte, 8), le32(0xFFFFFFFF), []byte("data")), false, Ebadmsgsize},
+		{"rread count", testMsg(Rread, le32(100), []byte("data")), false, Ebadmsgsize},
+		{"rstat size", testMsg(Rstat, le16(uint16(len(stat)+1)), stat), false, Ebadmsgsize},
+		{"rstat nested size", testMsg(Rstat, le16(uint16(len(stat)+2)), stat, []byte{0, 0}), false, Ebadstat},
+		{"twstat stat", testMsg(Twstat, le32(1), le16(uint16(len(stat))), stat), true, Ebadstat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Unpack(tt.buf, tt.dotu)
+			if err != tt.want {
+				t.Fatalf("Unpack(%v) error = %v, want %v", tt.buf, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackLimits(t *testing.T) {
+	fc := NewFcall(1 << 18)
+	long := strings.Repeat("x", 0x10000)
+	names := make([]string, MAXWELEM+1)
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"tversion", PackTversion(fc, 8192, long), Estrtoolong},
+		{"tattach", PackTattach(fc, 1, NOFID, "u", long, 0, true), Estrtoolong},
+		{"twalk", PackTwalk(fc, 1, 2, names), Etoomanywelem},
+		{"twalk name", PackTwalk(fc, 1, 2, []string{long}), Estrtoolong},
+		{"rwalk", PackRwalk(fc, make([]Qid, MAXWELEM+1)), Etoomanywelem},
+		{"rerror", PackRerror(fc, long, EIO, true), Estrtoolong},
+		{"rstat", PackRstat(fc, &Dir{Name: long[1:], Uid: "u"}, false), Ebadstat},
+		{"twalk max", PackTwalk(fc, 1, 2, names[1:]), nil},
+	}
+
+	for _, tt := range tests {
+		if tt.err != tt.want {
+			t.Errorf("%s: error = %v, want %v", tt.name, tt.err, tt.want)
+		}
+	}
+}
+
+func FuzzUnpack(f *testing.F) {
+	fc := NewFcall(8192)
+	_ = PackTwalk(fc, 1, 2, []string{"a", "bb"})
+	f.Add(fc.Pkt, false)
+	_ = PackRstat(fc, &Dir{Name: "n", Uid: "u", Ext: "e"}, true)
+	f.Add(fc.Pkt, true)
+	_ = PackRerror(fc, "error", EPERM, true)
+	f.Add(fc.Pkt, true)
+	_ = PackTwrite(fc, 1, 2, 4, []byte("data"))
+	f.Add(fc.Pkt, false)
+
+	f.Fuzz(func(t *testing.T, buf []byte, dotu bool) {
+		fc, n, err := Unpack(buf, dotu)
+		if err != nil {
+			if _, ok := err.(*Error); !ok {
+				t.Fatalf("Unpack error %T", err)
+			}
+			return
+		}
+
+		if n != int(fc.Size) || n > len(buf) || len(fc.Wname) > MAXWELEM || len(fc.Wqid) > MAXWELEM {
+			t.Fatalf("Unpack = %v, %d", fc, n)
+		}
+	})
+}
+
+func FuzzUnpackDir(f *testing.F) {
+	f.Add(PackDir(&Dir{Name: "name", Uid: "u", Gid: "g", Muid: "m"}, false), false)
+	f.Add(PackDir(&Dir{Name: "name", Uid: "u", Ext: "ext", Uidnum: 1}, true), true)
+
+	f.Fuzz(func(t *testing.T, buf []byte, dotu bool) {
+		d, b, n, err := UnpackDir(buf, dotu)
+		if err != nil {
+			return
+		}
+
+		if n != int(d.Size)+2 || n+len(b) != len(buf) {
+			t.Fatalf("UnpackDir = %v, %d bytes, %d left of %d", d, n, len(b), len(buf))
+		}
+
+		// if there is nothing after the fields, packing
+		// the stat gives the same bytes
+		if n == statsz(d, dotu) && !bytes.Equal(PackDir(d, dotu), buf[0:n]) {
+			t.Fatalf("PackDir(%v) = %v, want %v", d, PackDir(d, dotu), buf[0:n])
+		}
+	})
+}
+
+// Packs a message of the type with the values from src.
+func packFcall(fc *Fcall, mtype uint8, src *Fcall, dotu bool) error {
+	switch mtype {
+	case Tversion:
+		return PackTversion(fc, src.Msize, src.Version)
+	case Rversion:
+		return PackRversion(fc, src.Msize, src.Version)
+	case Tauth:
+		return PackTauth(fc, src.Afid, src.Uname, src.Aname, src.Unamenum, dotu)
+	case Rauth:
+		return PackRauth(fc, &src.Qid)
+	case Tattach:
+		return PackTattach(fc, src.Fid, src.Afid, src.Uname, src.Aname, src.Unamenum, dotu)
+	case Rattach:
+		return PackRattach(fc, &src.Qid)
+	case Rerror:
+		return PackRerror(fc, src.Error, src.Errornum, dotu)
+	case Tflush:
+		return PackTflush(fc, src.Oldtag)
+	case Rflush:
+		return PackRflush(fc)
+	case Twalk:
+		return PackTwalk(fc, src.Fid, src.Newfid, src.Wname)
+	case Rwalk:
+		return PackRwalk(fc, src.Wqid)
+	case Topen:
+		return PackTopen(fc, src.Fid, src.Mode)
+	case Ropen:
+		return PackRopen(fc, &src.Qid, src.Iounit)
+	case Tcreate:
+		return PackTcreate(fc, src.Fid, src.Name, src.Perm, src.Mode, src.Ext, dotu)
+	case Rcreate:
+		return PackRcreate(fc, &src.Qid, src.Iounit)
+	case Tread:
+		return PackTread(fc, src.Fid, src.Offset, src.Count)
+	case Rread:
+		return PackRread(fc, src.Data)
+	case Twrite:
+		return PackTwrite(fc, src.Fid, src.Offset, uint32(len(src.Data)), src.Data)
+	case Rwrite:
+		return PackRwrite(fc, src.Count)
+	case Tclunk:
+		return PackTclunk(fc, src.Fid)
+	case Rclunk:
+		return PackRclunk(fc)
+	case Tremove:
+		return PackTremove(fc, src.Fid)
+	case Rremove:
+		return PackRremove(fc)
+	case Tstat:
+		return PackTstat(fc, src.Fid)
+	case Rstat:
+		return PackRstat(fc, &src.Dir, dotu)
+	case Twstat:
+		return PackTwstat(fc, src.Fid, &src.Dir, dotu)
+	case Rwstat:
+		return PackRwstat(fc)
+	}
+
+	return Ebadmsgtype
+}
+
+func FuzzPackUnpack(f *testing.F) {
+	for mtype := uint8(Tversion); mtype < Tlast; mtype++ {
+		f.Add(mtype, mtype%4 == 0, uint32(mtype), uint32(42), uint64(1<<40), "a/bc", "user", []byte("data"))
+	}
+
+	f.Fuzz(func(t *testing.T, mtype uint8, dotu bool, n1, n2 uint32, off uint64, s1, s2 string, data []byte) {
+		src := &Fcall{Fid: n1, Afid: n2, Newfid: n2, Msize: n1, Count: n2, Offset: off, Mode: uint8(n1),
+			Perm: n2, Oldtag: uint16(n1), Iounit: n2, Errornum: n2, Unamenum: n2,
+			Version: s1, Uname: s1, Aname: s2, Error: s1, Name: s1, Ext: s2, Data: data,
+			Qid:  Qid{uint8(n1), n2, off},
+			Dir:  Dir{Type: uint16(n1), Dev: n2, Qid: Qid{uint8(n2), n1, off}, Name: s1, Uid: s2, Gid: s1, Muid: s2, Ext: s1},
+			Wqid: make([]Qid, n1%(MAXWELEM+1)),
+		}
+		if s1 != "" {
+			src.Wname = strings.Split(s1, "/")
+		}
+
+		fc := NewFcall(uint32(3*(len(s1)+len(s2))+len(data)) + 1024)
+		if err := packFcall(fc, mtype, src, dotu); err != nil {
+			return
+		}
+
+		fc1, _, err := Unpack(fc.Pkt, dotu)
+		if err != nil {
+			t.Fatalf("Unpack(%v) error = %v", fc.Pkt, err)
+		}
+
+		fc2 := NewFcall(uint32(len(fc.Buf)))
+		if err := packFcall(fc2, mtype, fc1, dotu); err != nil {
+			t.Fatalf("packing %v: %v", fc1, err)
+		}
+
+		if !bytes.Equal(fc.Pkt, fc2.Pkt) {
+			t.Fatalf("round trip of %v: %v, want %v", fc1, fc2.Pkt, fc.Pkt)
+		}
+	})
+}
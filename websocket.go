@@ -0,0 +1,449 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !tinygo
+
+package go9p
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The WebSocket subprotocol of 9P, agreed if the client asks for it.
+const WebSocketProtocol = "9p"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// The GUID appended to the key of the handshake (RFC 6455).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Returned for a WebSocket frame that doesn't carry 9P2000.
+var Ebadframe error = &Error{"invalid websocket frame", EINVAL}
+
+// A net.Conn carrying a 9P2000 stream in WebSocket binary frames. Each
+// message written is sent in a frame of its own, the frames read are
+// returned as a stream. Ping frames are answered, a close frame ends
+// the stream.
+type wsConn struct {
+	conn   net.Conn
+	rd     *bufio.Reader
+	client bool // the client masks the frames it sends
+
+	// reading, by a single goroutine
+	left int64   // bytes left in the current frame
+	key  [4]byte // mask of the current frame
+	pos  int     // position in the mask
+	eof  bool
+
+	wlock sync.Mutex
+	wbuf  []byte // partial message written
+	frame []byte
+}
+
+func newWsConn(c net.Conn, rd *bufio.Reader, client bool) *wsConn {
+	return &wsConn{conn: c, rd: rd, client: client}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.left == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > c.left {
+		b = b[0:c.left]
+	}
+
+	n, err := c.rd.Read(b)
+	c.unmask(b[0:n])
+	c.left -= int64(n)
+	return n, err
+}
+
+// Reads frame headers until a data frame with a payload.
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.rd, hdr[:]); err != nil {
+		return err
+	}
+
+	fin := hdr[0]&0x80 != 0
+	op := hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	n := int64(hdr[1] & 0x7F)
+	if masked == c.client || hdr[0]&0x70 != 0 {
+		// only the client masks, no extensions
+		return Ebadframe
+	}
+
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.rd, ext[:]); err != nil {
+			return err
+		}
+		n = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.rd, ext[:]); err != nil {
+			return err
+		}
+		n = int64(binary.BigEndian.Uint64(ext[:]))
+		if n < 0 {
+			return Ebadframe
+		}
+	}
+
+	c.key = [4]byte{}
+	c.pos = 0
+	if masked {
+		if _, err := io.ReadFull(c.rd, c.key[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case wsBinary, wsContinuation:
+		c.left = n
+		return nil
+
+	case wsClose, wsPing, wsPong:
+		if !fin || n > 125 {
+			return Ebadframe
+		}
+
+		data := make([]byte, n)
+		if _, err := io.ReadFull(c.rd, data); err != nil {
+			return err
+		}
+
+		c.unmask(data)
+		switch op {
+		case wsPing:
+			return c.writeFrame(wsPong, data)
+		case wsClose:
+			// echo the status code, if any
+			if len(data) > 2 {
+				data = data[0:2]
+			}
+			_ = c.writeFrame(wsClose, data)
+			c.eof = true
+		}
+
+		return nil
+	}
+
+	// text frames don't carry 9P
+	return Ebadframe
+}
+
+func (c *wsConn) unmask(b []byte) {
+	if c.client {
+		return
+	}
+
+	for i := range b {
+		b[i] ^= c.key[c.pos&3]
+		c.pos++
+	}
+}
+
+// Writes the data, sending each complete 9P2000 message in a frame.
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.wbuf = append(c.wbuf, b...)
+	for len(c.wbuf) >= 4 {
+		sz, _ := Gint32(c.wbuf)
+		if sz < 4 {
+			return 0, Ebadframe
+		}
+
+		if uint32(len(c.wbuf)) < sz {
+			break
+		}
+
+		if err := c.writeFrameLocked(wsBinary, c.wbuf[0:sz]); err != nil {
+			return 0, err
+		}
+
+		c.wbuf = c.wbuf[:copy(c.wbuf, c.wbuf[sz:])]
+	}
+
+	return len(b), nil
+}
+
+func (c *wsConn) writeFrame(op byte, data []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.writeFrameLocked(op, data)
+}
+
+func (c *wsConn) writeFrameLocked(op byte, data []byte) error {
+	f := append(c.frame[:0], 0x80|op)
+	var mask byte
+	if c.client {
+		mask = 0x80
+	}
+
+	n := len(data)
+	switch {
+	case n < 126:
+		f = append(f, mask|byte(n))
+	case n <= 0xFFFF:
+		f = append(f, mask|126)
+		f = binary.BigEndian.AppendUint16(f, uint16(n))
+	default:
+		f = append(f, mask|127)
+		f = binary.BigEndian.AppendUint64(f, uint64(n))
+	}
+
+	if c.client {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+
+		f = append(f, key[:]...)
+		start := len(f)
+		f = append(f, data...)
+		for i := range f[start:] {
+			f[start+i] ^= key[i&3]
+		}
+	} else {
+		f = append(f, data...)
+	}
+
+	c.frame = f
+	_, err := c.conn.Write(f)
+	return err
+}
+
+func (c *wsConn) Close() error {
+	// a normal closure, the peer may be gone already
+	_ = c.writeFrame(wsClose, []byte{0x03, 0xE8})
+	return c.conn.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *wsConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// Returns the Sec-WebSocket-Accept value for the key.
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// Returns true if the comma separated header values contain the token.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// The WebSocketHandler type accepts WebSocket sessions and serves 9P2000
+// on them.
+type WebSocketHandler struct {
+	Srv *Srv
+
+	// Returns true if a request from a browser page can connect. If
+	// nil, only requests without an Origin, or from the same host,
+	// are accepted.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Returns a handler accepting WebSocket sessions for the server.
+func (srv *Srv) WebSocketHandler() *WebSocketHandler {
+	return &WebSocketHandler{Srv: srv}
+}
+
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	check := h.CheckOrigin
+	if check == nil {
+		check = sameOrigin
+	}
+
+	if !check(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+
+	// the deadlines set for the request aren't for the 9P connection
+	// it becomes, and not all Hijackers clear them
+	_ = c.SetDeadline(time.Time{})
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n"
+	if headerHas(r.Header, "Sec-WebSocket-Protocol", WebSocketProtocol) {
+		resp += "Sec-WebSocket-Protocol: " + WebSocketProtocol + "\r\n"
+	}
+
+	if _, err := c.Write([]byte(resp + "\r\n")); err != nil {
+		_ = c.Close()
+		return
+	}
+
+	h.Srv.NewConn(newWsConn(c, rw.Reader, false))
+}
+
+// Connects to a WebSocket server at a ws:// or wss:// URL, and returns
+// a connection that can be used by Connect or MountConn.
+func DialWebSocket(rawurl string) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, &Error{err.Error(), EINVAL}
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "wss", "https":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		default:
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	var c net.Conn
+	switch u.Scheme {
+	case "ws", "http":
+		c, err = net.Dial("tcp", host)
+	case "wss", "https":
+		c, err = tls.Dial("tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, &Error{"unsupported scheme " + u.Scheme, EINVAL}
+	}
+
+	if err != nil {
+		return nil, &Error{err.Error(), EIO}
+	}
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		_ = c.Close()
+		return nil, &Error{err.Error(), EIO}
+	}
+
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       u.Host,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-WebSocket-Key":      {key},
+			"Sec-WebSocket-Version":  {"13"},
+			"Sec-WebSocket-Protocol": {WebSocketProtocol},
+		},
+	}
+
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+
+	if err := req.Write(c); err != nil {
+		_ = c.Close()
+		return nil, &Error{err.Error(), EIO}
+	}
+
+	rd := bufio.NewReader(c)
+	resp, err := http.ReadResponse(rd, req)
+	if err != nil {
+		_ = c.Close()
+		return nil, &Error{err.Error(), EIO}
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		_ = c.Close()
+		return nil, &Error{"websocket handshake failed: " + resp.Status, EIO}
+	}
+
+	return newWsConn(c, rd, true), nil
+}
+
+// Connects to a file server at a WebSocket URL and attaches to it as the
+// specified user.
+func MountWebSocket(rawurl, aname string, msize uint32, user User) (*Clnt, error) {
+	c, err := DialWebSocket(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	return MountConn(c, aname, msize, user)
+}
@@ -0,0 +1,163 @@
+//go:build !tinygo
+
+package go9p
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocket(t *testing.T) {
+	fs := newTestRamfs()
+	addRamFile(t, fs, nil, "file", strings.Repeat("x", 100000), 0666)
+	fs.Dotu = true
+	fs.Start(fs)
+	ts := httptest.NewServer(fs.WebSocketHandler())
+	t.Cleanup(ts.Close)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	clnt, err := MountWebSocket(url, "", 65536, OsUsers.Uid2User(0))
+	if err != nil {
+		t.Fatalf("MountWebSocket error = %v", err)
+	}
+	t.Cleanup(clnt.Unmount)
+	if got := readFile(t, clnt, "/file"); len(got) != 100000 {
+		t.Fatalf("read %d bytes, want 100000", len(got))
+	}
+}
+
+func TestWebSocketServerTimeouts(t *testing.T) {
+	fs := newTestRamfs()
+	addRamFile(t, fs, nil, "file", "data", 0666)
+	fs.Dotu = true
+	fs.Start(fs)
+	ts := httptest.NewUnstartedServer(fs.WebSocketHandler())
+	ts.Config.ReadTimeout = 50 * time.Millisecond
+	ts.Config.WriteTimeout = 50 * time.Millisecond
+	ts.Start()
+	t.Cleanup(ts.Close)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	clnt, err := MountWebSocket(url, "", 8192, OsUsers.Uid2User(0))
+	if err != nil {
+		t.Fatalf("MountWebSocket error = %v", err)
+	}
+	t.Cleanup(clnt.Unmount)
+
+	// the connection outlives the deadlines of the upgrade request
+	time.Sleep(200 * time.Millisecond)
+	if got := readFile(t, clnt, "/file"); got != "data" {
+		t.Fatalf("/file = %q", got)
+	}
+}
+
+func TestWebSocketHandlerRejects(t *testing.T) {
+	fs := newTestRamfs()
+	fs.Start(fs)
+	ts := httptest.NewServer(fs.WebSocketHandler())
+	t.Cleanup(ts.Close)
+
+	upgrade := map[string]string{
+		"Connection":            "Upgrade",
+		"Upgrade":               "websocket",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+		"Sec-WebSocket-Version": "13",
+	}
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"plain", nil, http.StatusBadRequest},
+		{"version", map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"origin", map[string]string{"Origin": "http://example.com"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatalf("NewRequest error = %v", err)
+			}
+			if tt.header != nil {
+				for k, v := range upgrade {
+					req.Header.Set(k, v)
+				}
+				for k, v := range tt.header {
+					req.Header.Set(k, v)
+				}
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Do error = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestWsAccept(t *testing.T) {
+	// the example of RFC 6455
+	if got := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("wsAccept = %q", got)
+	}
+}
+
+// A message written in parts is sent in a single frame, and pings are
+// answered.
+func TestWsConnFrames(t *testing.T) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { _ = c2.Close() })
+	srv := newWsConn(c1, bufio.NewReader(c1), false)
+	clnt := newWsConn(c2, bufio.NewReader(c2), true)
+
+	msg := []byte{9, 0, 0, 0, Tversion, 1, 2, 3, 4}
+	go func() {
+		_, _ = srv.Write(msg[0:3])
+		_, _ = srv.Write(msg[3:])
+	}()
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(c2, hdr[:]); err != nil {
+		t.Fatalf("ReadFull error = %v", err)
+	}
+	if hdr[0] != 0x80|wsBinary || hdr[1] != byte(len(msg)) {
+		t.Fatalf("frame header = %x, want a final binary frame of %d bytes", hdr, len(msg))
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c2, buf); err != nil || string(buf) != string(msg) {
+		t.Fatalf("frame = %v, %v, want %v", buf, err, msg)
+	}
+
+	// a ping from the client, then a message
+	go func() {
+		_ = clnt.writeFrame(wsPing, []byte("hi"))
+		_, _ = clnt.Write(msg)
+	}()
+	got := make(chan []byte)
+	go func() {
+		b := make([]byte, len(msg))
+		_, _ = io.ReadFull(srv, b)
+		got <- b
+	}()
+	if _, err := io.ReadFull(c2, hdr[:]); err != nil || hdr[0] != 0x80|wsPong {
+		t.Fatalf("frame header = %x, %v, want a pong", hdr, err)
+	}
+	pong := make([]byte, hdr[1])
+	_, _ = io.ReadFull(c2, pong)
+	if string(pong) != "hi" {
+		t.Fatalf("pong = %q, want %q", pong, "hi")
+	}
+	if b := <-got; string(b) != string(msg) {
+		t.Fatalf("read %v, want %v", b, msg)
+	}
+}